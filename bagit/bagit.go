@@ -0,0 +1,405 @@
+// Package bagit creates and validates BagIt bags (RFC 8493) on any vfs.FS.
+package bagit
+
+import (
+	"crypto"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kuleuven/vfs"
+	"github.com/kuleuven/vfs/manifest"
+	"go.uber.org/multierr"
+)
+
+const (
+	bagitFile   = "bagit.txt"
+	bagInfoFile = "bag-info.txt"
+	payloadDir  = "data"
+)
+
+// ErrNotBag is returned when validating a directory without bagit.txt.
+var ErrNotBag = errors.New("not a bag")
+
+// Algorithms maps the algorithm names used in manifest file names to hashes.
+var Algorithms = map[string]crypto.Hash{
+	"md5":    crypto.MD5,
+	"sha1":   crypto.SHA1,
+	"sha224": crypto.SHA224,
+	"sha256": crypto.SHA256,
+	"sha384": crypto.SHA384,
+	"sha512": crypto.SHA512,
+}
+
+func algorithmName(algorithm crypto.Hash) (string, error) {
+	for name, h := range Algorithms {
+		if h == algorithm {
+			return name, nil
+		}
+	}
+
+	return "", fmt.Errorf("%w: algorithm %v", vfs.ErrNotSupported, algorithm)
+}
+
+// Field is a label and value of bag-info.txt.
+type Field struct {
+	Label string
+	Value string
+}
+
+type Option func(*options)
+
+type options struct {
+	algorithms []crypto.Hash
+	info       []Field
+	workers    int
+}
+
+// WithAlgorithms sets the algorithms for which manifests are written.
+// Defaults to SHA-256.
+func WithAlgorithms(algorithms ...crypto.Hash) Option {
+	return func(o *options) {
+		o.algorithms = algorithms
+	}
+}
+
+// WithInfo adds a field to bag-info.txt. Bagging-Date and Payload-Oxum
+// are added automatically.
+func WithInfo(label, value string) Option {
+	return func(o *options) {
+		o.info = append(o.info, Field{label, value})
+	}
+}
+
+// WithWorkers sets the number of checksums that are computed in parallel.
+// Defaults to manifest.DefaultWorkers.
+func WithWorkers(workers int) Option {
+	return func(o *options) {
+		o.workers = workers
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		algorithms: []crypto.Hash{crypto.SHA256},
+		workers:    manifest.DefaultWorkers,
+	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return o
+}
+
+// CreateInPlace turns the directory at root into a bag, by moving its contents
+// to the payload directory and writing the tag files.
+func CreateInPlace(fs vfs.FS, root string, opts ...Option) error {
+	root = vfs.Clean(root)
+
+	if _, err := fs.Stat(vfs.Join(root, bagitFile)); err == nil {
+		return &os.PathError{Op: "bag", Path: root, Err: os.ErrExist}
+	}
+
+	entries, err := vfs.ReadDir(fs, root)
+	if err != nil {
+		return err
+	}
+
+	// Move the contents to a temporary directory first, as the
+	// contents might include a file or directory named data
+	tmp := vfs.Join(root, ".bagit-"+rand.Text())
+
+	if err := fs.Mkdir(tmp, 0o755); err != nil {
+		return err
+	}
+
+	var moved []string
+
+	// Move everything back if the payload cannot be put in place
+	rollback := func(err error) error {
+		for _, name := range slices.Backward(moved) {
+			err = multierr.Append(err, fs.Rename(vfs.Join(tmp, name), vfs.Join(root, name)))
+		}
+
+		return multierr.Append(err, fs.Rmdir(tmp))
+	}
+
+	for _, entry := range entries {
+		if err := fs.Rename(vfs.Join(root, entry.Name()), vfs.Join(tmp, entry.Name())); err != nil {
+			return rollback(err)
+		}
+
+		moved = append(moved, entry.Name())
+	}
+
+	if err := fs.Rename(tmp, vfs.Join(root, payloadDir)); err != nil {
+		return rollback(err)
+	}
+
+	return writeTags(fs, root, newOptions(opts))
+}
+
+// Create creates a bag at dstRoot in dst, with a copy of the tree at srcRoot
+// in src as payload. The checksums are computed from the copy, so that errors
+// while copying are detected.
+func Create(dst vfs.FS, dstRoot string, src vfs.FS, srcRoot string, opts ...Option) error {
+	dstRoot = vfs.Clean(dstRoot)
+	srcRoot = vfs.Clean(srcRoot)
+
+	if err := vfs.MkdirAll(dst, dstRoot, 0o755); err != nil {
+		return err
+	}
+
+	payload := vfs.Join(dstRoot, payloadDir)
+
+	if err := dst.Mkdir(payload, 0o755); err != nil {
+		return err
+	}
+
+	err := vfs.Walk(src, srcRoot, func(path string, info vfs.FileInfo, err error) error {
+		if err != nil || path == srcRoot {
+			return err
+		}
+
+		target := vfs.Join(payload, strings.TrimPrefix(strings.TrimPrefix(path, srcRoot), "/"))
+
+		switch {
+		case info.IsDir():
+			return dst.Mkdir(target, 0o755)
+		case info.Mode().IsRegular():
+			return vfs.StreamFile(dst, target, src, path, os.O_CREATE)
+		default:
+			return nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	return writeTags(dst, dstRoot, newOptions(opts))
+}
+
+// writeTags writes the tag files of the bag at root, for the payload in place.
+func writeTags(fs vfs.FS, root string, o options) error {
+	if err := writeFile(fs, vfs.Join(root, bagitFile), "BagIt-Version: 1.0\nTag-File-Character-Encoding: UTF-8\n"); err != nil {
+		return err
+	}
+
+	files, err := payloadChecksums(fs, root, o.algorithms, o.workers)
+	if err != nil {
+		return err
+	}
+
+	var (
+		tagFiles    = []string{bagitFile, bagInfoFile}
+		octets, num int64
+	)
+
+	for _, file := range files {
+		octets += file.Size
+		num++
+	}
+
+	oxum := fmt.Sprintf("%d.%d", octets, num)
+
+	for _, algorithm := range o.algorithms {
+		name, err := algorithmName(algorithm)
+		if err != nil {
+			return err
+		}
+
+		var buf strings.Builder
+
+		for _, file := range files {
+			fmt.Fprintf(&buf, "%s  %s\n", manifest.Checksum(file.Checksums[algorithm]), encodePath(file.Path))
+		}
+
+		manifestFile := "manifest-" + name + ".txt"
+
+		if err := writeFile(fs, vfs.Join(root, manifestFile), buf.String()); err != nil {
+			return err
+		}
+
+		tagFiles = append(tagFiles, manifestFile)
+	}
+
+	info := append([]Field{
+		{"Bagging-Date", time.Now().Format(time.DateOnly)},
+		{"Payload-Oxum", oxum},
+	}, o.info...)
+
+	var buf strings.Builder
+
+	for _, field := range info {
+		fmt.Fprintf(&buf, "%s: %s\n", field.Label, strings.ReplaceAll(field.Value, "\n", "\n  "))
+	}
+
+	if err := writeFile(fs, vfs.Join(root, bagInfoFile), buf.String()); err != nil {
+		return err
+	}
+
+	tagChecksums := make([]map[crypto.Hash][]byte, len(tagFiles))
+
+	for i, tagFile := range tagFiles {
+		if tagChecksums[i], err = computeChecksums(fs, vfs.Join(root, tagFile), o.algorithms); err != nil {
+			return err
+		}
+	}
+
+	for _, algorithm := range o.algorithms {
+		name, _ := algorithmName(algorithm) //nolint:errcheck
+
+		var buf strings.Builder
+
+		for i, tagFile := range tagFiles {
+			fmt.Fprintf(&buf, "%s  %s\n", manifest.Checksum(tagChecksums[i][algorithm]), encodePath(tagFile))
+		}
+
+		if err := writeFile(fs, vfs.Join(root, "tagmanifest-"+name+".txt"), buf.String()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeFile(fs vfs.FS, path, contents string) error {
+	return vfs.WriteFile(fs, path, []byte(contents), os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+}
+
+// payloadFile is a regular file of the payload, with its path relative to the bag.
+type payloadFile struct {
+	Path      string
+	Size      int64
+	Checksums map[crypto.Hash][]byte
+}
+
+// payloadChecksums lists the regular files of the payload of the bag at root,
+// and computes their checksums in parallel. Each file is read once for all
+// algorithms.
+func payloadChecksums(fs vfs.FS, root string, algorithms []crypto.Hash, workers int) ([]payloadFile, error) {
+	m, err := manifest.Snapshot(fs, vfs.Join(root, payloadDir), manifest.WithAlgorithm(0), manifest.WithXattrs(false))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []payloadFile
+
+	for _, entry := range m.Entries {
+		if entry.Mode.IsRegular() {
+			files = append(files, payloadFile{Path: payloadDir + entry.Path, Size: entry.Size})
+		}
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		result error
+		queue  = make(chan *payloadFile)
+	)
+
+	for range max(workers, 1) {
+		wg.Go(func() {
+			for file := range queue {
+				checksums, err := computeChecksums(fs, vfs.Join(root, file.Path), algorithms)
+				if err != nil {
+					mu.Lock()
+					result = multierr.Append(result, err)
+					mu.Unlock()
+				}
+
+				file.Checksums = checksums
+			}
+		})
+	}
+
+	for i := range files {
+		queue <- &files[i]
+	}
+
+	close(queue)
+
+	wg.Wait()
+
+	return files, result
+}
+
+// computeChecksums computes the checksums of a file for the given algorithms,
+// in a single pass. A single checksum is computed by the file system if it
+// implements vfs.ChecksumFS.
+func computeChecksums(fs vfs.FS, path string, algorithms []crypto.Hash) (map[crypto.Hash][]byte, error) {
+	if len(algorithms) == 1 {
+		checksum, err := computeChecksum(fs, path, algorithms[0])
+		if err != nil {
+			return nil, err
+		}
+
+		return map[crypto.Hash][]byte{algorithms[0]: checksum}, nil
+	}
+
+	var (
+		hashes  = map[crypto.Hash]hash.Hash{}
+		writers []io.Writer
+	)
+
+	for _, algorithm := range algorithms {
+		if !algorithm.Available() {
+			return nil, fmt.Errorf("%w: algorithm %v", vfs.ErrNotSupported, algorithm)
+		}
+
+		if _, ok := hashes[algorithm]; !ok {
+			hashes[algorithm] = algorithm.New()
+			writers = append(writers, hashes[algorithm])
+		}
+	}
+
+	r, err := vfs.FileReadSeekCloser(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	if _, err := io.Copy(io.MultiWriter(writers...), r); err != nil {
+		return nil, err
+	}
+
+	checksums := map[crypto.Hash][]byte{}
+
+	for algorithm, h := range hashes {
+		checksums[algorithm] = h.Sum(nil)
+	}
+
+	return checksums, nil
+}
+
+func computeChecksum(fs vfs.FS, path string, algorithm crypto.Hash) ([]byte, error) {
+	if checksumFS, ok := fs.(vfs.ChecksumFS); ok {
+		checksum, err := checksumFS.Checksum(path, algorithm)
+		if !errors.Is(err, vfs.ErrNotSupported) {
+			return checksum, err
+		}
+	}
+
+	return vfs.Checksum(fs, path, algorithm)
+}
+
+var pathEncoder = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+
+var pathDecoder = strings.NewReplacer("%25", "%", "%0D", "\r", "%0A", "\n", "%0d", "\r", "%0a", "\n")
+
+func encodePath(path string) string {
+	return pathEncoder.Replace(path)
+}
+
+func decodePath(path string) string {
+	return pathDecoder.Replace(path)
+}
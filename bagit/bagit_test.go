@@ -0,0 +1,201 @@
+package bagit
+
+import (
+	"crypto"
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/kuleuven/vfs"
+	"github.com/kuleuven/vfs/fs/nativefs"
+)
+
+func writeTree(t *testing.T, fs vfs.FS, root string) {
+	t.Helper()
+
+	if err := vfs.MkdirAll(fs, root+"/data", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, data := range map[string]string{
+		"/a.txt":           "first",
+		"/data/b.txt":      "second",
+		"/data/100%\n.txt": "third",
+	} {
+		if err := vfs.WriteFile(fs, root+path, []byte(data), os.O_CREATE|os.O_WRONLY); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCreateInPlace(t *testing.T) {
+	fs := nativefs.New(t.Context(), t.TempDir())
+
+	defer fs.Close()
+
+	writeTree(t, fs, "/bag")
+
+	if err := CreateInPlace(fs, "/bag", WithAlgorithms(crypto.SHA256, crypto.MD5), WithInfo("Source-Organization", "KU Leuven")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := CreateInPlace(fs, "/bag"); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected ErrExist, got %v", err)
+	}
+
+	for _, path := range []string{"/bag/data/a.txt", "/bag/data/data/b.txt", "/bag/manifest-md5.txt", "/bag/tagmanifest-sha256.txt"} {
+		if _, err := fs.Stat(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err := vfs.ReadFile(fs, "/bag/bag-info.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(info), "Payload-Oxum: 16.3\n") || !strings.Contains(string(info), "Source-Organization: KU Leuven\n") {
+		t.Fatalf("unexpected bag-info.txt:\n%s", info)
+	}
+
+	manifest, err := vfs.ReadFile(fs, "/bag/manifest-sha256.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(manifest), "  data/data/100%25%0A.txt\n") {
+		t.Fatalf("expected encoded path in manifest:\n%s", manifest)
+	}
+
+	report, err := Validate(fs, "/bag")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !report.Valid() {
+		t.Fatalf("expected a valid bag, got %+v", report)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	src := nativefs.New(t.Context(), t.TempDir())
+	dst := nativefs.New(t.Context(), t.TempDir())
+
+	defer src.Close()
+	defer dst.Close()
+
+	writeTree(t, src, "/tree")
+
+	if err := Create(dst, "/archive/bag", src, "/tree"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Validate(src, "/tree"); !errors.Is(err, ErrNotBag) {
+		t.Fatalf("expected ErrNotBag, got %v", err)
+	}
+
+	if err := vfs.WriteFile(dst, "/archive/bag/data/a.txt", []byte("FIRST"), os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dst.Remove("/archive/bag/data/data/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vfs.WriteFile(dst, "/archive/bag/data/extra.txt", []byte("extra"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vfs.WriteFile(dst, "/archive/bag/bag-info.txt", []byte("Changed: yes\n"), os.O_WRONLY|os.O_TRUNC); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Validate(dst, "/archive/bag", WithWorkers(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &Report{
+		Missing: []string{"data/data/b.txt"},
+		Extra:   []string{"data/extra.txt"},
+		Corrupt: []string{"bag-info.txt", "data/a.txt"},
+	}
+
+	if !reflect.DeepEqual(report, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, report)
+	}
+}
+
+// failingFS fails the rename with the given number.
+type failingFS struct {
+	vfs.FS
+	renames, fail int
+}
+
+func (fs *failingFS) Rename(oldpath, newpath string) error {
+	fs.renames++
+
+	if fs.renames == fs.fail {
+		return &os.PathError{Op: "rename", Path: oldpath, Err: os.ErrPermission}
+	}
+
+	return fs.FS.Rename(oldpath, newpath)
+}
+
+func TestCreateInPlaceRollback(t *testing.T) {
+	for fail := 1; fail <= 3; fail++ {
+		native := nativefs.New(t.Context(), t.TempDir())
+
+		writeTree(t, native, "/bag")
+
+		if err := CreateInPlace(&failingFS{FS: native, fail: fail}, "/bag"); !errors.Is(err, os.ErrPermission) {
+			t.Fatalf("expected ErrPermission, got %v", err)
+		}
+
+		entries, err := vfs.ReadDir(native, "/bag")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+
+		if !reflect.DeepEqual(names, []string{"a.txt", "data"}) {
+			t.Fatalf("rename %d: expected the original tree, got %v", fail, names)
+		}
+
+		native.Close()
+	}
+}
+
+func TestValidateEscapingPath(t *testing.T) {
+	fs := nativefs.New(t.Context(), t.TempDir())
+
+	defer fs.Close()
+
+	writeTree(t, fs, "/bag")
+
+	if err := CreateInPlace(fs, "/bag"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := vfs.ReadFile(fs, "/bag/tagmanifest-sha256.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data = append(data, strings.Repeat("0", 64)+"  ../secret.txt\n"...)
+
+	if err := vfs.WriteFile(fs, "/bag/tagmanifest-sha256.txt", data, os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Validate(fs, "/bag"); !errors.Is(err, ErrNotBag) {
+		t.Fatalf("expected ErrNotBag, got %v", err)
+	}
+}
@@ -0,0 +1,232 @@
+package bagit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	iofs "io/fs"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/kuleuven/vfs"
+	"github.com/kuleuven/vfs/manifest"
+)
+
+// Report lists the problems found while validating a bag.
+// Paths are relative to the bag, e.g. data/file.txt.
+type Report struct {
+	Missing []string // Files listed in a manifest that do not exist
+	Extra   []string // Payload files that are not listed in every payload manifest
+	Corrupt []string // Files of which the checksum does not match
+}
+
+// Valid returns whether no problems were found.
+func (r *Report) Valid() bool {
+	return len(r.Missing) == 0 && len(r.Extra) == 0 && len(r.Corrupt) == 0
+}
+
+// Validate checks the bag at root: every file listed in the payload and tag
+// manifests must exist and match its checksum, and every payload file must be
+// listed. Payload checksums are computed in parallel.
+func Validate(fs vfs.FS, root string, opts ...Option) (*Report, error) {
+	root = vfs.Clean(root)
+	o := newOptions(opts)
+
+	if _, err := fs.Stat(vfs.Join(root, bagitFile)); errors.Is(err, os.ErrNotExist) {
+		return nil, &os.PathError{Op: "validate", Path: root, Err: ErrNotBag}
+	} else if err != nil {
+		return nil, err
+	}
+
+	entries, err := vfs.ReadDir(fs, root)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		report  = &Report{}
+		payload = map[crypto.Hash]map[string][]byte{}
+		missing = map[string]bool{}
+		extra   = map[string]bool{}
+		corrupt = map[string]bool{}
+	)
+
+	for _, entry := range entries {
+		algorithm, isTag, ok := parseManifestName(entry.Name())
+		if !ok {
+			continue
+		}
+
+		listed, err := readManifest(fs, vfs.Join(root, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		if !isTag {
+			payload[algorithm] = listed
+
+			continue
+		}
+
+		if err := validateTags(fs, root, algorithm, listed, missing, corrupt); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(payload) == 0 {
+		return nil, fmt.Errorf("%w: no payload manifest in %s", ErrNotBag, root)
+	}
+
+	if err := validatePayload(fs, root, payload, o, missing, extra, corrupt); err != nil {
+		return nil, err
+	}
+
+	report.Missing = sortedKeys(missing)
+	report.Extra = sortedKeys(extra)
+	report.Corrupt = sortedKeys(corrupt)
+
+	return report, nil
+}
+
+// parseManifestName returns the algorithm of a (tag) manifest file name.
+func parseManifestName(filename string) (crypto.Hash, bool, bool) {
+	name, ok := strings.CutSuffix(filename, ".txt")
+	if !ok {
+		return 0, false, false
+	}
+
+	if name, ok = strings.CutPrefix(name, "tagmanifest-"); ok {
+		algorithm, ok := Algorithms[name]
+
+		return algorithm, true, ok
+	}
+
+	if name, ok = strings.CutPrefix(name, "manifest-"); ok {
+		algorithm, ok := Algorithms[name]
+
+		return algorithm, false, ok
+	}
+
+	return 0, false, false
+}
+
+// readManifest returns the checksums by path listed in a manifest.
+func readManifest(fs vfs.FS, path string) (map[string][]byte, error) {
+	data, err := vfs.ReadFile(fs, path)
+	if err != nil {
+		return nil, err
+	}
+
+	listed := map[string][]byte{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+
+		checksum, file, ok := strings.Cut(line, " ")
+		if !ok {
+			checksum, file, ok = strings.Cut(line, "\t")
+		}
+
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid line in %s: %q", ErrNotBag, path, line)
+		}
+
+		var c manifest.Checksum
+
+		if err := c.UnmarshalText([]byte(strings.ToLower(checksum))); err != nil {
+			return nil, fmt.Errorf("%w: invalid checksum in %s: %q", ErrNotBag, path, line)
+		}
+
+		file = decodePath(strings.TrimLeft(file, " \t"))
+
+		// Paths must stay within the bag
+		if !iofs.ValidPath(file) {
+			return nil, fmt.Errorf("%w: invalid path in %s: %q", ErrNotBag, path, file)
+		}
+
+		listed[file] = c
+	}
+
+	return listed, scanner.Err()
+}
+
+// validatePayload checks the payload against the manifests of all algorithms,
+// reading each payload file once.
+func validatePayload(fs vfs.FS, root string, manifests map[crypto.Hash]map[string][]byte, o options, missing, extra, corrupt map[string]bool) error {
+	algorithms := make([]crypto.Hash, 0, len(manifests))
+
+	for algorithm := range manifests {
+		algorithms = append(algorithms, algorithm)
+	}
+
+	files, err := payloadChecksums(fs, root, algorithms, o.workers)
+	if err != nil {
+		return err
+	}
+
+	present := map[string]bool{}
+
+	for _, file := range files {
+		present[file.Path] = true
+
+		for algorithm, listed := range manifests {
+			checksum, ok := listed[file.Path]
+
+			switch {
+			case !ok:
+				extra[file.Path] = true
+			case !bytes.Equal(checksum, file.Checksums[algorithm]):
+				corrupt[file.Path] = true
+			}
+		}
+	}
+
+	for _, listed := range manifests {
+		for path := range listed {
+			if !present[path] {
+				missing[path] = true
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateTags(fs vfs.FS, root string, algorithm crypto.Hash, listed map[string][]byte, missing, corrupt map[string]bool) error {
+	for path, expected := range listed {
+		checksum, err := computeChecksum(fs, vfs.Join(root, path), algorithm)
+		if errors.Is(err, os.ErrNotExist) {
+			missing[path] = true
+
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if !bytes.Equal(checksum, expected) {
+			corrupt[path] = true
+		}
+	}
+
+	return nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
@@ -8,21 +8,61 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"go.uber.org/multierr"
 )
 
+const (
+	inodesFile = "inodes.db"
+	valuesFile = "files.db"
+)
+
 // New creates a new ByteTree instance based on the given directory.
 // The directory must be writeable as the ByteTree will write to it.
 // The ByteTree will create two files in the given directory: "inodes.db"
-// and "files.db".
-func New(directory string) (*ByteTree, error) {
-	inodes, err := os.OpenFile(filepath.Join(directory, "inodes.db"), os.O_RDWR|os.O_CREATE|os.O_SYNC, 0o640)
+// and "files.db". Journals left behind by crashed instances are replayed.
+func New(directory string, opts ...Option) (*ByteTree, error) {
+	options := &ByteTree{}
+
+	for _, opt := range opts {
+		opt(options)
+	}
+
+	flag := os.O_SYNC
+
+	if options.journal != nil {
+		// Synced once per group commit
+		flag = 0
+	}
+
+	tree, err := open(directory, flag)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tree.replay(); err != nil {
+		return nil, multierr.Append(err, tree.Close())
+	}
+
+	if options.journal != nil {
+		if err := createJournal(directory, options.journal); err != nil {
+			return nil, multierr.Append(err, tree.Close())
+		}
+
+		tree.journal = options.journal
+	}
+
+	return tree, nil
+}
+
+func open(directory string, flag int) (*ByteTree, error) {
+	inodes, err := os.OpenFile(filepath.Join(directory, inodesFile), os.O_RDWR|os.O_CREATE|flag, 0o640)
 	if err != nil {
 		return nil, err
 	}
 
-	files, err := os.OpenFile(filepath.Join(directory, "files.db"), os.O_RDWR|os.O_CREATE|os.O_SYNC, 0o640)
+	files, err := os.OpenFile(filepath.Join(directory, valuesFile), os.O_RDWR|os.O_CREATE|flag, 0o640)
 	if err != nil {
 		inodes.Close()
 
@@ -30,7 +70,9 @@ func New(directory string) (*ByteTree, error) {
 	}
 
 	tree := &ByteTree{
-		file: inodes,
+		directory: directory,
+		flag:      flag,
+		file:      inodes,
 		values: &values{
 			file: files,
 		},
@@ -47,13 +89,75 @@ func New(directory string) (*ByteTree, error) {
 // the same prefix, additional child nodes are created until
 // the prefixes differ.
 type ByteTree struct {
-	file   *os.File
-	values *values
+	directory string
+	flag      int
+	file      *os.File
+	values    *values
+	journal   *journal // Pending writes, if group commit is enabled
+	locked    bool     // Whether inodes.db is locked during a group commit
+	sync.Mutex
 }
 
 var ErrHasValue = errors.New("has value")
 
 func (db *ByteTree) Put(value Value) error {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.journal != nil {
+		return db.record(entry{Value: value})
+	}
+
+	return db.retryReplaced(func() error {
+		return db.put(value, func() (int64, error) {
+			return db.values.Add(value)
+		})
+	})
+}
+
+// Update stores values and deletes handles as a group. Without group commit,
+// the group is written to files.db at once and the tree is locked once, which
+// is cheaper than separate calls to Put and Delete. The deletes are applied
+// after the values are stored, and handles that do not exist are ignored.
+func (db *ByteTree) Update(values []Value, deletes [][]byte) error {
+	db.Lock()
+	defer db.Unlock()
+
+	entries := make([]entry, 0, len(values)+len(deletes))
+
+	for _, value := range values {
+		entries = append(entries, entry{Value: value})
+	}
+
+	for _, handle := range deletes {
+		entries = append(entries, entry{Value: Value{Handle: handle}, deleted: true})
+	}
+
+	if db.journal == nil {
+		return db.applyRetry(entries)
+	}
+
+	if err := db.commitErr(); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if err := db.journal.add(e); err != nil {
+			return err
+		}
+	}
+
+	if len(db.journal.entries) >= db.journal.size {
+		return db.commit()
+	}
+
+	db.schedule()
+
+	return nil
+}
+
+// put stores value in the tree, calling add to add it to files.db if needed.
+func (db *ByteTree) put(value Value, add func() (int64, error)) error {
 	var offset int64
 
 	for i := range len(value.Handle) {
@@ -69,7 +173,7 @@ func (db *ByteTree) Put(value Value) error {
 		}
 
 		// Try to save the value
-		storedHandle, err := db.replaceValue(offset+int64(value.Handle[i])*8, ptr, value)
+		storedHandle, err := db.replaceValue(offset+int64(value.Handle[i])*8, ptr, value, add)
 		if err != ErrDifferentHandle {
 			return err
 		}
@@ -94,13 +198,13 @@ func (db *ByteTree) Put(value Value) error {
 		return err
 	}
 
-	_, err = db.replaceValue(offset+256*8, ptr, value)
+	_, err = db.replaceValue(offset+256*8, ptr, value, add)
 
 	return err
 }
 
-func (db *ByteTree) newValue(offset int64, value Value) error {
-	ptr, err := db.values.Add(value)
+func (db *ByteTree) newValue(offset int64, add func() (int64, error)) error {
+	ptr, err := add()
 	if err != nil {
 		return err
 	}
@@ -110,9 +214,9 @@ func (db *ByteTree) newValue(offset int64, value Value) error {
 
 var ErrDifferentHandle = errors.New("different handle")
 
-func (db *ByteTree) replaceValue(offset, ptr int64, value Value) ([]byte, error) {
+func (db *ByteTree) replaceValue(offset, ptr int64, value Value, add func() (int64, error)) ([]byte, error) {
 	if ptr == 0 {
-		return nil, db.newValue(offset, value)
+		return nil, db.newValue(offset, add)
 	}
 
 	stored, err := db.values.Get(-ptr - 1)
@@ -128,7 +232,7 @@ func (db *ByteTree) replaceValue(offset, ptr int64, value Value) ([]byte, error)
 		return stored.Handle, nil
 	}
 
-	newPtr, err := db.values.Add(value)
+	newPtr, err := add()
 	if err != nil {
 		return stored.Handle, err
 	}
@@ -156,16 +260,67 @@ func (db *ByteTree) expandTree(offset, next, ptr int64) (int64, error) {
 }
 
 func (db *ByteTree) Get(handle []byte) (string, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if e, ok := db.pending(handle); ok {
+		if e.deleted {
+			return "", os.ErrNotExist
+		}
+
+		return e.Path, nil
+	}
+
+	_, _, val, err := db.get(handle)
+	if !errors.Is(err, os.ErrNotExist) {
+		return val.Path, err
+	}
+
+	// The handle might have been stored by another process after the files were
+	// replaced by Compact or Rebuild. Writes notice this when taking the lock.
+	if replaced, rerr := db.refreshed(); rerr != nil {
+		return "", rerr
+	} else if !replaced {
+		return "", err
+	}
+
+	_, _, val, err = db.get(handle)
+
+	return val.Path, err
+}
+
+// get returns the value stored for handle, with the offset of its pointer and the pointer itself.
+func (db *ByteTree) get(handle []byte) (int64, int64, Value, error) {
+	offset, ptr, err := db.find(handle)
+	if err != nil {
+		return 0, 0, Value{}, err
+	}
+
+	val, err := db.values.Get(-ptr - 1)
+	if err != nil {
+		return 0, 0, Value{}, err
+	}
+
+	if !bytes.Equal(val.Handle, handle) {
+		return 0, 0, Value{}, os.ErrNotExist
+	}
+
+	return offset, ptr, val, nil
+}
+
+// find returns the offset of the pointer to the value that
+// might be stored for handle, and the pointer itself.
+func (db *ByteTree) find(handle []byte) (int64, int64, error) {
 	var offset int64
 
 	for i := range handle {
 		ptr, err := db.read(offset + int64(handle[i])*8)
 		if err != nil {
-			return "", err
+			return 0, 0, err
 		}
 
 		if ptr == 0 {
-			return "", os.ErrNotExist
+			return 0, 0, os.ErrNotExist
 		}
 
 		if ptr > 0 {
@@ -174,33 +329,59 @@ func (db *ByteTree) Get(handle []byte) (string, error) {
 			continue
 		}
 
-		val, err := db.values.Get(-ptr - 1)
-		if err != nil {
-			return "", err
-		}
-
-		if !bytes.Equal(val.Handle, handle) {
-			return "", os.ErrNotExist
-		}
-
-		return val.Path, nil
+		return offset + int64(handle[i])*8, ptr, nil
 	}
 
 	ptr, err := db.read(offset + 256*8)
 	if err != nil {
-		return "", err
+		return 0, 0, err
 	}
 
 	if ptr == 0 {
-		return "", os.ErrNotExist
+		return 0, 0, os.ErrNotExist
 	}
 
-	val, err := db.values.Get(-ptr - 1)
+	return offset + 256*8, ptr, nil
+}
+
+// Delete removes the value stored for handle. The deletion is recorded
+// in files.db, so that Rebuild does not restore the value.
+func (db *ByteTree) Delete(handle []byte) error {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.journal == nil {
+		return db.retryReplaced(func() error {
+			return db.remove(handle, true)
+		})
+	}
+
+	if e, ok := db.pending(handle); ok && e.deleted {
+		return os.ErrNotExist
+	} else if !ok {
+		if _, _, _, err := db.get(handle); err != nil {
+			return err
+		}
+	}
+
+	return db.record(entry{Value: Value{Handle: handle}, deleted: true})
+}
+
+// remove clears the pointer to the value of handle, after recording
+// the deletion in files.db if record is set.
+func (db *ByteTree) remove(handle []byte, record bool) error {
+	offset, ptr, _, err := db.get(handle)
 	if err != nil {
-		return "", err
+		return err
+	}
+
+	if record {
+		if _, err := db.values.AddDeletion(handle); err != nil {
+			return err
+		}
 	}
 
-	return val.Path, nil
+	return db.write(offset, ptr, 0)
 }
 
 func (db *ByteTree) read(offset int64) (int64, error) {
@@ -219,16 +400,18 @@ func (db *ByteTree) read(offset int64) (int64, error) {
 }
 
 func (db *ByteTree) write(offset, oldValue, newValue int64) error {
-	lock, err := Lock(db.file)
-	if err != nil {
-		return err
-	}
+	if !db.locked {
+		lock, err := lockFile(db.file)
+		if err != nil {
+			return err
+		}
 
-	defer lock.Unlock() //nolint:errcheck
+		defer lock.Unlock() //nolint:errcheck
+	}
 
 	var buf [8]byte
 
-	_, err = db.file.ReadAt(buf[:], offset)
+	_, err := db.file.ReadAt(buf[:], offset)
 	if err != nil && !errors.Is(err, io.EOF) {
 		return err
 	}
@@ -247,12 +430,14 @@ func (db *ByteTree) write(offset, oldValue, newValue int64) error {
 const chunkSize = 257 * 8
 
 func (db *ByteTree) newOffset() (int64, error) {
-	lock, err := Lock(db.file)
-	if err != nil {
-		return 0, err
-	}
+	if !db.locked {
+		lock, err := lockFile(db.file)
+		if err != nil {
+			return 0, err
+		}
 
-	defer lock.Unlock() //nolint:errcheck
+		defer lock.Unlock() //nolint:errcheck
+	}
 
 	offset, err := db.file.Seek(0, io.SeekEnd)
 	if err != nil {
@@ -272,6 +457,13 @@ func (db *ByteTree) newOffset() (int64, error) {
 
 // Print the tree for debugging purposes
 func (db *ByteTree) Print() {
+	db.Lock()
+	defer db.Unlock()
+
+	if err := db.commit(); err != nil {
+		fmt.Printf("commit: %v\n", err)
+	}
+
 	db.print(0, nil)
 }
 
@@ -321,6 +513,19 @@ func printValue(values *values, prefix []byte, ptr int64) {
 	fmt.Printf("%x\t%x\t%s\n", prefix, val.Handle, val.Path)
 }
 
+// Close applies the pending writes, and closes the tree.
 func (db *ByteTree) Close() error {
-	return multierr.Append(db.file.Close(), db.values.Close())
+	db.Lock()
+	defer db.Unlock()
+
+	var err error
+
+	if db.journal != nil {
+		err = db.commit()
+
+		// The journal is kept to be replayed if the commit failed
+		err = multierr.Append(err, db.journal.close(err == nil))
+	}
+
+	return multierr.Combine(err, db.file.Close(), db.values.Close())
 }
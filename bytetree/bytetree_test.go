@@ -2,9 +2,15 @@ package bytetree
 
 import (
 	"bytes"
+	"errors"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
 	"testing"
+	"time"
+
+	"go.uber.org/multierr"
 )
 
 func TestNew(t *testing.T) {
@@ -463,3 +469,543 @@ func TestLargeHandle(t *testing.T) {
 		t.Errorf("Expected path '/large/handle/path', got '%s'", path)
 	}
 }
+
+func putValues(t *testing.T, tree *ByteTree, values ...Value) {
+	t.Helper()
+
+	for _, value := range values {
+		if err := tree.Put(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func collectValues(t *testing.T, tree *ByteTree) []Value {
+	t.Helper()
+
+	var result []Value
+
+	for value, err := range tree.All() {
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result = append(result, value)
+	}
+
+	return result
+}
+
+func TestDeleteAndAll(t *testing.T) {
+	tree, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tree.Close()
+
+	putValues(t, tree,
+		Value{Handle: []byte("b"), Path: "/b"},
+		Value{Handle: []byte("ab"), Path: "/ab"},
+		Value{Handle: []byte("a"), Path: "/a"},
+		Value{Handle: []byte("abc"), Path: "/abc"},
+		Value{Handle: []byte("c"), Path: "/c"},
+	)
+
+	if err := tree.Delete([]byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Delete([]byte("ab")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+
+	if err := tree.Delete([]byte("abcd")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+
+	if _, err := tree.Get([]byte("ab")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+
+	expected := []Value{
+		{Handle: []byte("a"), Path: "/a"},
+		{Handle: []byte("abc"), Path: "/abc"},
+		{Handle: []byte("b"), Path: "/b"},
+		{Handle: []byte("c"), Path: "/c"},
+	}
+
+	if values := collectValues(t, tree); !reflect.DeepEqual(values, expected) {
+		t.Fatalf("expected %v, got %v", expected, values)
+	}
+
+	// The deleted handle can be reused
+	putValues(t, tree, Value{Handle: []byte("ab"), Path: "/ab2"})
+
+	if path, err := tree.Get([]byte("ab")); err != nil || path != "/ab2" {
+		t.Fatalf("expected /ab2, got %s (%v)", path, err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+
+	tree, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tree.Close()
+
+	// Another instance, like another process would have
+	other, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer other.Close()
+
+	for i := range 100 {
+		putValues(t, tree, Value{Handle: []byte{byte(i), 1}, Path: "/old"}, Value{Handle: []byte{byte(i), 1}, Path: "/new"})
+
+		if i%2 == 0 {
+			if err := tree.Delete([]byte{byte(i), 1}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	before, err := os.Stat(filepath.Join(dir, "files.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := collectValues(t, tree)
+
+	if err := tree.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := os.Stat(filepath.Join(dir, "files.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after.Size() >= before.Size()/4 {
+		t.Fatalf("expected files.db to shrink, from %d to %d bytes", before.Size(), after.Size())
+	}
+
+	for _, tree := range []*ByteTree{tree, other} {
+		if values := collectValues(t, tree); !reflect.DeepEqual(values, expected) {
+			t.Fatalf("expected %v, got %v", expected, values)
+		}
+
+		if err := tree.Verify(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The other instance writes to the new files
+	putValues(t, other, Value{Handle: []byte{0, 1}, Path: "/other"})
+
+	if path, err := tree.Get([]byte{0, 1}); err != nil || path != "/other" {
+		t.Fatalf("expected /other, got %s (%v)", path, err)
+	}
+
+	// Lookups and writes notice files replaced by another instance
+	if err := other.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	putValues(t, other, Value{Handle: []byte{200, 1}, Path: "/compacted"})
+
+	if path, err := tree.Get([]byte{200, 1}); err != nil || path != "/compacted" {
+		t.Fatalf("expected /compacted, got %s (%v)", path, err)
+	}
+
+	if err := tree.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	putValues(t, other, Value{Handle: []byte{201, 1}, Path: "/after"})
+
+	if path, err := tree.Get([]byte{201, 1}); err != nil || path != "/after" {
+		t.Fatalf("expected /after, got %s (%v)", path, err)
+	}
+}
+
+func TestVerifyAndRebuild(t *testing.T) {
+	dir := t.TempDir()
+
+	tree, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tree.Close()
+
+	putValues(t, tree,
+		Value{Handle: []byte("aa"), Path: "/aa"},
+		Value{Handle: []byte("ab"), Path: "/ab"},
+		Value{Handle: []byte("b"), Path: "/b"},
+		Value{Handle: []byte("b"), Path: "/b2"},
+	)
+
+	if err := tree.Delete([]byte("ab")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Corrupt the pointer to the node of prefix "a", and leave a partial record
+	if _, err := tree.file.WriteAt([]byte{1, 2, 3, 4, 5, 0, 0, 0}, int64('a')*8); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := tree.values.file.Write([]byte{0, 0, 0, 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	err = tree.Verify()
+	if !errors.Is(err, ErrCorrupt) || !errors.Is(err, ErrTruncated) {
+		t.Fatalf("expected a bad pointer and a truncated record, got %v", err)
+	}
+
+	if err := tree.Rebuild(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Value{
+		{Handle: []byte("aa"), Path: "/aa"},
+		{Handle: []byte("b"), Path: "/b2"},
+	}
+
+	if values := collectValues(t, tree); !reflect.DeepEqual(values, expected) {
+		t.Fatalf("expected %v, got %v", expected, values)
+	}
+}
+
+func expectPath(t *testing.T, tree *ByteTree, handle, path string) {
+	t.Helper()
+
+	stored, err := tree.Get([]byte(handle))
+
+	switch {
+	case path == "" && !errors.Is(err, os.ErrNotExist):
+		t.Errorf("expected ErrNotExist for %s, got %q (%v)", handle, stored, err)
+	case path != "" && (err != nil || stored != path):
+		t.Errorf("expected %s for %s, got %q (%v)", path, handle, stored, err)
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	dir := t.TempDir()
+
+	tree, err := New(dir, WithGroupCommit(time.Hour, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tree.Close()
+
+	other, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer other.Close()
+
+	putValues(t, other, Value{Handle: []byte("c"), Path: "/c"})
+
+	putValues(t, tree,
+		Value{Handle: []byte("a"), Path: "/a"},
+		Value{Handle: []byte("b"), Path: "/b"},
+	)
+
+	if err := tree.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tree.Delete([]byte("a")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+
+	// Pending writes are only visible to the tree itself
+	expectPath(t, tree, "a", "")
+	expectPath(t, tree, "b", "/b")
+	expectPath(t, other, "b", "")
+
+	if err := tree.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	expectPath(t, other, "a", "")
+	expectPath(t, other, "b", "/b")
+
+	// The fourth pending write triggers a commit
+	if err := tree.Delete([]byte("c")); err != nil {
+		t.Fatal(err)
+	}
+
+	putValues(t, tree,
+		Value{Handle: []byte("d"), Path: "/d"},
+		Value{Handle: []byte("e"), Path: "/e"},
+	)
+
+	expectPath(t, other, "d", "")
+
+	putValues(t, tree, Value{Handle: []byte("d"), Path: "/d2"})
+
+	expectPath(t, other, "c", "")
+	expectPath(t, other, "d", "/d2")
+	expectPath(t, other, "e", "/e")
+
+	if err := other.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGroupCommitInterval(t *testing.T) {
+	dir := t.TempDir()
+
+	tree, err := New(dir, WithGroupCommit(10*time.Millisecond, 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer tree.Close()
+
+	other, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer other.Close()
+
+	putValues(t, tree, Value{Handle: []byte("a"), Path: "/a"})
+
+	for range 100 {
+		if _, err := other.Get([]byte("a")); err == nil {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatal("pending write was not committed")
+}
+
+func TestGroupCommitError(t *testing.T) {
+	tree, err := New(t.TempDir(), WithGroupCommit(time.Millisecond, 100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putValues(t, tree, Value{Handle: []byte("a"), Path: "/a"})
+
+	// Make the scheduled commit fail
+	tree.Lock()
+	tree.values.file.Close()
+	tree.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+
+	if err := tree.Put(Value{Handle: []byte("b"), Path: "/b"}); err == nil {
+		t.Fatal("expected the error of the scheduled commit")
+	}
+
+	if err := tree.Close(); err == nil {
+		t.Fatal("expected the commit on close to fail")
+	}
+}
+
+func TestReplayJournal(t *testing.T) {
+	for _, state := range []byte{journalOpen, journalCommitting} {
+		dir := t.TempDir()
+
+		tree, err := New(dir, WithGroupCommit(time.Hour, 1000))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		putValues(t, tree, Value{Handle: []byte("a"), Path: "/a"})
+
+		if err := tree.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		putValues(t, tree, Value{Handle: []byte("b"), Path: "/b"})
+
+		if err := tree.Delete([]byte("a")); err != nil {
+			t.Fatal(err)
+		}
+
+		if state == journalCommitting {
+			// A crash while committing might leave the tree incomplete
+			if err := tree.journal.setState(state); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := tree.file.Truncate(0); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Crash without committing
+		if err := multierr.Combine(tree.journal.lock.Unlock(), tree.journal.file.Close(), tree.file.Close(), tree.values.Close()); err != nil {
+			t.Fatal(err)
+		}
+
+		tree, err = New(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectPath(t, tree, "a", "")
+		expectPath(t, tree, "b", "/b")
+
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if journals, err := filepath.Glob(filepath.Join(dir, journalPattern)); err != nil || len(journals) > 0 {
+			t.Errorf("expected the journal to be removed, got %v (%v)", journals, err)
+		}
+	}
+}
+
+func TestLock(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "file")
+
+	files := make([]*os.File, 2)
+
+	for i := range files {
+		file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer file.Close()
+
+		files[i] = file
+	}
+
+	lock, err := TryLock(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := TryLock(files[1]); !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("expected ErrLockHeld, got %v", err)
+	}
+
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err = Lock(files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLegacyLock(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("hard link locks are only used on linux")
+	}
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "file")
+
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer file.Close()
+
+	// A lock held by an older version
+	legacy := filepath.Join(dir, ".file.lock1")
+
+	if err = os.Link(name, legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = TryLock(file); !errors.Is(err, ErrLockHeld) {
+		t.Fatalf("expected ErrLockHeld, got %v", err)
+	}
+
+	if err = os.Remove(legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	// A link left behind by a crashed process does not hold the lock
+	if err = os.Link(name, filepath.Join(dir, ".file.ofdlock1")); err != nil {
+		t.Fatal(err)
+	}
+
+	lock, err := TryLock(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Older versions see the link of the lock
+	links, err := filepath.Glob(filepath.Join(dir, ".file.ofdlock*"))
+	if err != nil || len(links) != 1 || links[0] == filepath.Join(dir, ".file.ofdlock1") {
+		t.Fatalf("expected a new link, got %v (%v)", links, err)
+	}
+
+	if err = lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 1 {
+		t.Fatalf("expected only the file to remain, got %v (%v)", entries, err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithGroupCommit(time.Hour, 100)}} {
+		tree, err := New(t.TempDir(), opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		putValues(t, tree, Value{Handle: []byte("a"), Path: "/a"}, Value{Handle: []byte("b"), Path: "/b"})
+
+		err = tree.Update([]Value{
+			{Handle: []byte("a"), Path: "/moved"},
+			{Handle: []byte("c"), Path: "/c"},
+		}, [][]byte{[]byte("b"), []byte("missing")})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := tree.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []Value{
+			{Handle: []byte("a"), Path: "/moved"},
+			{Handle: []byte("c"), Path: "/c"},
+		}
+
+		if values := collectValues(t, tree); !reflect.DeepEqual(values, expected) {
+			t.Fatalf("expected %v, got %v", expected, values)
+		}
+
+		if err := tree.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package bytetree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"go.uber.org/multierr"
+)
+
+// ErrCorrupt is returned when the tree contains bad pointers or values.
+var ErrCorrupt = errors.New("corrupt tree")
+
+// ErrTruncated is returned when files.db ends with a partial record.
+var ErrTruncated = fmt.Errorf("%w: truncated record", ErrCorrupt)
+
+// All iterates over the values in the tree, ordered by handle.
+// The tree is locked during the iteration.
+func (db *ByteTree) All() iter.Seq2[Value, error] {
+	return func(yield func(Value, error) bool) {
+		db.Lock()
+		defer db.Unlock()
+
+		if err := db.commit(); err != nil {
+			yield(Value{}, err)
+
+			return
+		}
+
+		for value, err := range db.all() {
+			if !yield(value, err) {
+				return
+			}
+		}
+	}
+}
+
+func (db *ByteTree) all() iter.Seq2[Value, error] {
+	return func(yield func(Value, error) bool) {
+		if err := db.refresh(); err != nil {
+			yield(Value{}, err)
+
+			return
+		}
+
+		err := db.traverse(func(prefix []byte, exact bool, ptr int64, err error) bool {
+			var value Value
+
+			if err == nil {
+				value, err = db.value(prefix, exact, ptr)
+			}
+
+			if err != nil {
+				yield(Value{}, err)
+
+				return false
+			}
+
+			return yield(value, nil)
+		})
+		if err != nil {
+			yield(Value{}, err)
+		}
+	}
+}
+
+// Verify checks the tree for bad pointers, values that are stored at the
+// wrong place, and a truncated record at the end of files.db, e.g. after
+// a crash. All problems are returned, wrapping ErrCorrupt.
+func (db *ByteTree) Verify() error {
+	db.Lock()
+	defer db.Unlock()
+
+	if err := db.commit(); err != nil {
+		return err
+	}
+
+	if err := db.refresh(); err != nil {
+		return err
+	}
+
+	var result error
+
+	err := db.traverse(func(prefix []byte, exact bool, ptr int64, err error) bool {
+		if err == nil {
+			_, err = db.value(prefix, exact, ptr)
+		}
+
+		result = multierr.Append(result, err)
+
+		return true
+	})
+
+	result = multierr.Append(result, err)
+
+	return multierr.Append(result, db.values.scan(func(int64, Value, bool) error { return nil }))
+}
+
+// value returns the value for a pointer found at prefix in the tree.
+func (db *ByteTree) value(prefix []byte, exact bool, ptr int64) (Value, error) {
+	value, err := db.values.Get(-ptr - 1)
+
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return Value{}, fmt.Errorf("%w: bad value pointer %d", ErrCorrupt, -ptr-1)
+	case err != nil:
+		return Value{}, err
+	case exact && !bytes.Equal(value.Handle, prefix), !bytes.HasPrefix(value.Handle, prefix):
+		return Value{}, fmt.Errorf("%w: value %x stored at %x", ErrCorrupt, value.Handle, prefix)
+	default:
+		return value, nil
+	}
+}
+
+// traverse calls fn in order for the pointer to each value, together with
+// the prefix where it is stored, and for each bad pointer with an error.
+// The value stored at a node itself has an exact prefix, and comes first.
+func (db *ByteTree) traverse(fn func(prefix []byte, exact bool, ptr int64, err error) bool) error {
+	fi, err := db.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.traverseNode(0, nil, fi.Size(), fn)
+
+	return err
+}
+
+func (db *ByteTree) traverseNode(offset int64, prefix []byte, size int64, fn func([]byte, bool, int64, error) bool) (bool, error) {
+	// The root node might not be written completely
+	buf := make([]byte, chunkSize)
+
+	if _, err := db.file.ReadAt(buf, offset); err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+
+	pointer := func(i int) int64 {
+		return int64(binary.LittleEndian.Uint64(buf[i*8:]))
+	}
+
+	if ptr := pointer(256); ptr > 0 {
+		if !fn(prefix, true, ptr, fmt.Errorf("%w: bad pointer %d at %d", ErrCorrupt, ptr, offset+256*8)) {
+			return false, nil
+		}
+	} else if ptr < 0 && !fn(prefix, true, ptr, nil) {
+		return false, nil
+	}
+
+	for i := range 256 {
+		ptr := pointer(i)
+		next := append(slices.Clip(prefix), byte(i))
+
+		switch {
+		case ptr == 0:
+			continue
+		case ptr < 0:
+			if !fn(next, false, ptr, nil) {
+				return false, nil
+			}
+		case ptr <= offset || ptr%chunkSize != 0 || ptr+chunkSize > size:
+			if !fn(next, false, ptr, fmt.Errorf("%w: bad pointer %d at %d", ErrCorrupt, ptr, offset+int64(i)*8)) {
+				return false, nil
+			}
+		default:
+			if ok, err := db.traverseNode(ptr, next, size, fn); !ok || err != nil {
+				return ok, err
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// Compact rewrites inodes.db and files.db with only the current values,
+// i.e. without overwritten or deleted values and empty nodes. The tree can
+// be in use meanwhile: other instances of the tree, e.g. in other processes,
+// reopen the files on their next operation.
+func (db *ByteTree) Compact() error {
+	db.Lock()
+	defer db.Unlock()
+
+	if err := db.commit(); err != nil {
+		return err
+	}
+
+	return db.rewrite(func(tree *ByteTree) error {
+		for value, err := range db.all() {
+			if err != nil {
+				return err
+			}
+
+			if err := tree.Put(value); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// Compact compacts the tree in the given directory, see ByteTree.Compact.
+func Compact(directory string) error {
+	tree, err := New(directory)
+	if err != nil {
+		return err
+	}
+
+	return multierr.Append(tree.Compact(), tree.Close())
+}
+
+// Rebuild rebuilds the tree from the records in files.db, e.g. when Verify
+// reports a corrupt tree after a crash. For each handle, the last value
+// that was stored is restored, unless it was deleted afterwards.
+func (db *ByteTree) Rebuild() error {
+	db.Lock()
+	defer db.Unlock()
+
+	if err := db.commit(); err != nil {
+		return err
+	}
+
+	return db.rewrite(db.rebuild)
+}
+
+// rebuild fills tree with the last value of each handle in files.db.
+func (db *ByteTree) rebuild(tree *ByteTree) error {
+	latest := map[string]int64{}
+
+	err := db.values.scan(func(ptr int64, value Value, deleted bool) error {
+		if deleted {
+			delete(latest, string(value.Handle))
+		} else {
+			latest[string(value.Handle)] = ptr
+		}
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrTruncated) {
+		return err
+	}
+
+	for _, handle := range slices.Sorted(maps.Keys(latest)) {
+		value, err := db.values.Get(latest[handle])
+		if err != nil {
+			return err
+		}
+
+		if err := tree.Put(value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rewrite fills a new tree, and replaces the files of the tree with it, while
+// both files stay locked. Files.db is replaced first, and other instances only
+// reopen the files once inodes.db has been replaced as well.
+func (db *ByteTree) rewrite(fill func(*ByteTree) error) error {
+	if err := db.refresh(); err != nil {
+		return err
+	}
+
+	inodesLock, err := lockFile(db.file)
+	if err != nil {
+		return err
+	}
+
+	defer inodesLock.Unlock() //nolint:errcheck
+
+	valuesLock, err := lockFile(db.values.file)
+	if err != nil {
+		return err
+	}
+
+	defer valuesLock.Unlock() //nolint:errcheck
+
+	dir, err := os.MkdirTemp(db.directory, ".rewrite")
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(dir)
+
+	// The new files are synced once at the end
+	tree, err := open(dir, 0)
+	if err != nil {
+		return err
+	}
+
+	if err = fill(tree); err != nil {
+		return multierr.Append(err, tree.Close())
+	}
+
+	if err = multierr.Combine(tree.file.Sync(), tree.values.file.Sync(), tree.Close()); err != nil {
+		return err
+	}
+
+	for _, name := range []string{valuesFile, inodesFile} {
+		if err := os.Rename(filepath.Join(dir, name), filepath.Join(db.directory, name)); err != nil {
+			return err
+		}
+	}
+
+	return db.reopen()
+}
+
+// refresh reopens the files if they were replaced by Compact or Rebuild.
+func (db *ByteTree) refresh() error {
+	_, err := db.refreshed()
+
+	return err
+}
+
+// retryReplaced calls fn, and calls it again after reopening the files if it
+// returned ErrHasValue because the files were replaced while taking the lock.
+func (db *ByteTree) retryReplaced(fn func() error) error {
+	err := fn()
+	if !errors.Is(err, ErrHasValue) {
+		return err
+	}
+
+	replaced, rerr := db.refreshed()
+	if rerr != nil || !replaced {
+		return multierr.Append(err, rerr)
+	}
+
+	return fn()
+}
+
+// refreshed reopens the files if they were replaced by Compact or Rebuild,
+// and returns whether they were.
+func (db *ByteTree) refreshed() (bool, error) {
+	for range 100 {
+		replaced, err := isReplaced(db.file)
+		if err != nil {
+			return false, err
+		}
+
+		if replaced {
+			return true, db.reopen()
+		}
+
+		if replaced, err = isReplaced(db.values.file); err != nil || !replaced {
+			return false, err
+		}
+
+		// Files.db has been replaced, but inodes.db not yet
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return false, fmt.Errorf("%w: files.db was replaced without inodes.db", ErrCorrupt)
+}
+
+func (db *ByteTree) reopen() error {
+	tree, err := open(db.directory, db.flag)
+	if err != nil {
+		return err
+	}
+
+	err = multierr.Append(db.file.Close(), db.values.Close())
+
+	db.file = tree.file
+	db.values = tree.values
+
+	return err
+}
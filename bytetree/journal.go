@@ -0,0 +1,432 @@
+package bytetree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/multierr"
+)
+
+// Option configures a ByteTree.
+type Option func(*ByteTree)
+
+// WithGroupCommit batches the writes to the tree. Put and Delete only append
+// to a write-ahead journal, which is not synced, and the pending writes are
+// applied to the tree as a group after interval, once size writes are
+// pending, or when Sync or Close is called. Files.db and inodes.db are then
+// written without O_SYNC, and synced once per group.
+//
+// Pending writes are visible to this instance only. If the process crashes,
+// the journal is replayed by the next instance that opens the tree. Writes
+// that were pending are only guaranteed to survive a crash of the operating
+// system after Sync. If a scheduled commit fails, it is tried again later,
+// and the error is returned by the next Put, Delete or Update.
+func WithGroupCommit(interval time.Duration, size int) Option {
+	return func(db *ByteTree) {
+		db.journal = &journal{
+			interval: interval,
+			size:     size,
+		}
+	}
+}
+
+// Each instance with group commit has its own journal, that is locked while
+// the instance is open, so that the journals of crashed instances can be
+// recognized and replayed.
+const journalPattern = "journal-*.db"
+
+// The journal starts with a header with its state, followed by records in
+// the format of files.db. If the state is committing, the tree might be
+// partially updated, and is rebuilt from files.db on replay.
+var journalMagic = []byte("BTJ1")
+
+const (
+	journalOpen       = 'o'
+	journalCommitting = 'c'
+	journalHeaderSize = 8
+)
+
+type journal struct {
+	file     *os.File
+	lock     *FileLock
+	offset   int64
+	interval time.Duration
+	size     int
+	entries  []entry
+	pending  map[string]int // Index of the last entry of each handle
+	timer    *time.Timer
+	err      error // Error of the last scheduled commit, if it failed
+}
+
+// entry is a pending Put, or a Delete if deleted is set.
+type entry struct {
+	Value
+	deleted bool
+}
+
+func (e entry) appendTo(buf []byte) []byte {
+	if e.deleted {
+		return appendRecord(buf, e.Handle, nil, deleted)
+	}
+
+	return appendRecord(buf, e.Handle, []byte(e.Path), uint32(len(e.Path))) //nolint:gosec
+}
+
+func createJournal(directory string, j *journal) error {
+	name := filepath.Join(directory, fmt.Sprintf("journal-%016x.db", rand.Uint64())) //nolint:gosec
+
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		return err
+	}
+
+	lock, err := TryLock(file)
+	if err != nil {
+		return multierr.Combine(err, file.Close(), os.Remove(name))
+	}
+
+	j.file = file
+	j.lock = lock
+	j.offset = journalHeaderSize
+	j.pending = map[string]int{}
+
+	if err := j.setState(journalOpen); err != nil {
+		return multierr.Append(err, j.close(true))
+	}
+
+	return nil
+}
+
+// add appends an entry to the journal.
+func (j *journal) add(e entry) error {
+	buf := e.appendTo(nil)
+
+	if _, err := j.file.WriteAt(buf, j.offset); err != nil {
+		return err
+	}
+
+	j.offset += int64(len(buf))
+	j.pending[string(e.Handle)] = len(j.entries)
+	j.entries = append(j.entries, e)
+
+	return nil
+}
+
+// get returns the pending entry of handle.
+func (j *journal) get(handle []byte) (entry, bool) {
+	i, ok := j.pending[string(handle)]
+	if !ok {
+		return entry{}, false
+	}
+
+	return j.entries[i], true
+}
+
+func (j *journal) setState(state byte) error {
+	header := make([]byte, journalHeaderSize)
+
+	copy(header, journalMagic)
+	header[len(journalMagic)] = state
+
+	if _, err := j.file.WriteAt(header, 0); err != nil {
+		return err
+	}
+
+	return j.file.Sync()
+}
+
+// reset empties the journal after its entries were applied.
+func (j *journal) reset() error {
+	if err := j.file.Truncate(journalHeaderSize); err != nil {
+		return err
+	}
+
+	j.offset = journalHeaderSize
+	j.entries = nil
+	j.pending = map[string]int{}
+
+	return j.setState(journalOpen)
+}
+
+func (j *journal) close(remove bool) error {
+	if j.timer != nil {
+		j.timer.Stop()
+		j.timer = nil
+	}
+
+	err := multierr.Append(j.lock.Unlock(), j.file.Close())
+
+	if remove {
+		err = multierr.Append(err, os.Remove(j.file.Name()))
+	}
+
+	return err
+}
+
+// Sync applies the pending writes to the tree.
+func (db *ByteTree) Sync() error {
+	db.Lock()
+	defer db.Unlock()
+
+	return db.commit()
+}
+
+// pending returns the pending write of handle, if any.
+func (db *ByteTree) pending(handle []byte) (entry, bool) {
+	if db.journal == nil {
+		return entry{}, false
+	}
+
+	return db.journal.get(handle)
+}
+
+// record adds an entry to the journal, and commits the pending
+// entries if there are enough of them, or schedules a commit.
+func (db *ByteTree) record(e entry) error {
+	j := db.journal
+
+	if err := db.commitErr(); err != nil {
+		return err
+	}
+
+	if err := j.add(e); err != nil {
+		return err
+	}
+
+	if len(j.entries) >= j.size {
+		return db.commit()
+	}
+
+	db.schedule()
+
+	return nil
+}
+
+// schedule commits the pending entries after the interval.
+func (db *ByteTree) schedule() {
+	j := db.journal
+
+	if j.timer != nil {
+		return
+	}
+
+	j.timer = time.AfterFunc(j.interval, func() {
+		db.Lock()
+		defer db.Unlock()
+
+		if j.timer == nil {
+			// Committed or closed meanwhile
+			return
+		}
+
+		j.timer = nil
+
+		if err := db.commit(); err != nil {
+			// Try again later
+			j.err = err
+
+			db.schedule()
+		}
+	})
+}
+
+// commitErr returns the error of a failed scheduled commit once.
+func (db *ByteTree) commitErr() error {
+	err := db.journal.err
+
+	db.journal.err = nil
+
+	if err != nil {
+		return fmt.Errorf("group commit: %w", err)
+	}
+
+	return nil
+}
+
+// commit applies the pending entries to the tree as a group.
+func (db *ByteTree) commit() error {
+	j := db.journal
+
+	if j == nil || len(j.entries) == 0 {
+		return nil
+	}
+
+	if j.timer != nil {
+		j.timer.Stop()
+		j.timer = nil
+	}
+
+	// From here on, the tree might be partially updated after a crash
+	if err := j.setState(journalCommitting); err != nil {
+		return err
+	}
+
+	if err := db.applyRetry(j.entries); err != nil {
+		return err
+	}
+
+	// The pending entries that failed to commit before are committed now
+	j.err = nil
+
+	return j.reset()
+}
+
+// applyRetry applies entries, retrying if the files were replaced meanwhile.
+func (db *ByteTree) applyRetry(entries []entry) error {
+	for range 10 {
+		err := db.retryReplaced(func() error {
+			return db.apply(entries)
+		})
+		if errors.Is(err, ErrHasValue) {
+			continue
+		}
+
+		return err
+	}
+
+	return ErrHasValue
+}
+
+// apply adds all entries to files.db in a single write, and syncs it, before
+// pointing to them from inodes.db, which is locked and synced only once.
+func (db *ByteTree) apply(entries []entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	lock, err := lockFile(db.file)
+	if err != nil {
+		return err
+	}
+
+	defer lock.Unlock() //nolint:errcheck
+
+	db.locked = true
+
+	defer func() {
+		db.locked = false
+	}()
+
+	ptrs, err := db.values.addAll(entries)
+	if err != nil {
+		return err
+	}
+
+	if err := db.values.file.Sync(); err != nil {
+		return err
+	}
+
+	for i, e := range entries {
+		if e.deleted {
+			err = db.remove(e.Handle, false)
+		} else {
+			err = db.put(e.Value, func() (int64, error) {
+				return ptrs[i], nil
+			})
+		}
+
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return db.file.Sync()
+}
+
+// readJournal returns the state and the entries of a journal. A truncated
+// last entry is ignored, as it was never synced.
+func readJournal(file *os.File) (byte, []entry, error) {
+	header := make([]byte, journalHeaderSize)
+
+	if _, err := file.ReadAt(header, 0); errors.Is(err, io.EOF) {
+		// Created, but the header was never written
+		return journalOpen, nil, nil
+	} else if err != nil {
+		return 0, nil, err
+	}
+
+	if !bytes.HasPrefix(header, journalMagic) {
+		return 0, nil, fmt.Errorf("%w: bad journal header in %s", ErrCorrupt, file.Name())
+	}
+
+	var entries []entry
+
+	err := (&values{file: file}).scanFrom(journalHeaderSize, func(_ int64, value Value, deleted bool) error {
+		entries = append(entries, entry{Value: value, deleted: deleted})
+
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrTruncated) {
+		return 0, nil, err
+	}
+
+	return header[len(journalMagic)], entries, nil
+}
+
+// replay applies the journals of instances that are no longer open,
+// e.g. because their process crashed, and removes them.
+func (db *ByteTree) replay() error {
+	names, err := filepath.Glob(filepath.Join(db.directory, journalPattern))
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := db.replayJournal(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *ByteTree) replayJournal(name string) error {
+	file, err := os.OpenFile(name, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	lock, err := TryLock(file)
+	if errors.Is(err, ErrLockHeld) {
+		// In use
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	defer lock.Unlock() //nolint:errcheck
+
+	// Another instance might have replayed it meanwhile
+	if replaced, err := isReplaced(file); errors.Is(err, os.ErrNotExist) || replaced {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	state, entries, err := readJournal(file)
+	if err != nil {
+		return err
+	}
+
+	if state == journalCommitting {
+		if err := db.rewrite(db.rebuild); err != nil {
+			return err
+		}
+	}
+
+	if err := db.applyRetry(entries); err != nil {
+		return err
+	}
+
+	return os.Remove(name)
+}
@@ -1,35 +1,47 @@
 package bytetree
 
 import (
-	"errors"
 	"fmt"
 	"os"
-	"time"
 )
 
-type FileLock struct {
-	path string
-}
-
 var ErrTypeAssertion = fmt.Errorf("type assertion error")
 
 var ErrLockHeld = fmt.Errorf("lock held")
 
-func Lock(file *os.File) (*FileLock, error) {
-	for range 10 {
-		lock, err := TryLock(file)
-		if errors.Is(err, ErrLockHeld) {
-			time.Sleep(time.Second)
+// lockFile locks a file of the tree like Lock, but returns ErrHasValue if the
+// file was replaced by Compact or Rebuild, so that the operation is retried
+// after the files are reopened.
+func lockFile(file *os.File) (*FileLock, error) {
+	lock, err := Lock(file)
+	if err != nil {
+		return nil, err
+	}
+
+	if replaced, err := isReplaced(file); err != nil || replaced {
+		lock.Unlock() //nolint:errcheck
 
-			continue
+		if err != nil {
+			return nil, err
 		}
 
-		return lock, err
+		return nil, ErrHasValue
 	}
 
-	return nil, ErrLockHeld
+	return lock, nil
 }
 
-func (file *FileLock) Unlock() error {
-	return os.Remove(file.path)
+// isReplaced checks whether the path of the file refers to another file.
+func isReplaced(file *os.File) (bool, error) {
+	fi, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	current, err := os.Stat(file.Name())
+	if err != nil {
+		return false, err
+	}
+
+	return !os.SameFile(fi, current), nil
 }
@@ -4,42 +4,151 @@
 package bytetree
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"math/rand/v2"
 	"os"
 	"path/filepath"
 	"syscall"
+	"time"
+
+	"go.uber.org/multierr"
+	"golang.org/x/sys/unix"
 )
 
+// FileLock is an open file description lock, which is released when the
+// file is closed, also if the process crashes. As the lock belongs to the
+// open file, it does not exclude goroutines that share the same *os.File.
+//
+// Older versions of this package locked by creating a hard link to the file,
+// and only checked the number of links. To exclude them as well, a hard link
+// is created while the lock is held.
+type FileLock struct {
+	file *os.File
+	link string
+}
+
+// Lock waits until the file is locked, or returns ErrLockHeld if a lock file
+// of an older version of this package keeps existing.
+func Lock(file *os.File) (*FileLock, error) {
+	for range 10 {
+		lock, err := lock(file, unix.F_OFD_SETLKW)
+		if errors.Is(err, ErrLockHeld) {
+			time.Sleep(time.Second)
+
+			continue
+		}
+
+		return lock, err
+	}
+
+	return nil, ErrLockHeld
+}
+
+// TryLock locks the file, or returns ErrLockHeld if it is locked.
 func TryLock(file *os.File) (*FileLock, error) {
-	dir, name := filepath.Split(file.Name())
-	path := filepath.Join(dir, fmt.Sprintf(".%s.lock%x", name, rand.Uint64())) //nolint:gosec
+	return lock(file, unix.F_OFD_SETLK)
+}
 
-	if err := os.Link(file.Name(), path); err != nil {
+func lock(file *os.File, cmd int) (*FileLock, error) {
+	err := fcntl(file, cmd, unix.F_WRLCK)
+	if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EACCES) {
+		return nil, ErrLockHeld
+	} else if err != nil {
 		return nil, err
 	}
 
-	fi, err := file.Stat()
-	if err != nil {
-		os.Remove(path)
+	lock := &FileLock{
+		file: file,
+	}
 
-		return nil, err
+	dir, name := filepath.Split(file.Name())
+
+	// Links of this version to the locked file are left behind by a crash,
+	// as their lock was released. Links to a file that replaced it are not.
+	if err = removeStale(file, filepath.Join(dir, "."+name+".ofdlock*")); err != nil {
+		return nil, multierr.Append(err, lock.Unlock())
+	}
+
+	link := filepath.Join(dir, fmt.Sprintf(".%s.ofdlock%x", name, rand.Uint64())) //nolint:gosec
+
+	if err = os.Link(file.Name(), link); err != nil {
+		return nil, multierr.Append(err, lock.Unlock())
+	}
+
+	lock.link = link
+
+	// Older versions hold a link of their own. The link is checked rather
+	// than the file, which has no links left once it is replaced
+	fi, err := os.Stat(link)
+	if err != nil {
+		return nil, multierr.Append(err, lock.Unlock())
 	}
 
 	s, ok := fi.Sys().(*syscall.Stat_t)
 	if !ok {
-		os.Remove(path)
-
-		return nil, ErrTypeAssertion
+		return nil, multierr.Append(ErrTypeAssertion, lock.Unlock())
 	}
 
 	if s.Nlink != 2 {
-		os.Remove(path)
+		return nil, multierr.Append(ErrLockHeld, lock.Unlock())
+	}
 
-		return nil, ErrLockHeld
+	return lock, nil
+}
+
+func (file *FileLock) Unlock() error {
+	var err error
+
+	if file.link != "" {
+		err = os.Remove(file.link)
+	}
+
+	return multierr.Append(err, fcntl(file.file, unix.F_OFD_SETLK, unix.F_UNLCK))
+}
+
+func removeStale(file *os.File, pattern string) error {
+	links, err := filepath.Glob(pattern)
+	if err != nil || len(links) == 0 {
+		return err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	for _, link := range links {
+		li, err := os.Stat(link)
+
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return err
+		case !os.SameFile(fi, li):
+			continue
+		}
+
+		if err = os.Remove(link); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func fcntl(file *os.File, cmd int, typ int16) error {
+	flock := unix.Flock_t{
+		Type:   typ,
+		Whence: io.SeekStart,
 	}
 
-	return &FileLock{
-		path: path,
-	}, nil
+	for {
+		err := unix.FcntlFlock(file.Fd(), cmd, &flock)
+		if !errors.Is(err, unix.EINTR) {
+			return err
+		}
+	}
 }
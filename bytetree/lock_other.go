@@ -4,16 +4,39 @@
 package bytetree
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 )
 
+type FileLock struct {
+	path string
+}
+
+func Lock(file *os.File) (*FileLock, error) {
+	for range 10 {
+		lock, err := TryLock(file)
+		if errors.Is(err, ErrLockHeld) {
+			time.Sleep(time.Second)
+
+			continue
+		}
+
+		return lock, err
+	}
+
+	return nil, ErrLockHeld
+}
+
 func TryLock(file *os.File) (*FileLock, error) {
 	dir, name := filepath.Split(file.Name())
 	path := filepath.Join(dir, fmt.Sprintf("%s.%s.lock", dir, name))
 
-	if err := os.Symlink(file.Name(), path); err != nil {
+	if err := os.Symlink(file.Name(), path); errors.Is(err, os.ErrExist) {
+		return nil, ErrLockHeld
+	} else if err != nil {
 		return nil, err
 	}
 
@@ -21,3 +44,7 @@ func TryLock(file *os.File) (*FileLock, error) {
 		path: path,
 	}, nil
 }
+
+func (file *FileLock) Unlock() error {
+	return os.Remove(file.path)
+}
@@ -1,7 +1,10 @@
 package bytetree
 
 import (
+	"bufio"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"os"
 )
@@ -15,6 +18,12 @@ type Value struct {
 	Path   string
 }
 
+// A deletion is recorded with deleted as path length.
+const deleted = ^uint32(0)
+
+// maxRecordSize limits the allocation for a record pointed to by a bad pointer.
+const maxRecordSize = 1 << 20
+
 func (v *values) Get(ptr int64) (Value, error) {
 	var buf [8]byte
 
@@ -24,9 +33,17 @@ func (v *values) Get(ptr int64) (Value, error) {
 	}
 
 	handleLen := int(binary.BigEndian.Uint32(buf[:4]))
-	pathLen := int(binary.BigEndian.Uint32(buf[4:]))
+	pathLen := binary.BigEndian.Uint32(buf[4:])
+
+	if pathLen == deleted {
+		return Value{}, fmt.Errorf("%w: pointer %d to a deletion", ErrCorrupt, ptr)
+	}
+
+	if handleLen+int(pathLen) > maxRecordSize {
+		return Value{}, fmt.Errorf("%w: bad value pointer %d", ErrCorrupt, ptr)
+	}
 
-	payload := make([]byte, handleLen+pathLen)
+	payload := make([]byte, handleLen+int(pathLen))
 
 	_, err = v.file.ReadAt(payload, ptr+8)
 	if err != nil {
@@ -40,7 +57,16 @@ func (v *values) Get(ptr int64) (Value, error) {
 }
 
 func (v *values) Add(value Value) (int64, error) {
-	lock, err := Lock(v.file)
+	return v.add(value.Handle, []byte(value.Path), uint32(len(value.Path)))
+}
+
+// AddDeletion records that the value of handle was deleted.
+func (v *values) AddDeletion(handle []byte) (int64, error) {
+	return v.add(handle, nil, deleted)
+}
+
+func (v *values) add(handle, path []byte, pathLen uint32) (int64, error) {
+	lock, err := lockFile(v.file)
 	if err != nil {
 		return 0, err
 	}
@@ -52,27 +78,115 @@ func (v *values) Add(value Value) (int64, error) {
 		return 0, err
 	}
 
-	err = binary.Write(v.file, binary.BigEndian, uint32(len(value.Handle)))
+	// Write the record at once, so that a crash can only truncate the last record
+	_, err = v.file.Write(appendRecord(nil, handle, path, pathLen))
+
+	return ptr, err
+}
+
+// addAll adds the values and deletions of the entries in a single write,
+// and returns the pointers to their records.
+func (v *values) addAll(entries []entry) ([]int64, error) {
+	lock, err := lockFile(v.file)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	err = binary.Write(v.file, binary.BigEndian, uint32(len(value.Path)))
+	defer lock.Unlock() //nolint:errcheck
+
+	ptr, err := v.file.Seek(0, io.SeekEnd)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	_, err = v.file.Write(value.Handle)
-	if err != nil {
-		return 0, err
+	var (
+		buf  []byte
+		ptrs = make([]int64, len(entries))
+	)
+
+	for i, e := range entries {
+		ptrs[i] = ptr + int64(len(buf))
+		buf = e.appendTo(buf)
 	}
 
-	_, err = v.file.Write([]byte(value.Path))
+	_, err = v.file.Write(buf)
+
+	return ptrs, err
+}
+
+func appendRecord(buf, handle, path []byte, pathLen uint32) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(handle))) //nolint:gosec
+	buf = binary.BigEndian.AppendUint32(buf, pathLen)
+	buf = append(buf, handle...)
+
+	return append(buf, path...)
+}
+
+// scan calls fn for each record in order. A truncated last record,
+// left behind by a crash, results in ErrTruncated.
+func (v *values) scan(fn func(ptr int64, value Value, deleted bool) error) error {
+	return v.scanFrom(0, fn)
+}
+
+// scanFrom is scan, starting at the record at ptr.
+func (v *values) scanFrom(ptr int64, fn func(ptr int64, value Value, deleted bool) error) error {
+	fi, err := v.file.Stat()
 	if err != nil {
-		return 0, err
+		return err
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(v.file, ptr, fi.Size()-ptr))
+
+	var buf [8]byte
+
+	for {
+		if _, err := io.ReadFull(r, buf[:]); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return truncated(ptr, err)
+		}
+
+		handleLen := int(binary.BigEndian.Uint32(buf[:4]))
+		pathLen := binary.BigEndian.Uint32(buf[4:])
+
+		isDeletion := pathLen == deleted
+		if isDeletion {
+			pathLen = 0
+		}
+
+		if handleLen+int(pathLen) > maxRecordSize {
+			return fmt.Errorf("%w: bad record at %d", ErrCorrupt, ptr)
+		}
+
+		if ptr+8+int64(handleLen)+int64(pathLen) > fi.Size() {
+			return truncated(ptr, io.ErrUnexpectedEOF)
+		}
+
+		payload := make([]byte, handleLen+int(pathLen))
+
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return truncated(ptr, err)
+		}
+
+		value := Value{
+			Handle: payload[:handleLen],
+			Path:   string(payload[handleLen:]),
+		}
+
+		if err := fn(ptr, value, isDeletion); err != nil {
+			return err
+		}
+
+		ptr += int64(8 + len(payload))
+	}
+}
+
+func truncated(ptr int64, err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return fmt.Errorf("%w at %d", ErrTruncated, ptr)
 	}
 
-	return ptr, nil
+	return err
 }
 
 func (v *values) Close() error {
@@ -149,17 +149,7 @@ func Walk(fs WalkableFS, root string, fn WalkFunc) error {
 		return walkFS.Walk(root, fn)
 	}
 
-	var (
-		info FileInfo
-		err  error
-	)
-
-	if symlinkFS, ok := fs.(SymlinkFS); ok {
-		info, err = symlinkFS.Lstat(root)
-	} else {
-		info, err = fs.Stat(root)
-	}
-
+	info, err := lstat(fs, root)
 	if err != nil {
 		err = fn(root, nil, err)
 	} else {
@@ -244,7 +234,24 @@ type WalkRemoveFS interface {
 	Rmdir(path string) error
 }
 
+type RemoveAllFS interface {
+	WalkRemoveFS
+	RemoveAll(path string) error
+}
+
+// RemoveAll removes path and any children it contains.
+// If the file system implements RemoveAllFS, its RemoveAll method is used.
 func RemoveAll(fs WalkRemoveFS, path string) error {
+	if removeAllFS, ok := fs.(RemoveAllFS); ok {
+		return removeAllFS.RemoveAll(path)
+	}
+
+	return RemoveAllWalk(fs, path)
+}
+
+// RemoveAllWalk removes path and any children it contains,
+// by walking the tree and removing the entries one by one.
+func RemoveAllWalk(fs WalkRemoveFS, path string) error {
 	dirs := []string{}
 
 	err := Walk(fs, path, func(path string, info FileInfo, err error) error {
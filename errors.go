@@ -10,3 +10,5 @@ var ErrNotSupported = syscall.EOPNOTSUPP
 var ErrNotImplemented = fmt.Errorf("%w: not implemented", syscall.EPERM)
 
 var ErrInvalidHandle = fmt.Errorf("%w: invalid handle", syscall.EINVAL)
+
+var ErrLocked = fmt.Errorf("%w: locked by another owner", syscall.EAGAIN)
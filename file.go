@@ -3,9 +3,11 @@ package vfs
 import (
 	"errors"
 	"io"
+	"os"
 
 	"github.com/kuleuven/vfs/io/readerat"
 	"github.com/kuleuven/vfs/io/writerat"
+	"go.uber.org/multierr"
 )
 
 func ReadFile(fs FS, path string) ([]byte, error) {
@@ -72,3 +74,123 @@ func FileWriteCloser(fs FS, path string, flags int) (io.WriteCloser, error) {
 		Closer: writerAt,
 	}, nil
 }
+
+// CopyFile copies src to dst within fs, server-side if fs is a CopyFileFS
+// that supports it, or by streaming the data otherwise.
+func CopyFile(fs FS, src, dst string, flags int) error {
+	if copier, ok := fs.(CopyFileFS); ok {
+		if err := copier.CopyFile(src, dst, flags); !errors.Is(err, ErrNotSupported) {
+			return err
+		}
+	}
+
+	return StreamFile(fs, dst, fs, src, flags)
+}
+
+// StreamFile copies src in srcFS to dst in dstFS through this process,
+// keeping holes. Dst is opened with flags as by FileWrite, and truncated.
+func StreamFile(dstFS FS, dst string, srcFS FS, src string, flags int) error {
+	fi, err := srcFS.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	r, err := srcFS.FileRead(src)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	w, err := dstFS.FileWrite(dst, flags&^os.O_RDWR|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+
+	_, err = CopySparse(w, r, fi.Size())
+
+	return multierr.Append(err, w.Close())
+}
+
+// CopySparse copies size bytes from src to dst, and returns the number of
+// bytes copied. If src is a SparseReaderAt, only its data ranges are copied.
+// The holes are punched in dst if it is a PunchHoleWriterAt that supports
+// it, or written as zeros otherwise.
+func CopySparse(dst io.WriterAt, src io.ReaderAt, size int64) (int64, error) {
+	sparse, ok := src.(SparseReaderAt)
+	if !ok {
+		return io.Copy(io.NewOffsetWriter(dst, 0), io.NewSectionReader(src, 0, size))
+	}
+
+	var copied, offset int64
+
+	for offset < size {
+		data, err := sparse.SeekData(offset)
+		if errors.Is(err, io.EOF) {
+			data = size
+		} else if err != nil {
+			return copied, err
+		}
+
+		data = min(data, size)
+
+		if data > offset {
+			if err := fillHole(dst, offset, data-offset, data == size); err != nil {
+				return copied, err
+			}
+		}
+
+		if data == size {
+			break
+		}
+
+		hole, err := sparse.SeekHole(data)
+		if errors.Is(err, io.EOF) {
+			hole = size
+		} else if err != nil {
+			return copied, err
+		}
+
+		hole = min(hole, size)
+
+		n, err := io.Copy(io.NewOffsetWriter(dst, data), io.NewSectionReader(src, data, hole-data))
+		copied += n
+
+		if err != nil {
+			return copied, err
+		}
+
+		offset = hole
+	}
+
+	return copied, nil
+}
+
+// fillHole makes length bytes at offset read as zeros. A hole at the end
+// of the file is not extended by punching, so its last byte is written.
+func fillHole(dst io.WriterAt, offset, length int64, last bool) error {
+	if puncher, ok := dst.(PunchHoleWriterAt); ok {
+		err := puncher.PunchHole(offset, length)
+		if err == nil && last {
+			_, err = dst.WriteAt([]byte{0}, offset+length-1)
+		}
+
+		if !errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+	}
+
+	zeros := make([]byte, min(length, 32768))
+
+	for length > 0 {
+		n, err := dst.WriteAt(zeros[:min(length, int64(len(zeros)))], offset)
+		if err != nil {
+			return err
+		}
+
+		offset += int64(n)
+		length -= int64(n)
+	}
+
+	return nil
+}
@@ -26,11 +26,26 @@ var (
 	// Boolean indicating whether or not the inode handle database should be persisted.
 	DisablePersistentHandleDB = ContextKey("disable-persistent-handle-db")
 
+	// String indicating which store is used for the inode handle database, either
+	// "bytetree" or "sqlite". Defaults to "bytetree". Handles in the persistent
+	// storage of the other store are migrated when the selected store is created.
+	HandleDBStore = ContextKey("handle-db-store")
+
+	// Duration after which writes to the bytetree inode handle database are
+	// committed as a group, instead of syncing each write. Handles that are not
+	// committed yet are not visible to other processes that share the database.
+	// Defaults to 0, which disables group commit.
+	HandleDBCommitInterval = ContextKey("handle-db-commit-interval")
+
 	// Boolean indicating whether or not server inodes should be used when exposing a native posix file system.
 	UseServerInodes = ContextKey("use-serverino")
 
 	// Boolean indicating whether or not chown is supported when exposing a native posix file system.
 	AllowServerChown = ContextKey("allow-chown")
+
+	// Duration between two scans of the file system by polling watchers.
+	// Defaults to DefaultWatchInterval.
+	WatchInterval = ContextKey("watch-interval")
 )
 
 // Bool returns the boolean value associated with the given context key.
@@ -209,11 +224,59 @@ type LinkFS interface {
 	Link(oldname, newname string) error
 }
 
+// CopyFileFS is a file system that can copy files without streaming their
+// data through this process. Dst is opened with flags as by FileWrite, and
+// truncated. ErrNotSupported is returned if the copy cannot be done this
+// way, in which case CopyFile streams the data instead.
+type CopyFileFS interface {
+	FS
+	CopyFile(src, dst string, flags int) error
+}
+
 type WalkFS interface {
 	FS
 	Walk(path string, walkFn WalkFunc) error
 }
 
+type ParallelWalkFS interface {
+	FS
+	ParallelWalk(path string, opts WalkOptions, walkFn WalkFunc) error
+}
+
+// StatFS describes the capacity and usage of the file system containing a path.
+type StatFS struct {
+	BlockSize   uint64 // Size of a block in bytes
+	Blocks      uint64 // Total number of blocks
+	BlocksFree  uint64 // Number of free blocks
+	BlocksAvail uint64 // Number of free blocks available to the caller
+	Files       uint64 // Total number of inodes
+	FilesFree   uint64 // Number of free inodes
+}
+
+type StatFSFS interface {
+	FS
+	StatFS(path string) (*StatFS, error)
+}
+
+// LockFS supports byte-range locks. Locks are advisory, unless enforced by a wrapper.
+type LockFS interface {
+	FS
+	// AcquireLock acquires the lock, or returns ErrLocked if it conflicts
+	// with a lock of another owner. Acquiring a lock again renews its lease.
+	AcquireLock(path string, lock Lock) error
+	// ReleaseLock releases the locks of the owner in the range of the given lock.
+	ReleaseLock(path string, lock Lock) error
+	// TestLock returns ErrLocked if the lock would conflict with a lock of another owner.
+	TestLock(path string, lock Lock) error
+}
+
+// WatchFS reports changes to a path. If the path is a directory, changes to
+// its children are reported, and to all its descendants if recursive is set.
+type WatchFS interface {
+	FS
+	Watch(path string, recursive bool) (Watcher, error)
+}
+
 type SetExtendedAttrsFS interface {
 	FS
 	SetExtendedAttrs(path string, attrs Attributes) error
@@ -255,3 +318,23 @@ type WriterAtReaderAt interface {
 	io.ReaderAt
 	io.Closer
 }
+
+// SparseReaderAt is a ReaderAt that knows which ranges of the file hold data.
+// The other ranges are holes, that read as zeros.
+type SparseReaderAt interface {
+	ReaderAt
+	// SeekData returns the start of the first data range at or after offset,
+	// or io.EOF if there is no data after offset.
+	SeekData(offset int64) (int64, error)
+	// SeekHole returns the start of the first hole at or after offset, or
+	// io.EOF if offset is past the end of the file. The end of the file
+	// counts as a hole.
+	SeekHole(offset int64) (int64, error)
+}
+
+// PunchHoleWriterAt is a WriterAt that can turn a range into a hole,
+// without changing the size of the file.
+type PunchHoleWriterAt interface {
+	WriterAt
+	PunchHole(offset, length int64) error
+}
@@ -0,0 +1,371 @@
+package cachefs
+
+import (
+	"crypto"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kuleuven/vfs"
+)
+
+var (
+	_ vfs.ChecksumFS = &CacheFS{}
+	_ vfs.SymlinkFS  = &CacheSymlinkFS{}
+	_ vfs.LinkFS     = &CacheLinkFS{}
+	_ Invalidator    = &CacheFS{}
+)
+
+var (
+	DefaultTTL         = 5 * time.Second
+	DefaultNegativeTTL = time.Second
+	DefaultMaxEntries  = 10000
+)
+
+type Option func(*CacheFS)
+
+// WithTTL sets how long results of Stat, Lstat, List and Readlink are cached.
+func WithTTL(ttl time.Duration) Option {
+	return func(fs *CacheFS) {
+		fs.TTL = ttl
+	}
+}
+
+// WithListTTL sets how long results of List are cached, if it should differ from the TTL.
+func WithListTTL(ttl time.Duration) Option {
+	return func(fs *CacheFS) {
+		fs.ListTTL = ttl
+	}
+}
+
+// WithNegativeTTL sets how long non-existence of a path is cached.
+// Set to zero to disable negative caching.
+func WithNegativeTTL(ttl time.Duration) Option {
+	return func(fs *CacheFS) {
+		fs.NegativeTTL = ttl
+	}
+}
+
+// WithMaxEntries bounds the number of cached entries.
+func WithMaxEntries(maxEntries int) Option {
+	return func(fs *CacheFS) {
+		fs.cache.maxEntries = maxEntries
+	}
+}
+
+// New returns a file system that caches metadata lookups of the given file system.
+// Mutations through the returned file system invalidate the affected entries;
+// changes made by others become visible after the TTL expires, or after
+// calling Invalidate. If the given file system implements vfs.SymlinkFS or
+// vfs.LinkFS, so does the returned file system.
+func New(fs vfs.FS, options ...Option) vfs.FS {
+	cfs := &CacheFS{
+		FS:          fs,
+		TTL:         DefaultTTL,
+		NegativeTTL: DefaultNegativeTTL,
+		cache:       newLRU(DefaultMaxEntries),
+	}
+
+	for _, option := range options {
+		option(cfs)
+	}
+
+	if cfs.ListTTL == 0 {
+		cfs.ListTTL = cfs.TTL
+	}
+
+	symlinkFS, ok := fs.(vfs.SymlinkFS)
+	if !ok {
+		return cfs
+	}
+
+	slfs := &CacheSymlinkFS{CacheFS: cfs, symlinkFS: symlinkFS}
+
+	linkFS, ok := fs.(vfs.LinkFS)
+	if !ok {
+		return slfs
+	}
+
+	return &CacheLinkFS{CacheSymlinkFS: slfs, linkFS: linkFS}
+}
+
+// Invalidator is implemented by all file systems returned by New.
+type Invalidator interface {
+	Invalidate(path string, recursive bool)
+}
+
+type CacheFS struct {
+	FS          vfs.FS
+	TTL         time.Duration
+	ListTTL     time.Duration
+	NegativeTTL time.Duration
+	cache       *lru
+}
+
+type CacheSymlinkFS struct {
+	*CacheFS
+	symlinkFS vfs.SymlinkFS
+}
+
+type CacheLinkFS struct {
+	*CacheSymlinkFS
+	linkFS vfs.LinkFS
+}
+
+// Invalidate drops all cached entries for the given path, and for its parent
+// directory listing. If recursive is set, entries for all paths below the
+// given path are dropped as well. This can be used to process external
+// change notifications.
+func (c *CacheFS) Invalidate(path string, recursive bool) {
+	c.cache.remove(path, recursive)
+
+	if path != "/" && vfs.IsAbs(path) {
+		c.cache.remove(vfs.Dir(path), false)
+	}
+}
+
+// Len returns the number of cached entries.
+func (c *CacheFS) Len() int {
+	return c.cache.len()
+}
+
+// lookup returns the cached result, or calls fn and caches its result.
+func (c *CacheFS) lookup(kd kind, path string, ttl time.Duration, fn func() (any, error)) (any, error) {
+	k := key{kd, path}
+
+	if e, ok := c.cache.get(k); ok {
+		return e.value, e.err
+	}
+
+	// Results of lookups that race with Invalidate are not stored
+	l := c.cache.begin(k)
+
+	value, err := fn()
+
+	switch {
+	case err == nil:
+		c.cache.put(l, value, nil, ttl)
+	case errors.Is(err, os.ErrNotExist):
+		c.cache.put(l, nil, err, c.NegativeTTL)
+	default:
+		c.cache.put(l, nil, nil, 0)
+	}
+
+	return value, err
+}
+
+func (c *CacheFS) Stat(path string) (vfs.FileInfo, error) {
+	fi, err := c.lookup(kindStat, path, c.TTL, func() (any, error) {
+		fi, err := c.FS.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return &fileInfo{FileInfo: fi}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return fi.(vfs.FileInfo), nil //nolint:forcetypeassert
+}
+
+func (c *CacheFS) List(path string) (vfs.ListerAt, error) {
+	entries, err := c.lookup(kindList, path, c.ListTTL, func() (any, error) {
+		lister, err := c.FS.List(path)
+		if err != nil {
+			return nil, err
+		}
+
+		defer lister.Close()
+
+		entries, err := vfs.ListAll(lister)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, entry := range entries {
+			entries[i] = &fileInfo{FileInfo: entry}
+		}
+
+		return vfs.FileInfoListerAt(entries), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return entries.(vfs.FileInfoListerAt), nil //nolint:forcetypeassert
+}
+
+func (c *CacheFS) FileRead(path string) (vfs.ReaderAt, error) {
+	return c.FS.FileRead(path)
+}
+
+func (c *CacheFS) FileWrite(path string, flags int) (vfs.WriterAt, error) {
+	c.Invalidate(path, false)
+
+	w, err := c.FS.FileWrite(path, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	return &writerAt{WriterAt: w, c: c, path: path}, nil
+}
+
+func (c *CacheFS) Chmod(path string, mode os.FileMode) error {
+	defer c.Invalidate(path, false)
+
+	return c.FS.Chmod(path, mode)
+}
+
+func (c *CacheFS) Chown(path string, uid, gid int) error {
+	defer c.Invalidate(path, false)
+
+	return c.FS.Chown(path, uid, gid)
+}
+
+func (c *CacheFS) Chtimes(path string, atime, mtime time.Time) error {
+	defer c.Invalidate(path, false)
+
+	return c.FS.Chtimes(path, atime, mtime)
+}
+
+func (c *CacheFS) Truncate(path string, size int64) error {
+	defer c.Invalidate(path, false)
+
+	return c.FS.Truncate(path, size)
+}
+
+func (c *CacheFS) SetExtendedAttr(path, name string, value []byte) error {
+	defer c.Invalidate(path, false)
+
+	return c.FS.SetExtendedAttr(path, name, value)
+}
+
+func (c *CacheFS) UnsetExtendedAttr(path, name string) error {
+	defer c.Invalidate(path, false)
+
+	return c.FS.UnsetExtendedAttr(path, name)
+}
+
+func (c *CacheFS) SetExtendedAttrs(path string, attrs vfs.Attributes) error {
+	defer c.Invalidate(path, false)
+
+	return vfs.SetExtendedAttrs(c.FS, path, attrs)
+}
+
+func (c *CacheFS) Rename(oldpath, newpath string) error {
+	defer c.Invalidate(newpath, true)
+	defer c.Invalidate(oldpath, true)
+
+	return c.FS.Rename(oldpath, newpath)
+}
+
+func (c *CacheFS) Rmdir(path string) error {
+	defer c.Invalidate(path, true)
+
+	return c.FS.Rmdir(path)
+}
+
+func (c *CacheFS) Remove(path string) error {
+	defer c.Invalidate(path, false)
+
+	return c.FS.Remove(path)
+}
+
+func (c *CacheFS) Mkdir(path string, perm os.FileMode) error {
+	defer c.Invalidate(path, false)
+
+	return c.FS.Mkdir(path, perm)
+}
+
+func (c *CacheFS) Checksum(path string, algorithm crypto.Hash) ([]byte, error) {
+	if checksumFS, ok := c.FS.(vfs.ChecksumFS); ok {
+		return checksumFS.Checksum(path, algorithm)
+	}
+
+	return vfs.Checksum(c.FS, path, algorithm)
+}
+
+func (c *CacheFS) Close() error {
+	c.cache.remove("/", true)
+
+	return c.FS.Close()
+}
+
+func (c *CacheSymlinkFS) Lstat(path string) (vfs.FileInfo, error) {
+	fi, err := c.lookup(kindLstat, path, c.TTL, func() (any, error) {
+		fi, err := c.symlinkFS.Lstat(path)
+		if err != nil {
+			return nil, err
+		}
+
+		return &fileInfo{FileInfo: fi}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return fi.(vfs.FileInfo), nil //nolint:forcetypeassert
+}
+
+func (c *CacheSymlinkFS) Readlink(path string) (string, error) {
+	target, err := c.lookup(kindReadlink, path, c.TTL, func() (any, error) {
+		return c.symlinkFS.Readlink(path)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return target.(string), nil //nolint:forcetypeassert
+}
+
+func (c *CacheSymlinkFS) Symlink(target, link string) error {
+	defer c.Invalidate(link, false)
+
+	return c.symlinkFS.Symlink(target, link)
+}
+
+func (c *CacheLinkFS) Link(oldname, newname string) error {
+	defer c.Invalidate(newname, false)
+	defer c.Invalidate(oldname, false)
+
+	return c.linkFS.Link(oldname, newname)
+}
+
+// fileInfo caches the extended attributes of the wrapped file info.
+type fileInfo struct {
+	vfs.FileInfo
+	once  sync.Once
+	attrs vfs.Attributes
+	err   error
+}
+
+func (fi *fileInfo) Extended() (vfs.Attributes, error) {
+	fi.once.Do(func() {
+		fi.attrs, fi.err = fi.FileInfo.Extended()
+	})
+
+	// Return a copy, as callers might modify the attributes
+	attrs := vfs.Attributes{}
+
+	for name, value := range fi.attrs {
+		attrs[name] = value
+	}
+
+	return attrs, fi.err
+}
+
+// writerAt invalidates the cached metadata when the file is closed.
+type writerAt struct {
+	vfs.WriterAt
+	c    *CacheFS
+	path string
+}
+
+func (w *writerAt) Close() error {
+	defer w.c.Invalidate(w.path, false)
+
+	return w.WriterAt.Close()
+}
@@ -0,0 +1,164 @@
+package cachefs
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kuleuven/vfs"
+	"github.com/kuleuven/vfs/fs/chaosfs"
+	"github.com/kuleuven/vfs/fs/nativefs"
+)
+
+func TestCacheFS(t *testing.T) {
+	fs := New(nativefs.New(t.Context(), t.TempDir()))
+
+	defer func() {
+		if err := fs.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	vfs.RunTestSuiteRW(t, fs)
+}
+
+func TestCacheHits(t *testing.T) {
+	dir := t.TempDir()
+	stats := &chaosfs.Rule{Op: chaosfs.OpStat}
+	lists := &chaosfs.Rule{Op: chaosfs.OpList}
+
+	fs := New(chaosfs.New(nativefs.New(t.Context(), dir), 1, stats, lists)).(*CacheFS) //nolint:forcetypeassert
+
+	defer fs.Close()
+
+	if err := vfs.WriteFile(fs, "/file.txt", []byte("test"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	for range 3 {
+		if _, err := fs.Stat("/file.txt"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := fs.Stat("/missing"); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("Expected ErrNotExist, got %v", err)
+		}
+
+		if _, err := fs.List("/"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if stats.Calls() != 2 || lists.Calls() != 1 {
+		t.Errorf("Expected 2 stats and 1 list, got %d and %d", stats.Calls(), lists.Calls())
+	}
+
+	// Mutations invalidate the path and the parent listing
+	if err := fs.Rename("/file.txt", "/renamed.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Stat("/file.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected ErrNotExist, got %v", err)
+	}
+
+	entries, err := vfs.ReadDir(fs, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].Name() != "renamed.txt" {
+		t.Errorf("Expected renamed.txt in listing, got %v", entries)
+	}
+
+	// Extended attributes are cached with the file info
+	if err := fs.SetExtendedAttr("/renamed.txt", "user.test", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := fs.Stat("/renamed.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attrs, err := fi.Extended(); err != nil || string(attrs["user.test"]) != "value" {
+		t.Errorf("Expected xattr to be visible, got %v, %v", attrs, err)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	dir := t.TempDir()
+	native := nativefs.New(t.Context(), dir)
+
+	fs := New(native, WithTTL(time.Hour), WithNegativeTTL(time.Hour))
+
+	defer fs.Close()
+
+	if _, err := fs.Stat("/a/b"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected ErrNotExist, got %v", err)
+	}
+
+	// External change
+	if err := native.Mkdir("/a", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := native.Mkdir("/a/b", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Stat("/a/b"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected cached ErrNotExist, got %v", err)
+	}
+
+	fs.(Invalidator).Invalidate("/a", true) //nolint:forcetypeassert
+
+	if _, err := fs.Stat("/a/b"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLRU(t *testing.T) {
+	c := newLRU(2)
+
+	now := time.Now()
+
+	c.now = func() time.Time { return now }
+
+	c.put(c.begin(key{kindStat, "/a"}), 1, nil, time.Minute)
+	c.put(c.begin(key{kindStat, "/b"}), 2, nil, time.Minute)
+
+	if _, ok := c.get(key{kindStat, "/a"}); !ok {
+		t.Fatal("Expected /a to be cached")
+	}
+
+	c.put(c.begin(key{kindStat, "/c"}), 3, nil, time.Minute)
+
+	if _, ok := c.get(key{kindStat, "/b"}); ok {
+		t.Error("Expected /b to be evicted")
+	}
+
+	now = now.Add(2 * time.Minute)
+
+	if _, ok := c.get(key{kindStat, "/a"}); ok {
+		t.Error("Expected /a to be expired")
+	}
+}
+
+func TestLRURemoveDuringLookup(t *testing.T) {
+	c := newLRU(0)
+
+	l := c.begin(key{kindStat, "/a/b"})
+
+	c.remove("/a", true)
+	c.put(l, 1, nil, time.Minute)
+
+	if _, ok := c.get(key{kindStat, "/a/b"}); ok {
+		t.Error("Expected /a/b not to be cached")
+	}
+
+	if c.len() != 0 || len(c.lookups) != 0 {
+		t.Errorf("Expected empty cache, got %d entries and %d lookups", c.len(), len(c.lookups))
+	}
+}
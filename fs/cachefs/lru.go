@@ -0,0 +1,170 @@
+package cachefs
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+type kind byte
+
+const (
+	kindStat kind = iota
+	kindLstat
+	kindList
+	kindReadlink
+)
+
+type key struct {
+	kind kind
+	path string
+}
+
+type entry struct {
+	key     key
+	value   any
+	err     error
+	expires time.Time
+}
+
+// lookup is a lookup in progress. It is invalidated if its key is removed
+// before the result is stored.
+type lookup struct {
+	key     key
+	invalid bool
+}
+
+// lru is a size-bounded cache that evicts the least recently used entry.
+type lru struct {
+	maxEntries int
+	now        func() time.Time
+	list       *list.List
+	items      map[key]*list.Element
+	lookups    map[*lookup]struct{}
+	sync.Mutex
+}
+
+func newLRU(maxEntries int) *lru {
+	return &lru{
+		maxEntries: maxEntries,
+		now:        time.Now,
+		list:       list.New(),
+		items:      map[key]*list.Element{},
+		lookups:    map[*lookup]struct{}{},
+	}
+}
+
+func (c *lru) get(k key) (*entry, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	elem, ok := c.items[k]
+	if !ok {
+		return nil, false
+	}
+
+	e := elem.Value.(*entry) //nolint:forcetypeassert
+
+	if c.now().After(e.expires) {
+		c.list.Remove(elem)
+		delete(c.items, k)
+
+		return nil, false
+	}
+
+	c.list.MoveToFront(elem)
+
+	return e, true
+}
+
+// begin registers a lookup of k, that must be finished with put.
+func (c *lru) begin(k key) *lookup {
+	c.Lock()
+	defer c.Unlock()
+
+	l := &lookup{key: k}
+
+	c.lookups[l] = struct{}{}
+
+	return l
+}
+
+// put stores the result of the given lookup, unless its key
+// was removed since the lookup began.
+func (c *lru) put(l *lookup, value any, err error, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.lookups, l)
+
+	if ttl <= 0 || l.invalid {
+		return
+	}
+
+	k := l.key
+
+	e := &entry{
+		key:     k,
+		value:   value,
+		err:     err,
+		expires: c.now().Add(ttl),
+	}
+
+	if elem, ok := c.items[k]; ok {
+		elem.Value = e
+
+		c.list.MoveToFront(elem)
+
+		return
+	}
+
+	c.items[k] = c.list.PushFront(e)
+
+	for c.maxEntries > 0 && c.list.Len() > c.maxEntries {
+		last := c.list.Back()
+
+		c.list.Remove(last)
+		delete(c.items, last.Value.(*entry).key) //nolint:forcetypeassert
+	}
+}
+
+// remove drops all entries for the given path, and if recursive is set,
+// all entries for paths below it.
+func (c *lru) remove(path string, recursive bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	prefix := strings.TrimSuffix(path, "/") + "/"
+
+	for l := range c.lookups {
+		if l.key.path == path || recursive && strings.HasPrefix(l.key.path, prefix) {
+			l.invalid = true
+		}
+	}
+
+	if !recursive {
+		for _, kd := range []kind{kindStat, kindLstat, kindList, kindReadlink} {
+			if elem, ok := c.items[key{kd, path}]; ok {
+				c.list.Remove(elem)
+				delete(c.items, elem.Value.(*entry).key) //nolint:forcetypeassert
+			}
+		}
+
+		return
+	}
+
+	for k, elem := range c.items {
+		if k.path == path || strings.HasPrefix(k.path, prefix) {
+			c.list.Remove(elem)
+			delete(c.items, k)
+		}
+	}
+}
+
+func (c *lru) len() int {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.list.Len()
+}
@@ -0,0 +1,298 @@
+package chaosfs
+
+import (
+	"crypto"
+	"io"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kuleuven/vfs"
+)
+
+var _ vfs.ChecksumFS = &ChaosFS{}
+
+// New returns a file system that wraps the given file system and injects
+// faults according to the given rules. The seed makes the random decisions
+// reproducible: the same seed, rules and sequence of calls result in the
+// same faults.
+func New(fs vfs.FS, seed uint64, rules ...*Rule) *ChaosFS {
+	return &ChaosFS{
+		FS:    fs,
+		Rules: rules,
+		rnd:   rand.New(rand.NewPCG(seed, seed)), //nolint:gosec
+	}
+}
+
+type ChaosFS struct {
+	FS    vfs.FS
+	Rules []*Rule
+	rnd   *rand.Rand
+	sync.Mutex
+}
+
+// AddRule adds a rule to the file system.
+func (c *ChaosFS) AddRule(rule *Rule) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.Rules = append(c.Rules, rule)
+}
+
+// inject evaluates all rules for the given call. It returns the error to
+// return, if any, and whether the call should be shortened.
+func (c *ChaosFS) inject(op Op, path string, offset int64) (bool, error) {
+	return c.injectAny(op, offset, path)
+}
+
+// injectAny is like inject for calls on several paths. A rule that matches
+// any of them is evaluated once.
+func (c *ChaosFS) injectAny(op Op, offset int64, paths ...string) (bool, error) {
+	c.Lock()
+
+	var (
+		latency time.Duration
+		short   bool
+		err     error
+	)
+
+	for _, rule := range c.Rules {
+		matches := false
+
+		for _, path := range paths {
+			matches = matches || rule.matches(op, path, offset)
+		}
+
+		if !matches || !rule.fires(c.rnd) {
+			continue
+		}
+
+		latency += rule.Latency
+		short = short || rule.Short
+
+		if err == nil {
+			err = rule.Err
+		}
+	}
+
+	c.Unlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+
+	return short, err
+}
+
+func (c *ChaosFS) check(op Op, path string) error {
+	_, err := c.inject(op, path, 0)
+
+	return err
+}
+
+func (c *ChaosFS) Stat(path string) (vfs.FileInfo, error) {
+	if err := c.check(OpStat, path); err != nil {
+		return nil, err
+	}
+
+	return c.FS.Stat(path)
+}
+
+func (c *ChaosFS) List(path string) (vfs.ListerAt, error) {
+	if err := c.check(OpList, path); err != nil {
+		return nil, err
+	}
+
+	lister, err := c.FS.List(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &listerAt{c: c, path: path, ListerAt: lister}, nil
+}
+
+func (c *ChaosFS) FileRead(path string) (vfs.ReaderAt, error) {
+	if err := c.check(OpFileRead, path); err != nil {
+		return nil, err
+	}
+
+	r, err := c.FS.FileRead(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &readerAt{c: c, path: path, ReaderAt: r}, nil
+}
+
+func (c *ChaosFS) FileWrite(path string, flags int) (vfs.WriterAt, error) {
+	if err := c.check(OpFileWrite, path); err != nil {
+		return nil, err
+	}
+
+	w, err := c.FS.FileWrite(path, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	return &writerAt{c: c, path: path, WriterAt: w}, nil
+}
+
+func (c *ChaosFS) Chmod(path string, mode os.FileMode) error {
+	if err := c.check(OpChmod, path); err != nil {
+		return err
+	}
+
+	return c.FS.Chmod(path, mode)
+}
+
+func (c *ChaosFS) Chown(path string, uid, gid int) error {
+	if err := c.check(OpChown, path); err != nil {
+		return err
+	}
+
+	return c.FS.Chown(path, uid, gid)
+}
+
+func (c *ChaosFS) Chtimes(path string, atime, mtime time.Time) error {
+	if err := c.check(OpChtimes, path); err != nil {
+		return err
+	}
+
+	return c.FS.Chtimes(path, atime, mtime)
+}
+
+func (c *ChaosFS) Truncate(path string, size int64) error {
+	if err := c.check(OpTruncate, path); err != nil {
+		return err
+	}
+
+	return c.FS.Truncate(path, size)
+}
+
+func (c *ChaosFS) SetExtendedAttr(path, name string, value []byte) error {
+	if err := c.check(OpSetExtendedAttr, path); err != nil {
+		return err
+	}
+
+	return c.FS.SetExtendedAttr(path, name, value)
+}
+
+func (c *ChaosFS) UnsetExtendedAttr(path, name string) error {
+	if err := c.check(OpUnsetExtendedAttr, path); err != nil {
+		return err
+	}
+
+	return c.FS.UnsetExtendedAttr(path, name)
+}
+
+func (c *ChaosFS) Rename(oldpath, newpath string) error {
+	if _, err := c.injectAny(OpRename, 0, oldpath, newpath); err != nil {
+		return err
+	}
+
+	return c.FS.Rename(oldpath, newpath)
+}
+
+func (c *ChaosFS) Rmdir(path string) error {
+	if err := c.check(OpRmdir, path); err != nil {
+		return err
+	}
+
+	return c.FS.Rmdir(path)
+}
+
+func (c *ChaosFS) Remove(path string) error {
+	if err := c.check(OpRemove, path); err != nil {
+		return err
+	}
+
+	return c.FS.Remove(path)
+}
+
+func (c *ChaosFS) Mkdir(path string, perm os.FileMode) error {
+	if err := c.check(OpMkdir, path); err != nil {
+		return err
+	}
+
+	return c.FS.Mkdir(path, perm)
+}
+
+func (c *ChaosFS) Checksum(path string, algorithm crypto.Hash) ([]byte, error) {
+	if err := c.check(OpChecksum, path); err != nil {
+		return nil, err
+	}
+
+	if checksumFS, ok := c.FS.(vfs.ChecksumFS); ok {
+		return checksumFS.Checksum(path, algorithm)
+	}
+
+	return vfs.Checksum(c, path, algorithm)
+}
+
+func (c *ChaosFS) Close() error {
+	return c.FS.Close()
+}
+
+type readerAt struct {
+	c    *ChaosFS
+	path string
+	vfs.ReaderAt
+}
+
+func (r *readerAt) ReadAt(buf []byte, off int64) (int, error) {
+	short, err := r.c.inject(OpReadAt, r.path, off)
+	if err != nil {
+		return 0, err
+	}
+
+	if !short || len(buf) < 2 {
+		return r.ReaderAt.ReadAt(buf, off)
+	}
+
+	n, err := r.ReaderAt.ReadAt(buf[:len(buf)/2], off)
+	if err != nil {
+		return n, err
+	}
+
+	// A short read must report why
+	return n, io.ErrUnexpectedEOF
+}
+
+type writerAt struct {
+	c    *ChaosFS
+	path string
+	vfs.WriterAt
+}
+
+func (w *writerAt) WriteAt(buf []byte, off int64) (int, error) {
+	short, err := w.c.inject(OpWriteAt, w.path, off)
+	if err != nil {
+		return 0, err
+	}
+
+	if !short || len(buf) < 2 {
+		return w.WriterAt.WriteAt(buf, off)
+	}
+
+	n, err := w.WriterAt.WriteAt(buf[:len(buf)/2], off)
+	if err != nil {
+		return n, err
+	}
+
+	return n, io.ErrShortWrite
+}
+
+type listerAt struct {
+	c    *ChaosFS
+	path string
+	vfs.ListerAt
+}
+
+func (l *listerAt) ListAt(buf []vfs.FileInfo, off int64) (int, error) {
+	if _, err := l.c.inject(OpListAt, l.path, off); err != nil {
+		return 0, err
+	}
+
+	return l.ListerAt.ListAt(buf, off)
+}
@@ -0,0 +1,186 @@
+package chaosfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kuleuven/vfs"
+	"github.com/kuleuven/vfs/fs/nativefs"
+)
+
+func TestChaosFSLatency(t *testing.T) {
+	fs := New(nativefs.New(t.Context(), t.TempDir()), 1, &Rule{
+		Latency: time.Millisecond,
+		Nth:     10,
+	})
+
+	defer func() {
+		if err := fs.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	vfs.RunTestSuiteRW(t, fs)
+
+	if fs.Rules[0].Fired() == 0 {
+		t.Error("Expected latency rule to fire")
+	}
+}
+
+func TestChaosFSErrors(t *testing.T) {
+	fs := New(nativefs.New(t.Context(), t.TempDir()), 1,
+		&Rule{Path: "/broken", Err: syscall.ECONNRESET},
+		&Rule{Path: "/flaky.txt", Op: OpStat, Nth: 2, Err: syscall.EIO},
+		&Rule{Path: "/once", Op: OpMkdir, Times: 1, Err: syscall.EAGAIN},
+	)
+
+	defer fs.Close()
+
+	if err := fs.Mkdir("/broken", 0o755); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Expected ECONNRESET, got %v", err)
+	}
+
+	if _, err := fs.Stat("/broken/sub/file"); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Expected ECONNRESET for child path, got %v", err)
+	}
+
+	if err := vfs.WriteFile(fs, "/flaky.txt", []byte("test"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 4 {
+		_, err := fs.Stat("/flaky.txt")
+
+		if i%2 == 1 && !errors.Is(err, syscall.EIO) {
+			t.Errorf("Expected EIO on call %d, got %v", i+1, err)
+		} else if i%2 == 0 && err != nil {
+			t.Errorf("Expected no error on call %d, got %v", i+1, err)
+		}
+	}
+
+	if err := fs.Mkdir("/once", 0o755); !errors.Is(err, syscall.EAGAIN) {
+		t.Errorf("Expected EAGAIN, got %v", err)
+	}
+
+	if err := fs.Mkdir("/once", 0o755); err != nil {
+		t.Errorf("Expected retry to succeed, got %v", err)
+	}
+}
+
+func TestChaosFSMidStream(t *testing.T) {
+	fs := New(nativefs.New(t.Context(), t.TempDir()), 1,
+		&Rule{Op: OpReadAt, Offset: 10, Err: syscall.ECONNRESET},
+		&Rule{Op: OpReadAt, Short: true},
+	)
+
+	defer fs.Close()
+
+	if err := vfs.WriteFile(fs, "/file.txt", []byte("0123456789abcdefghij"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := fs.FileRead("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	buf := make([]byte, 8)
+
+	n, err := r.ReadAt(buf, 0)
+	if !errors.Is(err, io.ErrUnexpectedEOF) || n != 4 || string(buf[:n]) != "0123" {
+		t.Errorf("Expected short read of 4 bytes, got %d, %v", n, err)
+	}
+
+	if _, err := r.ReadAt(buf, 10); !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Expected ECONNRESET, got %v", err)
+	}
+}
+
+func TestChaosFSShortWrite(t *testing.T) {
+	fs := New(nativefs.New(t.Context(), t.TempDir()), 1, &Rule{Op: OpWriteAt, Short: true})
+
+	defer fs.Close()
+
+	data := []byte("0123456789abcdefghij")
+
+	w, err := fs.FileWrite("/file.txt", os.O_CREATE|os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := w.WriteAt(data, 0)
+	if n != 10 || !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("Expected short write of 10 bytes, got %d, %v", n, err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the first half was written
+	if payload, err := vfs.ReadFile(fs, "/file.txt"); err != nil || string(payload) != string(data[:n]) {
+		t.Errorf("Expected %q, got %q (%v)", data[:n], payload, err)
+	}
+
+	// Writers that retry short writes still write everything
+	if err := vfs.WriteFile(fs, "/file.txt", data, os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload, err := vfs.ReadFile(fs, "/file.txt"); err != nil || string(payload) != string(data) {
+		t.Errorf("Expected %q, got %q (%v)", data, payload, err)
+	}
+}
+
+func TestChaosFSRename(t *testing.T) {
+	fs := New(nativefs.New(t.Context(), t.TempDir()), 1, &Rule{Op: OpRename, Nth: 2, Err: syscall.EIO})
+
+	defer fs.Close()
+
+	for _, name := range []string{"/a", "/b"} {
+		if err := vfs.WriteFile(fs, name, []byte("data"), os.O_CREATE|os.O_WRONLY); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The rule is evaluated once per rename, not once per path
+	if err := fs.Rename("/a", "/c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Rename("/b", "/d"); !errors.Is(err, syscall.EIO) {
+		t.Errorf("Expected EIO on the second rename, got %v", err)
+	}
+}
+
+func TestChaosFSSeed(t *testing.T) {
+	run := func(seed uint64) []bool {
+		fs := New(nativefs.New(t.Context(), t.TempDir()), seed, &Rule{Probability: 0.5, Err: syscall.EIO})
+
+		defer fs.Close()
+
+		var result []bool
+
+		for range 64 {
+			_, err := fs.Stat("/")
+
+			result = append(result, err != nil)
+		}
+
+		return result
+	}
+
+	a, b := run(42), run(42)
+
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("Expected identical faults for the same seed, differ at call %d", i)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package chaosfs
+
+import (
+	"math/rand/v2"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/kuleuven/vfs"
+)
+
+type Op string
+
+const (
+	OpAny               Op = "*"
+	OpStat              Op = "Stat"
+	OpList              Op = "List"
+	OpFileRead          Op = "FileRead"
+	OpFileWrite         Op = "FileWrite"
+	OpChmod             Op = "Chmod"
+	OpChown             Op = "Chown"
+	OpChtimes           Op = "Chtimes"
+	OpTruncate          Op = "Truncate"
+	OpSetExtendedAttr   Op = "SetExtendedAttr"
+	OpUnsetExtendedAttr Op = "UnsetExtendedAttr"
+	OpRename            Op = "Rename"
+	OpRmdir             Op = "Rmdir"
+	OpRemove            Op = "Remove"
+	OpMkdir             Op = "Mkdir"
+	OpChecksum          Op = "Checksum"
+	OpReadAt            Op = "ReadAt"  // Calls on a ReaderAt returned by FileRead
+	OpWriteAt           Op = "WriteAt" // Calls on a WriterAt returned by FileWrite
+	OpListAt            Op = "ListAt"  // Calls on a ListerAt returned by List
+)
+
+// Rule describes a fault to inject. A rule matches a call if both the
+// operation and the path match. Each matching call increments the rule's
+// counter; whether the rule fires is then decided by After, Nth, Probability
+// and Times, in that order. A firing rule first sleeps for Latency, and then
+// either returns Err, or shortens the read or write if Short is set.
+type Rule struct {
+	// Path is a path.Match pattern. The rule matches if the pattern matches
+	// the path or any of its parent directories. An empty pattern matches all paths.
+	Path string
+
+	// Op is the operation to match. An empty value or OpAny matches all operations.
+	Op Op
+
+	// After skips the first After matching calls, e.g. to fail in the middle of a stream.
+	After int
+
+	// Offset only lets ReadAt, WriteAt and ListAt calls match from this offset onwards.
+	Offset int64
+
+	// Nth fires on every Nth matching call (counted after After). Zero means every call.
+	Nth int
+
+	// Probability that the rule fires. Zero means always.
+	Probability float64
+
+	// Times is the maximum number of times the rule fires. Zero means unlimited.
+	Times int
+
+	// Err is the error to return when the rule fires. If nil, the rule only adds latency
+	// or shortens reads and writes.
+	Err error
+
+	// Latency to add before the call is executed.
+	Latency time.Duration
+
+	// Short makes ReadAt and WriteAt calls transfer only half of the requested bytes.
+	// A short read returns io.ErrUnexpectedEOF, a short write returns io.ErrShortWrite.
+	Short bool
+
+	calls int
+	fired int
+	mu    sync.Mutex
+}
+
+func (r *Rule) matches(op Op, name string, offset int64) bool {
+	if r.Op != "" && r.Op != OpAny && r.Op != op {
+		return false
+	}
+
+	if offset < r.Offset {
+		return false
+	}
+
+	return matchPath(r.Path, name)
+}
+
+func matchPath(pattern, name string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	for {
+		if ok, err := path.Match(pattern, name); err == nil && ok {
+			return true
+		}
+
+		if name == "/" || !vfs.IsAbs(name) {
+			return false
+		}
+
+		name = vfs.Dir(name)
+	}
+}
+
+// fires increments the counters of the rule and decides whether it fires.
+func (r *Rule) fires(rnd *rand.Rand) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.calls++
+
+	if r.calls <= r.After {
+		return false
+	}
+
+	if r.Nth > 0 && (r.calls-r.After)%r.Nth != 0 {
+		return false
+	}
+
+	if r.Probability > 0 && rnd.Float64() >= r.Probability {
+		return false
+	}
+
+	if r.Times > 0 && r.fired >= r.Times {
+		return false
+	}
+
+	r.fired++
+
+	return true
+}
+
+// Calls returns the number of calls that matched the rule.
+func (r *Rule) Calls() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.calls
+}
+
+// Fired returns the number of times the rule fired.
+func (r *Rule) Fired() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.fired
+}
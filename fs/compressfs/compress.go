@@ -0,0 +1,409 @@
+package compressfs
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kuleuven/vfs"
+	"github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+var _ vfs.ChecksumFS = &CompressFS{}
+
+var DefaultBlockSize int64 = 1024 * 1024
+
+// MaxPendingBlocks is the number of blocks that a new file keeps in memory
+// while waiting for the blocks before them. Beyond that, or when a block that
+// was already compressed is written again, the file is spooled instead.
+var MaxPendingBlocks = 16
+
+// DefaultSkipExtensions lists extensions of files that are already compressed,
+// and are stored as is.
+var DefaultSkipExtensions = []string{
+	".gz", ".tgz", ".bz2", ".xz", ".zst", ".lz4", ".zip", ".7z", ".rar",
+	".bam", ".cram", ".jpg", ".jpeg", ".png", ".gif", ".webp",
+	".mp3", ".mp4", ".mkv", ".avi", ".mov", ".pdf", ".docx", ".xlsx", ".pptx",
+}
+
+type Option func(*CompressFS)
+
+// WithBlockSize sets the amount of plaintext in each compressed block. Smaller
+// blocks make random reads cheaper, larger blocks compress better. Existing
+// files keep the block size they were written with.
+func WithBlockSize(size int64) Option {
+	return func(fs *CompressFS) {
+		fs.BlockSize = size
+	}
+}
+
+// WithLevel sets the gzip compression level.
+func WithLevel(level int) Option {
+	return func(fs *CompressFS) {
+		fs.Level = level
+	}
+}
+
+// WithSkipExtensions sets the extensions of files that are stored uncompressed.
+func WithSkipExtensions(extensions ...string) Option {
+	return func(fs *CompressFS) {
+		fs.SkipExtensions = extensions
+	}
+}
+
+// WithSpoolDir sets the local directory that holds the plaintext of
+// compressed files that are being modified. Defaults to os.TempDir().
+func WithSpoolDir(dir string) Option {
+	return func(fs *CompressFS) {
+		fs.SpoolDir = dir
+	}
+}
+
+// New returns a file system that compresses files stored in the given file system.
+// Files are split in fixed-size blocks that are compressed independently, so
+// that random reads only need to decompress the blocks they touch.
+// Files without the compressed header, such as files written before the
+// wrapper was introduced, are read as is.
+func New(ctx context.Context, fs vfs.FS, options ...Option) *CompressFS {
+	c := &CompressFS{
+		Context:        ctx,
+		FS:             fs,
+		BlockSize:      DefaultBlockSize,
+		Level:          gzip.DefaultCompression,
+		SkipExtensions: DefaultSkipExtensions,
+	}
+
+	for _, option := range options {
+		option(c)
+	}
+
+	return c
+}
+
+type CompressFS struct {
+	Context        context.Context //nolint:containedctx
+	FS             vfs.FS
+	BlockSize      int64
+	Level          int
+	SkipExtensions []string
+	SpoolDir       string
+}
+
+func (c *CompressFS) Logger() *logrus.Entry {
+	return vfs.Logger(c.Context)
+}
+
+// skip returns whether the file at the given path is stored uncompressed.
+func (c *CompressFS) skip(p string) bool {
+	ext := strings.ToLower(path.Ext(p))
+
+	for _, skip := range c.SkipExtensions {
+		if ext == skip {
+			return true
+		}
+	}
+
+	return false
+}
+
+// open opens the underlying file for reading, and returns a decoder if the file is compressed.
+func (c *CompressFS) open(path string) (vfs.ReaderAt, *decoder, error) {
+	fi, err := c.FS.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r, err := c.FS.FileRead(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		return r, nil, err
+	}
+
+	ok, err := isCompressed(r, fi.Size())
+	if err != nil {
+		return nil, nil, multierr.Append(err, r.Close())
+	} else if !ok {
+		return r, nil, nil
+	}
+
+	d, err := newDecoder(r, fi.Size())
+	if err != nil {
+		return nil, nil, multierr.Append(err, r.Close())
+	}
+
+	return r, d, nil
+}
+
+// SizeAttr records the plaintext size of a compressed file, followed by the
+// size of the compressed file, so that a stale value can be detected.
+const SizeAttr = "user.compress.size"
+
+// saveSize records the plaintext size of a compressed file that was written.
+// File systems without extended attributes fall back to reading the trailer.
+func (c *CompressFS) saveSize(path string, size, rawSize int64) {
+	value := strconv.FormatInt(size, 10) + "/" + strconv.FormatInt(rawSize, 10)
+
+	if err := c.FS.SetExtendedAttr(path, SizeAttr, []byte(value)); err != nil {
+		c.Logger().Debugf("Could not record size of %s: %v", path, err)
+	}
+}
+
+// fileInfo reports the logical size of compressed files. It is recorded in
+// an extended attribute, or otherwise read from the trailer of the file,
+// when it is first requested.
+type fileInfo struct {
+	vfs.FileInfo
+	c    *CompressFS
+	path string
+	once sync.Once
+	size int64
+}
+
+func (fi *fileInfo) Size() int64 {
+	fi.once.Do(func() {
+		fi.size = fi.FileInfo.Size()
+
+		if !fi.Mode().IsRegular() {
+			return
+		}
+
+		if size, ok := fi.savedSize(); ok {
+			fi.size = size
+
+			return
+		}
+
+		size, err := fi.readSize()
+		if err != nil {
+			fi.c.Logger().Debugf("Could not determine size of %s: %v", fi.path, err)
+
+			return
+		}
+
+		fi.size = size
+	})
+
+	return fi.size
+}
+
+// savedSize returns the size recorded in the extended attributes,
+// if it matches the size of the compressed file.
+func (fi *fileInfo) savedSize() (int64, bool) {
+	attrs, err := fi.FileInfo.Extended()
+	if err != nil {
+		return 0, false
+	}
+
+	value, ok := attrs.GetString(SizeAttr)
+	if !ok {
+		return 0, false
+	}
+
+	sizeStr, rawStr, ok := strings.Cut(value, "/")
+	if !ok || rawStr != strconv.FormatInt(fi.FileInfo.Size(), 10) {
+		return 0, false
+	}
+
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+
+	return size, err == nil
+}
+
+// readSize reads the size from the trailer, if the file is compressed.
+func (fi *fileInfo) readSize() (int64, error) {
+	r, err := fi.c.FS.FileRead(fi.path)
+	if err != nil {
+		return 0, err
+	}
+
+	defer r.Close()
+
+	size, ok, err := readSize(r, fi.FileInfo.Size())
+	if err != nil || !ok {
+		return fi.FileInfo.Size(), err
+	}
+
+	return size, nil
+}
+
+func (c *CompressFS) Stat(path string) (vfs.FileInfo, error) {
+	fi, err := c.FS.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileInfo{FileInfo: fi, c: c, path: path}, nil
+}
+
+func (c *CompressFS) List(path string) (vfs.ListerAt, error) {
+	lister, err := c.FS.List(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer lister.Close()
+
+	entries, err := vfs.ListAll(lister)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(vfs.FileInfoListerAt, 0, len(entries))
+
+	for _, entry := range entries {
+		result = append(result, &fileInfo{FileInfo: entry, c: c, path: vfs.Join(path, entry.Name())})
+	}
+
+	return result, nil
+}
+
+// reader decompresses a compressed file.
+type reader struct {
+	*decoder
+	io.Closer
+}
+
+func (c *CompressFS) FileRead(path string) (vfs.ReaderAt, error) {
+	r, d, err := c.open(path)
+	if err != nil || d == nil {
+		return r, err
+	}
+
+	return &reader{decoder: d, Closer: r}, nil
+}
+
+// FileWrite compresses new files, or files opened with O_TRUNC, while they are
+// written. Existing compressed files are decompressed to a local spool file,
+// and compressed again when the writer is closed. Existing uncompressed files
+// and files with a skipped extension are written as is.
+func (c *CompressFS) FileWrite(path string, flags int) (vfs.WriterAt, error) {
+	if fi, err := c.FS.Stat(path); err == nil && fi.Mode().IsRegular() && fi.Size() > 0 && flags&os.O_TRUNC == 0 {
+		return c.modify(path, flags)
+	}
+
+	if c.skip(path) {
+		return c.FS.FileWrite(path, flags)
+	}
+
+	// Offsets are managed by the writer
+	w, err := c.FS.FileWrite(path, flags&^os.O_APPEND)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := c.newStreamWriter(path, w)
+	if err != nil {
+		return nil, multierr.Append(err, w.Close())
+	}
+
+	return s, nil
+}
+
+// modify opens an existing, non-empty file for writing.
+func (c *CompressFS) modify(path string, flags int) (vfs.WriterAt, error) {
+	r, d, err := c.open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if d == nil {
+		if err = r.Close(); err != nil {
+			return nil, err
+		}
+
+		return c.FS.FileWrite(path, flags)
+	}
+
+	s, err := c.newSpoolWriter(path, d)
+
+	return s, multierr.Append(err, r.Close())
+}
+
+func (c *CompressFS) Chmod(path string, mode os.FileMode) error {
+	return c.FS.Chmod(path, mode)
+}
+
+func (c *CompressFS) Chown(path string, uid, gid int) error {
+	return c.FS.Chown(path, uid, gid)
+}
+
+func (c *CompressFS) Chtimes(path string, atime, mtime time.Time) error {
+	return c.FS.Chtimes(path, atime, mtime)
+}
+
+func (c *CompressFS) Truncate(path string, size int64) error {
+	fi, err := c.FS.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if fi.Size() == 0 {
+		w, err := c.FileWrite(path, os.O_WRONLY|os.O_TRUNC)
+		if err != nil {
+			return err
+		}
+
+		if size > 0 {
+			_, err = w.WriteAt([]byte{0}, size-1)
+		}
+
+		return multierr.Append(err, w.Close())
+	}
+
+	w, err := c.modify(path, os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+
+	if s, ok := w.(*spoolWriter); ok {
+		err = s.Truncate(size)
+	} else {
+		err = c.FS.Truncate(path, size)
+	}
+
+	return multierr.Append(err, w.Close())
+}
+
+func (c *CompressFS) SetExtendedAttr(path, name string, value []byte) error {
+	return c.FS.SetExtendedAttr(path, name, value)
+}
+
+func (c *CompressFS) UnsetExtendedAttr(path, name string) error {
+	return c.FS.UnsetExtendedAttr(path, name)
+}
+
+func (c *CompressFS) SetExtendedAttrs(path string, attrs vfs.Attributes) error {
+	return vfs.SetExtendedAttrs(c.FS, path, attrs)
+}
+
+func (c *CompressFS) Rename(oldpath, newpath string) error {
+	return c.FS.Rename(oldpath, newpath)
+}
+
+func (c *CompressFS) Rmdir(path string) error {
+	return c.FS.Rmdir(path)
+}
+
+func (c *CompressFS) Remove(path string) error {
+	return c.FS.Remove(path)
+}
+
+func (c *CompressFS) Mkdir(path string, perm os.FileMode) error {
+	return c.FS.Mkdir(path, perm)
+}
+
+// Checksum computes the checksum of the uncompressed contents.
+func (c *CompressFS) Checksum(path string, algorithm crypto.Hash) ([]byte, error) {
+	return vfs.Checksum(c, path, algorithm)
+}
+
+func (c *CompressFS) Close() error {
+	return c.FS.Close()
+}
@@ -0,0 +1,275 @@
+package compressfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kuleuven/vfs"
+	"github.com/kuleuven/vfs/fs/nativefs"
+)
+
+func TestCompressFS(t *testing.T) {
+	fs := New(t.Context(), nativefs.New(t.Context(), t.TempDir()), WithBlockSize(16), WithSpoolDir(t.TempDir()))
+
+	defer func() {
+		if err := fs.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	vfs.RunTestSuiteRW(t, fs)
+}
+
+func TestCompression(t *testing.T) {
+	native := nativefs.New(t.Context(), t.TempDir())
+	fs := New(t.Context(), native, WithBlockSize(1024), WithSpoolDir(t.TempDir()))
+
+	data := []byte(strings.Repeat("ACGTTGCAACGTNNNN,sample,42\n", 1000))
+
+	if err := vfs.WriteFile(fs, "/reads.csv", data, os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := native.Stat("/reads.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if raw.Size() >= int64(len(data))/4 {
+		t.Fatalf("expected compressed file, got %d bytes for %d bytes of data", raw.Size(), len(data))
+	}
+
+	// The logical size is recorded when the file is written
+	attrs, err := raw.Extended()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := attrs.GetString(SizeAttr); value != fmt.Sprintf("%d/%d", len(data), raw.Size()) {
+		t.Fatalf("unexpected %s: %q", SizeAttr, value)
+	}
+
+	fi, err := fs.Stat("/reads.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Size() != int64(len(data)) {
+		t.Fatalf("expected logical size %d, got %d", len(data), fi.Size())
+	}
+
+	// A stale value is ignored
+	if err := native.SetExtendedAttr("/reads.csv", SizeAttr, []byte("1/1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if fi, err := fs.Stat("/reads.csv"); err != nil || fi.Size() != int64(len(data)) {
+		t.Fatalf("expected logical size %d, got %v, %v", len(data), fi, err)
+	}
+
+	entries, err := vfs.ReadDir(fs, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 || entries[0].Size() != int64(len(data)) {
+		t.Fatalf("unexpected listing: %v", entries)
+	}
+
+	r, err := fs.FileRead("/reads.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	for _, offset := range []int64{20000, 0, 1000, 1020, int64(len(data)) - 10} {
+		buf := make([]byte, 100)
+
+		n, err := r.ReadAt(buf, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(buf[:n], data[offset:min(offset+100, int64(len(data)))]) {
+			t.Fatalf("unexpected data at offset %d", offset)
+		}
+	}
+}
+
+func TestOutOfOrderWrites(t *testing.T) {
+	fs := New(t.Context(), nativefs.New(t.Context(), t.TempDir()), WithBlockSize(8), WithSpoolDir(t.TempDir()))
+
+	w, err := fs.FileWrite("/file", os.O_CREATE|os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, chunk := range []struct {
+		data   string
+		offset int64
+	}{
+		{"klmnop", 10},
+		{"abcde", 0},
+		{"fghij", 5},
+		{"xyz", 20},
+	} {
+		if _, err := w.WriteAt([]byte(chunk.data), chunk.offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A write in a compressed block continues in the spool
+	for _, offset := range []int64{0, 22} {
+		if _, err := w.WriteAt([]byte("A"), offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := vfs.ReadFile(fs, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "Abcdefghijklmnop\x00\x00\x00\x00xyA"; string(data) != expected {
+		t.Fatalf("expected %q, got %q", expected, data)
+	}
+}
+
+func TestPendingLimit(t *testing.T) {
+	defer func(limit int) {
+		MaxPendingBlocks = limit
+	}(MaxPendingBlocks)
+
+	MaxPendingBlocks = 2
+
+	native := nativefs.New(t.Context(), t.TempDir())
+	fs := New(t.Context(), native, WithBlockSize(4), WithSpoolDir(t.TempDir()))
+
+	w, err := fs.FileWrite("/file", os.O_CREATE|os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Blocks written backwards wait for the first one
+	expected := []byte("0123456789abcdefghij")
+
+	for offset := int64(len(expected)) - 4; offset >= 0; offset -= 4 {
+		if _, err := w.WriteAt(expected[offset:offset+4], offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := vfs.ReadFile(fs, "/file"); err != nil || !bytes.Equal(data, expected) {
+		t.Fatalf("expected %q, got %q (%v)", expected, data, err)
+	}
+
+	if raw, err := vfs.ReadFile(native, "/file"); err != nil || !bytes.HasPrefix(raw, magic) {
+		t.Fatalf("expected a compressed file (%v)", err)
+	}
+}
+
+func TestModify(t *testing.T) {
+	fs := New(t.Context(), nativefs.New(t.Context(), t.TempDir()), WithBlockSize(8), WithSpoolDir(t.TempDir()))
+
+	if err := vfs.WriteFile(fs, "/file", []byte("0123456789abcdefghij"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := fs.FileWrite("/file", os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.WriteAt([]byte("XY"), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.WriteAt([]byte("END"), 20); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Truncate("/file", 22); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := vfs.ReadFile(fs, "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := "012XY56789abcdefghijEN"; string(data) != expected {
+		t.Fatalf("expected %q, got %q", expected, data)
+	}
+}
+
+func TestUncompressedFiles(t *testing.T) {
+	native := nativefs.New(t.Context(), t.TempDir())
+	fs := New(t.Context(), native)
+
+	legacy := []byte("written before compression was enabled")
+
+	if err := vfs.WriteFile(native, "/legacy.txt", legacy, os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vfs.WriteFile(fs, "/archive.GZ", legacy, os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := vfs.ReadFile(native, "/archive.GZ")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(raw, legacy) {
+		t.Fatalf("expected file with skipped extension to be stored as is, got %q", raw)
+	}
+
+	// Extending a legacy file keeps it uncompressed
+	w, err := fs.FileWrite("/legacy.txt", os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.WriteAt([]byte("!"), int64(len(legacy))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/legacy.txt", "/archive.GZ"} {
+		data, err := vfs.ReadFile(fs, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fi, err := fs.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.HasPrefix(data, legacy) || fi.Size() != int64(len(data)) {
+			t.Fatalf("unexpected contents of %s: %q (size %d)", path, data, fi.Size())
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package compressfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A compressed file consists of a header, the compressed blocks, an index
+// and a trailer. Each block holds a fixed amount of plaintext, compressed as
+// a separate gzip member, so that blocks can be decompressed independently.
+// The index lists the offsets of all blocks; the trailer points to the index
+// and records the plaintext size.
+//
+//	header:  magic (8) | block size (4)
+//	blocks:  gzip member per block
+//	index:   offset of each block (8 each)
+//	trailer: index offset (8) | plaintext size (8) | end magic (8)
+const (
+	headerSize  = 12
+	trailerSize = 24
+)
+
+var (
+	magic    = []byte("VFSGZ001")
+	endMagic = []byte("VFSGZEND")
+)
+
+var ErrCorrupt = errors.New("corrupt compressed file")
+
+// encoder writes blocks sequentially to a compressed file.
+type encoder struct {
+	w         io.WriterAt
+	blockSize int64
+	level     int
+	offset    int64
+	index     []uint64
+	end       int64 // Size of the compressed file, after finish
+}
+
+func newEncoder(w io.WriterAt, blockSize int64, level int) (*encoder, error) {
+	header := binary.BigEndian.AppendUint32(append([]byte{}, magic...), uint32(blockSize)) //nolint:gosec
+
+	if _, err := w.WriteAt(header, 0); err != nil {
+		return nil, err
+	}
+
+	return &encoder{
+		w:         w,
+		blockSize: blockSize,
+		level:     level,
+		offset:    headerSize,
+	}, nil
+}
+
+func (e *encoder) writeBlock(data []byte) error {
+	var buf bytes.Buffer
+
+	gz, err := gzip.NewWriterLevel(&buf, e.level)
+	if err != nil {
+		return err
+	}
+
+	if _, err := gz.Write(data); err != nil {
+		return err
+	}
+
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	if _, err := e.w.WriteAt(buf.Bytes(), e.offset); err != nil {
+		return err
+	}
+
+	e.index = append(e.index, uint64(e.offset)) //nolint:gosec
+	e.offset += int64(buf.Len())
+
+	return nil
+}
+
+// finish writes the index and trailer.
+func (e *encoder) finish(size int64) error {
+	buf := make([]byte, 0, len(e.index)*8+trailerSize)
+
+	for _, offset := range e.index {
+		buf = binary.BigEndian.AppendUint64(buf, offset)
+	}
+
+	buf = binary.BigEndian.AppendUint64(buf, uint64(e.offset)) //nolint:gosec
+	buf = binary.BigEndian.AppendUint64(buf, uint64(size))     //nolint:gosec
+	buf = append(buf, endMagic...)
+
+	_, err := e.w.WriteAt(buf, e.offset)
+
+	e.end = e.offset + int64(len(buf))
+
+	return err
+}
+
+// isCompressed returns whether the file starts with the header of a compressed file.
+func isCompressed(r io.ReaderAt, rawSize int64) (bool, error) {
+	if rawSize < headerSize+trailerSize {
+		return false, nil
+	}
+
+	buf := make([]byte, len(magic))
+
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(buf, magic), nil
+}
+
+// readSize returns the plaintext size recorded in the trailer of a compressed
+// file, without reading its index. It returns false if the file is not compressed.
+func readSize(r io.ReaderAt, rawSize int64) (int64, bool, error) {
+	ok, err := isCompressed(r, rawSize)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+
+	trailer := make([]byte, trailerSize)
+
+	if _, err := r.ReadAt(trailer, rawSize-trailerSize); err != nil && !errors.Is(err, io.EOF) {
+		return 0, false, err
+	}
+
+	if !bytes.Equal(trailer[16:], endMagic) {
+		return 0, false, ErrCorrupt
+	}
+
+	return int64(binary.BigEndian.Uint64(trailer[8:16])), true, nil //nolint:gosec
+}
+
+// decoder gives random access to the plaintext of a compressed file.
+type decoder struct {
+	r         io.ReaderAt
+	blockSize int64
+	size      int64
+	index     []uint64 // Block offsets, followed by the index offset
+	cached    int64
+	block     []byte
+	sync.Mutex
+}
+
+func newDecoder(r io.ReaderAt, rawSize int64) (*decoder, error) {
+	header := make([]byte, headerSize)
+
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+
+	trailer := make([]byte, trailerSize)
+
+	if _, err := r.ReadAt(trailer, rawSize-trailerSize); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	if !bytes.Equal(header[:8], magic) || !bytes.Equal(trailer[16:], endMagic) {
+		return nil, ErrCorrupt
+	}
+
+	blockSize := int64(binary.BigEndian.Uint32(header[8:]))
+	indexOffset := int64(binary.BigEndian.Uint64(trailer[:8])) //nolint:gosec
+	size := int64(binary.BigEndian.Uint64(trailer[8:16]))      //nolint:gosec
+	indexEnd := rawSize - trailerSize
+
+	if blockSize <= 0 || indexOffset < headerSize || indexOffset > indexEnd || (indexEnd-indexOffset)%8 != 0 {
+		return nil, ErrCorrupt
+	}
+
+	buf := make([]byte, indexEnd-indexOffset)
+
+	if _, err := r.ReadAt(buf, indexOffset); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	index := make([]uint64, 0, len(buf)/8+1)
+
+	for i := 0; i < len(buf); i += 8 {
+		index = append(index, binary.BigEndian.Uint64(buf[i:]))
+	}
+
+	index = append(index, uint64(indexOffset)) //nolint:gosec
+
+	if int64(len(index)-1) != (size+blockSize-1)/blockSize {
+		return nil, ErrCorrupt
+	}
+
+	return &decoder{
+		r:         r,
+		blockSize: blockSize,
+		size:      size,
+		index:     index,
+		cached:    -1,
+	}, nil
+}
+
+// readBlock returns the plaintext of the block with the given index.
+// The last decompressed block is cached, to serve small sequential reads.
+func (d *decoder) readBlock(i int64) ([]byte, error) {
+	if d.cached == i {
+		return d.block, nil
+	}
+
+	start, end := int64(d.index[i]), int64(d.index[i+1]) //nolint:gosec
+
+	if end < start {
+		return nil, ErrCorrupt
+	}
+
+	buf := make([]byte, end-start)
+
+	if _, err := d.r.ReadAt(buf, start); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		return nil, fmt.Errorf("%w: block %d: %w", ErrCorrupt, i, err)
+	}
+
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		return nil, fmt.Errorf("%w: block %d: %w", ErrCorrupt, i, err)
+	}
+
+	if expected := min(d.blockSize, d.size-i*d.blockSize); int64(len(data)) != expected {
+		return nil, fmt.Errorf("%w: block %d has %d bytes, expected %d", ErrCorrupt, i, len(data), expected)
+	}
+
+	d.cached, d.block = i, data
+
+	return data, nil
+}
+
+func (d *decoder) ReadAt(buf []byte, offset int64) (int, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if offset >= d.size {
+		return 0, io.EOF
+	}
+
+	var n int
+
+	for n < len(buf) && offset < d.size {
+		i := offset / d.blockSize
+
+		block, err := d.readBlock(i)
+		if err != nil {
+			return n, err
+		}
+
+		m := copy(buf[n:], block[offset-i*d.blockSize:])
+
+		n += m
+		offset += int64(m)
+	}
+
+	if n < len(buf) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
@@ -0,0 +1,314 @@
+package compressfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/kuleuven/vfs"
+	"go.uber.org/multierr"
+)
+
+// pendingBlock is a block that has not been compressed yet.
+type pendingBlock struct {
+	data   []byte
+	ranges [][2]int64 // Sorted, non-overlapping ranges that have been written
+}
+
+func (b *pendingBlock) add(from, to int64) {
+	b.ranges = append(b.ranges, [2]int64{from, to})
+
+	sort.Slice(b.ranges, func(i, j int) bool {
+		return b.ranges[i][0] < b.ranges[j][0]
+	})
+
+	merged := b.ranges[:1]
+
+	for _, r := range b.ranges[1:] {
+		if last := &merged[len(merged)-1]; r[0] <= last[1] {
+			last[1] = max(last[1], r[1])
+		} else {
+			merged = append(merged, r)
+		}
+	}
+
+	b.ranges = merged
+}
+
+func (b *pendingBlock) complete() bool {
+	return len(b.ranges) == 1 && b.ranges[0][0] == 0 && b.ranges[0][1] == int64(len(b.data))
+}
+
+// streamWriter compresses a new file while it is written. Blocks are kept in
+// memory until they are completely written, and compressed in order. Writes
+// may arrive out of order: if they target a block that has already been
+// compressed, or if more than MaxPendingBlocks blocks are waiting, the file
+// continues in a spoolWriter instead.
+type streamWriter struct {
+	c       *CompressFS
+	path    string
+	w       vfs.WriterAt // Nil after switching to the spool
+	enc     *encoder
+	pending map[int64]*pendingBlock
+	next    int64 // Index of the next block to compress
+	size    int64
+	spool   *spoolWriter
+	err     error
+	sync.Mutex
+}
+
+func (c *CompressFS) newStreamWriter(path string, w vfs.WriterAt) (*streamWriter, error) {
+	enc, err := newEncoder(w, c.BlockSize, c.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamWriter{
+		c:       c,
+		path:    path,
+		w:       w,
+		enc:     enc,
+		pending: map[int64]*pendingBlock{},
+	}, nil
+}
+
+func (s *streamWriter) WriteAt(buf []byte, offset int64) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	if s.spool != nil {
+		return s.spool.WriteAt(buf, offset)
+	}
+
+	bs := s.enc.blockSize
+	end := offset + int64(len(buf))
+
+	if offset/bs < s.next {
+		s.c.Logger().Debugf("Spooling %s for a write at offset %d in a block that has already been compressed", s.path, offset)
+
+		if s.err = s.toSpool(); s.err != nil {
+			return 0, s.err
+		}
+
+		return s.spool.WriteAt(buf, offset)
+	}
+
+	for i := offset / bs; i*bs < end; i++ {
+		b, ok := s.pending[i]
+		if !ok {
+			b = &pendingBlock{data: make([]byte, bs)}
+			s.pending[i] = b
+		}
+
+		from, to := max(offset, i*bs), min(end, (i+1)*bs)
+
+		copy(b.data[from-i*bs:to-i*bs], buf[from-offset:to-offset])
+		b.add(from-i*bs, to-i*bs)
+	}
+
+	s.size = max(s.size, end)
+
+	// Compress all complete blocks that are next in line
+	for b, ok := s.pending[s.next]; ok && b.complete(); b, ok = s.pending[s.next] {
+		if s.err = s.enc.writeBlock(b.data); s.err != nil {
+			return 0, s.err
+		}
+
+		delete(s.pending, s.next)
+
+		s.next++
+	}
+
+	if len(s.pending) > MaxPendingBlocks {
+		s.c.Logger().Debugf("Spooling %s as %d blocks are waiting to be compressed", s.path, len(s.pending))
+
+		if s.err = s.toSpool(); s.err != nil {
+			return 0, s.err
+		}
+	}
+
+	return len(buf), nil
+}
+
+// toSpool continues the file in a spool. The blocks that were compressed
+// are finished as a compressed file, which is decompressed into the spool,
+// and the pending blocks are written on top.
+func (s *streamWriter) toSpool() error {
+	bs := s.enc.blockSize
+
+	err := s.enc.finish(s.next * bs)
+
+	err = multierr.Append(err, s.w.Close())
+
+	s.w = nil
+
+	if err != nil {
+		return err
+	}
+
+	r, d, err := s.c.open(s.path)
+	if err != nil {
+		return err
+	}
+
+	if d == nil {
+		return multierr.Append(fmt.Errorf("%w: %s", ErrCorrupt, s.path), r.Close())
+	}
+
+	spool, err := s.c.newSpoolWriter(s.path, d)
+	if err = multierr.Append(err, r.Close()); err != nil {
+		if spool != nil {
+			err = multierr.Combine(err, spool.File.Close(), os.Remove(spool.Name()))
+		}
+
+		return err
+	}
+
+	for i, b := range s.pending {
+		for _, rg := range b.ranges {
+			if _, err := spool.WriteAt(b.data[rg[0]:rg[1]], i*bs+rg[0]); err != nil {
+				return multierr.Combine(err, spool.File.Close(), os.Remove(spool.Name()))
+			}
+		}
+	}
+
+	s.pending = nil
+	s.spool = spool
+
+	return nil
+}
+
+func (s *streamWriter) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.spool != nil {
+		return s.spool.Close()
+	}
+
+	if s.w == nil {
+		return s.err
+	}
+
+	err := s.err
+
+	if err == nil {
+		err = s.flush()
+	}
+
+	if err = multierr.Append(err, s.w.Close()); err != nil {
+		return err
+	}
+
+	s.c.saveSize(s.path, s.size, s.enc.end)
+
+	return nil
+}
+
+// flush compresses the remaining blocks, filling holes with zeros, and writes the index.
+func (s *streamWriter) flush() error {
+	bs := s.enc.blockSize
+
+	for ; s.next*bs < s.size; s.next++ {
+		length := min(bs, s.size-s.next*bs)
+
+		data := make([]byte, length)
+
+		if b, ok := s.pending[s.next]; ok {
+			data = b.data[:length]
+		}
+
+		if err := s.enc.writeBlock(data); err != nil {
+			return err
+		}
+
+		delete(s.pending, s.next)
+	}
+
+	return s.enc.finish(s.size)
+}
+
+// spoolWriter modifies an existing compressed file. The plaintext is
+// decompressed to a local temporary file, which receives all writes and is
+// compressed again into the original file on Close.
+type spoolWriter struct {
+	c    *CompressFS
+	path string
+	*os.File
+}
+
+func (c *CompressFS) newSpoolWriter(path string, d *decoder) (*spoolWriter, error) {
+	f, err := os.CreateTemp(c.SpoolDir, "compressfs-")
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := io.Copy(f, io.NewSectionReader(d, 0, d.size)); err != nil {
+		return nil, multierr.Combine(err, f.Close(), os.Remove(f.Name()))
+	}
+
+	return &spoolWriter{
+		c:    c,
+		path: path,
+		File: f,
+	}, nil
+}
+
+func (s *spoolWriter) Close() error {
+	defer os.Remove(s.Name())
+
+	fi, err := s.Stat()
+	if err != nil {
+		return multierr.Append(err, s.File.Close())
+	}
+
+	w, err := s.c.FS.FileWrite(s.path, os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return multierr.Append(err, s.File.Close())
+	}
+
+	rawSize, err := s.c.compress(w, s.File, fi.Size())
+	if err = multierr.Combine(err, w.Close(), s.File.Close()); err != nil {
+		return err
+	}
+
+	s.c.saveSize(s.path, fi.Size(), rawSize)
+
+	return nil
+}
+
+// compress writes the given plaintext in compressed form,
+// and returns the size of the compressed file.
+func (c *CompressFS) compress(w io.WriterAt, r io.ReaderAt, size int64) (int64, error) {
+	enc, err := newEncoder(w, c.BlockSize, c.Level)
+	if err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, c.BlockSize)
+
+	for offset := int64(0); offset < size; offset += c.BlockSize {
+		n := min(c.BlockSize, size-offset)
+
+		if _, err := r.ReadAt(buf[:n], offset); err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+
+		if err := enc.writeBlock(buf[:n]); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := enc.finish(size); err != nil {
+		return 0, err
+	}
+
+	return enc.end, nil
+}
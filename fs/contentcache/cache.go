@@ -0,0 +1,316 @@
+package contentcache
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kuleuven/vfs"
+	"github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+var _ vfs.ChecksumFS = &ContentCache{}
+
+var (
+	DefaultBlockSize int64 = 4 * 1024 * 1024
+	DefaultMaxBytes  int64 = 10 * 1024 * 1024 * 1024
+)
+
+type Option func(*ContentCache)
+
+// WithBlockSize sets the size of the cached blocks.
+// All processes sharing a cache directory should use the same block size.
+func WithBlockSize(size int64) Option {
+	return func(c *ContentCache) {
+		c.BlockSize = size
+	}
+}
+
+// WithMaxBytes sets the byte budget of the cache directory.
+func WithMaxBytes(maxBytes int64) Option {
+	return func(c *ContentCache) {
+		c.store.maxBytes = maxBytes
+	}
+}
+
+// WithChecksum includes a checksum of the given algorithm in the validator
+// of cached files, if the underlying file system implements vfs.ChecksumFS.
+// This protects against modifications that keep both size and modification
+// time, at the cost of a checksum call per opened file.
+func WithChecksum(algorithm crypto.Hash) Option {
+	return func(c *ContentCache) {
+		c.ChecksumAlgorithm = algorithm
+	}
+}
+
+// New returns a file system that caches the contents of files of the given
+// file system in fixed-size blocks in the given local directory. Only the
+// blocks that are read are fetched and stored, so files can be cached partially.
+// Cached blocks are keyed by the path and a validator consisting of the size,
+// the modification time and optionally the checksum of the file, so that
+// blocks of a modified file are never returned. The least recently used blocks
+// are evicted when the cache exceeds its byte budget. Multiple processes
+// can share the same directory.
+func New(ctx context.Context, fs vfs.FS, dir string, options ...Option) (*ContentCache, error) {
+	s, err := openStore(dir, DefaultMaxBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &ContentCache{
+		Context:   ctx,
+		FS:        fs,
+		BlockSize: DefaultBlockSize,
+		store:     s,
+	}
+
+	for _, option := range options {
+		option(c)
+	}
+
+	return c, nil
+}
+
+type ContentCache struct {
+	Context           context.Context //nolint:containedctx
+	FS                vfs.FS
+	BlockSize         int64
+	ChecksumAlgorithm crypto.Hash
+	store             *store
+}
+
+func (c *ContentCache) Logger() *logrus.Entry {
+	return vfs.Logger(c.Context)
+}
+
+// Used returns the number of bytes used by the cache directory, as far as known by this process.
+func (c *ContentCache) Used() int64 {
+	return c.store.used.Load()
+}
+
+// Invalidate drops all cached blocks of the given path.
+func (c *ContentCache) Invalidate(path string) error {
+	return c.store.remove(path)
+}
+
+func (c *ContentCache) invalidate(path string) {
+	if err := c.Invalidate(path); err != nil {
+		c.Logger().Warnf("Cannot invalidate cached contents of %s: %v", path, err)
+	}
+}
+
+func (c *ContentCache) validator(path string, fi vfs.FileInfo) string {
+	var checksum []byte
+
+	if checksumFS, ok := c.FS.(vfs.ChecksumFS); ok && c.ChecksumAlgorithm != 0 {
+		var err error
+
+		checksum, err = checksumFS.Checksum(path, c.ChecksumAlgorithm)
+		if err != nil {
+			c.Logger().Debugf("Cannot compute checksum of %s: %v", path, err)
+		}
+	}
+
+	return fmt.Sprintf("%d:%d:%x", fi.Size(), fi.ModTime().UnixNano(), checksum)
+}
+
+func (c *ContentCache) Stat(path string) (vfs.FileInfo, error) {
+	return c.FS.Stat(path)
+}
+
+func (c *ContentCache) List(path string) (vfs.ListerAt, error) {
+	return c.FS.List(path)
+}
+
+func (c *ContentCache) FileRead(path string) (vfs.ReaderAt, error) {
+	fi, err := c.FS.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.IsDir() || c.BlockSize <= 0 {
+		return c.FS.FileRead(path)
+	}
+
+	return &readerAt{
+		c:         c,
+		path:      path,
+		size:      fi.Size(),
+		validator: c.validator(path, fi),
+	}, nil
+}
+
+func (c *ContentCache) FileWrite(path string, flags int) (vfs.WriterAt, error) {
+	c.invalidate(path)
+
+	return c.FS.FileWrite(path, flags)
+}
+
+func (c *ContentCache) Chmod(path string, mode os.FileMode) error {
+	return c.FS.Chmod(path, mode)
+}
+
+func (c *ContentCache) Chown(path string, uid, gid int) error {
+	return c.FS.Chown(path, uid, gid)
+}
+
+func (c *ContentCache) Chtimes(path string, atime, mtime time.Time) error {
+	return c.FS.Chtimes(path, atime, mtime)
+}
+
+func (c *ContentCache) Truncate(path string, size int64) error {
+	defer c.invalidate(path)
+
+	return c.FS.Truncate(path, size)
+}
+
+func (c *ContentCache) SetExtendedAttr(path, name string, value []byte) error {
+	return c.FS.SetExtendedAttr(path, name, value)
+}
+
+func (c *ContentCache) UnsetExtendedAttr(path, name string) error {
+	return c.FS.UnsetExtendedAttr(path, name)
+}
+
+func (c *ContentCache) SetExtendedAttrs(path string, attrs vfs.Attributes) error {
+	return vfs.SetExtendedAttrs(c.FS, path, attrs)
+}
+
+func (c *ContentCache) Rename(oldpath, newpath string) error {
+	defer c.invalidate(newpath)
+	defer c.invalidate(oldpath)
+
+	return c.FS.Rename(oldpath, newpath)
+}
+
+func (c *ContentCache) Rmdir(path string) error {
+	return c.FS.Rmdir(path)
+}
+
+func (c *ContentCache) Remove(path string) error {
+	defer c.invalidate(path)
+
+	return c.FS.Remove(path)
+}
+
+func (c *ContentCache) Mkdir(path string, perm os.FileMode) error {
+	return c.FS.Mkdir(path, perm)
+}
+
+func (c *ContentCache) Checksum(path string, algorithm crypto.Hash) ([]byte, error) {
+	if checksumFS, ok := c.FS.(vfs.ChecksumFS); ok {
+		return checksumFS.Checksum(path, algorithm)
+	}
+
+	return vfs.Checksum(c.FS, path, algorithm)
+}
+
+func (c *ContentCache) Close() error {
+	return multierr.Append(c.store.close(), c.FS.Close())
+}
+
+// readerAt serves reads from cached blocks, and fetches missing blocks
+// from the underlying file system. The underlying file is opened on the
+// first cache miss.
+type readerAt struct {
+	c         *ContentCache
+	path      string
+	size      int64
+	validator string
+	r         vfs.ReaderAt
+	sync.Mutex
+}
+
+func (r *readerAt) ReadAt(buf []byte, offset int64) (int, error) {
+	if offset >= r.size {
+		return 0, io.EOF
+	}
+
+	var n int
+
+	for n < len(buf) && offset < r.size {
+		index := offset / r.c.BlockSize
+
+		data, err := r.block(index)
+		if err != nil {
+			return n, err
+		}
+
+		start := offset - index*r.c.BlockSize
+
+		if start < int64(len(data)) {
+			m := copy(buf[n:], data[start:])
+
+			n += m
+			offset += int64(m)
+		}
+
+		if int64(len(data)) < r.blockLength(index) && offset >= index*r.c.BlockSize+int64(len(data)) {
+			// Short block, the file was truncated since it was opened
+			return n, io.EOF
+		}
+	}
+
+	if n < len(buf) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (r *readerAt) blockLength(index int64) int64 {
+	return min(r.c.BlockSize, r.size-index*r.c.BlockSize)
+}
+
+func (r *readerAt) block(index int64) ([]byte, error) {
+	length := r.blockLength(index)
+
+	if data, ok := r.c.store.get(r.path, r.validator, index, int(length)); ok {
+		return data, nil
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if r.r == nil {
+		var err error
+
+		r.r, err = r.c.FS.FileRead(r.path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data := make([]byte, length)
+
+	n, err := r.r.ReadAt(data, index*r.c.BlockSize)
+	if errors.Is(err, io.EOF) && n < len(data) {
+		// Don't cache short blocks
+		return data[:n], nil
+	} else if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	if err := r.c.store.put(r.path, r.validator, index, data); err != nil {
+		r.c.Logger().Warnf("Cannot cache block %d of %s: %v", index, r.path, err)
+	}
+
+	return data, nil
+}
+
+func (r *readerAt) Close() error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.r == nil {
+		return nil
+	}
+
+	return r.r.Close()
+}
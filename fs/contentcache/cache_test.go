@@ -0,0 +1,184 @@
+package contentcache
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kuleuven/vfs"
+	"github.com/kuleuven/vfs/fs/chaosfs"
+	"github.com/kuleuven/vfs/fs/nativefs"
+)
+
+func TestContentCache(t *testing.T) {
+	fs, err := New(t.Context(), nativefs.New(t.Context(), t.TempDir()), t.TempDir(), WithBlockSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := fs.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	vfs.RunTestSuiteRW(t, fs)
+}
+
+func TestCacheHits(t *testing.T) {
+	dir := t.TempDir()
+	cacheDir := t.TempDir()
+	reads := &chaosfs.Rule{Op: chaosfs.OpReadAt}
+
+	fs, err := New(t.Context(), chaosfs.New(nativefs.New(t.Context(), dir), 1, reads), cacheDir, WithBlockSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer fs.Close()
+
+	if err := vfs.WriteFile(fs, "/file.txt", []byte("0123456789"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	// Partial read, only the second block is fetched
+	r, err := fs.FileRead("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2)
+
+	if n, err := r.ReadAt(buf, 5); err != nil || string(buf[:n]) != "56" {
+		t.Errorf("Expected '56', got %q, %v", buf[:n], err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if reads.Calls() != 1 || fs.Used() != 4 {
+		t.Errorf("Expected 1 read and 4 cached bytes, got %d and %d", reads.Calls(), fs.Used())
+	}
+
+	// Full read, fetches the remaining blocks
+	for range 2 {
+		data, err := vfs.ReadFile(fs, "/file.txt")
+		if err != nil || string(data) != "0123456789" {
+			t.Fatalf("Expected '0123456789', got %q, %v", data, err)
+		}
+	}
+
+	if reads.Calls() != 3 || fs.Used() != 10 {
+		t.Errorf("Expected 3 reads and 10 cached bytes, got %d and %d", reads.Calls(), fs.Used())
+	}
+
+	// Another instance shares the cache directory
+	shared, err := New(t.Context(), chaosfs.New(nativefs.New(t.Context(), dir), 1, reads), cacheDir, WithBlockSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer shared.Close()
+
+	if shared.Used() != 10 {
+		t.Errorf("Expected 10 cached bytes, got %d", shared.Used())
+	}
+
+	if data, err := vfs.ReadFile(shared, "/file.txt"); err != nil || string(data) != "0123456789" {
+		t.Fatalf("Expected '0123456789', got %q, %v", data, err)
+	}
+
+	if reads.Calls() != 3 {
+		t.Errorf("Expected 3 reads, got %d", reads.Calls())
+	}
+
+	// Writes invalidate the cached blocks
+	if err := vfs.WriteFile(fs, "/file.txt", []byte("abcdefghij"), os.O_WRONLY|os.O_TRUNC); err != nil {
+		t.Fatal(err)
+	}
+
+	if fs.Used() != 0 {
+		t.Errorf("Expected empty cache, got %d", fs.Used())
+	}
+
+	if data, err := vfs.ReadFile(fs, "/file.txt"); err != nil || string(data) != "abcdefghij" {
+		t.Fatalf("Expected 'abcdefghij', got %q, %v", data, err)
+	}
+}
+
+func TestExternalModification(t *testing.T) {
+	native := nativefs.New(t.Context(), t.TempDir())
+
+	fs, err := New(t.Context(), native, t.TempDir(), WithBlockSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer fs.Close()
+
+	if err := vfs.WriteFile(native, "/file.txt", []byte("0123456789"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := vfs.ReadFile(fs, "/file.txt"); err != nil || string(data) != "0123456789" {
+		t.Fatalf("Expected '0123456789', got %q, %v", data, err)
+	}
+
+	// Same size, different modification time
+	if err := vfs.WriteFile(native, "/file.txt", []byte("abcdefghij"), os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := native.Chtimes("/file.txt", time.Now(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := vfs.ReadFile(fs, "/file.txt"); err != nil || string(data) != "abcdefghij" {
+		t.Fatalf("Expected 'abcdefghij', got %q, %v", data, err)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	native := nativefs.New(t.Context(), t.TempDir())
+
+	fs, err := New(t.Context(), native, t.TempDir(), WithBlockSize(10), WithMaxBytes(50))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer fs.Close()
+
+	now := time.Now()
+
+	fs.store.now = func() time.Time {
+		now = now.Add(time.Second)
+
+		return now
+	}
+
+	payload := bytes.Repeat([]byte("x"), 30)
+
+	for _, name := range []string{"/a", "/b"} {
+		if err := vfs.WriteFile(native, name, payload, os.O_CREATE|os.O_WRONLY); err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := fs.FileRead(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := io.Copy(io.Discard, io.NewSectionReader(r, 0, 30)); err != nil {
+			t.Fatal(err)
+		}
+
+		r.Close()
+	}
+
+	if fs.Used() > 45 {
+		t.Errorf("Expected at most 45 cached bytes, got %d", fs.Used())
+	}
+}
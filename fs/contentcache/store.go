@@ -0,0 +1,289 @@
+package contentcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/kuleuven/vfs/bytetree"
+)
+
+// store keeps blocks on local disk. The layout is
+//
+//	<dir>/<hash of path>/<hash of validator>/<block index>
+//
+// so that all blocks of a path can be dropped at once, and blocks of an
+// outdated version of a file are never returned. Blocks are written to a
+// temporary file and renamed into place, so that concurrent readers in
+// other processes never observe partial blocks. Recency is recorded in the
+// modification time of the block files, so that it is shared between processes.
+type store struct {
+	dir      string
+	maxBytes int64
+	used     atomic.Int64
+	lockFile *os.File
+	evicting sync.Mutex
+	now      func() time.Time
+}
+
+func openStore(dir string, maxBytes int64) (*store, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	lockFile, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &store{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lockFile: lockFile,
+		now:      time.Now,
+	}
+
+	blocks, err := s.scan()
+	if err != nil {
+		lockFile.Close()
+
+		return nil, err
+	}
+
+	var used int64
+
+	for _, b := range blocks {
+		used += b.size
+	}
+
+	s.used.Store(used)
+
+	return s, nil
+}
+
+func hash(s string) string {
+	h := sha256.Sum256([]byte(s))
+
+	return hex.EncodeToString(h[:])
+}
+
+func (s *store) pathDir(path string) string {
+	return filepath.Join(s.dir, hash(path))
+}
+
+func (s *store) blockPath(path, validator string, index int64) string {
+	return filepath.Join(s.pathDir(path), hash(validator), strconv.FormatInt(index, 10))
+}
+
+// get returns the block, if it is cached and has the expected length.
+func (s *store) get(path, validator string, index int64, length int) ([]byte, bool) {
+	name := s.blockPath(path, validator, index)
+
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, false
+	}
+
+	if len(data) != length {
+		// Corrupt or truncated block, drop it
+		s.removeFile(name)
+
+		return nil, false
+	}
+
+	// Mark as recently used; failure only affects eviction order
+	now := s.now()
+
+	os.Chtimes(name, now, now) //nolint:errcheck
+
+	return data, true
+}
+
+// put stores the block.
+func (s *store) put(path, validator string, index int64, data []byte) error {
+	name := s.blockPath(path, validator, index)
+	dir := filepath.Dir(name)
+
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(dir, fmt.Sprintf(".tmp%x", rand.Uint64())) //nolint:gosec
+
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		os.Remove(tmp)
+
+		return err
+	}
+
+	var previous int64
+
+	if fi, err := os.Stat(name); err == nil {
+		previous = fi.Size()
+	}
+
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+
+		return err
+	}
+
+	if s.used.Add(int64(len(data))-previous) > s.maxBytes {
+		return s.evict()
+	}
+
+	return nil
+}
+
+// remove drops all blocks of the given path.
+func (s *store) remove(path string) error {
+	dir := s.pathDir(path)
+
+	blocks, err := s.scanDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, b := range blocks {
+		s.removeFile(b.name)
+	}
+
+	err = os.RemoveAll(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *store) removeFile(name string) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return
+	}
+
+	if err := os.Remove(name); err == nil {
+		s.used.Add(-fi.Size())
+	}
+}
+
+type block struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (s *store) scan() ([]block, error) {
+	return s.scanDir(s.dir)
+}
+
+func (s *store) scanDir(dir string) ([]block, error) {
+	var blocks []block
+
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if errors.Is(err, os.ErrNotExist) {
+			// Removed by another process in the meantime
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		// Skip the lock files in the top directory, and blocks being written
+		if d.IsDir() || filepath.Dir(name) == s.dir || strings.HasPrefix(d.Name(), ".tmp") {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		blocks = append(blocks, block{
+			name:    name,
+			size:    fi.Size(),
+			modTime: fi.ModTime(),
+		})
+
+		return nil
+	})
+
+	return blocks, err
+}
+
+// LowWatermark is the fraction of the byte budget that is kept after eviction.
+var LowWatermark = 0.9
+
+// evict removes the least recently used blocks until the cache uses
+// less than LowWatermark of its budget. Only one process evicts at a time;
+// if another process holds the lock, eviction is left to that process.
+func (s *store) evict() error {
+	if !s.evicting.TryLock() {
+		return nil
+	}
+
+	defer s.evicting.Unlock()
+
+	lock, err := bytetree.TryLock(s.lockFile)
+	if errors.Is(err, bytetree.ErrLockHeld) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	defer lock.Unlock()
+
+	// Rescan, other processes might have added or removed blocks
+	blocks, err := s.scan()
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(blocks, func(i, j int) bool {
+		return blocks[i].modTime.Before(blocks[j].modTime)
+	})
+
+	var used int64
+
+	for _, b := range blocks {
+		used += b.size
+	}
+
+	target := int64(float64(s.maxBytes) * LowWatermark)
+
+	for _, b := range blocks {
+		if used <= target {
+			break
+		}
+
+		if err := os.Remove(b.name); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		used -= b.size
+
+		// Clean up empty directories, this fails if they are not empty
+		os.Remove(filepath.Dir(b.name))
+		os.Remove(filepath.Dir(filepath.Dir(b.name)))
+	}
+
+	s.used.Store(used)
+
+	return nil
+}
+
+func (s *store) close() error {
+	return s.lockFile.Close()
+}
@@ -0,0 +1,408 @@
+package dedupfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kuleuven/vfs"
+	"github.com/kuleuven/vfs/bytetree"
+	"go.uber.org/multierr"
+)
+
+const rootID = 1
+
+var ErrCorrupt = errors.New("corrupt journal")
+
+// inode is the metadata of a file or directory.
+type inode struct {
+	ID     uint64         `json:"id"`
+	Mode   os.FileMode    `json:"mode"`
+	UID    int            `json:"uid"`
+	GID    int            `json:"gid"`
+	Atime  time.Time      `json:"atime"`
+	Mtime  time.Time      `json:"mtime"`
+	Size   int64          `json:"size"`
+	Blob   string         `json:"blob,omitempty"` // SHA-256 of the contents, empty for empty files
+	Xattrs vfs.Attributes `json:"xattrs,omitempty"`
+	Links  []link         `json:"links,omitempty"` // Directory entries referring to the inode
+}
+
+type link struct {
+	Parent uint64 `json:"parent"`
+	Name   string `json:"name"`
+}
+
+func (ino *inode) clone() *inode {
+	c := *ino
+	c.Xattrs = maps.Clone(ino.Xattrs)
+	c.Links = slices.Clone(ino.Links)
+
+	return &c
+}
+
+func (ino *inode) removeLink(parent uint64, name string) {
+	ino.Links = slices.DeleteFunc(ino.Links, func(l link) bool {
+		return l.Parent == parent && l.Name == name
+	})
+}
+
+// record is a single entry in the journal. Records contain the complete
+// inode, so that replaying the journal only needs to keep the last record
+// of each inode.
+type record struct {
+	Inode  *inode `json:"inode,omitempty"`
+	Delete uint64 `json:"delete,omitempty"`
+}
+
+// db keeps all metadata in memory, and persists changes to an append-only
+// journal, that is compacted when it contains too many superseded records.
+// It is not safe for concurrent use.
+type db struct {
+	path     string
+	file     *os.File
+	lock     *bytetree.FileLock
+	inodes   map[uint64]*inode
+	children map[uint64]map[string]uint64
+	refs     map[string]int
+	next     uint64
+	records  int
+}
+
+func openDB(path string) (*db, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := bytetree.TryLock(file)
+	if err != nil {
+		return nil, multierr.Append(err, file.Close())
+	}
+
+	d := &db{
+		path:     path,
+		file:     file,
+		lock:     lock,
+		inodes:   map[uint64]*inode{},
+		children: map[uint64]map[string]uint64{},
+		refs:     map[string]int{},
+		next:     rootID + 1,
+	}
+
+	if err := d.load(); err != nil {
+		return nil, multierr.Append(err, d.close())
+	}
+
+	if _, ok := d.inodes[rootID]; !ok {
+		now := time.Now()
+
+		d.index(&inode{
+			ID:    rootID,
+			Mode:  os.ModeDir | 0o755,
+			UID:   os.Getuid(),
+			GID:   os.Getgid(),
+			Atime: now,
+			Mtime: now,
+		})
+	}
+
+	// Start from a compacted journal, which also drops a torn record at the end
+	if err := d.compact(); err != nil {
+		return nil, multierr.Append(err, d.close())
+	}
+
+	return d, nil
+}
+
+// load replays the journal. A record that was only partially written before
+// a crash, i.e. a last line without newline, is ignored. Any other record
+// that cannot be decoded is an error, as compacting would lose the records
+// after it.
+func (d *db) load() error {
+	data, err := io.ReadAll(d.file)
+	if err != nil {
+		return err
+	}
+
+	for n := 1; len(data) > 0; n++ {
+		line, rest, ok := bytes.Cut(data, []byte{'\n'})
+		if !ok {
+			// Torn record
+			return nil
+		}
+
+		data = rest
+
+		var r record
+
+		if err := json.Unmarshal(line, &r); err != nil {
+			return fmt.Errorf("%w: %s: record %d: %w", ErrCorrupt, d.path, n, err)
+		}
+
+		if r.Inode != nil {
+			d.index(r.Inode)
+		} else if ino, ok := d.inodes[r.Delete]; ok {
+			d.unindex(ino)
+		}
+	}
+
+	return nil
+}
+
+// index adds the inode to the in-memory indices, replacing any previous version.
+func (d *db) index(ino *inode) {
+	if old, ok := d.inodes[ino.ID]; ok {
+		d.unindex(old)
+	}
+
+	d.inodes[ino.ID] = ino
+
+	for _, l := range ino.Links {
+		if d.children[l.Parent] == nil {
+			d.children[l.Parent] = map[string]uint64{}
+		}
+
+		d.children[l.Parent][l.Name] = ino.ID
+	}
+
+	if ino.Blob != "" {
+		d.refs[ino.Blob]++
+	}
+
+	d.next = max(d.next, ino.ID+1)
+}
+
+// unindex removes the inode from the in-memory indices. It returns
+// the blob of the inode if it is no longer referenced.
+func (d *db) unindex(ino *inode) string {
+	delete(d.inodes, ino.ID)
+
+	for _, l := range ino.Links {
+		if d.children[l.Parent][l.Name] == ino.ID {
+			delete(d.children[l.Parent], l.Name)
+		}
+	}
+
+	if ino.Blob == "" {
+		return ""
+	}
+
+	if d.refs[ino.Blob]--; d.refs[ino.Blob] > 0 {
+		return ""
+	}
+
+	delete(d.refs, ino.Blob)
+
+	return ino.Blob
+}
+
+func (d *db) append(r record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	if _, err := d.file.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	if err := d.file.Sync(); err != nil {
+		return err
+	}
+
+	d.records++
+
+	if d.records > 2*len(d.inodes)+1024 {
+		return d.compact()
+	}
+
+	return nil
+}
+
+// compact rewrites the journal with a single record per inode.
+func (d *db) compact() error {
+	tmp := d.path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(f)
+
+	for _, id := range slices.Sorted(maps.Keys(d.inodes)) {
+		if err := enc.Encode(record{Inode: d.inodes[id]}); err != nil {
+			return multierr.Combine(err, f.Close(), os.Remove(tmp))
+		}
+	}
+
+	if err := multierr.Append(f.Sync(), f.Close()); err != nil {
+		return multierr.Append(err, os.Remove(tmp))
+	}
+
+	if err := os.Rename(tmp, d.path); err != nil {
+		return err
+	}
+
+	// Make sure the rename is persisted
+	if err := syncDir(filepath.Dir(d.path)); err != nil {
+		return err
+	}
+
+	// Lock the new journal before releasing the lock on the old one
+	file, err := os.OpenFile(d.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+
+	lock, err := bytetree.TryLock(file)
+	if err != nil {
+		return multierr.Append(err, file.Close())
+	}
+
+	err = multierr.Append(d.lock.Unlock(), d.file.Close())
+
+	d.file, d.lock, d.records = file, lock, len(d.inodes)
+
+	return err
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// put stores a new version of the inode. It returns a blob that is no longer referenced.
+func (d *db) put(ino *inode) (string, error) {
+	var released string
+
+	if old, ok := d.inodes[ino.ID]; ok {
+		d.unindex(old)
+
+		if old.Blob != "" && d.refs[old.Blob] == 0 && old.Blob != ino.Blob {
+			released = old.Blob
+		}
+	}
+
+	d.index(ino)
+
+	return released, d.append(record{Inode: ino})
+}
+
+// remove deletes the inode. It returns a blob that is no longer referenced.
+func (d *db) remove(ino *inode) (string, error) {
+	var released string
+
+	if old, ok := d.inodes[ino.ID]; ok {
+		released = d.unindex(old)
+	}
+
+	return released, d.append(record{Delete: ino.ID})
+}
+
+func (d *db) newID() uint64 {
+	id := d.next
+
+	d.next++
+
+	return id
+}
+
+// lookup resolves the given path to an inode.
+func (d *db) lookup(path string) (*inode, error) {
+	ino := d.inodes[rootID]
+
+	for _, name := range strings.Split(strings.Trim(vfs.Clean(path), "/"), "/") {
+		if name == "" {
+			continue
+		}
+
+		if !ino.Mode.IsDir() {
+			return nil, syscall.ENOTDIR
+		}
+
+		id, ok := d.children[ino.ID][name]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+
+		ino = d.inodes[id]
+	}
+
+	return ino, nil
+}
+
+// lookupParent resolves the parent directory of the given path.
+func (d *db) lookupParent(path string) (*inode, string, error) {
+	path = vfs.Clean(path)
+
+	if path == "/" {
+		return nil, "", syscall.EINVAL
+	}
+
+	parent, err := d.lookup(vfs.Dir(path))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !parent.Mode.IsDir() {
+		return nil, "", syscall.ENOTDIR
+	}
+
+	return parent, vfs.Base(path), nil
+}
+
+// pathOf returns the path of the first link of the inode.
+func (d *db) pathOf(id uint64) (string, error) {
+	var parts []string
+
+	for id != rootID {
+		ino, ok := d.inodes[id]
+		if !ok || len(ino.Links) == 0 || len(parts) > len(d.inodes) {
+			return "", os.ErrNotExist
+		}
+
+		parts = append(parts, ino.Links[0].Name)
+		id = ino.Links[0].Parent
+	}
+
+	slices.Reverse(parts)
+
+	return "/" + strings.Join(parts, "/"), nil
+}
+
+// isAncestor returns whether the directory with the given id is the
+// directory ino or one of its ancestors.
+func (d *db) isAncestor(id uint64, ino *inode) bool {
+	for {
+		if ino.ID == id {
+			return true
+		}
+
+		if ino.ID == rootID || len(ino.Links) == 0 {
+			return false
+		}
+
+		ino = d.inodes[ino.Links[0].Parent]
+	}
+}
+
+func (d *db) close() error {
+	return multierr.Combine(d.file.Sync(), d.lock.Unlock(), d.file.Close())
+}
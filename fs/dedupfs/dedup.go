@@ -0,0 +1,777 @@
+package dedupfs
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kuleuven/vfs"
+	"github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+var (
+	_ vfs.HandleResolveFS    = &DedupFS{}
+	_ vfs.LinkFS             = &DedupFS{}
+	_ vfs.ChecksumFS         = &DedupFS{}
+	_ vfs.SetExtendedAttrsFS = &DedupFS{}
+)
+
+const tmpDir = "/tmp"
+
+// New returns a file system that stores file contents as content-addressed
+// blobs in the given blob file system, named after their SHA-256 checksum,
+// so that identical files are only stored once. All other metadata is kept
+// in a journal in the given local directory. Handles are inode numbers, and
+// remain valid across renames.
+func New(ctx context.Context, blobs vfs.FS, dir string) (*DedupFS, error) {
+	db, err := openDB(filepath.Join(dir, "metadata.journal"))
+	if err != nil {
+		return nil, err
+	}
+
+	return &DedupFS{
+		Context: ctx,
+		Blobs:   blobs,
+		db:      db,
+		writing: map[string]bool{},
+		pinned:  map[string]int{},
+	}, nil
+}
+
+type DedupFS struct {
+	Context context.Context //nolint:containedctx
+	Blobs   vfs.FS
+	db      *db
+	writing map[string]bool // Temporary blobs of open writers
+	pinned  map[string]int  // Blobs that are being copied, and must not be removed
+	sync.Mutex
+}
+
+func (d *DedupFS) Logger() *logrus.Entry {
+	return vfs.Logger(d.Context)
+}
+
+func blobPath(blob string) string {
+	return "/" + blob[:2] + "/" + blob[2:4] + "/" + blob
+}
+
+// release removes a blob that is no longer referenced.
+// Pinned blobs are removed when they are unpinned.
+func (d *DedupFS) release(blob string, err error) error {
+	if blob == "" || d.pinned[blob] > 0 {
+		return err
+	}
+
+	if rmErr := d.Blobs.Remove(blobPath(blob)); rmErr != nil && !os.IsNotExist(rmErr) {
+		d.Logger().Warnf("Could not remove blob %s, it will be removed by the next garbage collection: %v", blob, rmErr)
+	}
+
+	return err
+}
+
+func (d *DedupFS) fileInfo(ino *inode, name string) *fileInfo {
+	return &fileInfo{
+		inode: ino.clone(),
+		name:  name,
+	}
+}
+
+func (d *DedupFS) Stat(path string) (vfs.FileInfo, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	ino, err := d.db.lookup(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+
+	return d.fileInfo(ino, vfs.Base(path)), nil
+}
+
+func (d *DedupFS) List(path string) (vfs.ListerAt, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	ino, err := d.db.lookup(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "list", Path: path, Err: err}
+	}
+
+	if !ino.Mode.IsDir() {
+		return nil, &os.PathError{Op: "list", Path: path, Err: syscall.ENOTDIR}
+	}
+
+	children := d.db.children[ino.ID]
+	result := make(vfs.FileInfoListerAt, 0, len(children))
+
+	for _, name := range slices.Sorted(maps.Keys(children)) {
+		result = append(result, d.fileInfo(d.db.inodes[children[name]], name))
+	}
+
+	return result, nil
+}
+
+func (d *DedupFS) Handle(path string) ([]byte, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	ino, err := d.db.lookup(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "handle", Path: path, Err: err}
+	}
+
+	return binary.BigEndian.AppendUint64(nil, ino.ID), nil
+}
+
+func (d *DedupFS) Path(handle []byte) (string, error) {
+	if len(handle) != 8 {
+		return "", os.ErrNotExist
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	return d.db.pathOf(binary.BigEndian.Uint64(handle))
+}
+
+func (d *DedupFS) FileRead(path string) (vfs.ReaderAt, error) {
+	d.Lock()
+
+	ino, err := d.db.lookup(path)
+
+	d.Unlock()
+
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	if ino.Mode.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: path, Err: syscall.EISDIR}
+	}
+
+	if ino.Blob == "" {
+		return emptyReader{}, nil
+	}
+
+	return d.Blobs.FileRead(blobPath(ino.Blob))
+}
+
+type emptyReader struct{}
+
+func (emptyReader) ReadAt([]byte, int64) (int, error) {
+	return 0, io.EOF
+}
+
+func (emptyReader) Close() error {
+	return nil
+}
+
+// FileWrite writes to a temporary blob, which is stored under its checksum
+// when the writer is closed. If the file exists and is not truncated, the
+// current contents are copied to the temporary blob first.
+func (d *DedupFS) FileWrite(path string, flags int) (vfs.WriterAt, error) {
+	d.Lock()
+
+	ino, err := d.open(path, flags)
+	if err != nil {
+		d.Unlock()
+
+		return nil, err
+	}
+
+	// Keep the current contents while they are copied without the lock
+	d.pin(ino.Blob)
+
+	d.Unlock()
+
+	defer d.unpin(ino.Blob)
+
+	return d.newWriter(ino)
+}
+
+// open looks up or creates the file to write.
+func (d *DedupFS) open(path string, flags int) (*inode, error) {
+	ino, err := d.db.lookup(path)
+
+	switch {
+	case err == nil && flags&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrExist}
+	case err == nil && ino.Mode.IsDir():
+		return nil, &os.PathError{Op: "open", Path: path, Err: syscall.EISDIR}
+	case os.IsNotExist(err) && flags&os.O_CREATE != 0:
+		ino, err = d.create(path, 0o640)
+	}
+
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+
+	if flags&os.O_TRUNC != 0 && ino.Blob != "" {
+		ino = ino.clone()
+		ino.Blob, ino.Size, ino.Mtime = "", 0, time.Now()
+
+		if err = d.release(d.db.put(ino)); err != nil {
+			return nil, err
+		}
+	}
+
+	return ino, nil
+}
+
+func (d *DedupFS) pin(blob string) {
+	if blob != "" {
+		d.pinned[blob]++
+	}
+}
+
+// unpin releases a pinned blob, and removes it if it is no longer referenced.
+func (d *DedupFS) unpin(blob string) {
+	if blob == "" {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	if d.pinned[blob]--; d.pinned[blob] > 0 {
+		return
+	}
+
+	delete(d.pinned, blob)
+
+	if d.db.refs[blob] == 0 {
+		d.release(blob, nil) //nolint:errcheck
+	}
+}
+
+// create adds a new empty file.
+func (d *DedupFS) create(path string, mode os.FileMode) (*inode, error) {
+	parent, name, err := d.db.lookupParent(path)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	ino := &inode{
+		ID:    d.db.newID(),
+		Mode:  mode,
+		UID:   os.Getuid(),
+		GID:   os.Getgid(),
+		Atime: now,
+		Mtime: now,
+		Links: []link{{Parent: parent.ID, Name: name}},
+	}
+
+	_, err = d.db.put(ino)
+
+	return ino, err
+}
+
+// newWriter opens a writer for the given inode, and copies its current
+// contents. It is called without the lock, the blob must be pinned.
+func (d *DedupFS) newWriter(ino *inode) (*writer, error) {
+	tmp := tmpDir + "/" + rand.Text()
+
+	// Protect the temporary blob from garbage collection
+	d.Lock()
+	d.writing[tmp] = true
+	d.Unlock()
+
+	if err := vfs.MkdirAll(d.Blobs, tmpDir, 0o755); err != nil {
+		return nil, multierr.Append(err, d.abort(tmp))
+	}
+
+	w, err := d.Blobs.FileWrite(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return nil, multierr.Append(err, d.abort(tmp))
+	}
+
+	wr := &writer{
+		d:    d,
+		id:   ino.ID,
+		tmp:  tmp,
+		w:    w,
+		hash: crypto.SHA256.New(),
+	}
+
+	if ino.Blob == "" {
+		return wr, nil
+	}
+
+	// Copy the current contents
+	r, err := d.Blobs.FileRead(blobPath(ino.Blob))
+	if err == nil {
+		_, err = io.Copy(io.NewOffsetWriter(wr, 0), io.NewSectionReader(r, 0, ino.Size))
+		err = multierr.Append(err, r.Close())
+	}
+
+	if err != nil {
+		return nil, multierr.Combine(err, w.Close(), d.abort(tmp))
+	}
+
+	return wr, nil
+}
+
+// commit stores the temporary blob under its checksum, and updates the inode.
+func (d *DedupFS) commit(id uint64, tmp, blob string, size int64) error {
+	d.Lock()
+	defer d.Unlock()
+
+	delete(d.writing, tmp)
+
+	ino, ok := d.db.inodes[id]
+	if !ok || size == 0 {
+		// The file was removed while it was being written, or is empty
+		err := d.Blobs.Remove(tmp)
+
+		if ok && ino.Blob != "" {
+			ino = ino.clone()
+			ino.Blob, ino.Size, ino.Mtime = "", 0, time.Now()
+
+			err = multierr.Append(err, d.release(d.db.put(ino)))
+		}
+
+		return err
+	}
+
+	if _, ok := d.db.refs[blob]; ok {
+		if err := d.Blobs.Remove(tmp); err != nil {
+			return err
+		}
+	} else if err := d.storeBlob(tmp, blob); err != nil {
+		return err
+	}
+
+	ino = ino.clone()
+	ino.Blob, ino.Size, ino.Mtime = blob, size, time.Now()
+
+	return d.release(d.db.put(ino))
+}
+
+func (d *DedupFS) storeBlob(tmp, blob string) error {
+	path := blobPath(blob)
+
+	if _, err := d.Blobs.Stat(path); err == nil {
+		// Left behind, e.g. by a crash before the metadata was updated
+		return d.Blobs.Remove(tmp)
+	}
+
+	if err := vfs.MkdirAll(d.Blobs, vfs.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	return d.Blobs.Rename(tmp, path)
+}
+
+// abort discards the temporary blob of a failed writer.
+func (d *DedupFS) abort(tmp string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	delete(d.writing, tmp)
+
+	if err := d.Blobs.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// update applies the given function to a copy of the inode at the given path, and stores the result.
+func (d *DedupFS) update(op, path string, fn func(*inode) error) error {
+	d.Lock()
+	defer d.Unlock()
+
+	ino, err := d.db.lookup(path)
+	if err != nil {
+		return &os.PathError{Op: op, Path: path, Err: err}
+	}
+
+	ino = ino.clone()
+
+	if err := fn(ino); err != nil {
+		return &os.PathError{Op: op, Path: path, Err: err}
+	}
+
+	return d.release(d.db.put(ino))
+}
+
+func (d *DedupFS) Chmod(path string, mode os.FileMode) error {
+	return d.update("chmod", path, func(ino *inode) error {
+		ino.Mode = ino.Mode&os.ModeType | mode&os.ModePerm
+
+		return nil
+	})
+}
+
+func (d *DedupFS) Chown(path string, uid, gid int) error {
+	return d.update("chown", path, func(ino *inode) error {
+		if uid >= 0 {
+			ino.UID = uid
+		}
+
+		if gid >= 0 {
+			ino.GID = gid
+		}
+
+		return nil
+	})
+}
+
+func (d *DedupFS) Chtimes(path string, atime, mtime time.Time) error {
+	return d.update("chtimes", path, func(ino *inode) error {
+		ino.Atime, ino.Mtime = atime, mtime
+
+		return nil
+	})
+}
+
+func (d *DedupFS) Truncate(path string, size int64) error {
+	w, err := d.FileWrite(path, os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+
+	return multierr.Append(w.(*writer).Truncate(size), w.Close()) //nolint:forcetypeassert
+}
+
+func (d *DedupFS) SetExtendedAttr(path, name string, value []byte) error {
+	return d.update("setxattr", path, func(ino *inode) error {
+		if ino.Xattrs == nil {
+			ino.Xattrs = vfs.Attributes{}
+		}
+
+		ino.Xattrs[name] = bytes.Clone(value)
+
+		return nil
+	})
+}
+
+func (d *DedupFS) UnsetExtendedAttr(path, name string) error {
+	return d.update("removexattr", path, func(ino *inode) error {
+		if _, ok := ino.Xattrs[name]; !ok {
+			return syscall.ENODATA
+		}
+
+		delete(ino.Xattrs, name)
+
+		return nil
+	})
+}
+
+// SetExtendedAttrs replaces all extended attributes.
+func (d *DedupFS) SetExtendedAttrs(path string, attrs vfs.Attributes) error {
+	return d.update("setxattr", path, func(ino *inode) error {
+		ino.Xattrs = vfs.Attributes{}
+
+		for name, value := range attrs {
+			ino.Xattrs[name] = bytes.Clone(value)
+		}
+
+		return nil
+	})
+}
+
+func (d *DedupFS) Mkdir(path string, perm os.FileMode) error {
+	d.Lock()
+	defer d.Unlock()
+
+	if _, err := d.db.lookup(path); err == nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: os.ErrExist}
+	}
+
+	_, err := d.create(path, os.ModeDir|perm&os.ModePerm)
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: path, Err: err}
+	}
+
+	return nil
+}
+
+// Link adds a directory entry for an existing file. Both entries
+// refer to the same inode, and share contents and metadata.
+func (d *DedupFS) Link(oldname, newname string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	ino, err := d.db.lookup(oldname)
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+
+	if ino.Mode.IsDir() {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+
+	if _, err := d.db.lookup(newname); err == nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+
+	parent, name, err := d.db.lookupParent(newname)
+	if err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+
+	ino = ino.clone()
+	ino.Links = append(ino.Links, link{Parent: parent.ID, Name: name})
+
+	return d.release(d.db.put(ino))
+}
+
+// Rename moves a file or directory. An existing file at newpath is replaced,
+// as is an empty directory if oldpath is a directory.
+func (d *DedupFS) Rename(oldpath, newpath string) error {
+	d.Lock()
+	defer d.Unlock()
+
+	ino, err := d.db.lookup(oldpath)
+	if err == nil && vfs.Clean(oldpath) == "/" {
+		err = syscall.EINVAL
+	}
+
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+
+	target, err := d.db.lookup(newpath)
+	if err == nil {
+		err = d.checkReplace(ino, target)
+	} else if os.IsNotExist(err) {
+		target, err = nil, nil
+	}
+
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+
+	// Renaming a file to another link of itself does nothing
+	if target != nil && target.ID == ino.ID {
+		return nil
+	}
+
+	parent, name, err := d.db.lookupParent(newpath)
+	if err == nil && d.db.isAncestor(ino.ID, parent) {
+		err = syscall.EINVAL
+	}
+
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+
+	oldParent, oldName, err := d.db.lookupParent(oldpath)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+
+	if target != nil {
+		target = target.clone()
+		target.removeLink(parent.ID, name)
+
+		if len(target.Links) > 0 {
+			err = d.release(d.db.put(target))
+		} else {
+			err = d.release(d.db.remove(target))
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	ino = ino.clone()
+	ino.removeLink(oldParent.ID, oldName)
+	ino.Links = append(ino.Links, link{Parent: parent.ID, Name: name})
+
+	return d.release(d.db.put(ino))
+}
+
+// checkReplace returns an error if ino cannot replace target in a rename.
+func (d *DedupFS) checkReplace(ino, target *inode) error {
+	switch {
+	case ino.Mode.IsDir() && !target.Mode.IsDir():
+		return syscall.ENOTDIR
+	case !ino.Mode.IsDir() && target.Mode.IsDir():
+		return syscall.EISDIR
+	case target.Mode.IsDir() && target.ID != ino.ID && len(d.db.children[target.ID]) > 0:
+		return syscall.ENOTEMPTY
+	default:
+		return nil
+	}
+}
+
+func (d *DedupFS) Rmdir(path string) error {
+	return d.unlink("rmdir", path, func(ino *inode) error {
+		if !ino.Mode.IsDir() {
+			return syscall.ENOTDIR
+		}
+
+		if len(d.db.children[ino.ID]) > 0 {
+			return syscall.ENOTEMPTY
+		}
+
+		return nil
+	})
+}
+
+func (d *DedupFS) Remove(path string) error {
+	return d.unlink("remove", path, func(ino *inode) error {
+		if ino.Mode.IsDir() {
+			return syscall.EISDIR
+		}
+
+		return nil
+	})
+}
+
+// unlink removes a directory entry, and the inode if it was the last entry.
+func (d *DedupFS) unlink(op, path string, check func(*inode) error) error {
+	d.Lock()
+	defer d.Unlock()
+
+	ino, err := d.db.lookup(path)
+	if err == nil {
+		err = check(ino)
+	}
+
+	var (
+		parent *inode
+		name   string
+	)
+
+	if err == nil {
+		parent, name, err = d.db.lookupParent(path)
+	}
+
+	if err != nil {
+		return &os.PathError{Op: op, Path: path, Err: err}
+	}
+
+	ino = ino.clone()
+	ino.removeLink(parent.ID, name)
+
+	if len(ino.Links) > 0 {
+		return d.release(d.db.put(ino))
+	}
+
+	return d.release(d.db.remove(ino))
+}
+
+// Checksum returns the SHA-256 checksum from the metadata, without reading
+// the contents. Other algorithms are computed from the contents.
+func (d *DedupFS) Checksum(path string, algorithm crypto.Hash) ([]byte, error) {
+	if algorithm != crypto.SHA256 {
+		return vfs.Checksum(d, path, algorithm)
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	ino, err := d.db.lookup(path)
+	if err != nil {
+		return nil, &os.PathError{Op: "checksum", Path: path, Err: err}
+	}
+
+	if ino.Mode.IsDir() {
+		return nil, &os.PathError{Op: "checksum", Path: path, Err: syscall.EISDIR}
+	}
+
+	if ino.Blob == "" {
+		return crypto.SHA256.New().Sum(nil), nil
+	}
+
+	return hex.DecodeString(ino.Blob)
+}
+
+// GC removes blobs that are not referenced by any file, and temporary blobs
+// that are not being written, e.g. left behind after a crash. It returns the
+// number of removed blobs. The blob store is walked without holding the lock;
+// each candidate is checked again before it is removed.
+func (d *DedupFS) GC() (int, error) {
+	d.Lock()
+	refs, pinned, writing := maps.Clone(d.db.refs), maps.Clone(d.pinned), maps.Clone(d.writing)
+	d.Unlock()
+
+	var candidates []string
+
+	err := vfs.Walk(d.Blobs, "/", func(path string, info vfs.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+
+			return err
+		}
+
+		if !info.IsDir() && !d.inUse(path, refs, pinned, writing) {
+			candidates = append(candidates, path)
+		}
+
+		return nil
+	})
+
+	var (
+		removed int
+		errs    error
+	)
+
+	for _, path := range candidates {
+		ok, rmErr := d.collect(path)
+		if rmErr != nil {
+			errs = multierr.Append(errs, rmErr)
+		} else if ok {
+			removed++
+		}
+	}
+
+	return removed, multierr.Append(err, errs)
+}
+
+// inUse returns whether the blob file at path is referenced, pinned or being written.
+func (d *DedupFS) inUse(path string, refs, pinned map[string]int, writing map[string]bool) bool {
+	if writing[path] || pinned[vfs.Base(path)] > 0 {
+		return true
+	}
+
+	name := vfs.Base(path)
+
+	return len(name) == 2*crypto.SHA256.Size() && path == blobPath(name) && refs[name] > 0
+}
+
+// collect removes the blob file at path if it is still not in use,
+// and returns whether it was removed.
+func (d *DedupFS) collect(path string) (bool, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.inUse(path, d.db.refs, d.pinned, d.writing) {
+		return false, nil
+	}
+
+	if err := d.Blobs.Remove(path); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (d *DedupFS) Close() error {
+	d.Lock()
+	defer d.Unlock()
+
+	return multierr.Append(d.db.close(), d.Blobs.Close())
+}
@@ -0,0 +1,370 @@
+package dedupfs
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/kuleuven/vfs"
+	"github.com/kuleuven/vfs/fs/nativefs"
+)
+
+func newTestFS(t *testing.T, blobs vfs.FS, dir string) *DedupFS {
+	t.Helper()
+
+	fs, err := New(t.Context(), blobs, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fs
+}
+
+func countBlobs(t *testing.T, blobs vfs.FS) int {
+	t.Helper()
+
+	var count int
+
+	err := vfs.Walk(blobs, "/", func(path string, info vfs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() && vfs.Dir(path) != tmpDir {
+			count++
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return count
+}
+
+func TestDedupFS(t *testing.T) {
+	fs := newTestFS(t, nativefs.New(t.Context(), t.TempDir()), t.TempDir())
+
+	defer func() {
+		if err := fs.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	vfs.RunTestSuiteRW(t, fs)
+
+	if err := vfs.WriteFile(fs, "/file.txt", []byte("test"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Mkdir("/dir", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	vfs.RunTestSuiteRO(t, fs)
+}
+
+func TestDeduplication(t *testing.T) {
+	blobs := nativefs.New(t.Context(), t.TempDir())
+	fs := newTestFS(t, blobs, t.TempDir())
+
+	defer fs.Close()
+
+	genome := bytes.Repeat([]byte("ACGT"), 10000)
+
+	for _, path := range []string{"/a.fa", "/b.fa"} {
+		if err := vfs.WriteFile(fs, path, genome, os.O_CREATE|os.O_WRONLY); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := countBlobs(t, blobs); n != 1 {
+		t.Fatalf("expected 1 blob, got %d", n)
+	}
+
+	checksum, err := fs.Checksum("/b.fa", crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := sha256.Sum256(genome); !bytes.Equal(checksum, expected[:]) {
+		t.Fatalf("unexpected checksum %x", checksum)
+	}
+
+	// Modifying one copy leaves the other intact
+	w, err := fs.FileWrite("/a.fa", os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.WriteAt([]byte("NNNN"), 100); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := vfs.ReadFile(fs, "/b.fa")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, genome) {
+		t.Fatal("unmodified copy changed")
+	}
+
+	if n := countBlobs(t, blobs); n != 2 {
+		t.Fatalf("expected 2 blobs, got %d", n)
+	}
+
+	// Removing both files releases both blobs
+	for _, path := range []string{"/a.fa", "/b.fa"} {
+		if err := fs.Remove(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := countBlobs(t, blobs); n != 0 {
+		t.Fatalf("expected no blobs, got %d", n)
+	}
+}
+
+func TestHardLinksAndHandles(t *testing.T) {
+	fs := newTestFS(t, nativefs.New(t.Context(), t.TempDir()), t.TempDir())
+
+	defer fs.Close()
+
+	if err := fs.Mkdir("/dir", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vfs.WriteFile(fs, "/dir/file", []byte("data"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	handle, err := fs.Handle("/dir/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Link("/dir/file", "/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Rename("/dir", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	if path, err := fs.Path(handle); err != nil || path != "/moved/file" {
+		t.Fatalf("expected /moved/file, got %q (%v)", path, err)
+	}
+
+	if err := fs.Chmod("/link", 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := fs.Stat("/moved/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.NumLinks() != 2 || fi.Mode() != 0o600 {
+		t.Fatalf("expected shared inode with 2 links and mode 0600, got %d links and mode %v", fi.NumLinks(), fi.Mode())
+	}
+
+	if err := fs.Remove("/moved/file"); err != nil {
+		t.Fatal(err)
+	}
+
+	if path, err := fs.Path(handle); err != nil || path != "/link" {
+		t.Fatalf("expected /link, got %q (%v)", path, err)
+	}
+
+	if err := fs.Rename("/moved", "/moved/sub"); err == nil {
+		t.Fatal("expected error when moving a directory into itself")
+	}
+}
+
+func TestPersistenceAndGC(t *testing.T) {
+	blobs := nativefs.New(t.Context(), t.TempDir())
+	dir := t.TempDir()
+	fs := newTestFS(t, blobs, dir)
+
+	if err := vfs.WriteFile(fs, "/file", []byte("persistent"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.SetExtendedAttr("/file", "user.test", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	handle, err := fs.Handle("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := New(t.Context(), blobs, dir); err == nil {
+		t.Fatal("expected the journal to be locked")
+	}
+
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leave an unreferenced blob and a temporary blob behind
+	orphan := blobPath(string(bytes.Repeat([]byte("ab"), 32)))
+
+	for _, path := range []string{orphan, tmpDir + "/leftover"} {
+		if err := vfs.MkdirAll(blobs, vfs.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := vfs.WriteFile(blobs, path, []byte("orphan"), os.O_CREATE|os.O_WRONLY); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	fs = newTestFS(t, nativefs.New(t.Context(), blobs.(*nativefs.NativeFS).Root), dir)
+
+	defer fs.Close()
+
+	data, err := vfs.ReadFile(fs, "/file")
+	if err != nil || string(data) != "persistent" {
+		t.Fatalf("unexpected contents %q (%v)", data, err)
+	}
+
+	fi, err := fs.Stat("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attrs, err := fi.Extended(); err != nil || string(attrs["user.test"]) != "value" {
+		t.Fatalf("unexpected attributes %v (%v)", attrs, err)
+	}
+
+	if path, err := fs.Path(handle); err != nil || path != "/file" {
+		t.Fatalf("expected /file, got %q (%v)", path, err)
+	}
+
+	removed, err := fs.GC()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if removed != 2 {
+		t.Fatalf("expected 2 removed blobs, got %d", removed)
+	}
+
+	if data, err := vfs.ReadFile(fs, "/file"); err != nil || string(data) != "persistent" {
+		t.Fatalf("unexpected contents after GC %q (%v)", data, err)
+	}
+}
+
+func TestJournalRecovery(t *testing.T) {
+	blobs := nativefs.New(t.Context(), t.TempDir())
+	dir := t.TempDir()
+	journal := filepath.Join(dir, "metadata.journal")
+	fs := newTestFS(t, blobs, dir)
+
+	if err := fs.Mkdir("/dir", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A torn record at the end is dropped
+	if err := os.WriteFile(journal, append(bytes.Clone(data), `{"inode":{"id":`...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	fs = newTestFS(t, blobs, dir)
+
+	if _, err := fs.Stat("/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A corrupt record before the end is an error
+	if err := os.WriteFile(journal, append([]byte("{\n"), data...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := New(t.Context(), blobs, dir); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("expected ErrCorrupt, got %v", err)
+	}
+
+	if corrupt, err := os.ReadFile(journal); err != nil || !bytes.HasSuffix(corrupt, data) {
+		t.Fatalf("expected the journal to be kept, got %q (%v)", corrupt, err)
+	}
+}
+
+func TestRenameReplace(t *testing.T) {
+	blobs := nativefs.New(t.Context(), t.TempDir())
+	fs := newTestFS(t, blobs, t.TempDir())
+
+	defer fs.Close()
+
+	for path, data := range map[string]string{"/a": "one", "/b": "two"} {
+		if err := vfs.WriteFile(fs, path, []byte(data), os.O_CREATE|os.O_WRONLY); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := fs.Rename("/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := vfs.ReadFile(fs, "/b"); err != nil || string(data) != "one" {
+		t.Fatalf("unexpected contents %q (%v)", data, err)
+	}
+
+	// The blob of the replaced file is released
+	if n := countBlobs(t, blobs); n != 1 {
+		t.Fatalf("expected 1 blob, got %d", n)
+	}
+
+	if err := fs.Mkdir("/dir", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Rename("/b", "/dir"); !errors.Is(err, syscall.EISDIR) {
+		t.Fatalf("expected EISDIR, got %v", err)
+	}
+
+	if err := fs.Mkdir("/empty", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Rename("/dir", "/empty"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Mkdir("/full", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Rename("/b", "/full/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Rename("/empty", "/full"); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Fatalf("expected ENOTEMPTY, got %v", err)
+	}
+}
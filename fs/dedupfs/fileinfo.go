@@ -0,0 +1,72 @@
+package dedupfs
+
+import (
+	"encoding/binary"
+	"maps"
+	"os"
+	"time"
+
+	"github.com/kuleuven/vfs"
+)
+
+var _ vfs.HandleFileInfo = &fileInfo{}
+
+type fileInfo struct {
+	*inode
+	name string
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.inode.Size
+}
+
+func (fi *fileInfo) Mode() os.FileMode {
+	return fi.inode.Mode
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return fi.Mtime
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.inode.Mode.IsDir()
+}
+
+func (fi *fileInfo) Sys() any {
+	return nil
+}
+
+func (fi *fileInfo) Uid() uint32 { //nolint:staticcheck
+	return uint32(fi.UID) //nolint:gosec
+}
+
+func (fi *fileInfo) Gid() uint32 { //nolint:staticcheck
+	return uint32(fi.GID) //nolint:gosec
+}
+
+func (fi *fileInfo) NumLinks() uint64 {
+	return uint64(max(len(fi.Links), 1))
+}
+
+func (fi *fileInfo) Extended() (vfs.Attributes, error) {
+	return maps.Clone(fi.Xattrs), nil
+}
+
+func (fi *fileInfo) Permissions() (*vfs.Permissions, error) {
+	return &vfs.Permissions{
+		Read:             true,
+		Write:            true,
+		Delete:           true,
+		Own:              true,
+		GetExtendedAttrs: true,
+		SetExtendedAttrs: true,
+	}, nil
+}
+
+func (fi *fileInfo) Handle() ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, fi.ID), nil
+}
@@ -0,0 +1,108 @@
+package dedupfs
+
+import (
+	"crypto"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"sync"
+
+	"github.com/kuleuven/vfs"
+	"go.uber.org/multierr"
+)
+
+var ErrClosed = errors.New("writer already closed")
+
+// writer writes to a temporary blob. The checksum is computed while the
+// file is written sequentially, and otherwise from the temporary blob on Close.
+type writer struct {
+	d      *DedupFS
+	id     uint64
+	tmp    string
+	w      vfs.WriterAt
+	hash   hash.Hash
+	hashed int64 // Number of bytes hashed, or -1 if the file was not written sequentially
+	size   int64
+	closed bool
+	sync.Mutex
+}
+
+func (w *writer) WriteAt(buf []byte, offset int64) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.closed {
+		return 0, ErrClosed
+	}
+
+	n, err := w.w.WriteAt(buf, offset)
+
+	if w.hashed >= 0 && offset == w.hashed {
+		w.hash.Write(buf[:n])
+		w.hashed += int64(n)
+	} else {
+		w.hashed = -1
+	}
+
+	w.size = max(w.size, offset+int64(n))
+
+	return n, err
+}
+
+func (w *writer) Truncate(size int64) error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	if err := w.d.Blobs.Truncate(w.tmp, size); err != nil {
+		return err
+	}
+
+	if size != w.hashed {
+		w.hashed = -1
+	}
+
+	w.size = size
+
+	return nil
+}
+
+func (w *writer) Close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.closed {
+		return ErrClosed
+	}
+
+	w.closed = true
+
+	if err := w.w.Close(); err != nil {
+		return multierr.Append(err, w.d.abort(w.tmp))
+	}
+
+	if w.hashed != w.size {
+		if err := w.rehash(); err != nil {
+			return multierr.Append(err, w.d.abort(w.tmp))
+		}
+	}
+
+	return w.d.commit(w.id, w.tmp, hex.EncodeToString(w.hash.Sum(nil)), w.size)
+}
+
+func (w *writer) rehash() error {
+	r, err := w.d.Blobs.FileRead(w.tmp)
+	if err != nil {
+		return err
+	}
+
+	w.hash = crypto.SHA256.New()
+
+	_, err = io.Copy(w.hash, io.NewSectionReader(r, 0, w.size))
+
+	return multierr.Append(err, r.Close())
+}
@@ -0,0 +1,509 @@
+package encfs
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/kuleuven/vfs"
+	"github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+var (
+	_ vfs.ChecksumFS = &EncFS{}
+	_ vfs.OpenFileFS = &EncFS{}
+)
+
+var DefaultBlockSize int64 = 64 * 1024
+
+type Option func(*EncFS)
+
+// WithBlockSize sets the plaintext size of the encrypted blocks.
+// Existing files can only be opened with the block size they were written with.
+func WithBlockSize(size int64) Option {
+	return func(fs *EncFS) {
+		fs.layout.blockSize = size
+	}
+}
+
+// WithEncryptedNames encrypts file and directory names deterministically.
+// Encrypted names are longer than the original names, which limits the
+// length of names that can be stored.
+func WithEncryptedNames() Option {
+	return func(fs *EncFS) {
+		fs.EncryptNames = true
+	}
+}
+
+// New returns a file system that encrypts the contents of files stored in the
+// given file system. Each file is encrypted with its own random key, which
+// is stored in the file header, wrapped by a key derived from the 32-byte master key.
+// Contents are encrypted in fixed-size blocks, so that random access reads and
+// writes remain efficient.
+func New(ctx context.Context, fs vfs.FS, masterKey []byte, options ...Option) (*EncFS, error) {
+	k, err := deriveKeys(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &EncFS{
+		Context: ctx,
+		FS:      fs,
+		keys:    k,
+		layout:  layout{blockSize: DefaultBlockSize},
+	}
+
+	for _, option := range options {
+		option(e)
+	}
+
+	return e, nil
+}
+
+type EncFS struct {
+	Context      context.Context //nolint:containedctx
+	FS           vfs.FS
+	EncryptNames bool
+	keys         *keys
+	layout       layout
+}
+
+func (e *EncFS) Logger() *logrus.Entry {
+	return vfs.Logger(e.Context)
+}
+
+func (e *EncFS) encPath(path string) string {
+	if !e.EncryptNames {
+		return path
+	}
+
+	return e.keys.encryptPath(vfs.Clean(path))
+}
+
+// fileInfo reports the plaintext name and size.
+type fileInfo struct {
+	vfs.FileInfo
+	name string
+	size int64
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
+
+func (e *EncFS) wrapFileInfo(fi vfs.FileInfo, name string) vfs.FileInfo {
+	size := fi.Size()
+
+	if fi.Mode().IsRegular() {
+		size = e.layout.plainSize(size)
+	}
+
+	return &fileInfo{
+		FileInfo: fi,
+		name:     name,
+		size:     size,
+	}
+}
+
+func (e *EncFS) Stat(path string) (vfs.FileInfo, error) {
+	fi, err := e.FS.Stat(e.encPath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	name := fi.Name()
+
+	if e.EncryptNames && path != "/" {
+		name = vfs.Base(path)
+	}
+
+	return e.wrapFileInfo(fi, name), nil
+}
+
+func (e *EncFS) List(path string) (vfs.ListerAt, error) {
+	lister, err := e.FS.List(e.encPath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	defer lister.Close()
+
+	entries, err := vfs.ListAll(lister)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(vfs.FileInfoListerAt, 0, len(entries))
+
+	for _, entry := range entries {
+		name := entry.Name()
+
+		if e.EncryptNames {
+			if name, err = e.keys.decryptName(name); err != nil {
+				e.Logger().Debugf("Skipping %s in %s: %v", entry.Name(), path, err)
+
+				continue
+			}
+		}
+
+		result = append(result, e.wrapFileInfo(entry, name))
+	}
+
+	return result, nil
+}
+
+func (e *EncFS) FileRead(path string) (vfs.ReaderAt, error) {
+	encPath := e.encPath(path)
+
+	fi, err := e.FS.Stat(encPath)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := e.FS.FileRead(encPath)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := e.open(r, nil, fi.Size())
+	if err != nil {
+		return nil, multierr.Append(err, r.Close())
+	}
+
+	h.closers = append(h.closers, r)
+
+	return h, nil
+}
+
+// open reads the header of an existing file, or writes a new header if
+// the file is empty and a writer is given.
+func (e *EncFS) open(r io.ReaderAt, w io.WriterAt, cipherSize int64) (*handle, error) {
+	var fileKey []byte
+
+	if cipherSize == 0 && w == nil {
+		// Empty file without header, nothing to decrypt
+		return &handle{layout: e.layout, r: r}, nil
+	}
+
+	if cipherSize == 0 {
+		var header []byte
+
+		header, fileKey = e.keys.newHeader(e.layout.blockSize)
+
+		if _, err := w.WriteAt(header, 0); err != nil {
+			return nil, err
+		}
+	} else {
+		header := make([]byte, headerSize)
+
+		if _, err := r.ReadAt(header, 0); err != nil && (!errors.Is(err, io.EOF) || cipherSize >= headerSize) {
+			return nil, err
+		} else if err != nil {
+			return nil, ErrInvalidHeader
+		}
+
+		var err error
+
+		if fileKey, err = e.keys.openHeader(header, e.layout.blockSize); err != nil {
+			return nil, err
+		}
+	}
+
+	aead, err := newAEAD(fileKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &handle{
+		layout: e.layout,
+		aead:   aead,
+		r:      r,
+		w:      w,
+		size:   e.layout.plainSize(cipherSize),
+	}, nil
+}
+
+func (e *EncFS) FileWrite(path string, flags int) (vfs.WriterAt, error) {
+	return e.openWrite(path, flags, 0o640)
+}
+
+// openWrite opens a file for reading and writing, as partial block
+// writes need to read the existing block.
+func (e *EncFS) openWrite(path string, flags int, perm os.FileMode) (*handle, error) {
+	encPath := e.encPath(path)
+
+	// Offsets are managed by the handle
+	flags &^= os.O_APPEND
+
+	if openFileFS, ok := e.FS.(vfs.OpenFileFS); ok {
+		f, err := openFileFS.OpenFile(encPath, flags&^(os.O_WRONLY)|os.O_RDWR, perm)
+		if err == nil {
+			return e.openFile(f)
+		} else if !errors.Is(err, vfs.ErrNotSupported) {
+			return nil, err
+		}
+
+		// E.g. irodsfs only opens files for reading and writing in some paths
+	}
+
+	w, err := e.FS.FileWrite(encPath, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := e.FS.Stat(encPath)
+	if err != nil {
+		return nil, multierr.Append(err, w.Close())
+	}
+
+	rw := &readWriterAt{
+		fs:     e.FS,
+		path:   encPath,
+		flags:  flags &^ (os.O_CREATE | os.O_EXCL | os.O_TRUNC),
+		w:      w,
+		recent: map[int64][]byte{},
+	}
+
+	h, err := e.open(rw, rw, fi.Size())
+	if err != nil {
+		return nil, multierr.Append(err, rw.Close())
+	}
+
+	h.truncate = func(size int64) error {
+		// Buffered writes must not end up beyond the new size
+		if err := rw.sync(); err != nil {
+			return err
+		}
+
+		return e.FS.Truncate(encPath, size)
+	}
+
+	h.closers = append(h.closers, rw)
+
+	return h, nil
+}
+
+func (e *EncFS) openFile(f vfs.File) (*handle, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, multierr.Append(err, f.Close())
+	}
+
+	h, err := e.open(f, f, fi.Size())
+	if err != nil {
+		return nil, multierr.Append(err, f.Close())
+	}
+
+	h.truncate = f.Truncate
+	h.closers = append(h.closers, f)
+
+	return h, nil
+}
+
+// maxRecentBlocks is the number of written blocks that a readWriterAt keeps.
+var maxRecentBlocks = 16
+
+// readWriterAt reads back written blocks, for file systems that cannot open
+// a file for reading and writing at once. As the writer may buffer, reading
+// a block that was written through it is only reliable after the writer is
+// closed. The most recently written blocks are kept, which covers sequential
+// writes. Other reads after a write first sync: the writer is closed and
+// reopened, and the reader is reopened.
+type readWriterAt struct {
+	fs     vfs.FS
+	path   string
+	flags  int // To reopen the writer
+	w      vfs.WriterAt
+	r      vfs.ReaderAt
+	recent map[int64][]byte // Blocks written since the last sync, by offset
+	dirty  bool
+}
+
+func (rw *readWriterAt) WriteAt(buf []byte, offset int64) (int, error) {
+	if rw.w == nil {
+		var err error
+
+		if rw.w, err = rw.fs.FileWrite(rw.path, rw.flags); err != nil {
+			return 0, err
+		}
+	}
+
+	rw.dirty = true
+
+	n, err := rw.w.WriteAt(buf, offset)
+	if err != nil {
+		delete(rw.recent, offset)
+
+		return n, err
+	}
+
+	if len(rw.recent) >= maxRecentBlocks {
+		clear(rw.recent)
+	}
+
+	rw.recent[offset] = bytes.Clone(buf)
+
+	return n, nil
+}
+
+func (rw *readWriterAt) ReadAt(buf []byte, offset int64) (int, error) {
+	if block, ok := rw.recent[offset]; ok && len(block) == len(buf) {
+		return copy(buf, block), nil
+	}
+
+	if err := rw.sync(); err != nil {
+		return 0, err
+	}
+
+	if rw.r == nil {
+		var err error
+
+		if rw.r, err = rw.fs.FileRead(rw.path); err != nil {
+			return 0, err
+		}
+	}
+
+	return rw.r.ReadAt(buf, offset)
+}
+
+// sync closes the writer if anything was written, so that the data is
+// persisted, and drops the reader, which might have cached stale data.
+// The writer is reopened on the next write.
+func (rw *readWriterAt) sync() error {
+	if !rw.dirty {
+		return nil
+	}
+
+	var err error
+
+	if rw.w != nil {
+		err = rw.w.Close()
+		rw.w = nil
+	}
+
+	if rw.r != nil {
+		err = multierr.Append(err, rw.r.Close())
+		rw.r = nil
+	}
+
+	clear(rw.recent)
+
+	rw.dirty = false
+
+	return err
+}
+
+// Close closes the writer first, so that written data is persisted.
+func (rw *readWriterAt) Close() error {
+	var err error
+
+	if rw.w != nil {
+		err = rw.w.Close()
+	}
+
+	if rw.r != nil {
+		err = multierr.Append(err, rw.r.Close())
+	}
+
+	return err
+}
+
+func (e *EncFS) OpenFile(path string, flag int, perm os.FileMode) (vfs.File, error) {
+	if fi, err := e.Stat(path); err == nil && fi.IsDir() {
+		return vfs.Open(e, path)
+	}
+
+	var (
+		h   *handle
+		err error
+	)
+
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		var r vfs.ReaderAt
+
+		r, err = e.FileRead(path)
+		if err == nil {
+			h = r.(*handle) //nolint:forcetypeassert
+		}
+	} else {
+		h, err = e.openWrite(path, flag, perm)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &file{
+		handle: h,
+		e:      e,
+		name:   path,
+		append: flag&os.O_APPEND != 0,
+	}, nil
+}
+
+func (e *EncFS) Chmod(path string, mode os.FileMode) error {
+	return e.FS.Chmod(e.encPath(path), mode)
+}
+
+func (e *EncFS) Chown(path string, uid, gid int) error {
+	return e.FS.Chown(e.encPath(path), uid, gid)
+}
+
+func (e *EncFS) Chtimes(path string, atime, mtime time.Time) error {
+	return e.FS.Chtimes(e.encPath(path), atime, mtime)
+}
+
+func (e *EncFS) Truncate(path string, size int64) error {
+	h, err := e.openWrite(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	return multierr.Append(h.Truncate(size), h.Close())
+}
+
+func (e *EncFS) SetExtendedAttr(path, name string, value []byte) error {
+	return e.FS.SetExtendedAttr(e.encPath(path), name, value)
+}
+
+func (e *EncFS) UnsetExtendedAttr(path, name string) error {
+	return e.FS.UnsetExtendedAttr(e.encPath(path), name)
+}
+
+func (e *EncFS) SetExtendedAttrs(path string, attrs vfs.Attributes) error {
+	return vfs.SetExtendedAttrs(e.FS, e.encPath(path), attrs)
+}
+
+func (e *EncFS) Rename(oldpath, newpath string) error {
+	return e.FS.Rename(e.encPath(oldpath), e.encPath(newpath))
+}
+
+func (e *EncFS) Rmdir(path string) error {
+	return e.FS.Rmdir(e.encPath(path))
+}
+
+func (e *EncFS) Remove(path string) error {
+	return e.FS.Remove(e.encPath(path))
+}
+
+func (e *EncFS) Mkdir(path string, perm os.FileMode) error {
+	return e.FS.Mkdir(e.encPath(path), perm)
+}
+
+// Checksum computes the checksum of the plaintext.
+func (e *EncFS) Checksum(path string, algorithm crypto.Hash) ([]byte, error) {
+	return vfs.Checksum(e, path, algorithm)
+}
+
+func (e *EncFS) Close() error {
+	return e.FS.Close()
+}
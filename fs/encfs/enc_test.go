@@ -0,0 +1,290 @@
+package encfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/kuleuven/vfs"
+	"github.com/kuleuven/vfs/fs/chaosfs"
+	"github.com/kuleuven/vfs/fs/nativefs"
+)
+
+var testKey = bytes.Repeat([]byte{0x42}, KeySize)
+
+func TestEncFS(t *testing.T) {
+	fs, err := New(t.Context(), nativefs.New(t.Context(), t.TempDir()), testKey, WithBlockSize(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := fs.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	vfs.RunTestSuiteRW(t, fs)
+}
+
+func TestEncFSWithEncryptedNames(t *testing.T) {
+	fs, err := New(t.Context(), nativefs.New(t.Context(), t.TempDir()), testKey, WithBlockSize(16), WithEncryptedNames())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer fs.Close()
+
+	vfs.RunTestSuiteRW(t, fs)
+}
+
+// bufferedFS buffers all writes until the writer is closed,
+// and does not implement vfs.OpenFileFS.
+type bufferedFS struct {
+	vfs.FS
+}
+
+func (b bufferedFS) FileWrite(path string, flags int) (vfs.WriterAt, error) {
+	w, err := b.FS.FileWrite(path, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	return &bufferedWriterAt{WriterAt: w}, nil
+}
+
+type bufferedWriterAt struct {
+	vfs.WriterAt
+	writes []func() error
+}
+
+func (w *bufferedWriterAt) WriteAt(buf []byte, offset int64) (int, error) {
+	data := bytes.Clone(buf)
+
+	w.writes = append(w.writes, func() error {
+		_, err := w.WriterAt.WriteAt(data, offset)
+
+		return err
+	})
+
+	return len(buf), nil
+}
+
+func (w *bufferedWriterAt) Close() error {
+	for _, write := range w.writes {
+		if err := write(); err != nil {
+			return err
+		}
+	}
+
+	return w.WriterAt.Close()
+}
+
+// notSupportedFS refuses to open files for reading and writing.
+type notSupportedFS struct {
+	vfs.FS
+}
+
+func (notSupportedFS) OpenFile(string, int, os.FileMode) (vfs.File, error) {
+	return nil, vfs.ErrNotSupported
+}
+
+func TestRandomAccess(t *testing.T) {
+	native := nativefs.New(t.Context(), t.TempDir())
+
+	// Read back blocks that are no longer kept
+	defer func(n int) { maxRecentBlocks = n }(maxRecentBlocks)
+
+	maxRecentBlocks = 1
+
+	for name, backend := range map[string]vfs.FS{
+		"OpenFile":     native,
+		"FileWrite":    chaosfs.New(native, 1),
+		"Buffered":     bufferedFS{native},
+		"NotSupported": notSupportedFS{bufferedFS{native}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			fs, err := New(t.Context(), backend, testKey, WithBlockSize(8))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path := "/" + name
+			expected := make([]byte, 0, 64)
+
+			write := func(data string, offset int64) {
+				t.Helper()
+
+				w, err := fs.FileWrite(path, os.O_CREATE|os.O_WRONLY)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// Write in pieces, last piece first
+				for i := (len(data) - 1) / 3 * 3; i >= 0; i -= 3 {
+					piece := data[i:min(i+3, len(data))]
+
+					if _, err := w.WriteAt([]byte(piece), offset+int64(i)); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if err := w.Close(); err != nil {
+					t.Fatal(err)
+				}
+
+				if end := offset + int64(len(data)); end > int64(len(expected)) {
+					expected = append(expected, make([]byte, end-int64(len(expected)))...)
+				}
+
+				copy(expected[offset:], data)
+			}
+
+			check := func() {
+				t.Helper()
+
+				data, err := vfs.ReadFile(fs, path)
+				if err != nil || !bytes.Equal(data, expected) {
+					t.Fatalf("Expected %q, got %q, %v", expected, data, err)
+				}
+
+				fi, err := fs.Stat(path)
+				if err != nil || fi.Size() != int64(len(expected)) {
+					t.Fatalf("Expected size %d, got %v, %v", len(expected), fi, err)
+				}
+			}
+
+			write("0123456789abcdef", 0) // Two full blocks
+			check()
+			write("XY", 7) // Across a block boundary
+			check()
+			write("tail", 16) // New block after a full last block
+			check()
+			write("hole", 30) // Beyond the end, zeros in between
+			check()
+
+			if err := fs.Truncate(path, 11); err != nil {
+				t.Fatal(err)
+			}
+
+			expected = expected[:11]
+			check()
+
+			if err := fs.Truncate(path, 20); err != nil {
+				t.Fatal(err)
+			}
+
+			expected = append(expected, make([]byte, 9)...)
+			check()
+
+			// The backend does not contain the plaintext
+			raw, err := vfs.ReadFile(native, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if bytes.Contains(raw, []byte("0123456")) {
+				t.Error("Expected content to be encrypted")
+			}
+
+			if fs.layout.plainSize(int64(len(raw))) != 20 || fs.layout.cipherSize(20) != int64(len(raw)) {
+				t.Errorf("Unexpected ciphertext size %d", len(raw))
+			}
+		})
+	}
+}
+
+func TestTampering(t *testing.T) {
+	native := nativefs.New(t.Context(), t.TempDir())
+
+	fs, err := New(t.Context(), native, testKey, WithBlockSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vfs.WriteFile(fs, "/file", []byte("0123456789abcdef"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wrong master key
+	other, err := New(t.Context(), native, bytes.Repeat([]byte{1}, KeySize), WithBlockSize(8))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := other.FileRead("/file"); !errors.Is(err, ErrInvalidHeader) {
+		t.Errorf("Expected ErrInvalidHeader, got %v", err)
+	}
+
+	// Truncation at a block boundary is detected
+	if err := native.Truncate("/file", fs.layout.cipherSize(8)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := vfs.ReadFile(fs, "/file"); !errors.Is(err, ErrCorruptBlock) {
+		t.Errorf("Expected ErrCorruptBlock, got %v", err)
+	}
+
+	if _, err := New(t.Context(), native, testKey[:16]); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Expected ErrInvalidKey, got %v", err)
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	native := nativefs.New(t.Context(), t.TempDir())
+
+	fs, err := New(t.Context(), native, testKey, WithBlockSize(8), WithEncryptedNames())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Mkdir("/dir", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.OpenFile("/dir/file.txt", os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"hello ", "world"} {
+		if _, err := f.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := f.Seek(6, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 10)
+
+	if n, err := f.Read(buf); err != nil || string(buf[:n]) != "world" {
+		t.Errorf("Expected 'world', got %q, %v", buf[:n], err)
+	}
+
+	if err := f.Truncate(5); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := vfs.ReadFile(fs, "/dir/file.txt"); err != nil || string(data) != "hello" {
+		t.Errorf("Expected 'hello', got %q, %v", data, err)
+	}
+
+	// Names are encrypted in the backend
+	entries, err := vfs.ReadDir(native, "/")
+	if err != nil || len(entries) != 1 || entries[0].Name() == "dir" {
+		t.Errorf("Expected an encrypted name, got %v, %v", entries, err)
+	}
+
+	entries, err = vfs.ReadDir(fs, "/dir")
+	if err != nil || len(entries) != 1 || entries[0].Name() != "file.txt" || entries[0].Size() != 5 {
+		t.Errorf("Expected file.txt of 5 bytes, got %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,297 @@
+package encfs
+
+import (
+	"crypto/cipher"
+	"errors"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/kuleuven/vfs"
+	"go.uber.org/multierr"
+)
+
+// handle gives random access to the plaintext of an encrypted file.
+// Partial block writes read, decrypt and re-encrypt the affected block.
+type handle struct {
+	layout
+	aead     cipher.AEAD
+	r        io.ReaderAt
+	w        io.WriterAt
+	truncate func(int64) error
+	size     int64
+	closers  []io.Closer
+	sync.Mutex
+}
+
+var ErrReadOnly = errors.New("file not opened for writing")
+
+// readBlock returns the plaintext of the block with the given index.
+func (h *handle) readBlock(index int64) ([]byte, error) {
+	length := h.blockLength(index, h.size)
+	buf := make([]byte, length+BlockOverhead)
+
+	n, err := h.r.ReadAt(buf, h.blockOffset(index))
+	if errors.Is(err, io.EOF) && n < len(buf) {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	return openBlock(h.aead, index, index == h.lastBlock(h.size), buf)
+}
+
+func (h *handle) writeBlock(index int64, last bool, plaintext []byte) error {
+	_, err := h.w.WriteAt(sealBlock(h.aead, index, last, plaintext), h.blockOffset(index))
+
+	return err
+}
+
+func (h *handle) ReadAt(buf []byte, offset int64) (int, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	if offset >= h.size {
+		return 0, io.EOF
+	}
+
+	var n int
+
+	for n < len(buf) && offset < h.size {
+		index := offset / h.blockSize
+
+		block, err := h.readBlock(index)
+		if err != nil {
+			return n, err
+		}
+
+		m := copy(buf[n:], block[offset-index*h.blockSize:])
+
+		n += m
+		offset += int64(m)
+	}
+
+	if n < len(buf) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (h *handle) WriteAt(buf []byte, offset int64) (int, error) {
+	if h.w == nil {
+		return 0, ErrReadOnly
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	// Fill the gap between the current end of the file and the offset with zeros
+	if err := h.extend(offset); err != nil {
+		return 0, err
+	}
+
+	if err := h.writeAt(buf, offset); err != nil {
+		return 0, err
+	}
+
+	return len(buf), nil
+}
+
+// writeAt writes the given data, at an offset that is not beyond the end of the file.
+func (h *handle) writeAt(data []byte, offset int64) error {
+	end := offset + int64(len(data))
+	newSize := max(h.size, end)
+
+	// If the data starts a new block after a full last block, the latter is no longer the last block
+	if offset == h.size && h.size > 0 && h.size%h.blockSize == 0 && end > h.size {
+		index := h.lastBlock(h.size)
+
+		block, err := h.readBlock(index)
+		if err != nil {
+			return err
+		}
+
+		if err := h.writeBlock(index, false, block); err != nil {
+			return err
+		}
+	}
+
+	for index := offset / h.blockSize; index*h.blockSize < end; index++ {
+		start := index * h.blockSize
+
+		var (
+			block []byte
+			err   error
+		)
+
+		// Read-modify-write of existing blocks
+		if start < h.size {
+			block, err = h.readBlock(index)
+			if err != nil {
+				return err
+			}
+		}
+
+		if length := h.blockLength(index, newSize); int64(len(block)) < length {
+			block = append(block, make([]byte, length-int64(len(block)))...)
+		}
+
+		from, to := max(offset, start), min(end, start+h.blockSize)
+
+		copy(block[from-start:to-start], data[from-offset:to-offset])
+
+		if err := h.writeBlock(index, index == h.lastBlock(newSize), block); err != nil {
+			return err
+		}
+	}
+
+	h.size = newSize
+
+	return nil
+}
+
+// extend grows the file with zeros up to the given size.
+func (h *handle) extend(size int64) error {
+	var zeros []byte
+
+	for h.size < size {
+		if zeros == nil {
+			zeros = make([]byte, h.blockSize)
+		}
+
+		n := min(h.blockSize-h.size%h.blockSize, size-h.size)
+
+		if err := h.writeAt(zeros[:n], h.size); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *handle) Truncate(size int64) error {
+	if h.w == nil {
+		return ErrReadOnly
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	if size >= h.size {
+		return h.extend(size)
+	}
+
+	if size > 0 {
+		index := h.lastBlock(size)
+
+		block, err := h.readBlock(index)
+		if err != nil {
+			return err
+		}
+
+		if err := h.writeBlock(index, true, block[:h.blockLength(index, size)]); err != nil {
+			return err
+		}
+	}
+
+	if err := h.truncate(h.cipherSize(size)); err != nil {
+		return err
+	}
+
+	h.size = size
+
+	return nil
+}
+
+func (h *handle) Size() int64 {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.size
+}
+
+func (h *handle) Close() error {
+	var err error
+
+	for _, closer := range h.closers {
+		err = multierr.Append(err, closer.Close())
+	}
+
+	return err
+}
+
+// file implements vfs.File on top of a handle.
+type file struct {
+	*handle
+	e      *EncFS
+	name   string
+	offset int64
+	append bool
+	sync.Mutex
+}
+
+func (f *file) Name() string {
+	return f.name
+}
+
+func (f *file) Stat() (vfs.FileInfo, error) {
+	return f.e.Stat(f.name)
+}
+
+func (f *file) Readdir(int) ([]vfs.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdir", Path: f.name, Err: vfs.ErrNotSupported}
+}
+
+func (f *file) Read(buf []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	n, err := f.ReadAt(buf, f.offset)
+
+	f.offset += int64(n)
+
+	if errors.Is(err, io.EOF) && n > 0 {
+		return n, nil
+	}
+
+	return n, err
+}
+
+func (f *file) Write(buf []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.append {
+		f.offset = f.Size()
+	}
+
+	n, err := f.WriteAt(buf, f.offset)
+
+	f.offset += int64(n)
+
+	return n, err
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.Size()
+	default:
+		return 0, os.ErrInvalid
+	}
+
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+
+	f.offset = offset
+
+	return offset, nil
+}
@@ -0,0 +1,145 @@
+package encfs
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// An encrypted file consists of a header, followed by the encrypted blocks.
+// The header contains a magic value, the plaintext block size and the file
+// key, wrapped by the master key. Each block is sealed with AES-GCM under
+// the file key with a random nonce, and authenticates its index and whether
+// it is the last block, so that blocks cannot be reordered and the file
+// cannot be truncated at a block boundary unnoticed.
+//
+//	header: magic (8) | block size (4) | nonce (12) | wrapped file key (32 + 16)
+//	block:  nonce (12) | ciphertext (up to block size) | tag (16)
+const (
+	nonceSize     = 12
+	tagSize       = 16
+	headerSize    = 8 + 4 + nonceSize + KeySize + tagSize
+	BlockOverhead = nonceSize + tagSize
+)
+
+var magic = []byte("VFSENC01")
+
+var (
+	ErrInvalidHeader = errors.New("invalid encrypted file header")
+	ErrCorruptBlock  = errors.New("corrupt encrypted block")
+)
+
+// layout converts between plaintext and ciphertext offsets.
+type layout struct {
+	blockSize int64
+}
+
+func (l layout) cipherBlockSize() int64 {
+	return l.blockSize + BlockOverhead
+}
+
+// plainSize returns the plaintext size of a file with the given ciphertext size.
+func (l layout) plainSize(cipherSize int64) int64 {
+	if cipherSize <= headerSize {
+		return 0
+	}
+
+	rem := cipherSize - headerSize
+	full := rem / l.cipherBlockSize()
+	last := rem % l.cipherBlockSize()
+
+	return full*l.blockSize + max(last-BlockOverhead, 0)
+}
+
+// cipherSize returns the ciphertext size of a file with the given plaintext size.
+func (l layout) cipherSize(plainSize int64) int64 {
+	full := plainSize / l.blockSize
+	last := plainSize % l.blockSize
+
+	size := headerSize + full*l.cipherBlockSize()
+
+	if last > 0 {
+		size += last + BlockOverhead
+	}
+
+	return size
+}
+
+// blockOffset returns the ciphertext offset of the block with the given index.
+func (l layout) blockOffset(index int64) int64 {
+	return headerSize + index*l.cipherBlockSize()
+}
+
+// blockLength returns the plaintext length of the block with the given index
+// in a file with the given plaintext size.
+func (l layout) blockLength(index, size int64) int64 {
+	return min(l.blockSize, max(size-index*l.blockSize, 0))
+}
+
+// lastBlock returns the index of the last block of a file with the given
+// plaintext size, or -1 if the file is empty.
+func (l layout) lastBlock(size int64) int64 {
+	return (size+l.blockSize-1)/l.blockSize - 1
+}
+
+func (k *keys) newHeader(blockSize int64) ([]byte, []byte) {
+	fileKey := randomBytes(KeySize)
+
+	header := make([]byte, 0, headerSize)
+	header = append(header, magic...)
+	header = binary.BigEndian.AppendUint32(header, uint32(blockSize)) //nolint:gosec
+
+	nonce := randomBytes(nonceSize)
+	header = append(header, nonce...)
+	header = k.wrap.Seal(header, nonce, fileKey, header[:12])
+
+	return header, fileKey
+}
+
+func (k *keys) openHeader(header []byte, blockSize int64) ([]byte, error) {
+	if len(header) != headerSize || !bytes.Equal(header[:8], magic) {
+		return nil, ErrInvalidHeader
+	}
+
+	if bs := int64(binary.BigEndian.Uint32(header[8:12])); bs != blockSize {
+		return nil, fmt.Errorf("%w: block size %d, expected %d", ErrInvalidHeader, bs, blockSize)
+	}
+
+	fileKey, err := k.wrap.Open(nil, header[12:12+nonceSize], header[12+nonceSize:], header[:12])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidHeader, err)
+	}
+
+	return fileKey, nil
+}
+
+func blockData(index int64, last bool) []byte {
+	ad := binary.BigEndian.AppendUint64(nil, uint64(index)) //nolint:gosec
+
+	if last {
+		return append(ad, 1)
+	}
+
+	return append(ad, 0)
+}
+
+func sealBlock(aead cipher.AEAD, index int64, last bool, plaintext []byte) []byte {
+	nonce := randomBytes(nonceSize)
+
+	return aead.Seal(nonce, nonce, plaintext, blockData(index, last))
+}
+
+func openBlock(aead cipher.AEAD, index int64, last bool, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < BlockOverhead {
+		return nil, ErrCorruptBlock
+	}
+
+	plaintext, err := aead.Open(nil, ciphertext[:nonceSize], ciphertext[nonceSize:], blockData(index, last))
+	if err != nil {
+		return nil, fmt.Errorf("%w %d: %w", ErrCorruptBlock, index, err)
+	}
+
+	return plaintext, nil
+}
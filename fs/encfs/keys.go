@@ -0,0 +1,133 @@
+package encfs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+const KeySize = 32
+
+var (
+	ErrInvalidKey  = errors.New("master key must be 32 bytes")
+	ErrInvalidName = errors.New("invalid encrypted name")
+)
+
+// keys holds the keys derived from the master key.
+type keys struct {
+	wrap  cipher.AEAD // Wraps the per-file keys
+	names cipher.AEAD // Encrypts names
+	mac   []byte      // Derives the nonces of encrypted names
+}
+
+func deriveKeys(master []byte) (*keys, error) {
+	if len(master) != KeySize {
+		return nil, ErrInvalidKey
+	}
+
+	wrapKey, err := hkdf.Key(sha256.New, master, nil, "vfs encfs file key wrapping", KeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	nameKey, err := hkdf.Key(sha256.New, master, nil, "vfs encfs name encryption", KeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	macKey, err := hkdf.Key(sha256.New, master, nil, "vfs encfs name nonces", KeySize)
+	if err != nil {
+		return nil, err
+	}
+
+	wrap, err := newAEAD(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := newAEAD(nameKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &keys{
+		wrap:  wrap,
+		names: names,
+		mac:   macKey,
+	}, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func randomBytes(n int) []byte {
+	buf := make([]byte, n)
+
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+
+	return buf
+}
+
+// encryptName encrypts a single path component deterministically, so that
+// lookups by name keep working. The nonce is derived from the name itself,
+// which only reveals whether two names are equal.
+func (k *keys) encryptName(name string) string {
+	if name == "." || name == ".." {
+		return name
+	}
+
+	mac := hmac.New(sha256.New, k.mac)
+
+	mac.Write([]byte(name))
+
+	nonce := mac.Sum(nil)[:k.names.NonceSize()]
+
+	return base64.RawURLEncoding.EncodeToString(k.names.Seal(nonce, nonce, []byte(name), nil))
+}
+
+func (k *keys) decryptName(encrypted string) (string, error) {
+	if encrypted == "." || encrypted == ".." {
+		return encrypted, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(encrypted)
+	if err != nil || len(data) < k.names.NonceSize() {
+		return "", ErrInvalidName
+	}
+
+	name, err := k.names.Open(nil, data[:k.names.NonceSize()], data[k.names.NonceSize():], nil)
+	if err != nil {
+		return "", ErrInvalidName
+	}
+
+	return string(name), nil
+}
+
+// encryptPath encrypts all components of the given absolute path.
+func (k *keys) encryptPath(path string) string {
+	if path == "/" || path == "" {
+		return path
+	}
+
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+
+	for i, part := range parts {
+		parts[i] = k.encryptName(part)
+	}
+
+	return "/" + strings.Join(parts, "/")
+}
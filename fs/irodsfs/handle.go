@@ -9,6 +9,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/kuleuven/iron"
 	"github.com/kuleuven/iron/api"
 	"github.com/kuleuven/vfs"
 )
@@ -61,6 +62,38 @@ func (fs *IRODS) openFile(name string, flags int) (*IRODSFileHandle, error) {
 	return fileHandle, nil
 }
 
+// reopen opens another handle to the same data object, using another
+// connection from the pool, e.g. to write chunks in parallel. It does not
+// wait for a connection, as the connections might all be held by open
+// handles, but returns iron.ErrNoConnectionsAvailable if none is available.
+// The returned handle must be closed before this one.
+func (handle *IRODSFileHandle) reopen() (*IRODSFileHandle, error) {
+	conns, err := handle.fs.Client.ConnectAvailable(handle.fs.Context, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(conns) == 0 {
+		return nil, iron.ErrNoConnectionsAvailable
+	}
+
+	// The data object exists by now, and must not be truncated again
+	mode := handle.mode &^ (os.O_CREATE | os.O_EXCL | os.O_TRUNC | os.O_APPEND)
+
+	// Reopen takes ownership of the connection
+	reopened, err := handle.handle.Reopen(conns[0], mode)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IRODSFileHandle{
+		fs:         handle.fs,
+		handle:     reopened,
+		mode:       mode,
+		dataobject: handle.dataobject,
+	}, nil
+}
+
 // IRODSFileHandle is a handle for a file opened
 type IRODSFileHandle struct {
 	fs           *IRODS
@@ -25,6 +25,8 @@ var _ vfs.OpenFileFS = &IRODS{}
 
 var _ vfs.HandleResolveFS = &IRODS{}
 
+var _ vfs.CopyFileFS = &IRODS{}
+
 type IRODS struct {
 	vfs.NotImplementedFS
 
@@ -32,6 +34,9 @@ type IRODS struct {
 	Context              context.Context //nolint:containedctx
 	ChunkSize            int
 	MaxChunks            int
+	MaxInFlight          int
+	WriteStreams         int
+	Pool                 *buffered.Pool // Shared by the buffers of all open files
 	OpenFileAllowedPaths []string
 
 	openFiles  []*IRODSFileHandle
@@ -42,6 +47,10 @@ type IRODS struct {
 
 var OpenFileAllowedPaths vfs.ContextKey = "open-file-allowed-paths"
 
+// BufferPool is the context key for a *buffered.Pool that limits the memory
+// used by the buffers of open files, shared by all IRODS instances using it.
+var BufferPool vfs.ContextKey = "buffer-pool"
+
 type Option func(*IRODS)
 
 func WithChunkSize(chunkSize int) Option {
@@ -56,6 +65,36 @@ func WithMaxChunks(maxChunks int) Option {
 	}
 }
 
+func WithMaxInFlight(maxInFlight int) Option {
+	return func(fs *IRODS) {
+		fs.MaxInFlight = maxInFlight
+	}
+}
+
+// WithWriteStreams sets the number of chunks that FileWrite uploads in
+// parallel, each over its own connection. FileWrite does not wait for
+// connections, and uses fewer streams if the client has none available.
+func WithWriteStreams(writeStreams int) Option {
+	return func(fs *IRODS) {
+		fs.WriteStreams = writeStreams
+	}
+}
+
+// WithPool sets the pool for the buffers of open files.
+func WithPool(pool *buffered.Pool) Option {
+	return func(fs *IRODS) {
+		fs.Pool = pool
+	}
+}
+
+// WithMemoryBudget limits the memory used by the buffers of open files
+// to the given number of bytes, using a pool for this instance.
+func WithMemoryBudget(budget int64) Option {
+	return func(fs *IRODS) {
+		fs.Pool = buffered.NewPool(budget)
+	}
+}
+
 func WithOpenFileAllowedPaths(openFileAllowedPaths []string) Option {
 	return func(fs *IRODS) {
 		fs.OpenFileAllowedPaths = openFileAllowedPaths
@@ -68,10 +107,12 @@ func WithOpenFileAllowedPaths(openFileAllowedPaths []string) Option {
 // zone configured in the iRODS client.
 func New(ctx context.Context, zone string, client *iron.Client, options ...Option) *IRODS {
 	fs := &IRODS{
-		Context:   ctx,
-		ChunkSize: DefaultChunkSize,
-		MaxChunks: DefaultMaxChunks,
-		Client:    client,
+		Context:      ctx,
+		ChunkSize:    DefaultChunkSize,
+		MaxChunks:    DefaultMaxChunks,
+		MaxInFlight:  DefaultMaxInFlight,
+		WriteStreams: DefaultWriteStreams,
+		Client:       client,
 	}
 
 	// Ensure zone is always set
@@ -82,6 +123,10 @@ func New(ctx context.Context, zone string, client *iron.Client, options ...Optio
 		fs.OpenFileAllowedPaths = v
 	}
 
+	if v, ok := ctx.Value(BufferPool).(*buffered.Pool); ok {
+		fs.Pool = v
+	}
+
 	// From options
 	for _, option := range options {
 		option(fs)
@@ -134,6 +179,15 @@ func (fs *IRODS) Groups() ([]string, error) {
 var (
 	DefaultChunkSize = 32768 * 32 * 32 // 32MB
 	DefaultMaxChunks = 2
+
+	// DefaultMaxInFlight is the number of chunks that are prefetched
+	// in parallel for sequential reads by FileRead.
+	DefaultMaxInFlight = 2
+
+	// DefaultWriteStreams is the number of chunks that are uploaded
+	// in parallel by FileWrite. Streams beyond the first one are only
+	// opened if the client has a connection available.
+	DefaultWriteStreams = 4
 )
 
 func (fs *IRODS) FileRead(path string) (vfs.ReaderAt, error) {
@@ -142,13 +196,12 @@ func (fs *IRODS) FileRead(path string) (vfs.ReaderAt, error) {
 		return handle, err
 	}
 
-	return &buffered.BufferedReaderAt{
-		ReaderAt: &buffered.BackgroundReader{
-			ReaderAt:  handle,
-			ChunkSize: fs.ChunkSize,
-		},
-		ChunkSize: fs.ChunkSize,
-		MaxChunks: fs.MaxChunks,
+	return &buffered.AdaptiveReaderAt{
+		ReaderAt:    handle,
+		ChunkSize:   fs.ChunkSize,
+		MaxChunks:   fs.MaxChunks,
+		MaxInFlight: fs.MaxInFlight,
+		Pool:        fs.Pool,
 	}, nil
 }
 
@@ -158,16 +211,51 @@ func (fs *IRODS) FileWrite(path string, flag int) (vfs.WriterAt, error) {
 		return handle, err
 	}
 
-	return &buffered.BufferedWriterAt{
-		WriterAt: &buffered.BackgroundWriter{
-			WriterAt:  handle,
+	var writer io.WriterAt = &buffered.BackgroundWriter{
+		WriterAt:  handle,
+		ChunkSize: fs.ChunkSize,
+		Pool:      fs.Pool,
+	}
+
+	if fs.WriteStreams > 1 {
+		writer = &buffered.ParallelWriter{
+			WriterAt: handle,
+			NewWriterAt: func() (io.WriterAt, error) {
+				return handle.reopen()
+			},
 			ChunkSize: fs.ChunkSize,
-		},
+			Streams:   fs.WriteStreams,
+			Pool:      fs.Pool,
+		}
+	}
+
+	return &buffered.BufferedWriterAt{
+		WriterAt:  writer,
 		ChunkSize: fs.ChunkSize,
 		MaxChunks: fs.MaxChunks,
+		Pool:      fs.Pool,
 	}, nil
 }
 
+// CopyFile copies a data object on the server. iRODS cannot copy onto an
+// existing data object, so vfs.ErrNotSupported is returned if dst exists.
+func (fs *IRODS) CopyFile(src, dst string, flags int) error {
+	_, err := fs.Client.GetDataObject(fs.Context, dst)
+	if err == nil && flags&os.O_EXCL != 0 {
+		return syscall.EEXIST
+	} else if err == nil {
+		return vfs.ErrNotSupported
+	} else if !errors.Is(err, api.ErrNoRowFound) {
+		return err
+	}
+
+	if flags&os.O_CREATE == 0 {
+		return os.ErrNotExist
+	}
+
+	return fs.Client.CopyDataObject(fs.Context, src, dst)
+}
+
 func (fs *IRODS) OpenFile(path string, flag int, perm os.FileMode) (vfs.File, error) {
 	// Check whether the OpenFile operation is enabled.
 	if flag&os.O_RDWR != 0 {
@@ -195,11 +283,13 @@ func (fs *IRODS) OpenFile(path string, flag int, perm os.FileMode) (vfs.File, er
 			ReaderAt:  handle,
 			ChunkSize: fs.ChunkSize,
 			MaxChunks: fs.MaxChunks,
+			Pool:      fs.Pool,
 		},
 		writerAt: &buffered.BufferedWriterAt{
 			WriterAt:  handle,
 			ChunkSize: fs.ChunkSize,
 			MaxChunks: fs.MaxChunks,
+			Pool:      fs.Pool,
 		},
 	}, nil
 }
@@ -321,6 +411,9 @@ func (f *FileBufferedAt) Close() error {
 	f.Lock()
 	defer f.Unlock()
 
+	// Return the read buffers to the pool, the file is closed by the writer
+	f.readerAt.Invalidate(0, -1)
+
 	return f.writerAt.Close()
 }
 
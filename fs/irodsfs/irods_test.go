@@ -1,11 +1,14 @@
 package irodsfs_test
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
 	"net"
+	"os"
 	"testing"
+	"time"
 
 	"gitea.icts.kuleuven.be/coz/cobalt"
 	"github.com/kuleuven/iron"
@@ -93,3 +96,71 @@ func TestIrodsFS(t *testing.T) {
 
 	vfs.RunTestSuiteRW(t, testfs)
 }
+
+func TestIrodsParallelWrite(t *testing.T) {
+	port := runServer(t.Context(), t.TempDir())
+
+	data := make([]byte, 100)
+
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	// With a single connection, the handle cannot be reopened,
+	// and all chunks are written through the first handle
+	for _, maxConns := range []int{1, 4} {
+		client, err := iron.New(t.Context(), iron.Env{
+			Host:            "localhost",
+			Port:            port,
+			Username:        "admin",
+			Password:        "test",
+			Zone:            "cobalt",
+			SSLVerifyServer: "none",
+		}, iron.Option{
+			ClientName: "test-irods-fs",
+			MaxConns:   maxConns,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		testfs := irodsfs.New(t.Context(), "cobalt", client,
+			irodsfs.WithChunkSize(11),
+			irodsfs.WithWriteStreams(4),
+		)
+
+		w, err := testfs.FileWrite("/parallel.txt", os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for off := 0; off < len(data); off += 10 {
+			if _, err := w.WriteAt(data[off:off+10], int64(off)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		done := make(chan error)
+
+		go func() {
+			done <- w.Close()
+		}()
+
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%d connections: expected Close not to wait for a connection", maxConns)
+		}
+
+		if read, err := vfs.ReadFile(testfs, "/parallel.txt"); err != nil || !bytes.Equal(read, data) {
+			t.Fatalf("%d connections: expected the written data, got %v (%v)", maxConns, read, err)
+		}
+
+		if err := testfs.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package irodsfs
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/kuleuven/iron/api"
+	"github.com/kuleuven/vfs"
+)
+
+var _ vfs.LockFS = &IRODS{}
+
+// Locks are stored as metadata on the data object, so that they are visible
+// to all clients of the zone. As iRODS cannot update metadata conditionally,
+// a lock is verified after it has been stored, and withdrawn if a conflicting
+// lock of another owner was stored concurrently.
+// Replicas that are open for writing are treated as an exclusive lock.
+const metaLock = "vfs::lock"
+
+// replicaLock represents a replica that is being written by another client.
+var replicaLock = vfs.HeldLock{Lock: vfs.Lock{Type: vfs.LockExclusive}}
+
+func (fs *IRODS) AcquireLock(path string, lock vfs.Lock) error {
+	meta, set, err := fs.locks(path)
+	if err != nil {
+		return err
+	}
+
+	updated, err := set.Acquire(lock, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if err := fs.storeLocks(path, meta, updated); err != nil {
+		return err
+	}
+
+	// Verify that no conflicting lock was stored in the meantime
+	if _, set, err = fs.locks(path); err != nil {
+		return err
+	}
+
+	if _, ok := set.Conflict(lock); !ok {
+		return nil
+	}
+
+	if err := fs.ReleaseLock(path, lock); err != nil {
+		vfs.Logger(fs.Context).Warnf("Could not withdraw conflicting lock on %s: %v", path, err)
+	}
+
+	return vfs.ErrLocked
+}
+
+func (fs *IRODS) ReleaseLock(path string, lock vfs.Lock) error {
+	meta, set, err := fs.locks(path)
+	if err != nil {
+		return err
+	}
+
+	return fs.storeLocks(path, meta, set.Release(lock))
+}
+
+func (fs *IRODS) TestLock(path string, lock vfs.Lock) error {
+	_, set, err := fs.locks(path)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := set.Conflict(lock); ok {
+		return vfs.ErrLocked
+	}
+
+	return nil
+}
+
+// locks returns the lock metadata of the data object, and the locks that have not expired,
+// including a lock for replicas that are being written.
+func (fs *IRODS) locks(path string) ([]api.Metadata, vfs.LockSet, error) {
+	obj, err := fs.Client.GetDataObject(fs.Context, path)
+	if err != nil {
+		return nil, nil, notExistError(err)
+	}
+
+	meta, err := fs.Client.ListMetadata(fs.Context, path, api.DataObjectType)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		lockMeta []api.Metadata
+		set      vfs.LockSet
+	)
+
+	for _, m := range meta {
+		if m.Name != metaLock {
+			continue
+		}
+
+		lockMeta = append(lockMeta, m)
+
+		var h vfs.HeldLock
+
+		if err := json.Unmarshal([]byte(m.Value), &h); err != nil {
+			vfs.Logger(fs.Context).Warnf("Ignoring invalid lock on %s: %v", path, err)
+
+			continue
+		}
+
+		set = append(set, h)
+	}
+
+	set, _ = set.Expire(time.Now())
+
+	if isBeingWritten(obj) {
+		set = append(set, replicaLock)
+	}
+
+	return lockMeta, set, nil
+}
+
+// Replica statuses of replicas that are being written. Stale replicas,
+// and replicas that are only being read, do not conflict with locks.
+const (
+	replicaIntermediate = "2"
+	replicaWriteLocked  = "4"
+)
+
+// isBeingWritten returns whether a replica of the data object is being written.
+func isBeingWritten(obj *api.DataObject) bool {
+	for _, replica := range obj.Replicas {
+		if replica.Status == replicaIntermediate || replica.Status == replicaWriteLocked {
+			return true
+		}
+	}
+
+	return false
+}
+
+// storeLocks replaces the lock metadata by the given locks.
+func (fs *IRODS) storeLocks(path string, current []api.Metadata, set vfs.LockSet) error {
+	keep := map[string]bool{}
+
+	var add, remove []api.Metadata
+
+	for _, h := range set {
+		if h == replicaLock {
+			continue
+		}
+
+		value, err := json.Marshal(h)
+		if err != nil {
+			return err
+		}
+
+		keep[string(value)] = true
+	}
+
+	for _, m := range current {
+		if keep[m.Value] {
+			delete(keep, m.Value)
+		} else {
+			remove = append(remove, m)
+		}
+	}
+
+	for value := range keep {
+		add = append(add, api.Metadata{Name: metaLock, Value: value})
+	}
+
+	if len(add) == 0 && len(remove) == 0 {
+		return nil
+	}
+
+	return fs.Client.ModifyMetadata(fs.Context, path, api.DataObjectType, add, remove)
+}
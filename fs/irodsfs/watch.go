@@ -0,0 +1,11 @@
+package irodsfs
+
+import "github.com/kuleuven/vfs"
+
+var _ vfs.WatchFS = &IRODS{}
+
+// Watch reports changes by polling the catalog. Changes to metadata are
+// only reported if the context has ListWithXattrs set.
+func (fs *IRODS) Watch(path string, recursive bool) (vfs.Watcher, error) {
+	return vfs.PollWatch(fs.Context, fs, path, recursive)
+}
@@ -0,0 +1,245 @@
+package lockfs
+
+import (
+	"context"
+	"crypto/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kuleuven/vfs"
+	"github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+var _ vfs.LockFS = &LockFS{}
+
+type Option func(*LockFS)
+
+// WithOwner sets the owner of the locks acquired through the file system.
+// Defaults to a random string.
+func WithOwner(owner string) Option {
+	return func(fs *LockFS) {
+		fs.Owner = owner
+	}
+}
+
+// WithManager sets the lock manager that keeps the locks if the wrapped
+// file system does not support locking. Sessions that need to see each
+// other's locks should share the same manager.
+func WithManager(manager *vfs.LockManager) Option {
+	return func(fs *LockFS) {
+		fs.Manager = manager
+	}
+}
+
+// New returns a file system that enforces byte-range locks: writes and
+// truncations through it fail with vfs.ErrLocked if they overlap a lock of
+// another owner. Locks are kept by the wrapped file system if it implements
+// vfs.LockFS, and otherwise by the lock manager.
+// All locks of the owner are released when the file system is closed.
+func New(ctx context.Context, fs vfs.FS, options ...Option) *LockFS {
+	l := &LockFS{
+		Context: ctx,
+		FS:      fs,
+		Owner:   rand.Text(),
+		held:    map[string]bool{},
+	}
+
+	for _, option := range options {
+		option(l)
+	}
+
+	if l.Manager == nil {
+		l.Manager = vfs.NewLockManager()
+	}
+
+	return l
+}
+
+type LockFS struct {
+	Context context.Context //nolint:containedctx
+	FS      vfs.FS
+	Owner   string
+	Manager *vfs.LockManager
+	held    map[string]bool // Paths on which locks were acquired
+	sync.Mutex
+}
+
+func (l *LockFS) Logger() *logrus.Entry {
+	return vfs.Logger(l.Context)
+}
+
+// locker is implemented by both vfs.LockFS and vfs.LockManager.
+type locker interface {
+	AcquireLock(path string, lock vfs.Lock) error
+	ReleaseLock(path string, lock vfs.Lock) error
+	TestLock(path string, lock vfs.Lock) error
+}
+
+// locks returns the file system that keeps the locks.
+func (l *LockFS) locks() locker {
+	if lockFS, ok := l.FS.(vfs.LockFS); ok {
+		return lockFS
+	}
+
+	return l.Manager
+}
+
+func (l *LockFS) own(lock vfs.Lock) vfs.Lock {
+	if lock.Owner == "" {
+		lock.Owner = l.Owner
+	}
+
+	return lock
+}
+
+// AcquireLock acquires a lock. If the owner of the lock is empty,
+// the owner of the file system is used.
+func (l *LockFS) AcquireLock(path string, lock vfs.Lock) error {
+	lock = l.own(lock)
+
+	if err := l.locks().AcquireLock(path, lock); err != nil {
+		return err
+	}
+
+	if lock.Owner == l.Owner {
+		l.Lock()
+		l.held[vfs.Clean(path)] = true
+		l.Unlock()
+	}
+
+	return nil
+}
+
+func (l *LockFS) ReleaseLock(path string, lock vfs.Lock) error {
+	return l.locks().ReleaseLock(path, l.own(lock))
+}
+
+func (l *LockFS) TestLock(path string, lock vfs.Lock) error {
+	return l.locks().TestLock(path, l.own(lock))
+}
+
+// check returns vfs.ErrLocked if the range is locked by another owner.
+func (l *LockFS) check(path string, offset, length int64) error {
+	err := l.TestLock(path, vfs.Lock{
+		Type:   vfs.LockExclusive,
+		Offset: offset,
+		Length: length,
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (l *LockFS) Stat(path string) (vfs.FileInfo, error) {
+	return l.FS.Stat(path)
+}
+
+func (l *LockFS) List(path string) (vfs.ListerAt, error) {
+	return l.FS.List(path)
+}
+
+func (l *LockFS) FileRead(path string) (vfs.ReaderAt, error) {
+	return l.FS.FileRead(path)
+}
+
+func (l *LockFS) FileWrite(path string, flags int) (vfs.WriterAt, error) {
+	if flags&os.O_TRUNC != 0 {
+		if err := l.check(path, 0, 0); err != nil {
+			return nil, &os.PathError{Op: "open", Path: path, Err: err}
+		}
+	}
+
+	w, err := l.FS.FileWrite(path, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	return &writer{WriterAt: w, l: l, path: path}, nil
+}
+
+// writer checks for locks of other owners before each write.
+type writer struct {
+	vfs.WriterAt
+	l    *LockFS
+	path string
+}
+
+func (w *writer) WriteAt(buf []byte, offset int64) (int, error) {
+	if len(buf) > 0 {
+		if err := w.l.check(w.path, offset, int64(len(buf))); err != nil {
+			return 0, &os.PathError{Op: "write", Path: w.path, Err: err}
+		}
+	}
+
+	return w.WriterAt.WriteAt(buf, offset)
+}
+
+func (l *LockFS) Chmod(path string, mode os.FileMode) error {
+	return l.FS.Chmod(path, mode)
+}
+
+func (l *LockFS) Chown(path string, uid, gid int) error {
+	return l.FS.Chown(path, uid, gid)
+}
+
+func (l *LockFS) Chtimes(path string, atime, mtime time.Time) error {
+	return l.FS.Chtimes(path, atime, mtime)
+}
+
+func (l *LockFS) Truncate(path string, size int64) error {
+	if err := l.check(path, size, 0); err != nil {
+		return &os.PathError{Op: "truncate", Path: path, Err: err}
+	}
+
+	return l.FS.Truncate(path, size)
+}
+
+func (l *LockFS) SetExtendedAttr(path, name string, value []byte) error {
+	return l.FS.SetExtendedAttr(path, name, value)
+}
+
+func (l *LockFS) UnsetExtendedAttr(path, name string) error {
+	return l.FS.UnsetExtendedAttr(path, name)
+}
+
+func (l *LockFS) SetExtendedAttrs(path string, attrs vfs.Attributes) error {
+	return vfs.SetExtendedAttrs(l.FS, path, attrs)
+}
+
+func (l *LockFS) Rename(oldpath, newpath string) error {
+	return l.FS.Rename(oldpath, newpath)
+}
+
+func (l *LockFS) Rmdir(path string) error {
+	return l.FS.Rmdir(path)
+}
+
+func (l *LockFS) Remove(path string) error {
+	return l.FS.Remove(path)
+}
+
+func (l *LockFS) Mkdir(path string, perm os.FileMode) error {
+	return l.FS.Mkdir(path, perm)
+}
+
+// Close releases all locks of the owner, and closes the wrapped file system.
+func (l *LockFS) Close() error {
+	l.Lock()
+	defer l.Unlock()
+
+	var err error
+
+	for path := range l.held {
+		if releaseErr := l.locks().ReleaseLock(path, vfs.Lock{Owner: l.Owner}); releaseErr != nil && !os.IsNotExist(releaseErr) {
+			err = multierr.Append(err, releaseErr)
+		}
+	}
+
+	l.held = map[string]bool{}
+
+	return multierr.Append(err, l.FS.Close())
+}
@@ -0,0 +1,140 @@
+package lockfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kuleuven/vfs"
+	"github.com/kuleuven/vfs/fs/chaosfs"
+	"github.com/kuleuven/vfs/fs/nativefs"
+)
+
+func TestLockFS(t *testing.T) {
+	fs := New(t.Context(), nativefs.New(t.Context(), t.TempDir()))
+
+	defer func() {
+		if err := fs.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	vfs.RunTestSuiteRW(t, fs)
+}
+
+func testMandatory(t *testing.T, a, b *LockFS) {
+	t.Helper()
+
+	if err := vfs.WriteFile(a, "/file", []byte("0123456789"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.AcquireLock("/file", vfs.Lock{Type: vfs.LockExclusive, Offset: 0, Length: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.AcquireLock("/file", vfs.Lock{Type: vfs.LockShared, Offset: 2, Length: 1}); !errors.Is(err, vfs.ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	w, err := b.FileWrite("/file", os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = w.WriteAt([]byte("x"), 3); !errors.Is(err, vfs.ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	if _, err = w.WriteAt([]byte("x"), 7); err != nil {
+		t.Fatalf("expected write outside the lock to succeed, got %v", err)
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.Truncate("/file", 2); !errors.Is(err, vfs.ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	if _, err = b.FileWrite("/file", os.O_WRONLY|os.O_TRUNC); !errors.Is(err, vfs.ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	// The owner itself is not restricted
+	if err = a.Truncate("/file", 8); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = a.ReleaseLock("/file", vfs.Lock{Offset: 0, Length: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.Truncate("/file", 2); err != nil {
+		t.Fatalf("expected truncate after release to succeed, got %v", err)
+	}
+}
+
+func TestMandatoryWithManager(t *testing.T) {
+	manager := vfs.NewLockManager()
+	root := t.TempDir()
+
+	a := New(t.Context(), chaosfs.New(nativefs.New(t.Context(), root), 1), WithOwner("a"), WithManager(manager))
+	b := New(t.Context(), chaosfs.New(nativefs.New(t.Context(), root), 1), WithOwner("b"), WithManager(manager))
+
+	defer b.Close()
+
+	testMandatory(t, a, b)
+
+	if err := a.AcquireLock("/file", vfs.Lock{Type: vfs.LockExclusive}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Closing releases all locks of the owner
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.TestLock("/file", vfs.Lock{Type: vfs.LockExclusive}); err != nil {
+		t.Fatalf("expected locks to be released on close, got %v", err)
+	}
+}
+
+func TestMandatoryWithNativeLocks(t *testing.T) {
+	root := t.TempDir()
+
+	a := New(t.Context(), nativefs.New(t.Context(), root), WithOwner("a"))
+	b := New(t.Context(), nativefs.New(t.Context(), root), WithOwner("b"))
+
+	defer a.Close()
+	defer b.Close()
+
+	testMandatory(t, a, b)
+}
+
+func TestLease(t *testing.T) {
+	manager := vfs.NewLockManager()
+	root := t.TempDir()
+
+	a := New(t.Context(), chaosfs.New(nativefs.New(t.Context(), root), 1), WithOwner("a"), WithManager(manager))
+	b := New(t.Context(), chaosfs.New(nativefs.New(t.Context(), root), 1), WithOwner("b"), WithManager(manager))
+
+	defer a.Close()
+	defer b.Close()
+
+	if err := a.AcquireLock("/file", vfs.Lock{Type: vfs.LockExclusive, TTL: 50 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.AcquireLock("/file", vfs.Lock{Type: vfs.LockExclusive}); !errors.Is(err, vfs.ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if err := b.AcquireLock("/file", vfs.Lock{Type: vfs.LockExclusive}); err != nil {
+		t.Fatalf("expected the lease to be expired, got %v", err)
+	}
+}
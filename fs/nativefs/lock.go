@@ -0,0 +1,218 @@
+package nativefs
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/kuleuven/vfs"
+	"go.uber.org/multierr"
+)
+
+var _ vfs.LockFS = &NativeFS{}
+
+type lockKey struct {
+	path, owner string
+}
+
+// fileLocks keeps a file open for each owner that holds locks, as the kernel
+// ties the locks to the open file. The lock manager keeps track of the locks
+// of each owner and their leases.
+type fileLocks struct {
+	manager    *vfs.LockManager
+	files      map[lockKey]*lockFile
+	filesMu    sync.Mutex // Protects files, also used when leases expire
+	sync.Mutex            // Serializes the lock operations
+}
+
+// lockFile is the file that holds the locks of an owner. Exclusive locks
+// need a file that is open for writing.
+type lockFile struct {
+	*os.File
+	writable bool
+}
+
+func newFileLocks() *fileLocks {
+	l := &fileLocks{
+		manager: vfs.NewLockManager(),
+		files:   map[lockKey]*lockFile{},
+	}
+
+	l.manager.OnExpire = func(path string, h vfs.HeldLock) {
+		l.filesMu.Lock()
+		defer l.filesMu.Unlock()
+
+		key := lockKey{path, h.Owner}
+
+		if f, ok := l.files[key]; ok {
+			SetLock(f.File, h.Lock, true) //nolint:errcheck
+
+			// The manager is locked, close the file once it is updated
+			go func() {
+				l.Lock()
+				defer l.Unlock()
+
+				l.closeUnused(key) //nolint:errcheck
+			}()
+		}
+	}
+
+	return l
+}
+
+// close releases all locks, by closing the files that hold them.
+func (l *fileLocks) close() error {
+	l.filesMu.Lock()
+	defer l.filesMu.Unlock()
+
+	var err error
+
+	for key, f := range l.files {
+		err = multierr.Append(err, f.Close())
+
+		delete(l.files, key)
+	}
+
+	return err
+}
+
+// lockFile returns the open file for the given owner, opening it if needed.
+// If an exclusive lock is requested and the file of the owner is read-only,
+// the file is reopened for writing, and the locks of the owner are moved.
+// The caller must hold m.locks.
+func (m *NativeFS) lockFile(key lockKey, lockType vfs.LockType) (*os.File, error) {
+	// Get the locks first, as the manager calls OnExpire with filesMu
+	held := m.locks.manager.Locks(key.path)
+
+	m.locks.filesMu.Lock()
+	defer m.locks.filesMu.Unlock()
+
+	old, ok := m.locks.files[key]
+	if ok && (old.writable || lockType == vfs.LockShared) {
+		return old.File, nil
+	}
+
+	rpath := m.BuildPath(key.path)
+
+	f := &lockFile{writable: true}
+
+	err := m.Context.Run(func() error {
+		var err error
+
+		f.File, err = os.OpenFile(rpath, os.O_RDWR, 0)
+		if lockType == vfs.LockShared && (errors.Is(err, os.ErrPermission) || errors.Is(err, syscall.EISDIR)) {
+			f.File, err = os.Open(rpath)
+			f.writable = false
+		}
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if ok {
+		// The read-only file only holds shared locks, which do not conflict
+		for _, h := range held {
+			if h.Owner != key.owner {
+				continue
+			}
+
+			if err := SetLock(f.File, h.Lock, false); err != nil {
+				return nil, multierr.Append(err, f.Close())
+			}
+		}
+
+		old.Close() //nolint:errcheck
+	}
+
+	m.locks.files[key] = f
+
+	return f.File, nil
+}
+
+// closeUnused closes the file of the owner if it no longer holds locks.
+// The caller must hold l.
+func (l *fileLocks) closeUnused(key lockKey) error {
+	if l.manager.Locks(key.path).Owned(key.owner) {
+		return nil
+	}
+
+	l.filesMu.Lock()
+	defer l.filesMu.Unlock()
+
+	f, ok := l.files[key]
+	if !ok {
+		return nil
+	}
+
+	delete(l.files, key)
+
+	return f.Close()
+}
+
+func (m *NativeFS) AcquireLock(path string, lock vfs.Lock) error {
+	m.locks.Lock()
+	defer m.locks.Unlock()
+
+	key := lockKey{vfs.Clean(path), lock.Owner}
+
+	f, err := m.lockFile(key, lock.Type)
+	if err != nil {
+		return err
+	}
+
+	if err = SetLock(f, lock, false); err == nil {
+		err = m.locks.manager.AcquireLock(key.path, lock)
+	}
+
+	if err != nil {
+		return multierr.Append(err, m.locks.closeUnused(key))
+	}
+
+	return nil
+}
+
+func (m *NativeFS) ReleaseLock(path string, lock vfs.Lock) error {
+	m.locks.Lock()
+	defer m.locks.Unlock()
+
+	key := lockKey{vfs.Clean(path), lock.Owner}
+
+	m.locks.filesMu.Lock()
+	f, ok := m.locks.files[key]
+	m.locks.filesMu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	if err := SetLock(f.File, lock, true); err != nil {
+		return err
+	}
+
+	if err := m.locks.manager.ReleaseLock(key.path, lock); err != nil {
+		return err
+	}
+
+	return m.locks.closeUnused(key)
+}
+
+func (m *NativeFS) TestLock(path string, lock vfs.Lock) error {
+	m.locks.Lock()
+	defer m.locks.Unlock()
+
+	key := lockKey{vfs.Clean(path), lock.Owner}
+
+	if err := m.locks.manager.TestLock(key.path, lock); err != nil {
+		return err
+	}
+
+	f, err := m.lockFile(key, vfs.LockShared)
+	if err != nil {
+		return err
+	}
+
+	return multierr.Append(TestLock(f, lock), m.locks.closeUnused(key))
+}
@@ -1,23 +1,33 @@
 package nativefs
 
 import (
+	"bytes"
 	"context"
 	"crypto"
+	"errors"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/kuleuven/vfs"
 	"github.com/kuleuven/vfs/fs/errorfs"
 	"github.com/kuleuven/vfs/runas"
+	"go.uber.org/multierr"
 )
 
 var (
 	_ vfs.OpenFileFS      = &NativeFS{}
 	_ vfs.SymlinkFS       = &NativeFS{}
 	_ vfs.LinkFS          = &NativeFS{}
+	_ vfs.StatFSFS        = &NativeFS{}
+	_ vfs.CopyFileFS      = &NativeFS{}
 	_ vfs.HandleResolveFS = &NativeServerInodeFS{}
+
+	_ vfs.SparseReaderAt    = &wrapFile{}
+	_ vfs.PunchHoleWriterAt = &wrapFile{}
 )
 
 func New(ctx context.Context, path string) vfs.FS {
@@ -27,6 +37,7 @@ func New(ctx context.Context, path string) vfs.FS {
 		Root:       path,
 		Context:    runas.RunAsCurrentUser(),
 		AllowChown: allowChown,
+		locks:      newFileLocks(),
 	}
 
 	if serverino, _ := ctx.Value(vfs.UseServerInodes).(bool); serverino {
@@ -48,6 +59,7 @@ func NewAsUser(ctx context.Context, path string, u *runas.User) vfs.FS {
 		Root:       path,
 		Context:    c,
 		AllowChown: allowChown,
+		locks:      newFileLocks(),
 	}
 
 	if serverino, _ := ctx.Value(vfs.UseServerInodes).(bool); serverino {
@@ -61,6 +73,7 @@ type NativeFS struct {
 	Root       string
 	Context    runas.Context
 	AllowChown bool
+	locks      *fileLocks
 }
 
 type NativeServerInodeFS struct {
@@ -228,7 +241,62 @@ func (m *NativeFS) Checksum(path string, algorithm crypto.Hash) ([]byte, error)
 }
 
 func (m *NativeFS) FileWrite(path string, flag int) (vfs.WriterAt, error) {
-	return m.openFile(m.BuildPath(path), flag, 0o640)
+	f, err := m.openFile(m.BuildPath(path), flag, 0o640)
+	if err != nil {
+		return nil, err
+	}
+
+	f.punch = true
+
+	return f, nil
+}
+
+// CopyFile copies src to dst using a reflink or copy_file_range if possible,
+// and streams the data, keeping holes, otherwise.
+func (m *NativeFS) CopyFile(src, dst string, flags int) error {
+	in, err := m.openFile(m.BuildPath(src), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	// Refuse to copy a file onto itself, before truncating it
+	err = m.Context.Run(func() error {
+		srcInfo, err := in.File.Stat()
+		if err != nil {
+			return err
+		}
+
+		dstInfo, err := os.Stat(m.BuildPath(dst))
+		if err == nil && os.SameFile(srcInfo, dstInfo) {
+			return &os.PathError{Op: "copy", Path: dst, Err: syscall.EINVAL}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	out, err := m.openFile(m.BuildPath(dst), flags&^os.O_RDWR|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+
+	err = m.Context.Run(func() error {
+		return CloneFile(out.File, in.File)
+	})
+
+	if errors.Is(err, vfs.ErrNotSupported) {
+		var fi vfs.FileInfo
+
+		if fi, err = in.Stat(); err == nil {
+			_, err = vfs.CopySparse(out, in, fi.Size())
+		}
+	}
+
+	return multierr.Append(err, out.Close())
 }
 
 func (m *NativeFS) Open(path string) (vfs.File, error) {
@@ -245,7 +313,7 @@ func (m *NativeFS) Open(path string) (vfs.File, error) {
 		return nil, err
 	}
 
-	return &wrapFile{f, path, m.Context}, nil
+	return &wrapFile{File: f, OrigPath: path, Context: m.Context}, nil
 }
 
 func (m *NativeFS) OpenFile(path string, flag int, perm os.FileMode) (vfs.File, error) {
@@ -266,7 +334,7 @@ func (m *NativeFS) openFile(path string, flag int, perm os.FileMode) (*wrapFile,
 		return nil, err
 	}
 
-	return &wrapFile{f, path, m.Context}, nil
+	return &wrapFile{File: f, OrigPath: path, Context: m.Context}, nil
 }
 
 func (m *NativeFS) Symlink(target, path string) error {
@@ -374,8 +442,22 @@ func (m *NativeFS) Rename(oldpath, newpath string) error {
 	})
 }
 
+func (m *NativeFS) StatFS(path string) (*vfs.StatFS, error) {
+	var stat *vfs.StatFS
+
+	err := m.Context.Run(func() error {
+		var err error
+
+		stat, err = StatFS(m.BuildPath(path))
+
+		return err
+	})
+
+	return stat, err
+}
+
 func (m *NativeFS) Close() error {
-	return m.Context.Close()
+	return multierr.Append(m.locks.close(), m.Context.Close())
 }
 
 func (m *NativeServerInodeFS) Handle(path string) ([]byte, error) {
@@ -426,6 +508,9 @@ type wrapFile struct {
 	*os.File
 	OrigPath string
 	Context  runas.Context
+	seekLock sync.Mutex  // Serializes the use of the file offset, as SeekData and SeekHole move it
+	punch    bool        // Whether WriteAt punches holes, only for files opened by FileWrite
+	noPunch  atomic.Bool // Whether the file system cannot punch holes
 }
 
 func (w *wrapFile) Name() string {
@@ -456,6 +541,9 @@ func (w *wrapFile) Truncate(size int64) error {
 }
 
 func (w *wrapFile) Read(p []byte) (int, error) {
+	w.seekLock.Lock()
+	defer w.seekLock.Unlock()
+
 	var n int
 
 	err := w.Context.Run(func() error {
@@ -470,6 +558,9 @@ func (w *wrapFile) Read(p []byte) (int, error) {
 }
 
 func (w *wrapFile) Write(p []byte) (int, error) {
+	w.seekLock.Lock()
+	defer w.seekLock.Unlock()
+
 	var n int
 
 	err := w.Context.Run(func() error {
@@ -484,6 +575,9 @@ func (w *wrapFile) Write(p []byte) (int, error) {
 }
 
 func (w *wrapFile) Seek(offset int64, whence int) (int64, error) {
+	w.seekLock.Lock()
+	defer w.seekLock.Unlock()
+
 	err := w.Context.Run(func() error {
 		var err error
 
@@ -495,6 +589,98 @@ func (w *wrapFile) Seek(offset int64, whence int) (int64, error) {
 	return offset, err
 }
 
+func (w *wrapFile) SeekData(offset int64) (int64, error) {
+	w.seekLock.Lock()
+	defer w.seekLock.Unlock()
+
+	err := w.Context.Run(func() error {
+		var err error
+
+		offset, err = SeekSparse(w.File, offset, false)
+
+		return err
+	})
+
+	return offset, err
+}
+
+func (w *wrapFile) SeekHole(offset int64) (int64, error) {
+	w.seekLock.Lock()
+	defer w.seekLock.Unlock()
+
+	err := w.Context.Run(func() error {
+		var err error
+
+		offset, err = SeekSparse(w.File, offset, true)
+
+		return err
+	})
+
+	return offset, err
+}
+
+// sparseBlockSize is the size of the aligned blocks of zeros
+// that WriteAt punches as holes.
+const sparseBlockSize = 4096
+
+var zeroBlock = make([]byte, sparseBlockSize)
+
+// WriteAt writes p at offset. For files opened by FileWrite, it punches holes
+// for the aligned blocks of zeros in p, if the file system supports it. The
+// last block of p is always written, so that the file is extended as by a
+// regular write.
+func (w *wrapFile) WriteAt(p []byte, offset int64) (int, error) {
+	if !w.punch || w.noPunch.Load() || len(p) <= sparseBlockSize {
+		return w.File.WriteAt(p, offset)
+	}
+
+	var (
+		pos   int
+		start = int((sparseBlockSize - offset%sparseBlockSize) % sparseBlockSize)
+	)
+
+	for start+sparseBlockSize < len(p) {
+		if !bytes.Equal(p[start:start+sparseBlockSize], zeroBlock) {
+			start += sparseBlockSize
+
+			continue
+		}
+
+		end := start + sparseBlockSize
+
+		for end+sparseBlockSize < len(p) && bytes.Equal(p[end:end+sparseBlockSize], zeroBlock) {
+			end += sparseBlockSize
+		}
+
+		if n, err := w.File.WriteAt(p[pos:start], offset+int64(pos)); err != nil {
+			return pos + n, err
+		}
+
+		err := PunchHole(w.File, offset+int64(start), int64(end-start))
+		if errors.Is(err, vfs.ErrNotSupported) {
+			w.noPunch.Store(true)
+
+			n, err := w.File.WriteAt(p[start:], offset+int64(start))
+
+			return start + n, err
+		} else if err != nil {
+			return start, err
+		}
+
+		pos, start = end, end
+	}
+
+	n, err := w.File.WriteAt(p[pos:], offset+int64(pos))
+
+	return pos + n, err
+}
+
+func (w *wrapFile) PunchHole(offset, length int64) error {
+	return w.Context.Run(func() error {
+		return PunchHole(w.File, offset, length)
+	})
+}
+
 func (w *wrapFile) Close() error {
 	return w.Context.Run(func() error {
 		return w.File.Close()
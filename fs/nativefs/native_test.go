@@ -1,9 +1,14 @@
 package nativefs
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"io"
 	"os"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/kuleuven/vfs"
 	"github.com/kuleuven/vfs/runas"
@@ -63,3 +68,508 @@ func TestNativeFSWithServerInodes(t *testing.T) {
 
 	vfs.RunTestSuiteRW(t, fs)
 }
+
+// expectEvents waits for the expected events in order, ignoring other events.
+func expectEvents(t *testing.T, w vfs.Watcher, expected ...vfs.Event) {
+	t.Helper()
+
+	timeout := time.After(5 * time.Second)
+
+	for len(expected) > 0 {
+		select {
+		case event, ok := <-w.Events():
+			if !ok {
+				t.Fatal("watcher closed")
+			}
+
+			if event == expected[0] {
+				expected = expected[1:]
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for %v", expected[0])
+		}
+	}
+}
+
+// expectRename waits for a rename event, or for a creation and a removal
+// if the watcher cannot detect renames.
+func expectRename(t *testing.T, w vfs.Watcher, oldpath, newpath string, renames bool) {
+	t.Helper()
+
+	if renames {
+		expectEvents(t, w, vfs.Event{Op: vfs.EventRename, Path: newpath, OldPath: oldpath})
+	} else {
+		expectEvents(t, w, vfs.Event{Op: vfs.EventCreate, Path: newpath}, vfs.Event{Op: vfs.EventRemove, Path: oldpath})
+	}
+}
+
+func testWatch(t *testing.T, fs vfs.FS, w vfs.Watcher, renames bool) {
+	t.Helper()
+
+	if err := fs.Mkdir("/dir/sub", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	expectEvents(t, w, vfs.Event{Op: vfs.EventCreate, Path: "/dir/sub"})
+
+	if err := vfs.WriteFile(fs, "/dir/sub/file", nil, os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	expectEvents(t, w, vfs.Event{Op: vfs.EventCreate, Path: "/dir/sub/file"})
+
+	if err := vfs.WriteFile(fs, "/dir/sub/file", []byte("data"), os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	expectEvents(t, w, vfs.Event{Op: vfs.EventWrite, Path: "/dir/sub/file"})
+
+	if err := fs.SetExtendedAttr("/dir/sub/file", "user.test", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+
+	expectEvents(t, w, vfs.Event{Op: vfs.EventXattr, Path: "/dir/sub/file"})
+
+	if err := fs.Rename("/dir/sub/file", "/dir/sub/renamed"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectRename(t, w, "/dir/sub/file", "/dir/sub/renamed", renames)
+
+	if err := fs.Rename("/dir/sub", "/dir/moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectRename(t, w, "/dir/sub", "/dir/moved", renames)
+
+	if err := fs.Remove("/dir/moved/renamed"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectEvents(t, w, vfs.Event{Op: vfs.EventRemove, Path: "/dir/moved/renamed"})
+}
+
+func TestWatch(t *testing.T) {
+	fs := New(t.Context(), t.TempDir())
+
+	defer fs.Close()
+
+	if err := fs.Mkdir("/dir", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := fs.(vfs.WatchFS).Watch("/dir", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testWatch(t, fs, w, true)
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := <-w.Events(); ok {
+		t.Fatal("expected the events channel to be closed")
+	}
+}
+
+func TestPollWatch(t *testing.T) {
+	ctx := context.WithValue(t.Context(), vfs.WatchInterval, 10*time.Millisecond)
+
+	fs := New(ctx, t.TempDir())
+
+	defer fs.Close()
+
+	if err := fs.Mkdir("/dir", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := vfs.PollWatch(ctx, fs, "/dir", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer w.Close()
+
+	// File infos of nativefs have no handles, so renames cannot be detected
+	testWatch(t, fs, w, false)
+}
+
+func TestSparse(t *testing.T) {
+	fs := New(t.Context(), t.TempDir())
+
+	defer fs.Close()
+
+	const (
+		size  = 2 << 20
+		block = 64 << 10
+	)
+
+	data := bytes.Repeat([]byte{1}, block)
+
+	// Data at 0 and at 1 MiB, with holes in between and at the end
+	w, err := fs.FileWrite("/sparse", os.O_CREATE|os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, off := range []int64{0, size / 2} {
+		if _, err = w.WriteAt(data, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs.Truncate("/sparse", size); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := fs.FileRead("/sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	sparse, ok := r.(vfs.SparseReaderAt)
+	if !ok {
+		t.Fatal("expected a SparseReaderAt")
+	}
+
+	if hole, err := sparse.SeekHole(0); err != nil {
+		t.Fatal(err)
+	} else if hole == size {
+		t.Skip("file system does not support holes")
+	} else if hole != block {
+		t.Errorf("expected a hole at %d, got %d", block, hole)
+	}
+
+	if next, err := sparse.SeekData(block); err != nil || next != size/2 {
+		t.Errorf("expected data at %d, got %d (%v)", size/2, next, err)
+	}
+
+	if _, err := sparse.SeekData(size/2 + block); !errors.Is(err, io.EOF) {
+		t.Errorf("expected EOF, got %v", err)
+	}
+
+	// Copying over an existing file punches the holes
+	if err = vfs.WriteFile(fs, "/copy", bytes.Repeat([]byte{2}, size), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err = fs.FileWrite("/copy", os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := vfs.CopySparse(w, r, size); err != nil || n != 2*block {
+		t.Fatalf("expected to copy %d bytes, got %d (%v)", 2*block, n, err)
+	}
+
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := vfs.ReadFile(fs, "/sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if copied, err := vfs.ReadFile(fs, "/copy"); err != nil || !bytes.Equal(copied, expected) {
+		t.Fatalf("copy does not match (%v)", err)
+	}
+
+	r, err = fs.FileRead("/copy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer r.Close()
+
+	if hole, err := r.(vfs.SparseReaderAt).SeekHole(0); err != nil || hole != block {
+		t.Errorf("expected a hole at %d in the copy, got %d (%v)", block, hole, err)
+	}
+}
+
+func TestSparseWrite(t *testing.T) {
+	fs := New(t.Context(), t.TempDir())
+
+	defer fs.Close()
+
+	const block = 64 << 10
+
+	// Data, a run of zeros that is punched, and trailing zeros that extend the file
+	data := append(bytes.Repeat([]byte{1}, block), make([]byte, 2*block)...)
+
+	if err := vfs.WriteFile(fs, "/sparse", data, os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if read, err := vfs.ReadFile(fs, "/sparse"); err != nil || !bytes.Equal(read, data) {
+		t.Fatalf("read data does not match (%v)", err)
+	}
+
+	f, err := fs.(vfs.OpenFileFS).OpenFile("/sparse", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+
+	sparse := f.(vfs.SparseReaderAt) //nolint:forcetypeassert
+
+	if hole, err := sparse.SeekHole(0); err != nil {
+		t.Fatal(err)
+	} else if hole == int64(len(data)) {
+		t.Skip("file system does not support holes")
+	} else if hole != block {
+		t.Errorf("expected a hole at %d, got %d", block, hole)
+	}
+
+	// Sequential reads are not disturbed by concurrent SeekData calls
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for range 1000 {
+			sparse.SeekData(0) //nolint:errcheck
+		}
+	}()
+
+	read, err := io.ReadAll(f)
+	if err != nil || !bytes.Equal(read, data) {
+		t.Errorf("sequential read does not match (%v)", err)
+	}
+
+	<-done
+
+	// Files opened by OpenFile are written as is
+	g, err := fs.(vfs.OpenFileFS).OpenFile("/dense", os.O_CREATE|os.O_RDWR, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer g.Close()
+
+	if _, err = g.WriteAt(data, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if hole, err := g.(vfs.SparseReaderAt).SeekHole(0); err != nil || hole != int64(len(data)) { //nolint:forcetypeassert
+		t.Errorf("expected no holes, got one at %d (%v)", hole, err)
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	fs := New(t.Context(), t.TempDir())
+
+	defer fs.Close()
+
+	data := bytes.Repeat([]byte("data"), 1<<18)
+
+	if err := vfs.WriteFile(fs, "/src", data, os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	// A longer existing file is truncated
+	if err := vfs.WriteFile(fs, "/dst", append(data, data...), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.(vfs.CopyFileFS).CopyFile("/src", "/dst", os.O_CREATE); err != nil {
+		t.Fatal(err)
+	}
+
+	if copied, err := vfs.ReadFile(fs, "/dst"); err != nil || !bytes.Equal(copied, data) {
+		t.Fatalf("copy does not match (%v)", err)
+	}
+
+	if err := vfs.CopyFile(fs, "/src", "/dst", os.O_CREATE|os.O_EXCL); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("expected ErrExist, got %v", err)
+	}
+}
+
+func TestCopyFileSame(t *testing.T) {
+	fs := New(t.Context(), t.TempDir())
+
+	defer fs.Close()
+
+	data := []byte("data")
+
+	if err := vfs.WriteFile(fs, "/src", data, os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.(vfs.LinkFS).Link("/src", "/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dst := range []string{"/src", "/link"} {
+		if err := fs.(vfs.CopyFileFS).CopyFile("/src", dst, os.O_CREATE); !errors.Is(err, syscall.EINVAL) {
+			t.Fatalf("expected EINVAL, got %v", err)
+		}
+	}
+
+	if read, err := vfs.ReadFile(fs, "/src"); err != nil || !bytes.Equal(read, data) {
+		t.Fatalf("source was modified (%v)", err)
+	}
+}
+
+func TestCloneFileSparse(t *testing.T) {
+	dir := t.TempDir()
+
+	const block = 64 << 10
+
+	src, err := os.Create(dir + "/src")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer src.Close()
+
+	// Data, a hole, data and a trailing hole
+	for _, offset := range []int64{0, 2 * block} {
+		if _, err = src.WriteAt(bytes.Repeat([]byte{1}, block), offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = src.Truncate(4 * block); err != nil {
+		t.Fatal(err)
+	}
+
+	if hole, err := SeekSparse(src, 0, true); err != nil {
+		t.Fatal(err)
+	} else if hole != block {
+		t.Skip("file system does not support holes")
+	}
+
+	dst, err := os.Create(dir + "/dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer dst.Close()
+
+	if _, err = dst.Write(bytes.Repeat([]byte{2}, 5*block)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = CloneFile(dst, src); errors.Is(err, vfs.ErrNotSupported) {
+		t.Skip("file system does not support copy_file_range")
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := os.ReadFile(dir + "/src")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if copied, err := os.ReadFile(dir + "/dst"); err != nil || !bytes.Equal(copied, expected) {
+		t.Fatalf("copy does not match (%v)", err)
+	}
+
+	if hole, err := SeekSparse(dst, 0, true); err != nil || hole != block {
+		t.Errorf("expected a hole at %d in the copy, got %d (%v)", block, hole, err)
+	}
+
+	if next, err := SeekSparse(dst, 3*block, false); !errors.Is(err, io.EOF) {
+		t.Errorf("expected no data after %d in the copy, got %d (%v)", 3*block, next, err)
+	}
+}
+
+func TestLockUpgrade(t *testing.T) {
+	dir := t.TempDir()
+
+	fs := New(t.Context(), dir).(*NativeFS)    //nolint:forcetypeassert
+	other := New(t.Context(), dir).(*NativeFS) //nolint:forcetypeassert
+
+	defer fs.Close()
+	defer other.Close()
+
+	if err := vfs.WriteFile(fs, "/file", []byte("data"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	shared := vfs.Lock{Owner: "a", Type: vfs.LockShared}
+
+	if err := fs.AcquireLock("/file", shared); err != nil {
+		t.Fatal(err)
+	}
+
+	// Hold the shared lock on a read-only file, as if the owner had no write
+	// permission, which cannot be tested as root
+	f, err := os.Open(dir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = SetLock(f, shared, false); err != nil {
+		t.Fatal(err)
+	}
+
+	key := lockKey{"/file", "a"}
+
+	fs.locks.files[key].Close()
+	fs.locks.files[key] = &lockFile{File: f}
+
+	// The file is reopened for writing, and the lock is upgraded
+	if err := fs.AcquireLock("/file", vfs.Lock{Owner: "a", Type: vfs.LockExclusive}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.AcquireLock("/file", vfs.Lock{Owner: "b", Type: vfs.LockShared}); !errors.Is(err, vfs.ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	if err := fs.ReleaseLock("/file", vfs.Lock{Owner: "a"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := other.AcquireLock("/file", vfs.Lock{Owner: "b", Type: vfs.LockExclusive}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockExpire(t *testing.T) {
+	dir := t.TempDir()
+
+	fs := New(t.Context(), dir).(*NativeFS)    //nolint:forcetypeassert
+	other := New(t.Context(), dir).(*NativeFS) //nolint:forcetypeassert
+
+	defer fs.Close()
+	defer other.Close()
+
+	if err := vfs.WriteFile(fs, "/file", []byte("data"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.AcquireLock("/file", vfs.Lock{Owner: "a", Type: vfs.LockExclusive, TTL: 10 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The file that held the expired lease is closed
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(5 * time.Millisecond) {
+		fs.locks.filesMu.Lock()
+		open := len(fs.locks.files)
+		fs.locks.filesMu.Unlock()
+
+		if open == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no open lock files, got %d", open)
+		}
+	}
+
+	if err := other.AcquireLock("/file", vfs.Lock{Owner: "b", Type: vfs.LockExclusive}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -5,7 +5,9 @@ package nativefs
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"slices"
@@ -13,6 +15,7 @@ import (
 
 	"github.com/joshlf/go-acl"
 	"github.com/kuleuven/vfs"
+	"golang.org/x/sys/unix"
 )
 
 func Inode(fi os.FileInfo) uint64 {
@@ -54,6 +57,170 @@ outer:
 	return curr, nil
 }
 
+func StatFS(path string) (*vfs.StatFS, error) {
+	var stat syscall.Statfs_t
+
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return nil, &os.PathError{Op: "statfs", Path: path, Err: err}
+	}
+
+	return &vfs.StatFS{
+		BlockSize:   uint64(stat.Bsize), //nolint:gosec
+		Blocks:      stat.Blocks,
+		BlocksFree:  stat.Bfree,
+		BlocksAvail: stat.Bavail,
+		Files:       stat.Files,
+		FilesFree:   stat.Ffree,
+	}, nil
+}
+
+// The fallocate mode to punch a hole without changing the file size.
+const punchMode = unix.FALLOC_FL_KEEP_SIZE | unix.FALLOC_FL_PUNCH_HOLE
+
+// SeekSparse returns the start of the first hole, or data range if hole is
+// false, at or after offset, or io.EOF if there is none. The file offset
+// is restored afterwards, so the caller must not use it concurrently.
+func SeekSparse(f *os.File, offset int64, hole bool) (int64, error) {
+	whence := unix.SEEK_DATA
+
+	if hole {
+		whence = unix.SEEK_HOLE
+	}
+
+	current, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+
+	next, err := f.Seek(offset, whence)
+	if errors.Is(err, syscall.ENXIO) {
+		err = io.EOF
+	}
+
+	if _, serr := f.Seek(current, io.SeekStart); err == nil {
+		err = serr
+	}
+
+	return next, err
+}
+
+// PunchHole deallocates the given range of the file, which then reads as zeros.
+func PunchHole(f *os.File, offset, length int64) error {
+	err := syscall.Fallocate(int(f.Fd()), punchMode, offset, length) //nolint:gosec
+	if err != nil {
+		return &os.PathError{Op: "fallocate", Path: f.Name(), Err: err}
+	}
+
+	return nil
+}
+
+// CloneFile copies the data of src to dst in the kernel, sharing the extents
+// if the file system supports reflinks, or using copy_file_range otherwise.
+// In the latter case dst is truncated first, and only the data ranges of
+// src are copied, so that holes are kept. If neither works for the files,
+// vfs.ErrNotSupported is returned.
+func CloneFile(dst, src *os.File) error {
+	if err := unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())); err == nil { //nolint:gosec
+		return nil
+	}
+
+	fi, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err = dst.Truncate(0); err != nil {
+		return err
+	}
+
+	var copied bool
+
+	for offset := int64(0); offset < fi.Size(); {
+		data, err := SeekSparse(src, offset, false)
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		hole, err := SeekSparse(src, data, true)
+		if err != nil {
+			return err
+		}
+
+		roff, woff := data, data
+
+		for roff < hole {
+			n, err := unix.CopyFileRange(int(src.Fd()), &roff, int(dst.Fd()), &woff, int(hole-roff), 0) //nolint:gosec
+			if err != nil && !copied && isNotSupported(err) {
+				return vfs.ErrNotSupported
+			} else if err != nil {
+				return &os.LinkError{Op: "copy_file_range", Old: src.Name(), New: dst.Name(), Err: err}
+			}
+
+			if n == 0 {
+				break
+			}
+
+			copied = true
+		}
+
+		offset = hole
+	}
+
+	// Trailing holes are not copied
+	return dst.Truncate(fi.Size())
+}
+
+func isNotSupported(err error) bool {
+	return errors.Is(err, unix.EXDEV) || errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EINVAL)
+}
+
+func flock(lock vfs.Lock, unlock bool) *syscall.Flock_t {
+	lk := &syscall.Flock_t{
+		Type:   syscall.F_RDLCK,
+		Whence: io.SeekStart,
+		Start:  lock.Offset,
+		Len:    lock.Length,
+	}
+
+	switch {
+	case unlock:
+		lk.Type = syscall.F_UNLCK
+	case lock.Type == vfs.LockExclusive:
+		lk.Type = syscall.F_WRLCK
+	}
+
+	return lk
+}
+
+// SetLock acquires or releases a byte-range lock on the given file. Open file
+// description locks are used, which are owned by the open file instead of the
+// process, so that each lock owner can use its own file.
+func SetLock(f *os.File, lock vfs.Lock, unlock bool) error {
+	err := syscall.FcntlFlock(f.Fd(), unix.F_OFD_SETLK, flock(lock, unlock))
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EACCES) {
+		return vfs.ErrLocked
+	}
+
+	return err
+}
+
+// TestLock checks whether a byte-range lock can be acquired on the given file.
+func TestLock(f *os.File, lock vfs.Lock) error {
+	lk := flock(lock, false)
+
+	if err := syscall.FcntlFlock(f.Fd(), unix.F_OFD_GETLK, lk); err != nil {
+		return err
+	}
+
+	if lk.Type != syscall.F_UNLCK {
+		return vfs.ErrLocked
+	}
+
+	return nil
+}
+
 func SystemPermissions(path string) (*vfs.Permissions, error) {
 	fi, err := os.Stat(path)
 	if err != nil {
@@ -4,6 +4,7 @@
 package nativefs
 
 import (
+	"io"
 	"os"
 
 	"github.com/kuleuven/vfs"
@@ -21,6 +22,20 @@ func FindByInodes(root string, handle []byte) (string, error) {
 	return "", vfs.ErrNotSupported
 }
 
+func StatFS(path string) (*vfs.StatFS, error) {
+	return nil, vfs.ErrNotSupported
+}
+
+// SetLock is a no-op, locks are only kept in process.
+func SetLock(_ *os.File, _ vfs.Lock, _ bool) error {
+	return nil
+}
+
+// TestLock is a no-op, locks are only kept in process.
+func TestLock(_ *os.File, _ vfs.Lock) error {
+	return nil
+}
+
 func SystemPermissions(path string) (*vfs.Permissions, error) {
 	if _, err := os.Stat(path); err != nil {
 		return nil, err
@@ -35,3 +50,33 @@ func SystemPermissions(path string) (*vfs.Permissions, error) {
 		SetExtendedAttrs: true,
 	}, nil
 }
+
+// SeekSparse returns the start of the first hole, or data range if hole is
+// false, at or after offset, or io.EOF if there is none. Files are not
+// sparse on this platform, so the end of the file is the only hole.
+func SeekSparse(f *os.File, offset int64, hole bool) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if offset >= fi.Size() {
+		return 0, io.EOF
+	}
+
+	if hole {
+		return fi.Size(), nil
+	}
+
+	return offset, nil
+}
+
+// PunchHole is not supported on this platform.
+func PunchHole(_ *os.File, _, _ int64) error {
+	return vfs.ErrNotSupported
+}
+
+// CloneFile is not supported on this platform.
+func CloneFile(_, _ *os.File) error {
+	return vfs.ErrNotSupported
+}
@@ -0,0 +1,320 @@
+//go:build linux
+// +build linux
+
+package nativefs
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/kuleuven/vfs"
+	"github.com/sirupsen/logrus"
+)
+
+var _ vfs.WatchFS = &NativeFS{}
+
+const watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_DELETE | syscall.IN_MOVED_FROM |
+	syscall.IN_MOVED_TO | syscall.IN_ATTRIB | syscall.IN_DELETE_SELF
+
+// Watch reports changes using inotify. Changes to extended attributes are
+// reported together with other metadata changes, such as permissions and timestamps.
+func (m *NativeFS) Watch(path string, recursive bool) (vfs.Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	w := &inotifyWatcher{
+		fs:        m,
+		file:      os.NewFile(uintptr(fd), "inotify"),
+		root:      vfs.Clean(path),
+		recursive: recursive,
+		paths:     map[int32]string{},
+		events:    make(chan vfs.Event, vfs.EventBufferSize),
+		done:      make(chan struct{}),
+	}
+
+	if err := w.add(w.root); err != nil {
+		w.file.Close()
+
+		return nil, err
+	}
+
+	go w.run()
+
+	return w, nil
+}
+
+type inotifyWatcher struct {
+	fs        *NativeFS
+	file      *os.File
+	root      string
+	recursive bool
+	paths     map[int32]string // Watch descriptors and their paths, only accessed by run after the initial add
+	events    chan vfs.Event
+	done      chan struct{}
+	once      sync.Once
+}
+
+func (w *inotifyWatcher) Events() <-chan vfs.Event {
+	return w.events
+}
+
+func (w *inotifyWatcher) Close() error {
+	var err error
+
+	w.once.Do(func() {
+		close(w.done)
+
+		err = w.file.Close()
+	})
+
+	return err
+}
+
+// add watches the path, and its subdirectories if the watcher is recursive.
+// Only errors for the path itself are returned.
+func (w *inotifyWatcher) add(path string) error {
+	rpath := w.fs.BuildPath(path)
+
+	var (
+		wd      int
+		entries []os.DirEntry
+	)
+
+	err := w.fs.Context.Run(func() error {
+		conn, err := w.file.SyscallConn()
+		if err != nil {
+			return err
+		}
+
+		if ctrlErr := conn.Control(func(fd uintptr) {
+			wd, err = syscall.InotifyAddWatch(int(fd), rpath, watchMask)
+		}); ctrlErr != nil {
+			return ctrlErr
+		}
+
+		if err != nil {
+			return &os.PathError{Op: "inotify_add_watch", Path: path, Err: err}
+		}
+
+		if w.recursive {
+			entries, _ = os.ReadDir(rpath) //nolint:errcheck
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	w.paths[int32(wd)] = path //nolint:gosec
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		if err := w.add(vfs.Join(path, entry.Name())); err != nil {
+			logrus.Debugf("Cannot watch %s: %v", vfs.Join(path, entry.Name()), err)
+		}
+	}
+
+	return nil
+}
+
+// remove stops watching the path and its subdirectories.
+func (w *inotifyWatcher) remove(path string) {
+	conn, err := w.file.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	for wd, p := range w.paths {
+		if p != path && !strings.HasPrefix(p, path+"/") {
+			continue
+		}
+
+		delete(w.paths, wd)
+
+		conn.Control(func(fd uintptr) { //nolint:errcheck
+			syscall.InotifyRmWatch(int(fd), uint32(wd)) //nolint:errcheck,gosec
+		})
+	}
+}
+
+// move updates the paths of the watches below a moved directory.
+func (w *inotifyWatcher) move(oldpath, newpath string) {
+	for wd, p := range w.paths {
+		if p == oldpath || strings.HasPrefix(p, oldpath+"/") {
+			w.paths[wd] = newpath + strings.TrimPrefix(p, oldpath)
+		}
+	}
+}
+
+func (w *inotifyWatcher) emit(event vfs.Event) bool {
+	select {
+	case w.events <- event:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+func (w *inotifyWatcher) run() {
+	defer close(w.events)
+
+	buf := make([]byte, 64*1024)
+
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				logrus.Warnf("Cannot read inotify events: %v", err)
+			}
+
+			return
+		}
+
+		if !w.handle(buf[:n]) {
+			return
+		}
+	}
+}
+
+type move struct {
+	path string
+	dir  bool
+}
+
+// handle processes a buffer of inotify events. Renames are reported if
+// both halves are in the same buffer, which the kernel does in practice.
+// Otherwise they are reported as a removal and a creation.
+func (w *inotifyWatcher) handle(buf []byte) bool {
+	var (
+		moves   = map[uint32]move{}
+		cookies []uint32
+	)
+
+	for len(buf) >= syscall.SizeofInotifyEvent {
+		wd := int32(binary.NativeEndian.Uint32(buf[0:])) //nolint:gosec
+		mask := binary.NativeEndian.Uint32(buf[4:])
+		cookie := binary.NativeEndian.Uint32(buf[8:])
+		nameLen := int(binary.NativeEndian.Uint32(buf[12:]))
+		name := strings.TrimRight(string(buf[syscall.SizeofInotifyEvent:syscall.SizeofInotifyEvent+nameLen]), "\x00")
+
+		buf = buf[syscall.SizeofInotifyEvent+nameLen:]
+
+		if mask&syscall.IN_Q_OVERFLOW != 0 {
+			if !w.emit(vfs.Event{Op: vfs.EventOverflow}) {
+				return false
+			}
+
+			continue
+		}
+
+		dir, ok := w.paths[wd]
+		if !ok {
+			continue
+		}
+
+		if mask&syscall.IN_IGNORED != 0 {
+			delete(w.paths, wd)
+
+			continue
+		}
+
+		var event vfs.Event
+
+		if name == "" {
+			// Events on the watched directory itself are reported by its parent
+			if dir != w.root {
+				continue
+			}
+
+			switch {
+			case mask&syscall.IN_CLOSE_WRITE != 0:
+				event = vfs.Event{Op: vfs.EventWrite, Path: dir}
+			case mask&syscall.IN_ATTRIB != 0:
+				event = vfs.Event{Op: vfs.EventXattr, Path: dir}
+			case mask&syscall.IN_DELETE_SELF != 0:
+				event = vfs.Event{Op: vfs.EventRemove, Path: dir}
+			default:
+				continue
+			}
+
+			if !w.emit(event) {
+				return false
+			}
+
+			continue
+		}
+
+		path := vfs.Join(dir, name)
+		isDir := mask&syscall.IN_ISDIR != 0
+
+		switch {
+		case mask&syscall.IN_CREATE != 0:
+			event = vfs.Event{Op: vfs.EventCreate, Path: path}
+
+			if w.recursive && isDir {
+				w.add(path) //nolint:errcheck
+			}
+		case mask&syscall.IN_CLOSE_WRITE != 0:
+			event = vfs.Event{Op: vfs.EventWrite, Path: path}
+		case mask&syscall.IN_ATTRIB != 0:
+			event = vfs.Event{Op: vfs.EventXattr, Path: path}
+		case mask&syscall.IN_DELETE != 0:
+			event = vfs.Event{Op: vfs.EventRemove, Path: path}
+		case mask&syscall.IN_MOVED_FROM != 0:
+			moves[cookie] = move{path, isDir}
+			cookies = append(cookies, cookie)
+
+			continue
+		case mask&syscall.IN_MOVED_TO != 0:
+			if from, ok := moves[cookie]; ok {
+				delete(moves, cookie)
+
+				event = vfs.Event{Op: vfs.EventRename, Path: path, OldPath: from.path}
+
+				if w.recursive && isDir {
+					w.move(from.path, path)
+				}
+			} else {
+				event = vfs.Event{Op: vfs.EventCreate, Path: path}
+
+				if w.recursive && isDir {
+					w.add(path) //nolint:errcheck
+				}
+			}
+		default:
+			continue
+		}
+
+		if !w.emit(event) {
+			return false
+		}
+	}
+
+	// Files moved out of the watched tree
+	for _, cookie := range cookies {
+		from, ok := moves[cookie]
+		if !ok {
+			continue
+		}
+
+		if w.recursive && from.dir {
+			w.remove(from.path)
+		}
+
+		if !w.emit(vfs.Event{Op: vfs.EventRemove, Path: from.path}) {
+			return false
+		}
+	}
+
+	return true
+}
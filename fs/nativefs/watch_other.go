@@ -0,0 +1,17 @@
+//go:build !linux
+// +build !linux
+
+package nativefs
+
+import (
+	"context"
+
+	"github.com/kuleuven/vfs"
+)
+
+var _ vfs.WatchFS = &NativeFS{}
+
+// Watch reports changes by polling, as inotify is only available on Linux.
+func (m *NativeFS) Watch(path string, recursive bool) (vfs.Watcher, error) {
+	return vfs.PollWatch(context.Background(), m, path, recursive)
+}
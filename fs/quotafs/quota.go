@@ -0,0 +1,669 @@
+package quotafs
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/kuleuven/vfs"
+	"github.com/sirupsen/logrus"
+	"go.uber.org/multierr"
+)
+
+var (
+	_ vfs.ChecksumFS = &QuotaFS{}
+	_ vfs.StatFSFS   = &QuotaFS{}
+)
+
+var ErrQuotaExceeded = syscall.EDQUOT
+
+// DefaultBlockSize is the block size reported by StatFS if the
+// underlying file system does not implement vfs.StatFSFS.
+var DefaultBlockSize uint64 = 4096
+
+type Option func(*QuotaFS)
+
+// WithLedger persists the usage in the given local file when the file
+// system is closed, so that the next instance does not need to rescan
+// the trees. If the ledger was not saved cleanly, e.g. after a crash,
+// or if the quotas changed, the trees are rescanned.
+func WithLedger(path string) Option {
+	return func(fs *QuotaFS) {
+		fs.Ledger = path
+	}
+}
+
+// New returns a file system that enforces the given quotas on the given file system.
+// Writes, truncates, directory creation and renames that would grow the usage of
+// a tree beyond its limits fail with ErrQuotaExceeded. The initial usage is
+// obtained by walking the trees, unless a clean ledger is available.
+// Only changes made through the returned file system are accounted for;
+// call Rescan to pick up changes made by others.
+func New(ctx context.Context, fs vfs.FS, quotas []Quota, options ...Option) (*QuotaFS, error) {
+	q := &QuotaFS{
+		Context: ctx,
+		FS:      fs,
+		files:   map[string]*openFile{},
+	}
+
+	for _, quota := range quotas {
+		quota.Path = vfs.Clean(quota.Path)
+
+		q.trees = append(q.trees, &tree{
+			Quota: quota,
+			uids:  map[uint32]Usage{},
+		})
+	}
+
+	for _, option := range options {
+		option(q)
+	}
+
+	if q.Ledger != "" && q.loadLedger() {
+		return q, q.saveLedger(false)
+	}
+
+	if err := q.Rescan(); err != nil {
+		return nil, err
+	}
+
+	if q.Ledger != "" {
+		return q, q.saveLedger(false)
+	}
+
+	return q, nil
+}
+
+type QuotaFS struct {
+	Context context.Context //nolint:containedctx
+	FS      vfs.FS
+	Ledger  string
+	trees   []*tree
+	files   map[string]*openFile // Files open for writing
+	sync.Mutex
+}
+
+// openFile is the size that is charged for a file that is open for writing.
+// It is shared by all writers of the file, and reconciled with the actual
+// size when the last one is closed.
+type openFile struct {
+	size    int64
+	refs    int
+	removed bool // The file was removed while open, and its size released
+}
+
+func (q *QuotaFS) Logger() *logrus.Entry {
+	return vfs.Logger(q.Context)
+}
+
+// loadLedger restores the usage from the ledger, and returns whether it succeeded.
+func (q *QuotaFS) loadLedger() bool {
+	l, err := loadLedger(q.Ledger)
+	if errors.Is(err, os.ErrNotExist) {
+		return false
+	} else if err != nil {
+		q.Logger().Warnf("Cannot load quota ledger %s: %v", q.Ledger, err)
+
+		return false
+	}
+
+	if !l.Clean || len(l.Reports) != len(q.trees) {
+		return false
+	}
+
+	for i, t := range q.trees {
+		if l.Reports[i].Quota != t.Quota {
+			return false
+		}
+	}
+
+	for i, t := range q.trees {
+		t.total = l.Reports[i].Total
+
+		for uid, usage := range l.Reports[i].UIDs {
+			t.uids[uid] = usage
+		}
+	}
+
+	return true
+}
+
+func (q *QuotaFS) saveLedger(clean bool) error {
+	return (&ledger{
+		Clean:   clean,
+		Reports: q.Report(),
+	}).save(q.Ledger)
+}
+
+// Rescan recomputes the usage of all trees by walking them.
+func (q *QuotaFS) Rescan() error {
+	for _, t := range q.trees {
+		uids, err := q.measure(t.Path, false)
+		if err != nil {
+			return err
+		}
+
+		q.Lock()
+
+		t.total = Usage{}
+		t.uids = map[uint32]Usage{}
+
+		for uid, usage := range uids {
+			t.apply(uid, usage)
+		}
+
+		q.Unlock()
+	}
+
+	return nil
+}
+
+// measure returns the usage per owner of the given path and everything below it.
+func (q *QuotaFS) measure(path string, includeRoot bool) (map[uint32]Usage, error) {
+	uids := map[uint32]Usage{}
+
+	err := vfs.Walk(q.FS, path, func(p string, fi vfs.FileInfo, err error) error {
+		if errors.Is(err, os.ErrNotExist) && p == path && !includeRoot {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if p != path || includeRoot {
+			uids[fi.Uid()] = uids[fi.Uid()].add(usageOf(fi))
+		}
+
+		return nil
+	})
+
+	return uids, err
+}
+
+func usageOf(fi vfs.FileInfo) Usage {
+	if fi.Mode().IsRegular() {
+		return Usage{Bytes: fi.Size(), Files: 1}
+	}
+
+	return Usage{Files: 1}
+}
+
+// Report returns the usage of all trees.
+func (q *QuotaFS) Report() []Report {
+	q.Lock()
+	defer q.Unlock()
+
+	var reports []Report
+
+	for _, t := range q.trees {
+		reports = append(reports, t.report())
+	}
+
+	return reports
+}
+
+// charge adds delta to the usage of all trees containing path.
+// If check is set and the limits of any tree would be exceeded,
+// nothing is changed and ErrQuotaExceeded is returned.
+func (q *QuotaFS) charge(path string, uid uint32, delta Usage, check bool) error {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.chargeLocked(path, uid, delta, check)
+}
+
+func (q *QuotaFS) chargeLocked(path string, uid uint32, delta Usage, check bool) error {
+	var trees []*tree
+
+	for _, t := range q.trees {
+		if !t.contains(path) {
+			continue
+		}
+
+		if check && t.exceeds(uid, delta) {
+			return &os.PathError{Op: "write", Path: path, Err: ErrQuotaExceeded}
+		}
+
+		trees = append(trees, t)
+	}
+
+	for _, t := range trees {
+		t.apply(uid, delta)
+	}
+
+	return nil
+}
+
+func (q *QuotaFS) Stat(path string) (vfs.FileInfo, error) {
+	return q.FS.Stat(path)
+}
+
+func (q *QuotaFS) List(path string) (vfs.ListerAt, error) {
+	return q.FS.List(path)
+}
+
+func (q *QuotaFS) FileRead(path string) (vfs.ReaderAt, error) {
+	return q.FS.FileRead(path)
+}
+
+func (q *QuotaFS) FileWrite(path string, flags int) (vfs.WriterAt, error) {
+	fi, err := q.FS.Stat(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	exists := err == nil
+
+	w, err := q.FS.FileWrite(path, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		if fi, err = q.FS.Stat(path); err != nil {
+			return nil, multierr.Append(err, w.Close())
+		}
+
+		if err = q.charge(path, fi.Uid(), usageOf(fi), true); err != nil {
+			return nil, multierr.Combine(err, w.Close(), q.FS.Remove(path))
+		}
+	}
+
+	return q.open(w, path, fi, exists && flags&os.O_TRUNC != 0), nil
+}
+
+// open registers a writer for the given file. If truncate is set,
+// the size that was charged for the file is released.
+func (q *QuotaFS) open(w vfs.WriterAt, path string, fi vfs.FileInfo, truncate bool) *writerAt {
+	q.Lock()
+	defer q.Unlock()
+
+	f, ok := q.files[path]
+	if !ok {
+		f = &openFile{size: fi.Size()}
+
+		q.files[path] = f
+	}
+
+	f.refs++
+
+	if truncate {
+		q.chargeLocked(path, fi.Uid(), Usage{Bytes: -f.size}, false) //nolint:errcheck
+
+		f.size = 0
+	}
+
+	return &writerAt{WriterAt: w, q: q, path: path, uid: fi.Uid(), file: f}
+}
+
+// grow charges the growth of an open file to the given size.
+func (q *QuotaFS) grow(w *writerAt, size int64) error {
+	q.Lock()
+	defer q.Unlock()
+
+	if size <= w.file.size {
+		return nil
+	}
+
+	// The data of a removed file is not charged anymore
+	if w.file.removed {
+		w.file.size = size
+
+		return nil
+	}
+
+	if err := q.chargeLocked(w.path, w.uid, Usage{Bytes: size - w.file.size}, true); err != nil {
+		return err
+	}
+
+	w.file.size = size
+
+	return nil
+}
+
+// release unregisters a writer. When the last writer of a file is closed,
+// the charged size is replaced by the actual size of the file.
+func (q *QuotaFS) release(w *writerAt) {
+	fi, err := q.FS.Stat(w.path)
+
+	q.Lock()
+	defer q.Unlock()
+
+	if w.file.refs--; w.file.refs > 0 {
+		return
+	}
+
+	if q.files[w.path] == w.file {
+		delete(q.files, w.path)
+	}
+
+	if err == nil && !w.file.removed && fi.Size() != w.file.size {
+		q.chargeLocked(w.path, w.uid, Usage{Bytes: fi.Size() - w.file.size}, false) //nolint:errcheck
+	}
+}
+
+func (q *QuotaFS) Chmod(path string, mode os.FileMode) error {
+	return q.FS.Chmod(path, mode)
+}
+
+func (q *QuotaFS) Chown(path string, uid, gid int) error {
+	fi, err := q.FS.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if err := q.FS.Chown(path, uid, gid); err != nil {
+		return err
+	}
+
+	if uid >= 0 && uint32(uid) != fi.Uid() {
+		q.charge(path, fi.Uid(), usageOf(fi).neg(), false) //nolint:errcheck
+		q.charge(path, uint32(uid), usageOf(fi), false)    //nolint:errcheck,gosec
+	}
+
+	return nil
+}
+
+func (q *QuotaFS) Chtimes(path string, atime, mtime time.Time) error {
+	return q.FS.Chtimes(path, atime, mtime)
+}
+
+func (q *QuotaFS) Truncate(path string, size int64) error {
+	fi, err := q.FS.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	charged, err := q.resize(path, fi, size, true)
+	if err != nil {
+		return err
+	}
+
+	if err := q.FS.Truncate(path, size); err != nil {
+		q.resize(path, fi, charged, false) //nolint:errcheck
+
+		return err
+	}
+
+	return nil
+}
+
+// resize charges the change of the size of path to size, and returns the
+// size that was charged before. For a file that is open for writing, the
+// size charged for its writers is used and updated instead of fi.Size().
+func (q *QuotaFS) resize(path string, fi vfs.FileInfo, size int64, check bool) (int64, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	charged := fi.Size()
+
+	f, open := q.files[path]
+	if open {
+		charged = f.size
+	}
+
+	if err := q.chargeLocked(path, fi.Uid(), Usage{Bytes: size - charged}, check); err != nil {
+		return charged, err
+	}
+
+	if open {
+		f.size = size
+	}
+
+	return charged, nil
+}
+
+func (q *QuotaFS) SetExtendedAttr(path, name string, value []byte) error {
+	return q.FS.SetExtendedAttr(path, name, value)
+}
+
+func (q *QuotaFS) UnsetExtendedAttr(path, name string) error {
+	return q.FS.UnsetExtendedAttr(path, name)
+}
+
+func (q *QuotaFS) SetExtendedAttrs(path string, attrs vfs.Attributes) error {
+	return vfs.SetExtendedAttrs(q.FS, path, attrs)
+}
+
+func (q *QuotaFS) Rename(oldpath, newpath string) error {
+	uids, err := q.measure(oldpath, true)
+	if err != nil {
+		return err
+	}
+
+	// Usage of the file that is replaced, if any
+	var replaced map[uint32]Usage
+
+	if _, err := q.lstat(newpath); err == nil && newpath != oldpath {
+		if replaced, err = q.measure(newpath, true); err != nil {
+			return err
+		}
+	}
+
+	if err := q.move(oldpath, newpath, uids, true); err != nil {
+		return err
+	}
+
+	if err := q.FS.Rename(oldpath, newpath); err != nil {
+		q.move(newpath, oldpath, uids, false) //nolint:errcheck
+
+		return err
+	}
+
+	for uid, usage := range replaced {
+		q.charge(newpath, uid, usage.neg(), false) //nolint:errcheck
+	}
+
+	return nil
+}
+
+// move transfers the given usage from the trees that contain oldpath
+// to the trees that contain newpath. Trees that contain both are not changed.
+// If check is set and the limits of any tree would be exceeded,
+// nothing is changed and ErrQuotaExceeded is returned.
+func (q *QuotaFS) move(oldpath, newpath string, uids map[uint32]Usage, check bool) error {
+	q.Lock()
+	defer q.Unlock()
+
+	var added, removed []*tree
+
+	for _, t := range q.trees {
+		switch inOld, inNew := t.contains(oldpath), t.contains(newpath); {
+		case inNew && !inOld:
+			added = append(added, t)
+		case inOld && !inNew:
+			removed = append(removed, t)
+		}
+	}
+
+	for _, t := range added {
+		// Usage of different owners only add up if the limits are not per owner
+		var total Usage
+
+		for uid, usage := range uids {
+			if check && t.exceeds(uid, usage) {
+				return &os.PathError{Op: "rename", Path: newpath, Err: ErrQuotaExceeded}
+			}
+
+			total = total.add(usage)
+		}
+
+		if check && !t.PerUID && t.exceeds(0, total) {
+			return &os.PathError{Op: "rename", Path: newpath, Err: ErrQuotaExceeded}
+		}
+	}
+
+	for uid, usage := range uids {
+		for _, t := range added {
+			t.apply(uid, usage)
+		}
+
+		for _, t := range removed {
+			t.apply(uid, usage.neg())
+		}
+	}
+
+	return nil
+}
+
+func (q *QuotaFS) Rmdir(path string) error {
+	fi, err := q.FS.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if err := q.FS.Rmdir(path); err != nil {
+		return err
+	}
+
+	return q.charge(path, fi.Uid(), usageOf(fi).neg(), false)
+}
+
+func (q *QuotaFS) Remove(path string) error {
+	fi, err := q.lstat(path)
+	if err != nil {
+		return err
+	}
+
+	if err := q.FS.Remove(path); err != nil {
+		return err
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	usage := usageOf(fi)
+
+	// Release the size charged for the writers, which are not reconciled anymore
+	if f, ok := q.files[path]; ok && fi.Mode().IsRegular() {
+		usage.Bytes = f.size
+		f.removed = true
+
+		delete(q.files, path)
+	}
+
+	return q.chargeLocked(path, fi.Uid(), usage.neg(), false)
+}
+
+func (q *QuotaFS) lstat(path string) (vfs.FileInfo, error) {
+	if symlinkFS, ok := q.FS.(vfs.SymlinkFS); ok {
+		return symlinkFS.Lstat(path)
+	}
+
+	return q.FS.Stat(path)
+}
+
+func (q *QuotaFS) Mkdir(path string, perm os.FileMode) error {
+	if err := q.FS.Mkdir(path, perm); err != nil {
+		return err
+	}
+
+	fi, err := q.FS.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if err := q.charge(path, fi.Uid(), usageOf(fi), true); err != nil {
+		return multierr.Append(err, q.FS.Rmdir(path))
+	}
+
+	return nil
+}
+
+func (q *QuotaFS) Checksum(path string, algorithm crypto.Hash) ([]byte, error) {
+	if checksumFS, ok := q.FS.(vfs.ChecksumFS); ok {
+		return checksumFS.Checksum(path, algorithm)
+	}
+
+	return vfs.Checksum(q.FS, path, algorithm)
+}
+
+// StatFS reports the capacity of the underlying file system, limited
+// by the quotas of the trees that contain the path. Limits that apply
+// per owner are not taken into account.
+func (q *QuotaFS) StatFS(path string) (*vfs.StatFS, error) {
+	stat := &vfs.StatFS{
+		BlockSize:   DefaultBlockSize,
+		Blocks:      ^uint64(0),
+		BlocksFree:  ^uint64(0),
+		BlocksAvail: ^uint64(0),
+		Files:       ^uint64(0),
+		FilesFree:   ^uint64(0),
+	}
+
+	if statFS, ok := q.FS.(vfs.StatFSFS); ok {
+		var err error
+
+		stat, err = statFS.StatFS(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	for _, t := range q.trees {
+		if !t.contains(path) || t.PerUID {
+			continue
+		}
+
+		if t.MaxBytes > 0 && stat.BlockSize > 0 {
+			total := uint64(t.MaxBytes) / stat.BlockSize                      //nolint:gosec
+			free := uint64(max(t.MaxBytes-t.total.Bytes, 0)) / stat.BlockSize //nolint:gosec
+
+			stat.Blocks = min(stat.Blocks, total)
+			stat.BlocksFree = min(stat.BlocksFree, free)
+			stat.BlocksAvail = min(stat.BlocksAvail, free)
+		}
+
+		if t.MaxFiles > 0 {
+			stat.Files = min(stat.Files, uint64(t.MaxFiles))                               //nolint:gosec
+			stat.FilesFree = min(stat.FilesFree, uint64(max(t.MaxFiles-t.total.Files, 0))) //nolint:gosec
+		}
+	}
+
+	return stat, nil
+}
+
+func (q *QuotaFS) Close() error {
+	var err error
+
+	if q.Ledger != "" {
+		err = q.saveLedger(true)
+	}
+
+	return multierr.Append(err, q.FS.Close())
+}
+
+// writerAt charges the growth of the file before writing.
+// The file size is reconciled with the actual size when it is closed.
+type writerAt struct {
+	vfs.WriterAt
+	q    *QuotaFS
+	path string
+	uid  uint32
+	file *openFile
+	once sync.Once
+}
+
+func (w *writerAt) WriteAt(buf []byte, offset int64) (int, error) {
+	if err := w.q.grow(w, offset+int64(len(buf))); err != nil {
+		return 0, err
+	}
+
+	return w.WriterAt.WriteAt(buf, offset)
+}
+
+func (w *writerAt) Close() error {
+	err := w.WriterAt.Close()
+
+	w.once.Do(func() {
+		w.q.release(w)
+	})
+
+	return err
+}
@@ -0,0 +1,338 @@
+package quotafs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kuleuven/vfs"
+	"github.com/kuleuven/vfs/fs/nativefs"
+)
+
+func TestQuotaFS(t *testing.T) {
+	fs, err := New(t.Context(), nativefs.New(t.Context(), t.TempDir()), []Quota{{Path: "/", MaxBytes: 1 << 20}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if err := fs.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	vfs.RunTestSuiteRW(t, fs)
+}
+
+func TestQuotaExceeded(t *testing.T) {
+	native := nativefs.New(t.Context(), t.TempDir())
+
+	if err := native.Mkdir("/scratch", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vfs.WriteFile(native, "/scratch/existing", []byte("0123456789"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err := New(t.Context(), native, []Quota{{Path: "/scratch", MaxBytes: 20, MaxFiles: 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer fs.Close()
+
+	expect := func(bytes, files int64) {
+		t.Helper()
+
+		if u := fs.Report()[0].Total; u.Bytes != bytes || u.Files != files {
+			t.Errorf("Expected %d bytes and %d files, got %v", bytes, files, u)
+		}
+	}
+
+	expect(10, 1)
+
+	// Writes beyond the limit are refused
+	w, err := fs.FileWrite("/scratch/file", os.O_CREATE|os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.WriteAt([]byte("01234"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.WriteAt([]byte("0123456789"), 5); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(15, 2)
+
+	// Truncate growth is refused, shrinking is allowed
+	if err := fs.Truncate("/scratch/file", 100); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+
+	if err := fs.Truncate("/scratch/existing", 5); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(10, 2)
+
+	// File count
+	if err := fs.Mkdir("/scratch/dir", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Mkdir("/scratch/dir2", 0o755); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+
+	if _, err := native.Stat("/scratch/dir2"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected dir2 to be removed, got %v", err)
+	}
+
+	expect(10, 3)
+
+	// Moving into the tree is refused, moving out releases usage
+	if err := vfs.WriteFile(fs, "/outside", []byte("x"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Rename("/outside", "/scratch/outside"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+
+	if err := fs.Rename("/scratch/file", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(5, 2)
+
+	if err := fs.Remove("/scratch/existing"); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(0, 1)
+
+	stat, err := fs.StatFS("/scratch")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stat.Files != 3 || stat.FilesFree != 2 {
+		t.Errorf("Expected 3 files and 2 free, got %v", stat)
+	}
+}
+
+func TestPerUID(t *testing.T) {
+	native := nativefs.New(t.Context(), t.TempDir())
+
+	fs, err := New(t.Context(), native, []Quota{{Path: "/", MaxFiles: 2, PerUID: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer fs.Close()
+
+	if err := fs.Mkdir("/a", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Mkdir("/b", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Mkdir("/c", 0o755); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("Expected ErrQuotaExceeded, got %v", err)
+	}
+
+	if uids := fs.Report()[0].UIDs; len(uids) != 1 || uids[uint32(os.Getuid())].Files != 2 { //nolint:gosec
+		t.Errorf("Expected 2 files for the current user, got %v", uids)
+	}
+}
+
+func TestLedger(t *testing.T) {
+	native := nativefs.New(t.Context(), t.TempDir())
+	ledger := filepath.Join(t.TempDir(), "ledger.json")
+	quotas := []Quota{{Path: "/", MaxBytes: 100}}
+
+	fs, err := New(t.Context(), native, quotas, WithLedger(ledger))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vfs.WriteFile(fs, "/file", []byte("0123456789"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes made by others are not picked up, as the ledger is clean
+	if err := vfs.WriteFile(native, "/other", []byte("0123456789"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	fs, err = New(t.Context(), native, quotas, WithLedger(ledger))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if u := fs.Report()[0].Total; u.Bytes != 10 {
+		t.Errorf("Expected 10 bytes from the ledger, got %v", u)
+	}
+
+	// Without clean shutdown, the next instance rescans
+	fs, err = New(t.Context(), native, quotas, WithLedger(ledger))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer fs.Close()
+
+	if u := fs.Report()[0].Total; u.Bytes != 20 {
+		t.Errorf("Expected 20 bytes after rescan, got %v", u)
+	}
+}
+
+// replaceFS replaces existing files on rename, like POSIX rename.
+type replaceFS struct {
+	vfs.FS
+}
+
+func (r replaceFS) Rename(oldpath, newpath string) error {
+	if err := r.FS.Remove(newpath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return r.FS.Rename(oldpath, newpath)
+}
+
+func TestRenameReplace(t *testing.T) {
+	fs, err := New(t.Context(), replaceFS{nativefs.New(t.Context(), t.TempDir())}, []Quota{{Path: "/", MaxBytes: 100}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer fs.Close()
+
+	for _, name := range []string{"/a", "/b"} {
+		if err := vfs.WriteFile(fs, name, []byte("0123456789"), os.O_CREATE|os.O_WRONLY); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := fs.Rename("/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if u := fs.Report()[0].Total; u.Bytes != 10 || u.Files != 1 {
+		t.Errorf("Expected 10 bytes and 1 file, got %v", u)
+	}
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	fs, err := New(t.Context(), nativefs.New(t.Context(), t.TempDir()), []Quota{{Path: "/", MaxBytes: 15}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer fs.Close()
+
+	var writers []vfs.WriterAt
+
+	// Both writers write the same range, which is charged once
+	for range 2 {
+		w, err := fs.FileWrite("/file", os.O_CREATE|os.O_WRONLY)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := w.WriteAt([]byte("0123456789"), 0); err != nil {
+			t.Fatal(err)
+		}
+
+		writers = append(writers, w)
+	}
+
+	for _, w := range writers {
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if u := fs.Report()[0].Total; u.Bytes != 10 || u.Files != 1 {
+		t.Errorf("Expected 10 bytes and 1 file, got %v", u)
+	}
+}
+
+func TestOpenTruncateRemove(t *testing.T) {
+	fs, err := New(t.Context(), nativefs.New(t.Context(), t.TempDir()), []Quota{{Path: "/", MaxBytes: 15}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer fs.Close()
+
+	expect := func(bytes, files int64) {
+		t.Helper()
+
+		if u := fs.Report()[0].Total; u.Bytes != bytes || u.Files != files {
+			t.Errorf("Expected %d bytes and %d files, got %v", bytes, files, u)
+		}
+	}
+
+	// Truncating an open file updates the size charged for its writer
+	w, err := fs.FileWrite("/file", os.O_CREATE|os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.WriteAt([]byte("0123456789"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Truncate("/file", 4); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(4, 1)
+
+	if _, err := w.WriteAt([]byte("0123456789"), 5); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(15, 1)
+
+	// Removing an open file releases its size once
+	if w, err = fs.FileWrite("/file", os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Remove("/file"); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(0, 0)
+
+	if _, err := w.WriteAt([]byte("0123456789"), 15); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(0, 0)
+}
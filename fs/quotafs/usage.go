@@ -0,0 +1,141 @@
+package quotafs
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Quota limits the usage of a tree.
+type Quota struct {
+	Path     string `json:"path"`      // Root of the tree
+	MaxBytes int64  `json:"max_bytes"` // Maximum number of bytes, zero means unlimited
+	MaxFiles int64  `json:"max_files"` // Maximum number of files and directories, zero means unlimited
+	PerUID   bool   `json:"per_uid"`   // Apply the limits to each owner separately instead of to the whole tree
+}
+
+// Usage counts the bytes and files in a tree.
+type Usage struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+func (u Usage) add(other Usage) Usage {
+	return Usage{
+		Bytes: u.Bytes + other.Bytes,
+		Files: u.Files + other.Files,
+	}
+}
+
+func (u Usage) neg() Usage {
+	return Usage{
+		Bytes: -u.Bytes,
+		Files: -u.Files,
+	}
+}
+
+// exceeds returns whether adding delta to u exceeds the limits of q.
+// Deltas that do not grow the usage never exceed the limits, so that
+// usage can always be reduced, even if it is above the limits.
+func (u Usage) exceeds(delta Usage, q Quota) bool {
+	if delta.Bytes > 0 && q.MaxBytes > 0 && u.Bytes+delta.Bytes > q.MaxBytes {
+		return true
+	}
+
+	return delta.Files > 0 && q.MaxFiles > 0 && u.Files+delta.Files > q.MaxFiles
+}
+
+// Report describes the usage of a tree.
+type Report struct {
+	Quota Quota            `json:"quota"`
+	Total Usage            `json:"total"`
+	UIDs  map[uint32]Usage `json:"uids"`
+}
+
+type tree struct {
+	Quota
+	total Usage
+	uids  map[uint32]Usage
+}
+
+func (t *tree) contains(path string) bool {
+	return t.Path == "/" || path == t.Path || strings.HasPrefix(path, t.Path+"/")
+}
+
+func (t *tree) exceeds(uid uint32, delta Usage) bool {
+	if t.PerUID {
+		return t.uids[uid].exceeds(delta, t.Quota)
+	}
+
+	return t.total.exceeds(delta, t.Quota)
+}
+
+func (t *tree) apply(uid uint32, delta Usage) {
+	t.total = t.total.add(delta)
+	t.uids[uid] = t.uids[uid].add(delta)
+}
+
+func (t *tree) report() Report {
+	r := Report{
+		Quota: t.Quota,
+		Total: t.total,
+		UIDs:  map[uint32]Usage{},
+	}
+
+	for uid, usage := range t.uids {
+		r.UIDs[uid] = usage
+	}
+
+	return r
+}
+
+// ledger is the persisted usage of all trees. It is marked as unclean
+// as soon as it is loaded, and only marked clean again when it is saved
+// on Close, so that the usage is rescanned after a crash.
+type ledger struct {
+	Clean   bool     `json:"clean"`
+	Reports []Report `json:"reports"`
+}
+
+func loadLedger(path string) (*ledger, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var l ledger
+
+	if err := json.Unmarshal(data, &l); err != nil {
+		return nil, err
+	}
+
+	return &l, nil
+}
+
+func (l *ledger) save(path string) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	// Make sure the rename is persisted
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+
+	defer dir.Close()
+
+	return dir.Sync()
+}
@@ -0,0 +1,63 @@
+package resilientfs
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/kuleuven/iron/msg"
+	"github.com/pkg/sftp"
+)
+
+// ConnectionErrorCodes lists the iRODS error codes that indicate that the
+// connection to the iRODS agent is lost.
+var ConnectionErrorCodes = []msg.ErrorCode{
+	msg.SYS_SOCK_OPEN_ERR,
+	msg.SYS_HEADER_READ_LEN_ERR,
+	msg.SYS_HEADER_WRITE_LEN_ERR,
+	msg.SYS_SOCK_READ_TIMEDOUT,
+	msg.SYS_SOCK_READ_ERR,
+	msg.SYS_SOCK_WRITE_ERR,
+	msg.SYS_SOCK_CONNECT_ERR,
+	msg.USER_SOCK_OPEN_ERR,
+	msg.USER_SOCK_CONNECT_ERR,
+	msg.USER_SOCK_CONNECT_TIMEDOUT,
+}
+
+// IsConnectionError checks whether the error indicates that the connection
+// to the backend is lost, and that a new connection might succeed.
+// An io.EOF is considered a connection error, as metadata operations never
+// return it otherwise. Callers that read file contents must check for io.EOF
+// themselves.
+func IsConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+
+	for _, errno := range []syscall.Errno{syscall.ECONNRESET, syscall.ECONNABORTED, syscall.ECONNREFUSED, syscall.ENOTCONN, syscall.EPIPE, syscall.ETIMEDOUT} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+
+	if errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, sftp.ErrSSHFxNoConnection) {
+		return true
+	}
+
+	var irodsErr *msg.IRODSError
+
+	if errors.As(err, &irodsErr) {
+		for _, code := range ConnectionErrorCodes {
+			if irodsErr.Code == code || (irodsErr.Code/1000)*1000 == code {
+				return true
+			}
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,715 @@
+package resilientfs
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/kuleuven/vfs"
+)
+
+var (
+	_ vfs.ChecksumFS      = &ResilientFS{}
+	_ vfs.SymlinkFS       = &ResilientFS{}
+	_ vfs.LinkFS          = &ResilientFS{}
+	_ vfs.OpenFileFS      = &ResilientFS{}
+	_ vfs.HandleResolveFS = &ResilientHandleFS{}
+)
+
+// Factory creates a new connection to the backend.
+type Factory func() (vfs.FS, error)
+
+type Option func(*ResilientFS)
+
+// WithMaxRetries sets the number of times an idempotent operation is retried
+// after a connection error.
+func WithMaxRetries(maxRetries int) Option {
+	return func(fs *ResilientFS) {
+		fs.MaxRetries = maxRetries
+	}
+}
+
+// WithBackoff sets the initial and maximal delay between two connection attempts.
+// The delay doubles after each failed attempt.
+func WithBackoff(initial, maximal time.Duration) Option {
+	return func(fs *ResilientFS) {
+		fs.InitialBackoff = initial
+		fs.MaxBackoff = maximal
+	}
+}
+
+// WithConnectionErrorCheck overrides the function that decides whether
+// an error indicates a lost connection.
+func WithConnectionErrorCheck(check func(error) bool) Option {
+	return func(fs *ResilientFS) {
+		fs.IsConnectionError = check
+	}
+}
+
+var (
+	DefaultMaxRetries     = 5
+	DefaultInitialBackoff = 100 * time.Millisecond
+	DefaultMaxBackoff     = 10 * time.Second
+)
+
+// New returns a file system that obtains its backend from the given factory,
+// and replaces it by a new one when a connection error is detected.
+// Idempotent operations (Stat, List, FileRead, Checksum, and operations that
+// set an absolute value such as Chmod or SetExtendedAttr) are retried on a
+// new connection. Other operations return the connection error, but the next
+// call will use a new connection. Readers returned by FileRead and listers
+// returned by List are reopened transparently and resume at the same offset.
+// The factory is called lazily, the first time the file system is used.
+func New(ctx context.Context, factory Factory, options ...Option) *ResilientFS {
+	fs := &ResilientFS{
+		Context:           ctx,
+		Factory:           factory,
+		MaxRetries:        DefaultMaxRetries,
+		InitialBackoff:    DefaultInitialBackoff,
+		MaxBackoff:        DefaultMaxBackoff,
+		IsConnectionError: IsConnectionError,
+	}
+
+	for _, option := range options {
+		option(fs)
+	}
+
+	return fs
+}
+
+// NewWithHandles is like New, for backends that implement vfs.HandleResolveFS.
+// New does not expose handles, as the backend is only created on first use,
+// and wrappers such as rootfs decide up front whether to track handles.
+func NewWithHandles(ctx context.Context, factory Factory, options ...Option) *ResilientHandleFS {
+	return &ResilientHandleFS{
+		ResilientFS: New(ctx, factory, options...),
+	}
+}
+
+// ResilientHandleFS is a ResilientFS that resolves handles on the backend.
+type ResilientHandleFS struct {
+	*ResilientFS
+}
+
+func (r *ResilientHandleFS) Handle(path string) ([]byte, error) {
+	var handle []byte
+
+	err := r.do(true, func(fs vfs.FS) error {
+		handleFS, ok := fs.(vfs.HandleFS)
+		if !ok {
+			return vfs.ErrNotSupported
+		}
+
+		var err error
+
+		handle, err = handleFS.Handle(path)
+
+		return err
+	})
+
+	return handle, err
+}
+
+func (r *ResilientHandleFS) Path(handle []byte) (string, error) {
+	var path string
+
+	err := r.do(true, func(fs vfs.FS) error {
+		resolveFS, ok := fs.(vfs.HandleResolveFS)
+		if !ok {
+			return vfs.ErrNotSupported
+		}
+
+		var err error
+
+		path, err = resolveFS.Path(handle)
+
+		return err
+	})
+
+	return path, err
+}
+
+type ResilientFS struct {
+	Context           context.Context //nolint:containedctx
+	Factory           Factory
+	MaxRetries        int
+	InitialBackoff    time.Duration
+	MaxBackoff        time.Duration
+	IsConnectionError func(error) bool
+
+	fs         vfs.FS
+	generation int
+	closed     bool
+	sync.Mutex
+}
+
+var ErrClosed = errors.New("file system is closed")
+
+// Generation returns the number of connections that have been made so far.
+func (r *ResilientFS) Generation() int {
+	r.Lock()
+	defer r.Unlock()
+
+	return r.generation
+}
+
+// current returns the current backend, and creates one if needed.
+func (r *ResilientFS) current() (vfs.FS, int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.closed {
+		return nil, 0, ErrClosed
+	}
+
+	if r.fs != nil {
+		return r.fs, r.generation, nil
+	}
+
+	fs, err := r.Factory()
+	if err != nil {
+		return nil, r.generation, err
+	}
+
+	r.fs = fs
+	r.generation++
+
+	if r.generation > 1 {
+		vfs.Logger(r.Context).Warnf("Reconnected backend (generation %d)", r.generation)
+	}
+
+	return r.fs, r.generation, nil
+}
+
+// invalidate discards the backend of the given generation, so that the next
+// call to current creates a new one. If the backend was already replaced,
+// nothing happens.
+func (r *ResilientFS) invalidate(generation int) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.fs == nil || r.generation != generation {
+		return
+	}
+
+	if err := r.fs.Close(); err != nil {
+		vfs.Logger(r.Context).Debugf("Closing broken backend: %v", err)
+	}
+
+	r.fs = nil
+}
+
+// backoff waits before the given attempt. It returns an error if the context is done.
+func (r *ResilientFS) backoff(attempt int) error {
+	delay := r.InitialBackoff
+
+	for range attempt {
+		delay *= 2
+
+		if delay >= r.MaxBackoff {
+			delay = r.MaxBackoff
+
+			break
+		}
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-r.Context.Done():
+		return r.Context.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// do runs the given function on the current backend. If a connection error occurs,
+// the backend is replaced. If the operation is idempotent, or if no backend could be
+// created at all, the function is retried on the new backend.
+func (r *ResilientFS) do(idempotent bool, fn func(fs vfs.FS) error) error {
+	return r.doGeneration(idempotent, func(fs vfs.FS, _ int) error {
+		return fn(fs)
+	})
+}
+
+// doGeneration is like do, but also passes the generation of the backend to
+// fn, for handles that must only invalidate the backend they were opened on.
+func (r *ResilientFS) doGeneration(idempotent bool, fn func(fs vfs.FS, generation int) error) error {
+	var err error
+
+	for attempt := 0; attempt <= r.MaxRetries; attempt++ {
+		if attempt > 0 {
+			if berr := r.backoff(attempt - 1); berr != nil {
+				return berr
+			}
+		}
+
+		fs, generation, connErr := r.current()
+		if errors.Is(connErr, ErrClosed) {
+			return connErr
+		}
+
+		if connErr != nil {
+			vfs.Logger(r.Context).Warnf("Failed to connect backend: %v", connErr)
+
+			err = connErr
+
+			continue
+		}
+
+		err = fn(fs, generation)
+		if !r.IsConnectionError(err) {
+			return err
+		}
+
+		vfs.Logger(r.Context).Warnf("Connection error on backend (generation %d): %v", generation, err)
+
+		r.invalidate(generation)
+
+		if !idempotent {
+			return err
+		}
+	}
+
+	return err
+}
+
+func (r *ResilientFS) Stat(path string) (vfs.FileInfo, error) {
+	var fi vfs.FileInfo
+
+	err := r.do(true, func(fs vfs.FS) error {
+		var err error
+
+		fi, err = fs.Stat(path)
+
+		return err
+	})
+
+	return fi, err
+}
+
+func (r *ResilientFS) List(path string) (vfs.ListerAt, error) {
+	var (
+		lister     vfs.ListerAt
+		generation int
+	)
+
+	err := r.doGeneration(true, func(fs vfs.FS, gen int) error {
+		var err error
+
+		lister, err = fs.List(path)
+		generation = gen
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &listerAt{r: r, path: path, lister: lister, generation: generation}, nil
+}
+
+func (r *ResilientFS) FileRead(path string) (vfs.ReaderAt, error) {
+	reader := &readerAt{r: r, path: path}
+
+	if err := reader.open(); err != nil {
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+func (r *ResilientFS) FileWrite(path string, flags int) (vfs.WriterAt, error) {
+	var (
+		writer     vfs.WriterAt
+		generation int
+	)
+
+	err := r.doGeneration(false, func(fs vfs.FS, gen int) error {
+		var err error
+
+		writer, err = fs.FileWrite(path, flags)
+		generation = gen
+
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &writerAt{r: r, WriterAt: writer, generation: generation}, nil
+}
+
+func (r *ResilientFS) Chmod(path string, mode os.FileMode) error {
+	return r.do(true, func(fs vfs.FS) error {
+		return fs.Chmod(path, mode)
+	})
+}
+
+func (r *ResilientFS) Chown(path string, uid, gid int) error {
+	return r.do(true, func(fs vfs.FS) error {
+		return fs.Chown(path, uid, gid)
+	})
+}
+
+func (r *ResilientFS) Chtimes(path string, atime, mtime time.Time) error {
+	return r.do(true, func(fs vfs.FS) error {
+		return fs.Chtimes(path, atime, mtime)
+	})
+}
+
+func (r *ResilientFS) Truncate(path string, size int64) error {
+	return r.do(true, func(fs vfs.FS) error {
+		return fs.Truncate(path, size)
+	})
+}
+
+func (r *ResilientFS) SetExtendedAttr(path, name string, value []byte) error {
+	return r.do(true, func(fs vfs.FS) error {
+		return fs.SetExtendedAttr(path, name, value)
+	})
+}
+
+func (r *ResilientFS) UnsetExtendedAttr(path, name string) error {
+	return r.do(true, func(fs vfs.FS) error {
+		return fs.UnsetExtendedAttr(path, name)
+	})
+}
+
+func (r *ResilientFS) SetExtendedAttrs(path string, attrs vfs.Attributes) error {
+	return r.do(true, func(fs vfs.FS) error {
+		return vfs.SetExtendedAttrs(fs, path, attrs)
+	})
+}
+
+func (r *ResilientFS) Rename(oldpath, newpath string) error {
+	return r.do(false, func(fs vfs.FS) error {
+		return fs.Rename(oldpath, newpath)
+	})
+}
+
+func (r *ResilientFS) Rmdir(path string) error {
+	return r.do(false, func(fs vfs.FS) error {
+		return fs.Rmdir(path)
+	})
+}
+
+func (r *ResilientFS) Remove(path string) error {
+	return r.do(false, func(fs vfs.FS) error {
+		return fs.Remove(path)
+	})
+}
+
+func (r *ResilientFS) Mkdir(path string, perm os.FileMode) error {
+	return r.do(false, func(fs vfs.FS) error {
+		return fs.Mkdir(path, perm)
+	})
+}
+
+func (r *ResilientFS) Checksum(path string, algorithm crypto.Hash) ([]byte, error) {
+	var checksum []byte
+
+	err := r.do(true, func(fs vfs.FS) error {
+		var err error
+
+		if checksumFS, ok := fs.(vfs.ChecksumFS); ok {
+			checksum, err = checksumFS.Checksum(path, algorithm)
+		} else {
+			checksum, err = vfs.Checksum(fs, path, algorithm)
+		}
+
+		return err
+	})
+
+	return checksum, err
+}
+
+// Lstat is Stat if the backend does not support symlinks.
+func (r *ResilientFS) Lstat(path string) (vfs.FileInfo, error) {
+	var fi vfs.FileInfo
+
+	err := r.do(true, func(fs vfs.FS) error {
+		var err error
+
+		if symlinkFS, ok := fs.(vfs.SymlinkFS); ok {
+			fi, err = symlinkFS.Lstat(path)
+		} else {
+			fi, err = fs.Stat(path)
+		}
+
+		return err
+	})
+
+	return fi, err
+}
+
+func (r *ResilientFS) Readlink(path string) (string, error) {
+	var target string
+
+	err := r.do(true, func(fs vfs.FS) error {
+		symlinkFS, ok := fs.(vfs.SymlinkFS)
+		if !ok {
+			return vfs.ErrNotSupported
+		}
+
+		var err error
+
+		target, err = symlinkFS.Readlink(path)
+
+		return err
+	})
+
+	return target, err
+}
+
+func (r *ResilientFS) Symlink(target, path string) error {
+	return r.do(false, func(fs vfs.FS) error {
+		if symlinkFS, ok := fs.(vfs.SymlinkFS); ok {
+			return symlinkFS.Symlink(target, path)
+		}
+
+		return vfs.ErrNotSupported
+	})
+}
+
+func (r *ResilientFS) Link(target, path string) error {
+	return r.do(false, func(fs vfs.FS) error {
+		if linkFS, ok := fs.(vfs.LinkFS); ok {
+			return linkFS.Link(target, path)
+		}
+
+		return vfs.ErrNotSupported
+	})
+}
+
+// OpenFile is not retried, and the file is not reopened after a connection error.
+func (r *ResilientFS) OpenFile(path string, flag int, perm os.FileMode) (vfs.File, error) {
+	var file vfs.File
+
+	err := r.do(false, func(fs vfs.FS) error {
+		openFileFS, ok := fs.(vfs.OpenFileFS)
+		if !ok {
+			return vfs.ErrNotSupported
+		}
+
+		var err error
+
+		file, err = openFileFS.OpenFile(path, flag, perm)
+
+		return err
+	})
+
+	return file, err
+}
+
+func (r *ResilientFS) Close() error {
+	r.Lock()
+	defer r.Unlock()
+
+	r.closed = true
+
+	if r.fs == nil {
+		return nil
+	}
+
+	err := r.fs.Close()
+
+	r.fs = nil
+
+	return err
+}
+
+// readerAt reopens the file on a new backend if a connection error occurs.
+type readerAt struct {
+	r          *ResilientFS
+	path       string
+	reader     vfs.ReaderAt // Nil if reopening failed
+	generation int
+	sync.Mutex
+}
+
+func (h *readerAt) open() error {
+	return h.r.doGeneration(true, func(fs vfs.FS, generation int) error {
+		reader, err := fs.FileRead(h.path)
+		if err != nil {
+			return err
+		}
+
+		h.reader = reader
+		h.generation = generation
+
+		return nil
+	})
+}
+
+func (h *readerAt) ReadAt(buf []byte, off int64) (int, error) {
+	h.Lock()
+	reader, generation := h.reader, h.generation
+	h.Unlock()
+
+	// Try again if reopening failed before
+	if reader == nil {
+		var err error
+
+		if reader, generation, err = h.reopen(generation); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := reader.ReadAt(buf, off)
+	if errors.Is(err, io.EOF) || !h.r.IsConnectionError(err) {
+		return n, err
+	}
+
+	// Resume after the bytes that were read
+	for attempt := 0; attempt < h.r.MaxRetries && h.r.IsConnectionError(err) && !errors.Is(err, io.EOF); attempt++ {
+		vfs.Logger(h.r.Context).Warnf("Connection error while reading %s at offset %d: %v", h.path, off+int64(n), err)
+
+		if reader, generation, err = h.reopen(generation); err != nil {
+			return n, err
+		}
+
+		var m int
+
+		m, err = reader.ReadAt(buf[n:], off+int64(n))
+		n += m
+	}
+
+	return n, err
+}
+
+// reopen replaces the reader of the given generation by a reader on a new backend.
+func (h *readerAt) reopen(generation int) (vfs.ReaderAt, int, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	// Another goroutine has already reopened the reader
+	if h.generation != generation && h.reader != nil {
+		return h.reader, h.generation, nil
+	}
+
+	h.r.invalidate(generation)
+
+	if h.reader != nil {
+		h.reader.Close() //nolint:errcheck
+
+		h.reader = nil
+	}
+
+	if err := h.open(); err != nil {
+		return nil, 0, err
+	}
+
+	return h.reader, h.generation, nil
+}
+
+func (h *readerAt) Close() error {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.reader == nil {
+		return nil
+	}
+
+	return h.reader.Close()
+}
+
+// writerAt does not retry writes, as the data that is not yet flushed by
+// the backend would be lost, but it makes sure a new backend is used next.
+type writerAt struct {
+	r *ResilientFS
+	vfs.WriterAt
+	generation int
+}
+
+func (h *writerAt) WriteAt(buf []byte, off int64) (int, error) {
+	n, err := h.WriterAt.WriteAt(buf, off)
+	if h.r.IsConnectionError(err) {
+		h.r.invalidate(h.generation)
+	}
+
+	return n, err
+}
+
+func (h *writerAt) Close() error {
+	err := h.WriterAt.Close()
+	if h.r.IsConnectionError(err) {
+		h.r.invalidate(h.generation)
+	}
+
+	return err
+}
+
+// listerAt reopens the listing on a new backend if a connection error occurs.
+type listerAt struct {
+	r          *ResilientFS
+	path       string
+	lister     vfs.ListerAt // Nil if reopening failed
+	generation int
+	sync.Mutex
+}
+
+func (l *listerAt) ListAt(buf []vfs.FileInfo, off int64) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+
+	// Try again if reopening failed before
+	if l.lister != nil {
+		n, err := l.lister.ListAt(buf, off)
+		if errors.Is(err, io.EOF) || !l.r.IsConnectionError(err) {
+			return n, err
+		}
+
+		l.r.invalidate(l.generation)
+
+		l.lister.Close() //nolint:errcheck
+
+		l.lister = nil
+	}
+
+	var (
+		n   int
+		eof bool
+	)
+
+	err := l.r.doGeneration(true, func(fs vfs.FS, generation int) error {
+		lister, err := fs.List(l.path)
+		if err != nil {
+			return err
+		}
+
+		l.lister = lister
+		l.generation = generation
+
+		n, err = lister.ListAt(buf, off)
+		if errors.Is(err, io.EOF) {
+			eof = true
+
+			return nil
+		}
+
+		return err
+	})
+
+	if eof {
+		return n, io.EOF
+	}
+
+	return n, err
+}
+
+func (l *listerAt) Close() error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.lister == nil {
+		return nil
+	}
+
+	return l.lister.Close()
+}
@@ -0,0 +1,224 @@
+package resilientfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kuleuven/iron/msg"
+	"github.com/kuleuven/vfs"
+	"github.com/kuleuven/vfs/fs/chaosfs"
+	"github.com/kuleuven/vfs/fs/nativefs"
+	"github.com/pkg/sftp"
+)
+
+func TestResilientFS(t *testing.T) {
+	dir := t.TempDir()
+
+	fs := New(t.Context(), func() (vfs.FS, error) {
+		return nativefs.New(t.Context(), dir), nil
+	})
+
+	defer func() {
+		if err := fs.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	vfs.RunTestSuiteRW(t, fs)
+}
+
+func TestReconnect(t *testing.T) {
+	dir := t.TempDir()
+
+	rules := []*chaosfs.Rule{
+		{Path: "/file.txt", Op: chaosfs.OpStat, Times: 2, Err: syscall.ECONNRESET},
+		{Path: "/file.txt", Op: chaosfs.OpReadAt, Offset: 5, Times: 1, Err: sftp.ErrSSHFxConnectionLost},
+		{Path: "/dir", Op: chaosfs.OpRemove, Times: 1, Err: &msg.IRODSError{Code: msg.SYS_HEADER_READ_LEN_ERR}},
+	}
+
+	var connects int
+
+	fs := New(t.Context(), func() (vfs.FS, error) {
+		connects++
+
+		if connects == 2 {
+			return nil, syscall.ECONNREFUSED
+		}
+
+		return chaosfs.New(nativefs.New(t.Context(), dir), 1, rules...), nil
+	}, WithBackoff(time.Millisecond, 10*time.Millisecond))
+
+	defer fs.Close()
+
+	if err := vfs.WriteFile(fs, "/file.txt", []byte("0123456789"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	// Stat is retried until it succeeds, the second connection attempt fails
+	if _, err := fs.Stat("/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if fs.Generation() != 3 {
+		t.Errorf("Expected generation 3, got %d", fs.Generation())
+	}
+
+	// Reads resume at the same offset on a new connection
+	r, err := fs.FileRead("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 5)
+
+	if n, err := r.ReadAt(buf, 5); err != nil || string(buf[:n]) != "56789" {
+		t.Errorf("Expected '56789', got %q, %v", buf[:n], err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Error(err)
+	}
+
+	if fs.Generation() != 4 {
+		t.Errorf("Expected generation 4, got %d", fs.Generation())
+	}
+
+	// Non-idempotent operations are not retried
+	if err := fs.Mkdir("/dir", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Remove("/dir/file"); !IsConnectionError(err) {
+		t.Errorf("Expected connection error, got %v", err)
+	}
+
+	if _, err := fs.Stat("/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	if fs.Generation() != 5 {
+		t.Errorf("Expected generation 5, got %d", fs.Generation())
+	}
+}
+
+func TestClosed(t *testing.T) {
+	fs := New(t.Context(), func() (vfs.FS, error) {
+		return nativefs.New(t.Context(), t.TempDir()), nil
+	})
+
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Stat("/"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+}
+
+func TestSymlink(t *testing.T) {
+	fs := New(t.Context(), func() (vfs.FS, error) {
+		return nativefs.New(t.Context(), t.TempDir()), nil
+	})
+
+	defer fs.Close()
+
+	if err := fs.Symlink("target", "/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	if target, err := fs.Readlink("/link"); err != nil || target != "target" {
+		t.Errorf("Expected target, got %q, %v", target, err)
+	}
+
+	if fi, err := fs.Lstat("/link"); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Expected symlink, got %v, %v", fi, err)
+	}
+}
+
+func TestNotSupported(t *testing.T) {
+	fs := NewWithHandles(t.Context(), func() (vfs.FS, error) {
+		return chaosfs.New(nativefs.New(t.Context(), t.TempDir()), 1), nil
+	})
+
+	defer fs.Close()
+
+	if err := fs.Symlink("target", "/link"); !errors.Is(err, vfs.ErrNotSupported) {
+		t.Errorf("Expected ErrNotSupported, got %v", err)
+	}
+
+	if _, err := fs.Handle("/"); !errors.Is(err, vfs.ErrNotSupported) {
+		t.Errorf("Expected ErrNotSupported, got %v", err)
+	}
+
+	if _, err := fs.Lstat("/"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+
+	fs := New(ctx, func() (vfs.FS, error) {
+		cancel()
+
+		return nil, syscall.ECONNREFUSED
+	}, WithBackoff(time.Millisecond, 10*time.Millisecond))
+
+	defer fs.Close()
+
+	if _, err := fs.Stat("/"); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
+
+func TestReopenFailure(t *testing.T) {
+	dir := t.TempDir()
+
+	rules := []*chaosfs.Rule{
+		{Path: "/file.txt", Op: chaosfs.OpReadAt, Times: 1, Err: syscall.ECONNRESET},
+	}
+
+	var down bool
+
+	fs := New(t.Context(), func() (vfs.FS, error) {
+		if down {
+			return nil, syscall.ECONNREFUSED
+		}
+
+		return chaosfs.New(nativefs.New(t.Context(), dir), 1, rules...), nil
+	}, WithMaxRetries(1), WithBackoff(time.Millisecond, time.Millisecond))
+
+	defer fs.Close()
+
+	if err := vfs.WriteFile(fs, "/file.txt", []byte("0123456789"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := fs.FileRead("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	down = true
+
+	buf := make([]byte, 5)
+
+	if _, err := r.ReadAt(buf, 0); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Errorf("Expected ECONNREFUSED, got %v", err)
+	}
+
+	// The closed reader is not used anymore, the file is reopened instead
+	down = false
+
+	if n, err := r.ReadAt(buf, 0); err != nil || string(buf[:n]) != "01234" {
+		t.Errorf("Expected '01234', got %q, %v", buf[:n], err)
+	}
+
+	if err := r.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,126 @@
+package handledb
+
+import (
+	"bytes"
+	"errors"
+	"iter"
+	"os"
+	"slices"
+)
+
+// batch is a Store that keeps writes in memory, on top of another store,
+// until they are committed as a group.
+type batch struct {
+	store   Store
+	pending map[string]*string // Path of each written handle, or nil if deleted
+}
+
+var _ Store = &batch{}
+
+func newBatch(store Store) *batch {
+	return &batch{
+		store:   store,
+		pending: map[string]*string{},
+	}
+}
+
+func (b *batch) Put(handle []byte, path string) error {
+	b.pending[string(handle)] = &path
+
+	return nil
+}
+
+func (b *batch) Get(handle []byte) (string, error) {
+	if path, ok := b.pending[string(handle)]; ok {
+		if path == nil {
+			return "", os.ErrNotExist
+		}
+
+		return *path, nil
+	}
+
+	return b.store.Get(handle)
+}
+
+func (b *batch) Delete(handle []byte) error {
+	if _, err := b.Get(handle); err != nil {
+		return err
+	}
+
+	b.pending[string(handle)] = nil
+
+	return nil
+}
+
+func (b *batch) All() iter.Seq2[Value, error] {
+	return func(yield func(Value, error) bool) {
+		var values []Value
+
+		for value, err := range b.store.All() {
+			if err != nil {
+				yield(Value{}, err)
+
+				return
+			}
+
+			if _, ok := b.pending[string(value.Handle)]; !ok {
+				values = append(values, value)
+			}
+		}
+
+		for handle, path := range b.pending {
+			if path != nil {
+				values = append(values, Value{Handle: []byte(handle), Path: *path})
+			}
+		}
+
+		slices.SortFunc(values, func(a, b Value) int {
+			return bytes.Compare(a.Handle, b.Handle)
+		})
+
+		for _, value := range values {
+			if !yield(value, nil) {
+				return
+			}
+		}
+	}
+}
+
+// commit writes the pending writes to the underlying store, as a group
+// if the store supports it.
+func (b *batch) commit() error {
+	var (
+		values  []Value
+		deletes [][]byte
+	)
+
+	for handle, path := range b.pending {
+		if path == nil {
+			deletes = append(deletes, []byte(handle))
+		} else {
+			values = append(values, Value{Handle: []byte(handle), Path: *path})
+		}
+	}
+
+	if store, ok := b.store.(updater); ok {
+		return store.Update(values, deletes)
+	}
+
+	for _, value := range values {
+		if err := b.store.Put(value.Handle, value.Path); err != nil {
+			return err
+		}
+	}
+
+	for _, handle := range deletes {
+		if err := b.store.Delete(handle); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *batch) Close() error {
+	return nil
+}
@@ -2,93 +2,431 @@ package handledb
 
 import (
 	"crypto"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"os"
+	"slices"
 	"sync"
 
-	"github.com/kuleuven/vfs/bytetree"
+	"github.com/kuleuven/vfs"
 
 	_ "crypto/md5" //nolint:gosec
 )
 
 type DB struct {
-	tree *bytetree.ByteTree
+	store   Store
+	indexed bool // Whether all generated handles are in the index
 	sync.Mutex
 }
 
-// 64 exabyte is not a good idea :)
-// <path>/inodes.db [inode:number]
-// <path>/files.db  [number:path]
-// <path>/lock
+// New opens a database in the directory at path, using the bytetree store.
+func New(path string) (*DB, error) {
+	return Open(path, TreeStoreKind)
+}
+
+// indexedKey marks a store in which all generated handles are indexed.
+var indexedKey = []byte("handledb:indexed")
 
-// byte -> 0 <not known>
-// byte -> negative int64 <position of record>
-// byte -> int64 <position of next byte range>
+// NewWithStore returns a database that uses the given store.
+func NewWithStore(store Store) (*DB, error) {
+	db := &DB{
+		store: store,
+	}
 
-// byte -> [byte]byte
+	_, err := store.Get(indexedKey)
+	if err == nil {
+		db.indexed = true
 
-func New(path string) (*DB, error) {
-	if err := os.MkdirAll(path, 0o750); err != nil {
+		return db, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
 		return nil, err
 	}
 
-	tree, err := bytetree.New(path)
+	// A new store has no handles from before the index existed
+	for _, err := range store.All() {
+		return db, err
+	}
 
-	// tree.Print()
+	db.indexed = true
 
-	return &DB{
-		tree: tree,
-	}, err
+	return db, store.Put(indexedKey, "1")
 }
 
 func (db *DB) Put(handle []byte, path string) error {
 	db.Lock()
 	defer db.Unlock()
 
-	for range 10 {
-		err := db.tree.Put(bytetree.Value{Handle: handle, Path: path})
-		if errors.Is(err, bytetree.ErrHasValue) {
-			continue
-		}
-
-		return err
-	}
+	return db.put(handle, path)
+}
 
-	return bytetree.ErrHasValue
+func (db *DB) put(handle []byte, path string) error {
+	return db.store.Put(handle, path)
 }
 
+// Get returns the path of a handle, or os.ErrNotExist
+// if the handle is unknown or tombstoned.
 func (db *DB) Get(handle []byte) (string, error) {
 	db.Lock()
 	defer db.Unlock()
 
-	return db.tree.Get(handle)
+	return db.get(handle)
 }
 
+func (db *DB) get(handle []byte) (string, error) {
+	path, err := db.store.Get(handle)
+	if err == nil && path == tombstone {
+		return "", os.ErrNotExist
+	}
+
+	return path, err
+}
+
+// A tombstoned handle is stored with an empty path.
+const tombstone = ""
+
+// Generate returns the handle of path, and generates one if path has none.
 func (db *DB) Generate(path string) ([]byte, error) {
-	hasher := crypto.MD5.New()
+	db.Lock()
+	defer db.Unlock()
+
+	handle, err := db.lookup(path)
+	if !errors.Is(err, os.ErrNotExist) {
+		return handle, err
+	}
 
-	_, err := hasher.Write([]byte(path))
+	handle, err = db.allocate(path)
 	if err != nil {
 		return nil, err
 	}
 
-	handle := hasher.Sum(nil)[:8]
+	if err := db.put(handle, path); err != nil {
+		return nil, err
+	}
+
+	return handle, db.putIndex(path, handle)
+}
+
+// Lookup returns the handle of path, or os.ErrNotExist if none was generated.
+func (db *DB) Lookup(path string) ([]byte, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	return db.lookup(path)
+}
+
+// lookup finds the handle of path in the index. Handles generated before the
+// index existed are found by probing handles starting at the hash of the path,
+// and are added to the index.
+func (db *DB) lookup(path string) ([]byte, error) {
+	handle, err := db.index(path)
+	if !errors.Is(err, os.ErrNotExist) || db.indexed {
+		return handle, err
+	}
+
+	handle = hash(path)[:8]
 
 	for {
-		stored, err := db.Get(handle)
+		stored, err := db.store.Get(handle)
 		if err != nil {
-			return handle, db.Put(handle, path)
+			return nil, err
 		}
 
 		if stored == path {
-			return handle, nil
+			return handle, db.putIndex(path, handle)
 		}
 
 		binary.BigEndian.PutUint64(handle, binary.BigEndian.Uint64(handle)+1)
 	}
 }
 
+// allocate returns a free handle for path. The hash of the path is tried first,
+// and random handles afterwards, so that allocating takes constant time even
+// when paths are removed and recreated repeatedly.
+func (db *DB) allocate(path string) ([]byte, error) {
+	handle := hash(path)[:8]
+
+	for {
+		_, err := db.store.Get(handle)
+		if errors.Is(err, os.ErrNotExist) {
+			return handle, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		rand.Read(handle) //nolint:errcheck
+	}
+}
+
+// Populate generates the handles of all files in fs, and marks the index as
+// complete, so that Generate no longer probes for handles generated before
+// the index existed.
+func (db *DB) Populate(fs vfs.WalkableFS) error {
+	err := vfs.ParallelWalk(fs, "/", vfs.WalkOptions{}, func(path string, info vfs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		_, err = db.Generate(path)
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	db.indexed = true
+
+	return db.put(indexedKey, "1")
+}
+
+// Move re-points the handle of oldpath to newpath, so that a renamed object
+// keeps its handle. The handle that newpath had is tombstoned, as the object
+// it referred to has been replaced.
+func (db *DB) Move(oldpath, newpath string) error {
+	if oldpath == newpath {
+		return nil
+	}
+
+	db.Lock()
+	defer db.Unlock()
+
+	if err := db.tombstone(newpath); err != nil {
+		return err
+	}
+
+	handle, err := db.lookup(oldpath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := db.put(handle, newpath); err != nil {
+		return err
+	}
+
+	if err := db.putIndex(newpath, handle); err != nil {
+		return err
+	}
+
+	return db.removeIndex(oldpath)
+}
+
+// Update calls fn with a database on top of db, of which the writes are
+// applied to the store as a group after fn returns, e.g. to move the handles
+// of a renamed directory and all its descendants at once. If fn returns an
+// error, nothing is written.
+func (db *DB) Update(fn func(tx *DB) error) error {
+	db.Lock()
+	defer db.Unlock()
+
+	b := newBatch(db.store)
+
+	tx := &DB{
+		store:   b,
+		indexed: db.indexed,
+	}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	return b.commit()
+}
+
+// Tombstone marks the handle of a removed path, so that Get returns
+// os.ErrNotExist, and a new object at the same path gets a new handle.
+func (db *DB) Tombstone(path string) error {
+	db.Lock()
+	defer db.Unlock()
+
+	return db.tombstone(path)
+}
+
+func (db *DB) tombstone(path string) error {
+	handle, err := db.lookup(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := db.put(handle, tombstone); err != nil {
+		return err
+	}
+
+	return db.removeIndex(path)
+}
+
+// The index is stored under keys that cannot collide with generated
+// handles, as they are longer. Paths with the same hash share a key,
+// which maps to a bucket of index entries.
+func indexKey(path string) []byte {
+	return append([]byte{'p'}, hash(path)...)
+}
+
+// indexEntry is a path and its handle in a bucket of the index. It is
+// encoded as the handle, the length of the path (4 bytes) and the path.
+type indexEntry struct {
+	handle []byte
+	path   string
+}
+
+func (db *DB) bucket(path string) ([]indexEntry, error) {
+	value, err := db.store.Get(indexKey(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var entries []indexEntry
+
+	for len(value) > 0 {
+		if len(value) < 12 {
+			return nil, fmt.Errorf("%w: index of %s", ErrCorrupt, path)
+		}
+
+		n := int(binary.BigEndian.Uint32([]byte(value[8:12])))
+
+		if len(value) < 12+n {
+			return nil, fmt.Errorf("%w: index of %s", ErrCorrupt, path)
+		}
+
+		entries = append(entries, indexEntry{
+			handle: []byte(value[:8]),
+			path:   value[12 : 12+n],
+		})
+
+		value = value[12+n:]
+	}
+
+	return entries, nil
+}
+
+func (db *DB) putBucket(path string, entries []indexEntry) error {
+	if len(entries) == 0 {
+		return db.store.Delete(indexKey(path))
+	}
+
+	var buf []byte
+
+	for _, entry := range entries {
+		buf = append(buf, entry.handle...)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(entry.path))) //nolint:gosec
+		buf = append(buf, entry.path...)
+	}
+
+	return db.put(indexKey(path), string(buf))
+}
+
+func (db *DB) index(path string) ([]byte, error) {
+	entries, err := db.bucket(path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.path == path {
+			return entry.handle, nil
+		}
+	}
+
+	return nil, os.ErrNotExist
+}
+
+// putIndex adds path to its bucket, keeping the entries of other paths with the same hash.
+func (db *DB) putIndex(path string, handle []byte) error {
+	entries, err := db.bucket(path)
+	if err != nil {
+		return err
+	}
+
+	entries = slices.DeleteFunc(entries, func(entry indexEntry) bool {
+		return entry.path == path
+	})
+
+	return db.putBucket(path, append(entries, indexEntry{handle: handle, path: path}))
+}
+
+func (db *DB) removeIndex(path string) error {
+	entries, err := db.bucket(path)
+	if err != nil {
+		return err
+	}
+
+	kept := slices.DeleteFunc(slices.Clone(entries), func(entry indexEntry) bool {
+		return entry.path == path
+	})
+
+	if len(kept) == len(entries) {
+		return nil
+	}
+
+	return db.putBucket(path, kept)
+}
+
+func hash(path string) []byte {
+	hasher := crypto.MD5.New()
+
+	hasher.Write([]byte(path))
+
+	return hasher.Sum(nil)
+}
+
+// Compact removes garbage from the store, if supported.
+func (db *DB) Compact() error {
+	db.Lock()
+	defer db.Unlock()
+
+	if store, ok := db.store.(compacter); ok {
+		return store.Compact()
+	}
+
+	return vfs.ErrNotSupported
+}
+
+// Verify checks the store for corruption, if supported.
+func (db *DB) Verify() error {
+	db.Lock()
+	defer db.Unlock()
+
+	if store, ok := db.store.(verifier); ok {
+		return store.Verify()
+	}
+
+	return vfs.ErrNotSupported
+}
+
+// Rebuild repairs a corrupt store, if supported.
+func (db *DB) Rebuild() error {
+	db.Lock()
+	defer db.Unlock()
+
+	if store, ok := db.store.(rebuilder); ok {
+		return store.Rebuild()
+	}
+
+	return vfs.ErrNotSupported
+}
+
+// Sync persists the pending writes of the store, if it batches them.
+func (db *DB) Sync() error {
+	db.Lock()
+	defer db.Unlock()
+
+	if store, ok := db.store.(syncer); ok {
+		return store.Sync()
+	}
+
+	return nil
+}
+
 func (db *DB) Close() error {
-	return db.tree.Close()
+	return db.store.Close()
 }
@@ -1,6 +1,16 @@
 package handledb
 
-import "testing"
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kuleuven/vfs"
+	"github.com/kuleuven/vfs/fs/nativefs"
+)
 
 func TestDB(t *testing.T) {
 	db, err := New(t.TempDir())
@@ -38,3 +48,426 @@ func TestDB(t *testing.T) {
 		t.Errorf("Expected path 'test2', got '%s'", path)
 	}
 }
+
+func TestMoveAndTombstone(t *testing.T) {
+	db, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	handle, err := db.Generate("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db.Lookup("/b"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+
+	for _, paths := range [][2]string{{"/a", "/b"}, {"/b", "/c"}} {
+		path := paths[1]
+
+		if err = db.Move(paths[0], path); err != nil {
+			t.Fatal(err)
+		}
+
+		moved, err := db.Generate(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(moved, handle) {
+			t.Fatalf("expected handle %x for %s, got %x", handle, path, moved)
+		}
+
+		if stored, err := db.Get(handle); err != nil || stored != path {
+			t.Fatalf("expected %s, got %s (%v)", path, stored, err)
+		}
+	}
+
+	// The old paths get new handles
+	other, err := db.Generate("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(other, handle) {
+		t.Fatal("expected a new handle for /a")
+	}
+
+	if err = db.Tombstone("/c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = db.Get(handle); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+
+	recreated, err := db.Generate("/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(recreated, handle) {
+		t.Fatal("expected a new handle for a recreated /c")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	db, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	handles := map[string][]byte{}
+
+	for _, path := range []string{"/dir", "/dir/a", "/dir/b"} {
+		if handles[path], err = db.Generate(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	errAbort := errors.New("abort")
+
+	// Nothing is written if the update fails
+	err = db.Update(func(tx *DB) error {
+		if err := tx.Move("/dir", "/aborted"); err != nil {
+			return err
+		}
+
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("expected errAbort, got %v", err)
+	}
+
+	if path, err := db.Get(handles["/dir"]); err != nil || path != "/dir" {
+		t.Fatalf("expected /dir, got %s (%v)", path, err)
+	}
+
+	err = db.Update(func(tx *DB) error {
+		for _, path := range []string{"/dir", "/dir/a", "/dir/b"} {
+			if err := tx.Move(path, "/moved"+path[4:]); err != nil {
+				return err
+			}
+		}
+
+		// Writes are visible within the update
+		if path, err := tx.Get(handles["/dir/a"]); err != nil || path != "/moved/a" {
+			t.Errorf("expected /moved/a, got %s (%v)", path, err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, handle := range handles {
+		moved := "/moved" + path[4:]
+
+		if current, err := db.Lookup(moved); err != nil || !bytes.Equal(current, handle) {
+			t.Errorf("expected handle %x for %s, got %x (%v)", handle, moved, current, err)
+		}
+
+		if _, err := db.Lookup(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("expected ErrNotExist for %s, got %v", path, err)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	db, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	handles := map[string]bool{}
+
+	// Recreating the same path repeatedly takes no probing
+	for range 100 {
+		handle, err := db.Generate("/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if again, err := db.Generate("/a"); err != nil || !bytes.Equal(again, handle) {
+			t.Fatalf("expected handle %x, got %x (%v)", handle, again, err)
+		}
+
+		if handles[string(handle)] {
+			t.Fatalf("handle %x was reused", handle)
+		}
+
+		handles[string(handle)] = true
+
+		if err := db.Tombstone("/a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIndexCollision(t *testing.T) {
+	db, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	// Pretend that /other has the same hash as /a
+	other := indexEntry{handle: []byte("12345678"), path: "/other"}
+
+	if err := db.putBucket("/a", []indexEntry{other}); err != nil {
+		t.Fatal(err)
+	}
+
+	handle, err := db.Generate("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := db.bucket("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []indexEntry{other, {handle: handle, path: "/a"}}
+
+	if !reflect.DeepEqual(entries, expected) {
+		t.Fatalf("expected %v, got %v", expected, entries)
+	}
+
+	if err := db.Tombstone("/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, err := db.bucket("/a"); err != nil || !reflect.DeepEqual(entries, []indexEntry{other}) {
+		t.Fatalf("expected only /other, got %v (%v)", entries, err)
+	}
+}
+
+func TestPopulate(t *testing.T) {
+	store, err := NewTreeStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Handles generated before the index existed
+	legacy := map[string][]byte{}
+
+	for _, path := range []string{"/", "/dir", "/dir/file"} {
+		handle := hash(path)[:8]
+
+		if err := store.Put(handle, path); err != nil {
+			t.Fatal(err)
+		}
+
+		legacy[path] = handle
+	}
+
+	db, err := NewWithStore(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	if db.indexed {
+		t.Fatal("expected a store with legacy handles not to be indexed")
+	}
+
+	fs := nativefs.New(t.Context(), t.TempDir())
+
+	if err := vfs.MkdirAll(fs, "/dir", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/dir/file", "/new"} {
+		if err := vfs.WriteFile(fs, path, []byte("data"), os.O_CREATE|os.O_WRONLY); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := db.Populate(fs); err != nil {
+		t.Fatal(err)
+	}
+
+	if !db.indexed {
+		t.Fatal("expected the store to be indexed")
+	}
+
+	for path, handle := range legacy {
+		if indexed, err := db.index(path); err != nil || !bytes.Equal(indexed, handle) {
+			t.Errorf("expected handle %x for %s, got %x (%v)", handle, path, indexed, err)
+		}
+	}
+
+	if _, err := db.index("/new"); err != nil {
+		t.Errorf("expected /new to be indexed, got %v", err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	db, err := New(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	handle, err := db.Generate("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Move("/a", "/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Move("/b", "/c"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	if moved, err := db.Lookup("/c"); err != nil || !bytes.Equal(moved, handle) {
+		t.Fatalf("expected handle %x, got %x (%v)", handle, moved, err)
+	}
+}
+
+func testStore(t *testing.T, store Store) {
+	t.Helper()
+
+	for _, value := range []Value{
+		{Handle: []byte{2}, Path: "/b"},
+		{Handle: []byte{1}, Path: "/a"},
+		{Handle: []byte{1, 2}, Path: "/c"},
+		{Handle: []byte{2}, Path: "/d"},
+	} {
+		if err := store.Put(value.Handle, value.Path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.Delete([]byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Delete([]byte{1, 2}); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+
+	if _, err := store.Get([]byte{3}); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected ErrNotExist, got %v", err)
+	}
+
+	migrated, err := NewTreeStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer migrated.Close()
+
+	if err := Migrate(migrated, store); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Value{
+		{Handle: []byte{1}, Path: "/a"},
+		{Handle: []byte{2}, Path: "/d"},
+	}
+
+	for _, store := range []Store{store, migrated} {
+		var values []Value
+
+		for value, err := range store.All() {
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			values = append(values, value)
+		}
+
+		if !reflect.DeepEqual(values, expected) {
+			t.Fatalf("expected %v, got %v", expected, values)
+		}
+	}
+}
+
+func TestTreeStore(t *testing.T) {
+	store, err := NewTreeStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store.Close()
+
+	testStore(t, store)
+}
+
+func TestSQLiteStore(t *testing.T) {
+	store, err := NewSQLiteStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store.Close()
+
+	testStore(t, store)
+
+	if err := store.Verify(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	if _, err := Open(t.TempDir(), "unknown"); !errors.Is(err, vfs.ErrNotSupported) {
+		t.Fatalf("expected ErrNotSupported, got %v", err)
+	}
+
+	dir := t.TempDir()
+
+	db, err := Open(dir, TreeStoreKind)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handle, err := db.Generate("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Switching to SQLite migrates the handles
+	db, err = Open(dir, SQLiteStoreKind)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+
+	if path, err := db.Get(handle); err != nil || path != "/a" {
+		t.Fatalf("expected /a, got %s (%v)", path, err)
+	}
+
+	// The store was migrated in a temporary directory
+	if matches, err := filepath.Glob(filepath.Join(dir, ".migrate-*")); err != nil || len(matches) > 0 {
+		t.Fatalf("expected no temporary directories, got %v (%v)", matches, err)
+	}
+}
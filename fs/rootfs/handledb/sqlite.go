@@ -0,0 +1,187 @@
+package handledb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"iter"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/kuleuven/vfs"
+	"go.uber.org/multierr"
+)
+
+const sqliteFile = "handles.sqlite"
+
+// SQLiteDriver is the database/sql driver used by SQLiteStore. The pure-Go
+// modernc.org/sqlite driver is registered under this name.
+var SQLiteDriver = "sqlite"
+
+// SQLiteStore is a Store in a SQLite database, which can be queried
+// by handle and by path.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+var _ Store = &SQLiteStore{}
+
+// NewSQLiteStore opens the SQLite database in the directory at path.
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	if !slices.Contains(sql.Drivers(), SQLiteDriver) {
+		return nil, fmt.Errorf("%w: sql driver %q is not registered", vfs.ErrNotSupported, SQLiteDriver)
+	}
+
+	dsn := "file:" + filepath.Join(path, sqliteFile) + "?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_pragma=synchronous(NORMAL)"
+
+	db, err := sql.Open(SQLiteDriver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS handles (handle BLOB PRIMARY KEY, path TEXT NOT NULL) WITHOUT ROWID`,
+		`CREATE INDEX IF NOT EXISTS handles_path ON handles (path)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+
+			return nil, err
+		}
+	}
+
+	return &SQLiteStore{
+		db: db,
+	}, nil
+}
+
+func (s *SQLiteStore) Put(handle []byte, path string) error {
+	_, err := s.db.Exec(`INSERT INTO handles (handle, path) VALUES (?, ?) ON CONFLICT (handle) DO UPDATE SET path = excluded.path`, handle, path)
+
+	return err
+}
+
+func (s *SQLiteStore) Get(handle []byte) (string, error) {
+	var path string
+
+	err := s.db.QueryRow(`SELECT path FROM handles WHERE handle = ?`, handle).Scan(&path)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", os.ErrNotExist
+	}
+
+	return path, err
+}
+
+func (s *SQLiteStore) Delete(handle []byte) error {
+	result, err := s.db.Exec(`DELETE FROM handles WHERE handle = ?`, handle)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return os.ErrNotExist
+	}
+
+	return nil
+}
+
+// Update stores values and deletes handles in a single transaction.
+func (s *SQLiteStore) Update(values []Value, deletes [][]byte) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, value := range values {
+		if _, err := tx.Exec(`INSERT INTO handles (handle, path) VALUES (?, ?) ON CONFLICT (handle) DO UPDATE SET path = excluded.path`, value.Handle, value.Path); err != nil {
+			return multierr.Append(err, tx.Rollback())
+		}
+	}
+
+	for _, handle := range deletes {
+		if _, err := tx.Exec(`DELETE FROM handles WHERE handle = ?`, handle); err != nil {
+			return multierr.Append(err, tx.Rollback())
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStore) All() iter.Seq2[Value, error] {
+	return func(yield func(Value, error) bool) {
+		rows, err := s.db.Query(`SELECT handle, path FROM handles ORDER BY handle`)
+		if err != nil {
+			yield(Value{}, err)
+
+			return
+		}
+
+		defer rows.Close()
+
+		for rows.Next() {
+			var value Value
+
+			if err := rows.Scan(&value.Handle, &value.Path); err != nil {
+				yield(Value{}, err)
+
+				return
+			}
+
+			if !yield(value, nil) {
+				return
+			}
+		}
+
+		if err := rows.Err(); err != nil {
+			yield(Value{}, err)
+		}
+	}
+}
+
+// Compact rebuilds the database file without free pages.
+func (s *SQLiteStore) Compact() error {
+	_, err := s.db.Exec(`VACUUM`)
+
+	return err
+}
+
+// Verify runs the integrity check of SQLite.
+func (s *SQLiteStore) Verify() error {
+	rows, err := s.db.Query(`PRAGMA integrity_check`)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	var problems []string
+
+	for rows.Next() {
+		var problem string
+
+		if err := rows.Scan(&problem); err != nil {
+			return err
+		}
+
+		if problem != "ok" {
+			problems = append(problems, problem)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %v", ErrCorrupt, problems)
+	}
+
+	return nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
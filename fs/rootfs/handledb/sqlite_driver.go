@@ -0,0 +1,3 @@
+package handledb
+
+import _ "modernc.org/sqlite" // Registers the sqlite driver
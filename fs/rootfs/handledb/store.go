@@ -0,0 +1,169 @@
+package handledb
+
+import (
+	"fmt"
+	"iter"
+	"os"
+	"path/filepath"
+
+	"github.com/kuleuven/vfs"
+	"github.com/kuleuven/vfs/bytetree"
+	"go.uber.org/multierr"
+)
+
+// Value is a handle and the path it refers to.
+type Value = bytetree.Value
+
+// ErrCorrupt is returned by Verify when the store is corrupt.
+var ErrCorrupt = bytetree.ErrCorrupt
+
+// Store persists the handles and their paths.
+type Store interface {
+	// Put stores the path of a handle, replacing a previous one.
+	Put(handle []byte, path string) error
+	// Get returns the path of a handle, or os.ErrNotExist.
+	Get(handle []byte) (string, error)
+	// Delete removes a handle, or returns os.ErrNotExist.
+	Delete(handle []byte) error
+	// All iterates over the stored values, ordered by handle.
+	All() iter.Seq2[Value, error]
+	Close() error
+}
+
+// The kinds of stores that can be selected with the vfs.HandleDBStore context key.
+const (
+	TreeStoreKind   = "bytetree"
+	SQLiteStoreKind = "sqlite"
+)
+
+// OpenStore opens a store of the given kind in the directory at path.
+// An empty kind selects the bytetree store, which is configured by opts.
+func OpenStore(path, kind string, opts ...bytetree.Option) (Store, error) {
+	if err := os.MkdirAll(path, 0o750); err != nil {
+		return nil, err
+	}
+
+	switch kind {
+	case TreeStoreKind, "":
+		return NewTreeStore(path, opts...)
+	case SQLiteStoreKind:
+		return NewSQLiteStore(path)
+	default:
+		return nil, fmt.Errorf("%w: handle store %q", vfs.ErrNotSupported, kind)
+	}
+}
+
+// storeFiles returns the files of a store of the given kind. The last file
+// is created last, and marks that the store exists.
+func storeFiles(kind string) []string {
+	if kind == SQLiteStoreKind {
+		return []string{sqliteFile}
+	}
+
+	return []string{valuesFile, inodesFile}
+}
+
+// storeExists checks whether the directory at path contains a store of the given kind.
+func storeExists(path, kind string) bool {
+	files := storeFiles(kind)
+
+	_, err := os.Stat(filepath.Join(path, files[len(files)-1]))
+
+	return err == nil
+}
+
+// Open opens a database in the directory at path, using a store of the
+// given kind. If there is no such store yet, but the directory contains
+// a store of another kind, its handles are migrated first.
+func Open(path, kind string, opts ...bytetree.Option) (*DB, error) {
+	if kind == "" {
+		kind = TreeStoreKind
+	}
+
+	if !storeExists(path, kind) {
+		if err := migrate(path, kind, opts...); err != nil {
+			return nil, err
+		}
+	}
+
+	store, err := OpenStore(path, kind, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := NewWithStore(store)
+	if err != nil {
+		return nil, multierr.Append(err, store.Close())
+	}
+
+	return db, nil
+}
+
+// migrate copies the handles of a store of another kind in the directory
+// at path, if there is one, to a new store of the given kind. The new store
+// is built in a temporary directory, and only moved into place when it is
+// complete, so that an interrupted migration is started over by the next Open.
+func migrate(path, kind string, opts ...bytetree.Option) error {
+	for _, other := range []string{TreeStoreKind, SQLiteStoreKind} {
+		if other == kind || !storeExists(path, other) {
+			continue
+		}
+
+		tmp, err := os.MkdirTemp(path, ".migrate-")
+		if err != nil {
+			return err
+		}
+
+		defer os.RemoveAll(tmp)
+
+		dst, err := OpenStore(tmp, kind, opts...)
+		if err != nil {
+			return err
+		}
+
+		src, err := OpenStore(path, other)
+		if err != nil {
+			return multierr.Append(err, dst.Close())
+		}
+
+		if err := multierr.Combine(Migrate(dst, src), src.Close(), dst.Close()); err != nil {
+			return err
+		}
+
+		for _, name := range storeFiles(kind) {
+			if err := os.Rename(filepath.Join(tmp, name), filepath.Join(path, name)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	return nil
+}
+
+// Migrate copies all handles from src to dst.
+func Migrate(dst, src Store) error {
+	for value, err := range src.All() {
+		if err != nil {
+			return err
+		}
+
+		if err := dst.Put(value.Handle, value.Path); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Optional interfaces for maintenance of a store.
+type (
+	compacter interface{ Compact() error }
+	verifier  interface{ Verify() error }
+	rebuilder interface{ Rebuild() error }
+	syncer    interface{ Sync() error }
+	updater   interface {
+		Update(values []Value, deletes [][]byte) error
+	}
+)
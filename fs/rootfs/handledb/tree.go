@@ -0,0 +1,104 @@
+package handledb
+
+import (
+	"errors"
+	"iter"
+
+	"github.com/kuleuven/vfs/bytetree"
+)
+
+// 64 exabyte is not a good idea :)
+// <path>/inodes.db [inode:number]
+// <path>/files.db  [number:path]
+// <path>/lock
+
+// byte -> 0 <not known>
+// byte -> negative int64 <position of record>
+// byte -> int64 <position of next byte range>
+
+// byte -> [byte]byte
+
+const (
+	inodesFile = "inodes.db"
+	valuesFile = "files.db"
+)
+
+// TreeStore is a Store on a bytetree.ByteTree.
+type TreeStore struct {
+	tree *bytetree.ByteTree
+}
+
+var _ Store = &TreeStore{}
+
+// NewTreeStore opens the bytetree in the directory at path.
+func NewTreeStore(path string, opts ...bytetree.Option) (*TreeStore, error) {
+	tree, err := bytetree.New(path, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TreeStore{
+		tree: tree,
+	}, nil
+}
+
+func (s *TreeStore) Put(handle []byte, path string) error {
+	return retry(func() error {
+		return s.tree.Put(bytetree.Value{Handle: handle, Path: path})
+	})
+}
+
+func (s *TreeStore) Get(handle []byte) (string, error) {
+	return s.tree.Get(handle)
+}
+
+func (s *TreeStore) Delete(handle []byte) error {
+	return retry(func() error {
+		return s.tree.Delete(handle)
+	})
+}
+
+// Update stores values and deletes handles as a group.
+func (s *TreeStore) Update(values []Value, deletes [][]byte) error {
+	return retry(func() error {
+		return s.tree.Update(values, deletes)
+	})
+}
+
+func (s *TreeStore) All() iter.Seq2[Value, error] {
+	return s.tree.All()
+}
+
+func (s *TreeStore) Compact() error {
+	return s.tree.Compact()
+}
+
+func (s *TreeStore) Verify() error {
+	return s.tree.Verify()
+}
+
+func (s *TreeStore) Rebuild() error {
+	return s.tree.Rebuild()
+}
+
+func (s *TreeStore) Sync() error {
+	return s.tree.Sync()
+}
+
+func (s *TreeStore) Close() error {
+	return s.tree.Close()
+}
+
+// retry retries an update of the tree that conflicted with another process.
+func retry(fn func() error) error {
+	for range 10 {
+		err := fn()
+		if errors.Is(err, bytetree.ErrHasValue) {
+			continue
+		}
+
+		return err
+	}
+
+	return bytetree.ErrHasValue
+}
@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"github.com/kuleuven/vfs"
+	"github.com/kuleuven/vfs/bytetree"
 	"github.com/kuleuven/vfs/fs/rootfs/handledb"
 	"github.com/sirupsen/logrus"
 	"go.uber.org/multierr"
@@ -24,9 +25,24 @@ var _ vfs.RootFS = &Root{}
 
 var _ vfs.WalkFS = &Root{}
 
+var _ vfs.ParallelWalkFS = &Root{}
+
+var _ vfs.StatFSFS = &Root{}
+
+var _ vfs.LockFS = &Root{}
+
+var _ vfs.WatchFS = &Root{}
+
+var _ vfs.CopyFileFS = &Root{}
+
+// HandleDBCommitSize is the number of pending writes after which the inode
+// handle database commits them, if vfs.HandleDBCommitInterval is set.
+var HandleDBCommitSize = 4096
+
 type Root struct {
-	Context context.Context //nolint:containedctx
-	mounts  []*Mount
+	Context  context.Context //nolint:containedctx
+	mounts   []*Mount
+	notifier vfs.Notifier // Synthesizes events for changes made through the root
 }
 
 func New(ctx context.Context) *Root {
@@ -133,7 +149,13 @@ func (r *Root) prepareMount(path string, fs vfs.FS, index byte) *Mount {
 		return mount
 	}
 
-	db, err := handledb.New(filepath.Join(storage, fmt.Sprintf("%02x", mount.Index)))
+	var opts []bytetree.Option
+
+	if interval := vfs.Duration(r.Context, vfs.HandleDBCommitInterval); interval > 0 {
+		opts = append(opts, bytetree.WithGroupCommit(interval, HandleDBCommitSize))
+	}
+
+	db, err := handledb.Open(filepath.Join(storage, fmt.Sprintf("%02x", mount.Index)), vfs.String(r.Context, vfs.HandleDBStore), opts...)
 	if err != nil {
 		r.Logger().Warnf("Cannot load HandleDB for %s: %v", mount.Mountpoint, err)
 
@@ -162,6 +184,84 @@ func (m Mount) Below(path string) bool {
 	return strings.HasPrefix(m.Mountpoint, path+string(vfs.Separator))
 }
 
+// renameHandles updates the HandleDB after oldpath was renamed to newpath,
+// so that the handles of the object and its descendants move along. The
+// descendants are listed first, and their handles are updated as a group.
+// This is best-effort: entries that cannot be walked are tombstoned instead,
+// and all errors are returned after the other handles were moved.
+func (m *Mount) renameHandles(oldpath, newpath string) error {
+	if m.HandleDB == nil {
+		return nil
+	}
+
+	handleFS, ok := m.FS.(vfs.HandleFS)
+
+	var (
+		paths   []string
+		handles [][]byte
+		failed  []string
+		errs    error
+	)
+
+	err := vfs.Walk(m.FS, newpath, func(path string, info vfs.FileInfo, err error) error {
+		var handle []byte
+
+		if err == nil && ok {
+			handle, err = handleFS.Handle(path)
+		}
+
+		if err != nil {
+			failed = append(failed, path)
+			errs = multierr.Append(errs, err)
+
+			return nil
+		}
+
+		paths = append(paths, path)
+		handles = append(handles, handle)
+
+		return nil
+	})
+
+	errs = multierr.Append(errs, err)
+
+	err = m.HandleDB.Update(func(tx *handledb.DB) error {
+		for i, path := range paths {
+			var err error
+
+			if ok {
+				err = tx.Put(handles[i], path)
+			} else {
+				err = tx.Move(oldpath+strings.TrimPrefix(path, newpath), path)
+			}
+
+			errs = multierr.Append(errs, err)
+		}
+
+		for _, path := range failed {
+			errs = multierr.Append(errs, tx.Tombstone(oldpath+strings.TrimPrefix(path, newpath)))
+		}
+
+		return nil
+	})
+
+	return multierr.Append(errs, err)
+}
+
+// removeHandle tombstones the generated handle of a removed path.
+// Handles of a HandleFS are not reused for a new object at the same path.
+func (m *Mount) removeHandle(path string) error {
+	if m.HandleDB == nil {
+		return nil
+	}
+
+	if _, ok := m.FS.(vfs.HandleFS); ok {
+		return nil
+	}
+
+	return m.HandleDB.Tombstone(path)
+}
+
 func (r *Root) Close() error {
 	r.Logger().Trace("Close()")
 
@@ -338,7 +438,18 @@ func (r *Root) FileWrite(path string, flag int) (vfs.WriterAt, error) {
 		return nil, err
 	}
 
-	return fs.FileWrite(path, flag)
+	watched, created := r.watchWrite(fs, path, flag)
+
+	w, err := fs.FileWrite(path, flag)
+	if err != nil || !watched {
+		return w, err
+	}
+
+	if created {
+		r.notify(vfs.EventCreate, fs, path)
+	}
+
+	return r.notifier.NotifyWriter(w, vfs.Join(fs.Mountpoint, path[1:])), nil
 }
 
 func (r *Root) Open(path string) (vfs.File, error) {
@@ -363,12 +474,28 @@ func (r *Root) OpenFile(path string, flag int, perm os.FileMode) (vfs.File, erro
 	}
 
 	if ofs, ok := fs.FS.(vfs.OpenFileFS); ok {
+		var watched, created bool
+
+		if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+			watched, created = r.watchWrite(fs, path, flag)
+		}
+
 		f, err := ofs.OpenFile(path, flag, perm)
 		if err != nil {
 			return nil, err
 		}
 
-		return &wrapFileName{f, logicalPath}, nil
+		if !watched {
+			return &wrapFileName{f, logicalPath, nil}, nil
+		}
+
+		if created {
+			r.notify(vfs.EventCreate, fs, path)
+		}
+
+		return &wrapFileName{f, logicalPath, func() {
+			r.notify(vfs.EventWrite, fs, path)
+		}}, nil
 	}
 
 	if flag&os.O_WRONLY == 0 && flag&os.O_RDWR == 0 {
@@ -381,12 +508,23 @@ func (r *Root) OpenFile(path string, flag int, perm os.FileMode) (vfs.File, erro
 type wrapFileName struct {
 	vfs.File
 	logicalPath string
+	notify      func() // Called after a file opened for writing is closed
 }
 
 func (w *wrapFileName) Name() string {
 	return w.logicalPath
 }
 
+func (w *wrapFileName) Close() error {
+	err := w.File.Close()
+
+	if w.notify != nil {
+		w.notify()
+	}
+
+	return err
+}
+
 func (r *Root) Chmod(path string, mode os.FileMode) error {
 	r.Logger().Debugf("Chmod(%q, %v)", path, mode)
 
@@ -428,7 +566,13 @@ func (r *Root) Truncate(path string, size int64) error {
 		return err
 	}
 
-	return fs.Truncate(path, size)
+	if err := fs.Truncate(path, size); err != nil {
+		return err
+	}
+
+	r.notify(vfs.EventWrite, fs, path)
+
+	return nil
 }
 
 func (r *Root) SetExtendedAttr(path, name string, value []byte) error {
@@ -439,7 +583,13 @@ func (r *Root) SetExtendedAttr(path, name string, value []byte) error {
 		return err
 	}
 
-	return fs.SetExtendedAttr(path, name, value)
+	if err := fs.SetExtendedAttr(path, name, value); err != nil {
+		return err
+	}
+
+	r.notify(vfs.EventXattr, fs, path)
+
+	return nil
 }
 
 func (r *Root) UnsetExtendedAttr(path, name string) error {
@@ -450,7 +600,13 @@ func (r *Root) UnsetExtendedAttr(path, name string) error {
 		return err
 	}
 
-	return fs.UnsetExtendedAttr(path, name)
+	if err := fs.UnsetExtendedAttr(path, name); err != nil {
+		return err
+	}
+
+	r.notify(vfs.EventXattr, fs, path)
+
+	return nil
 }
 
 func (r *Root) SetExtendedAttrs(path string, attrs vfs.Attributes) error {
@@ -461,7 +617,13 @@ func (r *Root) SetExtendedAttrs(path string, attrs vfs.Attributes) error {
 		return err
 	}
 
-	return vfs.SetExtendedAttrs(fs, path, attrs)
+	if err := vfs.SetExtendedAttrs(fs, path, attrs); err != nil {
+		return err
+	}
+
+	r.notify(vfs.EventXattr, fs, path)
+
+	return nil
 }
 
 func (r *Root) Rename(oldpath, newpath string) error {
@@ -481,7 +643,104 @@ func (r *Root) Rename(oldpath, newpath string) error {
 		return vfs.ErrNotSupported
 	}
 
-	return fs.Rename(path, target)
+	if err := fs.Rename(path, target); err != nil {
+		return err
+	}
+
+	// The rename stands, even if not all handles can follow
+	if err := fs.renameHandles(path, target); err != nil {
+		r.Logger().Warnf("Rename(%q, %q): cannot move all handles: %v", oldpath, newpath, err)
+	}
+
+	r.notifier.Notify(vfs.Event{
+		Op:      vfs.EventRename,
+		Path:    vfs.Join(fs.Mountpoint, target[1:]),
+		OldPath: vfs.Join(fs.Mountpoint, path[1:]),
+	})
+
+	return nil
+}
+
+// CopyFile copies src to dst, server-side if both are on the same mount and
+// its file system supports it, or by streaming the data otherwise. The paths
+// are checked as by FileRead and FileWrite before dst is touched: src must
+// be a file, and dst must not resolve to src.
+func (r *Root) CopyFile(src, dst string, flags int) error {
+	r.Logger().Debugf("CopyFile(%q, %q, %d)", src, dst, flags)
+
+	logicalSrc, logicalDst := src, dst
+
+	fs, src, err := r.FollowSymlinks(src)
+	if err != nil {
+		return err
+	}
+
+	dstfs, dst, err := r.FollowSymlinks(dst)
+	if err != nil {
+		return err
+	}
+
+	if err = checkCopy(fs, src, dstfs, dst); errors.Is(err, syscall.EISDIR) {
+		return &os.PathError{Op: "copy", Path: logicalSrc, Err: err}
+	} else if errors.Is(err, syscall.EINVAL) {
+		return &os.PathError{Op: "copy", Path: logicalDst, Err: err}
+	} else if err != nil {
+		return err
+	}
+
+	watched, created := r.watchWrite(dstfs, dst, flags)
+
+	err = vfs.ErrNotSupported
+
+	if copyFS, ok := fs.FS.(vfs.CopyFileFS); ok && fs == dstfs {
+		err = copyFS.CopyFile(src, dst, flags)
+	}
+
+	if errors.Is(err, vfs.ErrNotSupported) {
+		err = vfs.StreamFile(dstfs, dst, fs, src, flags)
+	}
+
+	if err != nil || !watched {
+		return err
+	}
+
+	if created {
+		r.notify(vfs.EventCreate, dstfs, dst)
+	}
+
+	r.notify(vfs.EventWrite, dstfs, dst)
+
+	return nil
+}
+
+// checkCopy returns an error if src in fs cannot be copied to dst in dstfs,
+// because src is a directory or the same file as dst.
+func checkCopy(fs *Mount, src string, dstfs *Mount, dst string) error {
+	fi, err := fs.Stat(src)
+	if err != nil {
+		return err
+	}
+
+	if fi.IsDir() {
+		return syscall.EISDIR
+	}
+
+	if fs == dstfs && src == dst {
+		return syscall.EINVAL
+	}
+
+	dfi, err := dstfs.Stat(dst)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if fs == dstfs && os.SameFile(fi, dfi) {
+		return syscall.EINVAL
+	}
+
+	return nil
 }
 
 func (r *Root) Rmdir(path string) error {
@@ -492,7 +751,17 @@ func (r *Root) Rmdir(path string) error {
 		return err
 	}
 
-	return fs.Rmdir(path)
+	if err := fs.Rmdir(path); err != nil {
+		return err
+	}
+
+	if err := fs.removeHandle(path); err != nil {
+		r.Logger().Warnf("Rmdir(%q): cannot tombstone handle: %v", path, err)
+	}
+
+	r.notify(vfs.EventRemove, fs, path)
+
+	return nil
 }
 
 func (r *Root) Remove(path string) error {
@@ -503,7 +772,17 @@ func (r *Root) Remove(path string) error {
 		return err
 	}
 
-	return fs.Remove(path)
+	if err := fs.Remove(path); err != nil {
+		return err
+	}
+
+	if err := fs.removeHandle(path); err != nil {
+		r.Logger().Warnf("Remove(%q): cannot tombstone handle: %v", path, err)
+	}
+
+	r.notify(vfs.EventRemove, fs, path)
+
+	return nil
 }
 
 func (r *Root) Mkdir(path string, perm os.FileMode) error {
@@ -514,7 +793,13 @@ func (r *Root) Mkdir(path string, perm os.FileMode) error {
 		return err
 	}
 
-	return fs.Mkdir(path, perm)
+	if err := fs.Mkdir(path, perm); err != nil {
+		return err
+	}
+
+	r.notify(vfs.EventCreate, fs, path)
+
+	return nil
 }
 
 func (r *Root) Link(target, path string) error {
@@ -538,11 +823,18 @@ func (r *Root) Link(target, path string) error {
 		return vfs.ErrNotSupported
 	}
 
-	if linkFS, ok := fs.FS.(vfs.LinkFS); ok {
-		return linkFS.Link(target, path)
+	linkFS, ok := fs.FS.(vfs.LinkFS)
+	if !ok {
+		return vfs.ErrNotSupported
 	}
 
-	return vfs.ErrNotSupported
+	if err := linkFS.Link(target, path); err != nil {
+		return err
+	}
+
+	r.notify(vfs.EventCreate, fs, path)
+
+	return nil
 }
 
 func (r *Root) Symlink(target, path string) error {
@@ -573,11 +865,17 @@ func (r *Root) Symlink(target, path string) error {
 		return vfs.ErrNotSupported
 	}
 
-	if !vfs.IsAbs(target) {
-		return symlinkFS.Symlink(target, path)
+	if vfs.IsAbs(target) {
+		target = abstarget
+	}
+
+	if err := symlinkFS.Symlink(target, path); err != nil {
+		return err
 	}
 
-	return symlinkFS.Symlink(abstarget, path)
+	r.notify(vfs.EventCreate, fs, path)
+
+	return nil
 }
 
 func (r *Root) List(path string) (vfs.ListerAt, error) {
@@ -812,6 +1110,68 @@ func (r *Root) Handle(path string) ([]byte, error) {
 
 var UnsupportedHandle = byte(254)
 
+// RenameHandles updates the handles after oldpath was renamed to newpath
+// outside of the root, e.g. as reported by the backend, so that the handles
+// of the object and its descendants keep referring to them.
+func (r *Root) RenameHandles(oldpath, newpath string) error {
+	r.Logger().Debugf("RenameHandles(%q, %q)", oldpath, newpath)
+
+	fs, path, err := r.ResolvePath(oldpath)
+	if err != nil {
+		return err
+	}
+
+	newfs, target, err := r.ResolvePath(newpath)
+	if err != nil {
+		return err
+	}
+
+	if fs.Mountpoint != newfs.Mountpoint {
+		return vfs.ErrNotSupported
+	}
+
+	return fs.renameHandles(path, target)
+}
+
+// RemoveHandles tombstones the handle of a path that was removed
+// outside of the root, so that it is not reused for a new object.
+func (r *Root) RemoveHandles(path string) error {
+	r.Logger().Debugf("RemoveHandles(%q)", path)
+
+	fs, path, err := r.ResolvePath(path)
+	if err != nil {
+		return err
+	}
+
+	return fs.removeHandle(path)
+}
+
+// PopulateHandles generates the handles of all objects in the mount at
+// mountpoint, so that handles generated before the handle database kept
+// an index of paths no longer need to be probed for.
+func (r *Root) PopulateHandles(mountpoint string) error {
+	r.Logger().Debugf("PopulateHandles(%q)", mountpoint)
+
+	for _, mp := range r.mounts {
+		if mp.Mountpoint != mountpoint {
+			continue
+		}
+
+		if mp.HandleDB == nil {
+			return vfs.ErrNotSupported
+		}
+
+		// Handles of a HandleFS are not generated
+		if _, ok := mp.FS.(vfs.HandleFS); ok {
+			return nil
+		}
+
+		return mp.HandleDB.Populate(mp.FS)
+	}
+
+	return os.ErrNotExist
+}
+
 func (r *Root) Path(handle []byte) (string, error) {
 	r.Logger().Debugf("Path(%s)", hex.EncodeToString(handle))
 
@@ -844,7 +1204,11 @@ func (r *Root) Path(handle []byte) (string, error) {
 			path, err = mp.HandleDB.Get(handle[1:])
 		}
 
-		return vfs.Join(mp.Mountpoint, path[1:]), err
+		if err != nil {
+			return "", err
+		}
+
+		return vfs.Join(mp.Mountpoint, path[1:]), nil
 	}
 
 	return "", os.ErrNotExist
@@ -894,7 +1258,7 @@ func (r *Root) walkFS(mountpoint string, fn vfs.WalkFunc) vfs.WalkFunc {
 func (r *Root) RemoveAll(path string) error {
 	r.Logger().Debugf("RemoveAll(%q)", path)
 
-	return vfs.RemoveAll(r, path)
+	return vfs.RemoveAllWalk(r, path)
 }
 
 func (r *Root) Checksum(path string, algorithm crypto.Hash) ([]byte, error) {
@@ -912,3 +1276,160 @@ func (r *Root) Checksum(path string, algorithm crypto.Hash) ([]byte, error) {
 
 	return vfs.Checksum(fs.FS, path, algorithm)
 }
+
+func (r *Root) StatFS(path string) (*vfs.StatFS, error) {
+	r.Logger().Debugf("StatFS(%q)", path)
+
+	fs, path, err := r.FollowSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+
+	statFS, ok := fs.FS.(vfs.StatFSFS)
+	if ok {
+		return statFS.StatFS(path)
+	}
+
+	return nil, vfs.ErrNotSupported
+}
+
+func (r *Root) AcquireLock(path string, lock vfs.Lock) error {
+	r.Logger().Debugf("AcquireLock(%q, %v)", path, lock)
+
+	return r.lockFS(path, func(fs vfs.LockFS, path string) error {
+		return fs.AcquireLock(path, lock)
+	})
+}
+
+func (r *Root) ReleaseLock(path string, lock vfs.Lock) error {
+	r.Logger().Debugf("ReleaseLock(%q, %v)", path, lock)
+
+	return r.lockFS(path, func(fs vfs.LockFS, path string) error {
+		return fs.ReleaseLock(path, lock)
+	})
+}
+
+func (r *Root) TestLock(path string, lock vfs.Lock) error {
+	r.Logger().Debugf("TestLock(%q, %v)", path, lock)
+
+	return r.lockFS(path, func(fs vfs.LockFS, path string) error {
+		return fs.TestLock(path, lock)
+	})
+}
+
+func (r *Root) lockFS(path string, fn func(vfs.LockFS, string) error) error {
+	fs, path, err := r.FollowSymlinks(path)
+	if err != nil {
+		return err
+	}
+
+	lockFS, ok := fs.FS.(vfs.LockFS)
+	if ok {
+		return fn(lockFS, path)
+	}
+
+	return vfs.ErrNotSupported
+}
+
+// Watch reports changes to the path. Changes made through the root are
+// reported immediately. Changes made by others are reported if the mounted
+// file systems implement vfs.WatchFS. Event paths are resolved paths,
+// i.e. symlinks in the watched path are followed.
+func (r *Root) Watch(path string, recursive bool) (vfs.Watcher, error) {
+	r.Logger().Debugf("Watch(%q, %v)", path, recursive)
+
+	fs, fspath, err := r.FollowSymlinks(path)
+	if err != nil {
+		return nil, err
+	}
+
+	realPath := vfs.Join(fs.Mountpoint, fspath[1:])
+
+	watchers := []vfs.Watcher{r.notifier.Watch(realPath, recursive)}
+
+	mounts := []*Mount{fs}
+
+	if recursive {
+		for _, m := range r.mounts {
+			if m.Below(realPath) || realPath == "/" && m.Mountpoint != "/" {
+				mounts = append(mounts, m)
+			}
+		}
+	}
+
+	for _, m := range mounts {
+		watchFS, ok := m.FS.(vfs.WatchFS)
+		if !ok {
+			continue
+		}
+
+		watchPath := "/"
+
+		if m == fs {
+			watchPath = fspath
+		}
+
+		w, err := watchFS.Watch(watchPath, recursive)
+		if err != nil {
+			for _, w := range watchers {
+				w.Close()
+			}
+
+			return nil, err
+		}
+
+		watchers = append(watchers, vfs.FilterWatcher(w, r.translateEvent(m)))
+	}
+
+	return vfs.MergeWatchers(watchers...), nil
+}
+
+// translateEvent returns a function that translates the paths of events of the mount
+// to paths of the root. Events for paths that are hidden by another mount are dropped.
+func (r *Root) translateEvent(mount *Mount) func(vfs.Event) (vfs.Event, bool) {
+	translate := func(path string) (string, bool) {
+		if path == "" {
+			return "", true
+		}
+
+		path = vfs.Join(mount.Mountpoint, path[1:])
+
+		for _, m := range r.mounts {
+			if len(m.Mountpoint) > len(mount.Mountpoint) && m.Contains(path) {
+				return "", false
+			}
+		}
+
+		return path, true
+	}
+
+	return func(event vfs.Event) (vfs.Event, bool) {
+		var ok1, ok2 bool
+
+		event.Path, ok1 = translate(event.Path)
+		event.OldPath, ok2 = translate(event.OldPath)
+
+		return event, ok1 && ok2
+	}
+}
+
+// notify reports an event for a path of a mount to the watchers.
+func (r *Root) notify(op vfs.EventOp, mount *Mount, path string) {
+	r.notifier.Notify(vfs.Event{Op: op, Path: vfs.Join(mount.Mountpoint, path[1:])})
+}
+
+// watchWrite returns whether a file opened for writing with the given flags
+// is watched, and if so, whether it will be created.
+func (r *Root) watchWrite(mount *Mount, path string, flag int) (bool, bool) {
+	if !r.notifier.Watched(vfs.Join(mount.Mountpoint, path[1:])) {
+		return false, false
+	}
+
+	if flag&os.O_CREATE == 0 {
+		return true, false
+	}
+
+	_, err := mount.Stat(path)
+
+	return true, errors.Is(err, os.ErrNotExist)
+}
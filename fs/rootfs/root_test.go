@@ -1,10 +1,18 @@
 package rootfs
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"os"
+	"reflect"
+	"slices"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/kuleuven/vfs"
+	"github.com/kuleuven/vfs/fs/chaosfs"
 	"github.com/kuleuven/vfs/fs/emptyfs"
 	"github.com/kuleuven/vfs/fs/nativefs"
 )
@@ -64,3 +72,341 @@ func TestRootNativeFSServerInodes(t *testing.T) {
 
 	vfs.RunTestSuiteRW(t, root)
 }
+
+// collectEvents returns the events reported until no event arrives for the given period.
+func collectEvents(w vfs.Watcher, period time.Duration) []vfs.Event {
+	var events []vfs.Event
+
+	for {
+		select {
+		case event := <-w.Events():
+			events = append(events, event)
+		case <-time.After(period):
+			return events
+		}
+	}
+}
+
+func TestRootWatch(t *testing.T) {
+	ctx := context.WithValue(t.Context(), vfs.DisablePersistentHandleDB, true)
+
+	root := New(ctx)
+
+	defer root.Close()
+
+	// Changes to chaosfs are only reported by the root itself,
+	// changes to nativefs are also reported by inotify.
+	root.MustMount("/", chaosfs.New(nativefs.New(ctx, t.TempDir()), 1), 0)
+	root.MustMount("/native", nativefs.New(ctx, t.TempDir()), 1)
+
+	w, err := root.Watch("/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer w.Close()
+
+	for _, dir := range []string{"/", "/native/"} {
+		if err := root.Mkdir(dir+"dir", 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := vfs.WriteFile(root, dir+"dir/file", []byte("data"), os.O_CREATE|os.O_WRONLY); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := root.Rename(dir+"dir/file", dir+"renamed"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := root.Remove(dir + "renamed"); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []vfs.Event{
+			{Op: vfs.EventCreate, Path: dir + "dir"},
+			{Op: vfs.EventCreate, Path: dir + "dir/file"},
+			{Op: vfs.EventWrite, Path: dir + "dir/file"},
+			{Op: vfs.EventRename, Path: dir + "renamed", OldPath: dir + "dir/file"},
+			{Op: vfs.EventRemove, Path: dir + "renamed"},
+		}
+
+		events := collectEvents(w, 200*time.Millisecond)
+
+		for _, event := range expected {
+			var count int
+
+			for _, e := range events {
+				if e == event {
+					count++
+				}
+			}
+
+			if count != 1 {
+				t.Errorf("expected %v once, got %v", event, events)
+			}
+		}
+	}
+}
+
+func TestRootParallelWalk(t *testing.T) {
+	ctx := context.WithValue(t.Context(), vfs.DisablePersistentHandleDB, true)
+
+	root := New(ctx)
+
+	defer root.Close()
+
+	root.MustMount("/", nativefs.New(ctx, t.TempDir()), 0)
+
+	if err := root.Mkdir("/data", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	root.MustMount("/data/mnt", nativefs.New(ctx, t.TempDir()), 1)
+	root.MustMount("/data/mnt/nested", nativefs.New(ctx, t.TempDir()), 2)
+
+	for _, dir := range []string{"/data/dir", "/data/mnt/dir", "/data/mnt/nested/dir"} {
+		if err := vfs.MkdirAll(root, dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := vfs.WriteFile(root, dir+"/file", []byte("data"), os.O_CREATE|os.O_WRONLY); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	walk := func(walker func(string, vfs.WalkFunc) error, skip map[string]error) []string {
+		var paths []string
+
+		if err := walker("/data", func(path string, info vfs.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			paths = append(paths, path)
+
+			return skip[path]
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		slices.Sort(paths)
+
+		return paths
+	}
+
+	expected := walk(root.Walk, nil)
+
+	if len(expected) != 9 {
+		t.Fatalf("expected 9 entries, got %v", expected)
+	}
+
+	for _, opts := range []vfs.WalkOptions{{Workers: 2}, {Ordered: true}} {
+		parallelWalk := func(path string, fn vfs.WalkFunc) error {
+			return root.ParallelWalk(path, opts, fn)
+		}
+
+		if paths := walk(parallelWalk, nil); !reflect.DeepEqual(paths, expected) {
+			t.Errorf("%+v: expected %v, got %v", opts, expected, paths)
+		}
+
+		skipped := []string{"/data", "/data/dir", "/data/dir/file", "/data/mnt"}
+
+		if paths := walk(parallelWalk, map[string]error{"/data/mnt": vfs.SkipDir}); !reflect.DeepEqual(paths, skipped) {
+			t.Errorf("%+v: expected %v, got %v", opts, skipped, paths)
+		}
+	}
+}
+
+func TestRootHandlesFollowRenames(t *testing.T) {
+	ctx := context.WithValue(t.Context(), vfs.PersistentStorage, t.TempDir())
+
+	root := New(ctx)
+
+	defer root.Close()
+
+	native := nativefs.New(ctx, t.TempDir())
+
+	root.MustMount("/", native, 0)
+
+	if err := vfs.MkdirAll(root, "/dir/sub", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vfs.WriteFile(root, "/dir/sub/file", []byte("data"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	handles := map[string][]byte{}
+
+	for _, path := range []string{"/dir", "/dir/sub/file"} {
+		handle, err := root.Handle(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		handles[path] = handle
+	}
+
+	expectHandle := func(path string, handle []byte) {
+		t.Helper()
+
+		if resolved, err := root.Path(handle); err != nil || resolved != path {
+			t.Errorf("expected %x to resolve to %s, got %s (%v)", handle, path, resolved, err)
+		}
+
+		if current, err := root.Handle(path); err != nil || !bytes.Equal(current, handle) {
+			t.Errorf("expected handle %x for %s, got %x (%v)", handle, path, current, err)
+		}
+	}
+
+	if err := root.Rename("/dir", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectHandle("/moved", handles["/dir"])
+	expectHandle("/moved/sub/file", handles["/dir/sub/file"])
+
+	// A rename outside of the root, reported afterwards
+	if err := native.Rename("/moved", "/external"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := root.RenameHandles("/moved", "/external"); err != nil {
+		t.Fatal(err)
+	}
+
+	expectHandle("/external", handles["/dir"])
+	expectHandle("/external/sub/file", handles["/dir/sub/file"])
+
+	if err := root.Remove("/external/sub/file"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := root.Path(handles["/dir/sub/file"]); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected ErrNotExist for a removed file, got %v", err)
+	}
+
+	if err := vfs.WriteFile(root, "/external/sub/file", []byte("new"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if handle, err := root.Handle("/external/sub/file"); err != nil || bytes.Equal(handle, handles["/dir/sub/file"]) {
+		t.Errorf("expected a new handle for a new file, got %x (%v)", handle, err)
+	}
+}
+
+func TestRootRenameUnreadable(t *testing.T) {
+	ctx := context.WithValue(t.Context(), vfs.PersistentStorage, t.TempDir())
+
+	root := New(ctx)
+
+	defer root.Close()
+
+	native := nativefs.New(ctx, t.TempDir())
+
+	root.MustMount("/", chaosfs.New(native, 1, &chaosfs.Rule{Path: "/moved/locked", Op: chaosfs.OpList, Err: syscall.EACCES}), 0)
+
+	if err := vfs.MkdirAll(root, "/dir/locked", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vfs.WriteFile(root, "/dir/file", []byte("data"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	handles := map[string][]byte{}
+
+	for _, path := range []string{"/dir", "/dir/file", "/dir/locked"} {
+		handle, err := root.Handle(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		handles[path] = handle
+	}
+
+	// The rename stands, even though a subdirectory cannot be walked
+	if err := root.Rename("/dir", "/moved"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := native.Stat("/moved/locked"); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, moved := range map[string]string{"/dir": "/moved", "/dir/file": "/moved/file"} {
+		if resolved, err := root.Path(handles[path]); err != nil || resolved != moved {
+			t.Errorf("expected %s to move to %s, got %s (%v)", path, moved, resolved, err)
+		}
+	}
+
+	if _, err := root.Path(handles["/dir/locked"]); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected ErrNotExist for an entry that could not be walked, got %v", err)
+	}
+}
+
+func TestRootCopyFile(t *testing.T) {
+	ctx := context.WithValue(t.Context(), vfs.PersistentStorage, t.TempDir())
+
+	root := New(ctx)
+
+	defer root.Close()
+
+	root.MustMount("/", nativefs.New(ctx, t.TempDir()), 0)
+	root.MustMount("/other", nativefs.New(ctx, t.TempDir()), 1)
+
+	if err := vfs.WriteFile(root, "/file", []byte("data"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	// Within a mount, and streamed across mounts
+	for _, path := range []string{"/copy", "/other/copy"} {
+		if err := root.CopyFile("/file", path, os.O_CREATE|os.O_EXCL); err != nil {
+			t.Fatal(err)
+		}
+
+		if data, err := vfs.ReadFile(root, path); err != nil || string(data) != "data" {
+			t.Errorf("expected data in %s, got %q (%v)", path, data, err)
+		}
+
+		if err := root.CopyFile("/file", path, os.O_CREATE|os.O_EXCL); !errors.Is(err, os.ErrExist) {
+			t.Errorf("expected ErrExist for %s, got %v", path, err)
+		}
+	}
+
+	if err := root.CopyFile("/missing", "/other/missing", os.O_CREATE); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+
+	// Copies onto the source itself are refused before it is truncated
+	if err := root.Symlink("/file", "/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := root.Link("/file", "/hardlink"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{"/file", "/link", "/hardlink"} {
+		if err := root.CopyFile("/file", path, os.O_CREATE); !errors.Is(err, syscall.EINVAL) {
+			t.Errorf("expected EINVAL for %s, got %v", path, err)
+		}
+	}
+
+	if data, err := vfs.ReadFile(root, "/file"); err != nil || string(data) != "data" {
+		t.Errorf("expected data in /file, got %q (%v)", data, err)
+	}
+
+	if err := root.Mkdir("/dir", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := root.CopyFile("/dir", "/dircopy", os.O_CREATE); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("expected EISDIR, got %v", err)
+	}
+
+	if _, err := root.Stat("/dircopy"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected no copy of a directory, got %v", err)
+	}
+}
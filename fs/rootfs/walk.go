@@ -0,0 +1,152 @@
+package rootfs
+
+import (
+	"context"
+	"sync"
+
+	"github.com/kuleuven/vfs"
+)
+
+// ParallelWalk walks the tree at path like Walk, but walks the mounts below
+// path concurrently, each using the ParallelWalk of the mounted file system.
+// The calls of walkFn are serialized on the calling goroutine.
+func (r *Root) ParallelWalk(path string, opts vfs.WalkOptions, walkFn vfs.WalkFunc) error {
+	r.Logger().Debugf("ParallelWalk(%q)", path)
+
+	if opts.Ordered {
+		// Delivery is sequential anyway, list the mounts through the root
+		return vfs.ParallelWalkList(r, path, opts, walkFn)
+	}
+
+	fs, path, err := r.FollowSymlinks(path)
+	if err != nil {
+		return err
+	}
+
+	if opts.Context == nil {
+		opts.Context = context.Background()
+	}
+
+	ctx, cancel := context.WithCancel(opts.Context)
+
+	defer cancel()
+
+	opts.Context = ctx
+
+	w := &rootWalker{
+		Root:   r,
+		opts:   opts,
+		cancel: cancel,
+		calls:  make(chan walkCall),
+	}
+
+	w.walkMount(fs, path)
+
+	done := make(chan struct{})
+
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+
+	for {
+		select {
+		case call := <-w.calls:
+			call.reply <- w.call(walkFn, call)
+		case <-done:
+			if w.err == vfs.SkipAll {
+				return nil
+			}
+
+			return w.err
+		}
+	}
+}
+
+type walkCall struct {
+	path  string
+	info  vfs.FileInfo
+	err   error
+	reply chan error
+}
+
+type rootWalker struct {
+	*Root
+	opts   vfs.WalkOptions
+	cancel context.CancelFunc
+	calls  chan walkCall
+	wg     sync.WaitGroup
+	mu     sync.Mutex
+	err    error // The first error or SkipAll, which stops all walks
+}
+
+func (w *rootWalker) stop(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err == nil {
+		w.err = err
+	}
+
+	w.cancel()
+}
+
+func (w *rootWalker) stopped() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.err
+}
+
+// call runs walkFn on the calling goroutine of ParallelWalk.
+func (w *rootWalker) call(walkFn vfs.WalkFunc, call walkCall) error {
+	if err := w.stopped(); err != nil {
+		return err
+	}
+
+	err := walkFn(call.path, call.info, call.err)
+	if err != nil && err != vfs.SkipDir && err != vfs.SkipSubDirs {
+		w.stop(err)
+	}
+
+	return err
+}
+
+func (w *rootWalker) walkMount(m *Mount, path string) {
+	w.wg.Go(func() {
+		if err := vfs.ParallelWalk(m.FS, path, w.opts, w.walkFn(m.Mountpoint)); err != nil {
+			w.stop(err)
+		}
+	})
+}
+
+// walkFn passes the entries of a mount to the calling goroutine, and starts
+// walking the mounts in each directory that is walked into.
+func (w *rootWalker) walkFn(mountpoint string) vfs.WalkFunc {
+	return func(path string, info vfs.FileInfo, err error) error {
+		path = vfs.Clean(mountpoint + path)
+		reply := make(chan error, 1)
+
+		select {
+		case w.calls <- walkCall{path: path, info: info, err: err, reply: reply}:
+		case <-w.opts.Context.Done():
+			return w.opts.Context.Err()
+		}
+
+		if err1 := <-reply; err1 != nil || err != nil {
+			return err1
+		}
+
+		if !info.IsDir() {
+			return nil
+		}
+
+		for _, m := range w.mounts {
+			if m.Mountpoint != "/" && vfs.Dir(m.Mountpoint) == path {
+				w.walkMount(m, "/")
+			}
+		}
+
+		return nil
+	}
+}
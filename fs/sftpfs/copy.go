@@ -0,0 +1,433 @@
+package sftpfs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/kuleuven/vfs"
+	"go.uber.org/multierr"
+	"golang.org/x/crypto/ssh"
+)
+
+var _ vfs.CopyFileFS = &SFTP{}
+
+// Extensions for server-side copies. The sftp client cannot send extended
+// requests, so they are sent over a separate sftp session instead, that is
+// opened on first use and kept until the SFTP instance is closed.
+const (
+	copyFileExtension = "copy-file"
+	copyDataExtension = "copy-data"
+)
+
+// CopyFile copies src to dst on the server, using the copy-data or
+// copy-file extension. If the server supports neither, or the SFTP
+// instance was created without ssh connection, vfs.ErrNotSupported is
+// returned.
+func (s *SFTP) CopyFile(src, dst string, flags int) error {
+	s.rawLock.Lock()
+	defer s.rawLock.Unlock()
+
+	session, err := s.rawSession()
+	if err != nil {
+		return err
+	}
+
+	_, copyData := session.extensions[copyDataExtension]
+	_, copyFile := session.extensions[copyFileExtension]
+
+	// Refuse to copy a file onto itself, before copy-data truncates it
+	if (copyData || copyFile) && s.sameFile(src, dst) {
+		return &os.PathError{Op: "copy", Path: dst, Err: syscall.EINVAL}
+	}
+
+	switch {
+	case copyData:
+		err = session.copyData(src, dst, flags)
+	case copyFile:
+		// Copy-file always creates dst
+		if flags&os.O_CREATE == 0 {
+			if _, err := s.Stat(dst); err != nil {
+				return err
+			}
+		}
+
+		err = session.copyFile(src, dst, flags&os.O_EXCL == 0)
+	default:
+		// Do not keep a session that is of no use
+		s.openRaw = nil
+
+		return multierr.Append(vfs.ErrNotSupported, s.closeRaw())
+	}
+
+	if session.broken {
+		err = multierr.Append(err, s.closeRaw())
+	}
+
+	return err
+}
+
+// sameFile checks whether src and dst refer to the same file,
+// after cleaning them and after resolving them on the server.
+func (s *SFTP) sameFile(src, dst string) bool {
+	if path.Clean(src) == path.Clean(dst) {
+		return true
+	}
+
+	srcPath, err := s.Client.RealPath(src)
+	if err != nil {
+		return false
+	}
+
+	dstPath, err := s.Client.RealPath(dst)
+
+	return err == nil && srcPath == dstPath
+}
+
+// rawSession returns the session for requests that the client does not
+// support, and opens it on first use. The caller must hold rawLock.
+func (s *SFTP) rawSession() (*rawSession, error) {
+	if s.raw != nil {
+		return s.raw, nil
+	}
+
+	if s.openRaw == nil {
+		return nil, vfs.ErrNotSupported
+	}
+
+	session, err := s.openRaw()
+	if err != nil {
+		return nil, err
+	}
+
+	s.raw = session
+
+	return session, nil
+}
+
+// closeRaw closes the session opened by rawSession, if any.
+// The caller must hold rawLock.
+func (s *SFTP) closeRaw() error {
+	if s.raw == nil {
+		return nil
+	}
+
+	err := s.raw.Close()
+
+	s.raw = nil
+
+	return err
+}
+
+// SFTP protocol version 3 packet types, open flags and status codes.
+const (
+	sshFxpInit     = 1
+	sshFxpVersion  = 2
+	sshFxpOpen     = 3
+	sshFxpClose    = 4
+	sshFxpStatus   = 101
+	sshFxpHandle   = 102
+	sshFxpExtended = 200
+
+	sshFxfRead  = 0x01
+	sshFxfWrite = 0x02
+	sshFxfCreat = 0x08
+	sshFxfTrunc = 0x10
+	sshFxfExcl  = 0x20
+
+	sshFxOK               = 0
+	sshFxNoSuchFile       = 2
+	sshFxPermissionDenied = 3
+	sshFxOpUnsupported    = 8
+	sshFxFileExists       = 11
+)
+
+const maxRawPacket = 256 * 1024
+
+var ErrUnexpectedPacket = errors.New("sftp: unexpected packet")
+
+// rawSession is a minimal sftp session for the requests that
+// the sftp client does not support.
+type rawSession struct {
+	w          io.WriteCloser
+	r          io.Reader
+	closer     io.Closer // The ssh session, if any
+	id         uint32
+	extensions map[string]string // Extensions supported by the server
+	broken     bool              // Whether a request failed outside of the protocol
+}
+
+func newRawSession(conn *ssh.Client) (*rawSession, error) {
+	session, err := conn.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := session.StdinPipe()
+	if err != nil {
+		return nil, multierr.Append(err, session.Close())
+	}
+
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return nil, multierr.Append(err, session.Close())
+	}
+
+	if err = session.RequestSubsystem("sftp"); err != nil {
+		return nil, multierr.Append(err, session.Close())
+	}
+
+	return initRawSession(r, w, session)
+}
+
+// initRawSession starts an sftp session over r and w, and reads the
+// extensions that the server supports. The session is closed on failure.
+func initRawSession(r io.Reader, w io.WriteCloser, closer io.Closer) (*rawSession, error) {
+	s := &rawSession{
+		w:          w,
+		r:          r,
+		closer:     closer,
+		extensions: map[string]string{},
+	}
+
+	if err := s.send(sshFxpInit, binary.BigEndian.AppendUint32(nil, 3)); err != nil {
+		return nil, multierr.Append(err, s.Close())
+	}
+
+	typ, payload, err := s.recv()
+	if err != nil {
+		return nil, multierr.Append(err, s.Close())
+	} else if typ != sshFxpVersion || len(payload) < 4 {
+		return nil, multierr.Append(ErrUnexpectedPacket, s.Close())
+	}
+
+	// The version is followed by pairs of extension names and data
+	for payload = payload[4:]; len(payload) > 0; {
+		name, rest, ok := readString(payload)
+		if !ok {
+			return nil, multierr.Append(ErrUnexpectedPacket, s.Close())
+		}
+
+		data, rest, ok := readString(rest)
+		if !ok {
+			return nil, multierr.Append(ErrUnexpectedPacket, s.Close())
+		}
+
+		s.extensions[name] = data
+		payload = rest
+	}
+
+	return s, nil
+}
+
+func (s *rawSession) Close() error {
+	err := s.w.Close()
+
+	if s.closer != nil {
+		err = multierr.Append(err, s.closer.Close())
+	}
+
+	return err
+}
+
+func (s *rawSession) send(typ byte, payload []byte) error {
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1)) //nolint:gosec
+	buf = append(buf, typ)
+	buf = append(buf, payload...)
+
+	_, err := s.w.Write(buf)
+
+	return err
+}
+
+func (s *rawSession) recv() (byte, []byte, error) {
+	header := make([]byte, 5)
+
+	if _, err := io.ReadFull(s.r, header); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header)
+	if length < 1 || length > maxRawPacket {
+		return 0, nil, fmt.Errorf("%w: length %d", ErrUnexpectedPacket, length)
+	}
+
+	payload := make([]byte, length-1)
+
+	if _, err := io.ReadFull(s.r, payload); err != nil {
+		return 0, nil, err
+	}
+
+	return header[4], payload, nil
+}
+
+// request sends a request and returns the type and payload of the
+// response, after the request id.
+func (s *rawSession) request(typ byte, payload []byte) (byte, []byte, error) {
+	s.id++
+
+	if err := s.send(typ, append(binary.BigEndian.AppendUint32(nil, s.id), payload...)); err != nil {
+		s.broken = true
+
+		return 0, nil, err
+	}
+
+	rtyp, response, err := s.recv()
+	if err != nil {
+		s.broken = true
+
+		return 0, nil, err
+	}
+
+	if len(response) < 4 || binary.BigEndian.Uint32(response) != s.id {
+		s.broken = true
+
+		return 0, nil, ErrUnexpectedPacket
+	}
+
+	return rtyp, response[4:], nil
+}
+
+// status sends a request that is answered by a status.
+func (s *rawSession) status(typ byte, payload []byte) error {
+	rtyp, response, err := s.request(typ, payload)
+	if err != nil {
+		return err
+	}
+
+	if rtyp != sshFxpStatus {
+		return ErrUnexpectedPacket
+	}
+
+	return statusError(response)
+}
+
+func (s *rawSession) open(path string, pflags uint32) (string, error) {
+	payload := appendString(nil, path)
+	payload = binary.BigEndian.AppendUint32(payload, pflags)
+	payload = binary.BigEndian.AppendUint32(payload, 0) // No attributes
+
+	rtyp, response, err := s.request(sshFxpOpen, payload)
+	if err != nil {
+		return "", err
+	}
+
+	switch rtyp {
+	case sshFxpHandle:
+		handle, _, ok := readString(response)
+		if !ok {
+			return "", ErrUnexpectedPacket
+		}
+
+		return handle, nil
+	case sshFxpStatus:
+		if err := statusError(response); err != nil {
+			return "", err
+		}
+	}
+
+	return "", ErrUnexpectedPacket
+}
+
+func (s *rawSession) close(handle string) error {
+	return s.status(sshFxpClose, appendString(nil, handle))
+}
+
+// copyData copies src to dst with the copy-data extension,
+// that copies between two open handles.
+func (s *rawSession) copyData(src, dst string, flags int) error {
+	pflags := uint32(sshFxfWrite | sshFxfTrunc)
+
+	if flags&os.O_CREATE != 0 {
+		pflags |= sshFxfCreat
+	}
+
+	if flags&os.O_EXCL != 0 {
+		pflags |= sshFxfExcl
+	}
+
+	in, err := s.open(src, sshFxfRead)
+	if err != nil {
+		return err
+	}
+
+	out, err := s.open(dst, pflags)
+	if err != nil {
+		return multierr.Append(err, s.close(in))
+	}
+
+	// Copy from offset 0 until the end of src, to offset 0
+	payload := appendString(nil, copyDataExtension)
+	payload = appendString(payload, in)
+	payload = binary.BigEndian.AppendUint64(payload, 0)
+	payload = binary.BigEndian.AppendUint64(payload, 0)
+	payload = appendString(payload, out)
+	payload = binary.BigEndian.AppendUint64(payload, 0)
+
+	err = s.status(sshFxpExtended, payload)
+
+	return multierr.Combine(err, s.close(out), s.close(in))
+}
+
+// copyFile copies src to dst with the copy-file extension.
+func (s *rawSession) copyFile(src, dst string, overwrite bool) error {
+	payload := appendString(nil, copyFileExtension)
+	payload = appendString(payload, src)
+	payload = appendString(payload, dst)
+
+	if overwrite {
+		payload = append(payload, 1)
+	} else {
+		payload = append(payload, 0)
+	}
+
+	return s.status(sshFxpExtended, payload)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(s))) //nolint:gosec
+
+	return append(buf, s...)
+}
+
+func readString(buf []byte) (string, []byte, bool) {
+	if len(buf) < 4 {
+		return "", nil, false
+	}
+
+	length := binary.BigEndian.Uint32(buf)
+
+	if uint64(len(buf)-4) < uint64(length) {
+		return "", nil, false
+	}
+
+	return string(buf[4 : 4+length]), buf[4+length:], true
+}
+
+func statusError(response []byte) error {
+	if len(response) < 4 {
+		return ErrUnexpectedPacket
+	}
+
+	code := binary.BigEndian.Uint32(response)
+	msg, _, _ := readString(response[4:])
+
+	switch code {
+	case sshFxOK:
+		return nil
+	case sshFxNoSuchFile:
+		return os.ErrNotExist
+	case sshFxPermissionDenied:
+		return os.ErrPermission
+	case sshFxOpUnsupported:
+		return vfs.ErrNotSupported
+	case sshFxFileExists:
+		return os.ErrExist
+	default:
+		return fmt.Errorf("sftp: %q (code %d)", msg, code)
+	}
+}
@@ -2,12 +2,14 @@ package sftpfs
 
 import (
 	"bytes"
+	"context"
 	"crypto"
 	"encoding/hex"
 	"errors"
 	"io"
 	"os"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -22,32 +24,62 @@ import (
 
 var _ vfs.AdvancedLinkFS = &SFTP{}
 
+var _ vfs.WatchFS = &SFTP{}
+
 var MaxPacket = 32 * 1024 * 1024 // 32 MB
 
 func New(conn *ssh.Client) (*SFTP, error) {
+	return NewContext(context.Background(), conn)
+}
+
+// NewContext is like New. Watchers are stopped when the context is done,
+// and poll at the interval set by the vfs.WatchInterval context key.
+func NewContext(ctx context.Context, conn *ssh.Client) (*SFTP, error) {
 	sftpClient, err := sftp.NewClient(conn, sftp.UseConcurrentWrites(true), sftp.MaxPacketUnchecked(MaxPacket))
 	if err != nil {
 		return nil, err
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
+
 	return &SFTP{
 		Client: sftpClient,
+		openRaw: func() (*rawSession, error) {
+			return newRawSession(conn)
+		},
+		ctx:    ctx,
+		cancel: cancel,
 	}, nil
 }
 
 func NewPipe(r io.Reader, w io.WriteCloser) (*SFTP, error) {
+	return NewPipeContext(context.Background(), r, w)
+}
+
+// NewPipeContext is like NewPipe, see NewContext.
+func NewPipeContext(ctx context.Context, r io.Reader, w io.WriteCloser) (*SFTP, error) {
 	sftpClient, err := sftp.NewClientPipe(r, w, sftp.UseConcurrentWrites(true), sftp.MaxPacketUnchecked(MaxPacket))
 	if err != nil {
 		return nil, err
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
+
 	return &SFTP{
 		Client: sftpClient,
+		ctx:    ctx,
+		cancel: cancel,
 	}, nil
 }
 
 type SFTP struct {
-	Client *sftp.Client
+	Client  *sftp.Client
+	openRaw func() (*rawSession, error) // Opens a session for requests that the client does not support
+	raw     *rawSession
+	rawLock sync.Mutex
+	ctx     context.Context    //nolint:containedctx
+	cancel  context.CancelFunc // Stops the watchers
+	ctxOnce sync.Once
 }
 
 func (s *SFTP) Chmod(path string, mode os.FileMode) error {
@@ -340,7 +372,19 @@ func (s *SFTP) Checksum(path string, algorithm crypto.Hash) ([]byte, error) {
 }
 
 func (s *SFTP) Close() error {
-	return s.Client.Close()
+	s.watchContext()
+	s.cancel()
+
+	s.rawLock.Lock()
+	defer s.rawLock.Unlock()
+
+	return multierr.Append(s.closeRaw(), s.Client.Close())
+}
+
+// Watch reports changes by polling, as SFTP has no change notifications.
+// Watchers are closed when the file system is closed.
+func (s *SFTP) Watch(path string, recursive bool) (vfs.Watcher, error) {
+	return vfs.PollWatch(s.watchContext(), s, path, recursive)
 }
 
 type SFTPFile struct {
@@ -499,3 +543,15 @@ func (s *SFTPFileInfo) Permissions() (*vfs.Permissions, error) {
 		SetExtendedAttrs: true,
 	}, nil
 }
+
+// watchContext returns the context that stops the watchers. It is created
+// here if the SFTP instance was not created by one of the constructors.
+func (s *SFTP) watchContext() context.Context {
+	s.ctxOnce.Do(func() {
+		if s.ctx == nil {
+			s.ctx, s.cancel = context.WithCancel(context.Background())
+		}
+	})
+
+	return s.ctx
+}
@@ -1,16 +1,27 @@
 package sftpfs
 
 import (
+	"context"
+	"encoding/binary"
+	"errors"
 	"io"
 	"os"
+	"slices"
+	"strconv"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/kuleuven/vfs"
 	"github.com/kuleuven/vfs/fs/wrapfs"
 	"github.com/pkg/sftp"
+	"go.uber.org/multierr"
 )
 
-func TestSFTP(t *testing.T) {
+// newTestSFTP connects to an sftp server over pipes.
+func newTestSFTP(t *testing.T, ctx context.Context) *SFTP {
+	t.Helper()
+
 	r1, w1, err := os.Pipe()
 	if err != nil {
 		t.Fatal(err)
@@ -37,11 +48,17 @@ func TestSFTP(t *testing.T) {
 		server.Serve()
 	}()
 
-	fs, err := NewPipe(r2, w1)
+	fs, err := NewPipeContext(ctx, r2, w1)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	return fs
+}
+
+func TestSFTP(t *testing.T) {
+	fs := newTestSFTP(t, t.Context())
+
 	subdir := t.TempDir()
 
 	sub := wrapfs.Sub(fs, subdir)
@@ -70,3 +87,304 @@ type OpenFileSub struct {
 func (f *OpenFileSub) OpenFile(name string, flag int, perm os.FileMode) (vfs.File, error) {
 	return f.parent.OpenFile(vfs.Join(f.dir, name), flag, perm)
 }
+
+func TestWatch(t *testing.T) {
+	ctx := context.WithValue(t.Context(), vfs.WatchInterval, 10*time.Millisecond)
+	fs := newTestSFTP(t, ctx)
+	dir := t.TempDir()
+
+	w, err := fs.Watch(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vfs.WriteFile(fs, dir+"/file", []byte("data"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case event := <-w.Events():
+		if event.Path != dir+"/file" {
+			t.Errorf("Unexpected event %v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected an event within the configured interval")
+	}
+
+	// Closing the file system stops the watcher
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for range w.Events() { //nolint:revive
+	}
+}
+
+// serveCopy is a minimal sftp server over r and w, that advertises the given
+// extensions and handles the requests of a raw session.
+func serveCopy(r io.Reader, w io.WriteCloser, extensions ...string) {
+	conn := &rawSession{r: r, w: w}
+
+	defer conn.Close()
+
+	handles := map[string]*os.File{}
+
+	defer func() {
+		for _, f := range handles {
+			f.Close()
+		}
+	}()
+
+	for {
+		typ, payload, err := conn.recv()
+		if err != nil {
+			return
+		}
+
+		if typ == sshFxpInit {
+			version := binary.BigEndian.AppendUint32(nil, 3)
+
+			for _, name := range extensions {
+				version = appendString(appendString(version, name), "1")
+			}
+
+			if conn.send(sshFxpVersion, version) != nil {
+				return
+			}
+
+			continue
+		}
+
+		id, payload := payload[:4], payload[4:]
+
+		reply := func(err error) error {
+			code := uint32(sshFxOK)
+
+			switch {
+			case errors.Is(err, os.ErrNotExist):
+				code = sshFxNoSuchFile
+			case errors.Is(err, os.ErrExist):
+				code = sshFxFileExists
+			case err != nil:
+				code = sshFxOpUnsupported
+			}
+
+			status := binary.BigEndian.AppendUint32(slices.Clone(id), code)
+
+			return conn.send(sshFxpStatus, appendString(appendString(status, ""), ""))
+		}
+
+		switch typ {
+		case sshFxpOpen:
+			path, rest, _ := readString(payload)
+			pflags := binary.BigEndian.Uint32(rest)
+
+			flags := os.O_RDONLY
+
+			if pflags&sshFxfWrite != 0 {
+				flags = os.O_WRONLY
+			}
+
+			for pflag, flag := range map[uint32]int{sshFxfCreat: os.O_CREATE, sshFxfTrunc: os.O_TRUNC, sshFxfExcl: os.O_EXCL} {
+				if pflags&pflag != 0 {
+					flags |= flag
+				}
+			}
+
+			f, err := os.OpenFile(path, flags, 0o600)
+			if err != nil {
+				err = reply(err)
+			} else {
+				handle := strconv.Itoa(len(handles))
+				handles[handle] = f
+				err = conn.send(sshFxpHandle, appendString(slices.Clone(id), handle))
+			}
+
+			if err != nil {
+				return
+			}
+		case sshFxpClose:
+			handle, _, _ := readString(payload)
+
+			err := handles[handle].Close()
+
+			delete(handles, handle)
+
+			if reply(err) != nil {
+				return
+			}
+		case sshFxpExtended:
+			name, rest, _ := readString(payload)
+
+			var err error
+
+			switch name {
+			case copyDataExtension:
+				in, rest, _ := readString(rest)
+				out, _, _ := readString(rest[16:])
+
+				_, err = io.Copy(handles[out], handles[in])
+			case copyFileExtension:
+				src, rest, _ := readString(rest)
+				dst, rest, _ := readString(rest)
+
+				flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+
+				if rest[0] == 0 {
+					flags |= os.O_EXCL
+				}
+
+				err = copyLocal(src, dst, flags)
+			default:
+				err = vfs.ErrNotSupported
+			}
+
+			if reply(err) != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func copyLocal(src, dst string, flags int) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, flags, 0o600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+
+	return multierr.Append(err, out.Close())
+}
+
+func TestCopyFile(t *testing.T) {
+	for _, extension := range []string{copyDataExtension, copyFileExtension} {
+		t.Run(extension, func(t *testing.T) {
+			fs := newTestSFTP(t, t.Context())
+
+			var opened int
+
+			fs.openRaw = func() (*rawSession, error) {
+				opened++
+
+				r1, w1 := io.Pipe()
+				r2, w2 := io.Pipe()
+
+				go serveCopy(r1, w2, extension)
+
+				return initRawSession(r2, w1, nil)
+			}
+
+			dir := t.TempDir()
+			src, dst := dir+"/src", dir+"/dst"
+
+			if err := os.WriteFile(src, []byte("test"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := fs.CopyFile(src, dst, os.O_CREATE|os.O_EXCL); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := fs.CopyFile(src, dst, os.O_CREATE|os.O_EXCL); !errors.Is(err, os.ErrExist) {
+				t.Fatalf("expected %v, got %v", os.ErrExist, err)
+			}
+
+			if err := fs.CopyFile(dir+"/missing", dst, 0); !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("expected %v, got %v", os.ErrNotExist, err)
+			}
+
+			if err := fs.CopyFile(src, dst, 0); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, path := range []string{src, dir + "/./src"} {
+				if err := fs.CopyFile(src, path, os.O_CREATE); !errors.Is(err, syscall.EINVAL) {
+					t.Fatalf("expected %v, got %v", syscall.EINVAL, err)
+				}
+			}
+
+			if data, err := os.ReadFile(src); err != nil || string(data) != "test" {
+				t.Fatalf("unexpected content %q (%v)", data, err)
+			}
+
+			if data, err := os.ReadFile(dst); err != nil {
+				t.Fatal(err)
+			} else if string(data) != "test" {
+				t.Fatalf("unexpected content %q", data)
+			}
+
+			if opened != 1 {
+				t.Fatalf("expected one session, got %d", opened)
+			}
+
+			if err := fs.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if fs.raw != nil {
+				t.Fatal("expected the session to be closed")
+			}
+		})
+	}
+}
+
+func TestCopyFileNotSupported(t *testing.T) {
+	fs := newTestSFTP(t, t.Context())
+
+	if err := fs.CopyFile("/src", "/dst", os.O_CREATE); !errors.Is(err, vfs.ErrNotSupported) {
+		t.Fatalf("expected %v, got %v", vfs.ErrNotSupported, err)
+	}
+
+	var opened int
+
+	fs.openRaw = func() (*rawSession, error) {
+		opened++
+
+		r1, w1 := io.Pipe()
+		r2, w2 := io.Pipe()
+
+		go serveCopy(r1, w2)
+
+		return initRawSession(r2, w1, nil)
+	}
+
+	for range 2 {
+		if err := fs.CopyFile("/src", "/dst", os.O_CREATE); !errors.Is(err, vfs.ErrNotSupported) {
+			t.Fatalf("expected %v, got %v", vfs.ErrNotSupported, err)
+		}
+	}
+
+	if opened != 1 || fs.raw != nil {
+		t.Fatalf("expected one session that is closed, got %d", opened)
+	}
+}
+
+func TestClientOnly(t *testing.T) {
+	fs := &SFTP{Client: newTestSFTP(t, t.Context()).Client}
+
+	w, err := fs.Watch(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.CopyFile("/src", "/dst", os.O_CREATE); !errors.Is(err, vfs.ErrNotSupported) {
+		t.Errorf("expected %v, got %v", vfs.ErrNotSupported, err)
+	}
+
+	if err := fs.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for range w.Events() { //nolint:revive
+	}
+}
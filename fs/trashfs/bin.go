@@ -0,0 +1,226 @@
+package trashfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kuleuven/vfs"
+)
+
+// Entry describes an entry in the trash.
+type Entry struct {
+	Name    string    // Name of the entry in the trash directory
+	Path    string    // Original path, empty if unknown
+	Deleted time.Time // Time of deletion
+	Size    int64     // Total size of the files in the entry
+	IsDir   bool
+}
+
+var ErrUnknownPath = errors.New("original path unknown")
+
+// Conflict determines what Restore does if the target path exists.
+type Conflict int
+
+const (
+	ConflictFail    Conflict = iota // Fail with os.ErrExist
+	ConflictRename                  // Restore next to the existing path, with a suffix
+	ConflictReplace                 // Move the existing path into the trash first
+)
+
+// Entries returns the entries in the trash of the current user, oldest first.
+func (t *TrashFS) Entries() ([]Entry, error) {
+	infos, err := vfs.ReadDir(t.FS, t.Dir())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(infos))
+
+	for _, fi := range infos {
+		entry, err := t.entry(fi)
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Deleted.Before(entries[j].Deleted)
+	})
+
+	return entries, nil
+}
+
+func (t *TrashFS) entry(fi vfs.FileInfo) (Entry, error) {
+	entry := Entry{
+		Name:  fi.Name(),
+		Size:  fi.Size(),
+		IsDir: fi.IsDir(),
+	}
+
+	// Fall back to the timestamp in the name
+	if prefix, _, ok := strings.Cut(fi.Name(), "."); ok {
+		if nanos, err := strconv.ParseInt(prefix, 10, 64); err == nil {
+			entry.Deleted = time.Unix(0, nanos)
+		}
+	}
+
+	if attrs, err := fi.Extended(); err == nil {
+		if path, ok := attrs.GetString(OriginalPathAttr); ok {
+			entry.Path = path
+		}
+
+		if deleted, ok := attrs.GetString(DeletedAttr); ok {
+			if ts, err := time.Parse(time.RFC3339Nano, deleted); err == nil {
+				entry.Deleted = ts
+			}
+		}
+	}
+
+	if !fi.IsDir() {
+		return entry, nil
+	}
+
+	entry.Size = 0
+
+	err := vfs.Walk(t.FS, vfs.Join(t.Dir(), fi.Name()), func(_ string, fi vfs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if fi.Mode().IsRegular() {
+			entry.Size += fi.Size()
+		}
+
+		return nil
+	})
+
+	return entry, err
+}
+
+// Restore moves the entry with the given name out of the trash, to the given
+// target path, or to its original path if target is empty. Missing parent
+// directories are created. It returns the path the entry was restored to.
+func (t *TrashFS) Restore(name, target string, conflict Conflict) (string, error) {
+	path := vfs.Join(t.Dir(), name)
+
+	fi, err := t.lstat(path)
+	if err != nil {
+		return "", err
+	}
+
+	if target == "" {
+		entry, err := t.entry(fi)
+		if err != nil {
+			return "", err
+		}
+
+		if entry.Path == "" {
+			return "", &os.PathError{Op: "restore", Path: path, Err: ErrUnknownPath}
+		}
+
+		target = entry.Path
+	}
+
+	if err := vfs.MkdirAll(t.FS, vfs.Dir(target), 0o755); err != nil {
+		return "", err
+	}
+
+	target, err = t.resolveConflict(target, conflict)
+	if err != nil {
+		return "", err
+	}
+
+	if err := t.rename(path, target); err != nil {
+		return "", err
+	}
+
+	for _, attr := range []string{OriginalPathAttr, DeletedAttr} {
+		if err := t.FS.UnsetExtendedAttr(target, attr); err != nil && !errors.Is(err, vfs.ErrNotSupported) {
+			t.Logger().Debugf("Cannot remove %s from %s: %v", attr, target, err)
+		}
+	}
+
+	return target, nil
+}
+
+func (t *TrashFS) resolveConflict(target string, conflict Conflict) (string, error) {
+	if _, err := t.lstat(target); errors.Is(err, os.ErrNotExist) {
+		return target, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	switch conflict {
+	case ConflictRename:
+		for i := 1; ; i++ {
+			candidate := fmt.Sprintf("%s.restored%d", target, i)
+
+			if _, err := t.lstat(candidate); errors.Is(err, os.ErrNotExist) {
+				return candidate, nil
+			} else if err != nil {
+				return "", err
+			}
+		}
+	case ConflictReplace:
+		return target, t.trash(target)
+	default:
+		return "", &os.PathError{Op: "restore", Path: target, Err: os.ErrExist}
+	}
+}
+
+// Purge permanently deletes entries that were deleted longer than maxAge ago,
+// and then the oldest entries until the trash holds at most maxBytes.
+// Zero values disable the respective limit. It returns the number of
+// deleted entries.
+func (t *TrashFS) Purge(maxAge time.Duration, maxBytes int64) (int, error) {
+	entries, err := t.Entries()
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+
+	for _, entry := range entries {
+		total += entry.Size
+	}
+
+	var purged int
+
+	for _, entry := range entries {
+		expired := maxAge > 0 && t.now().Sub(entry.Deleted) > maxAge
+		oversized := maxBytes > 0 && total > maxBytes
+
+		if !expired && !oversized {
+			break
+		}
+
+		if err := vfs.RemoveAllWalk(t.FS, vfs.Join(t.Dir(), entry.Name)); err != nil {
+			return purged, err
+		}
+
+		total -= entry.Size
+		purged++
+	}
+
+	return purged, nil
+}
+
+// Empty permanently deletes all entries in the trash of the current user.
+func (t *TrashFS) Empty() error {
+	if _, err := t.lstat(t.Dir()); errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return vfs.RemoveAllWalk(t.FS, t.Dir())
+}
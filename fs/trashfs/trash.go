@@ -0,0 +1,344 @@
+package trashfs
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kuleuven/vfs"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	_ vfs.ChecksumFS  = &TrashFS{}
+	_ vfs.RemoveAllFS = &TrashFS{}
+)
+
+// Extended attributes set on entries in the trash.
+const (
+	OriginalPathAttr = "user.trash.path"
+	DeletedAttr      = "user.trash.deleted"
+)
+
+var DefaultRoot = "/.trash"
+
+type Option func(*TrashFS)
+
+// WithRoot sets the directory that contains the trash directories of all users.
+func WithRoot(root string) Option {
+	return func(fs *TrashFS) {
+		fs.Root = root
+	}
+}
+
+// WithUser sets the name of the trash directory of the current user.
+// Defaults to the uid of the current process.
+func WithUser(user string) Option {
+	return func(fs *TrashFS) {
+		fs.User = user
+	}
+}
+
+// New returns a file system that moves removed files and directories into
+// a trash directory of the current user, instead of deleting them.
+// Entries can be listed, restored and purged using the methods of the returned
+// file system. Removing entries inside the trash directory deletes them.
+func New(ctx context.Context, fs vfs.FS, options ...Option) *TrashFS {
+	t := &TrashFS{
+		Context: ctx,
+		FS:      fs,
+		Root:    DefaultRoot,
+		User:    strconv.Itoa(os.Getuid()),
+		now:     time.Now,
+	}
+
+	for _, option := range options {
+		option(t)
+	}
+
+	return t
+}
+
+type TrashFS struct {
+	Context context.Context //nolint:containedctx
+	FS      vfs.FS
+	Root    string
+	User    string
+	now     func() time.Time
+}
+
+func (t *TrashFS) Logger() *logrus.Entry {
+	return vfs.Logger(t.Context)
+}
+
+// Dir returns the trash directory of the current user.
+func (t *TrashFS) Dir() string {
+	return vfs.Join(t.Root, t.User)
+}
+
+// inTrash returns whether the path is the trash root or lies below it.
+func (t *TrashFS) inTrash(path string) bool {
+	return path == t.Root || strings.HasPrefix(path, t.Root+"/")
+}
+
+// trash moves the given path into the trash directory.
+func (t *TrashFS) trash(path string) error {
+	if err := vfs.MkdirAll(t.FS, t.Dir(), 0o700); err != nil {
+		return err
+	}
+
+	now := t.now()
+	target := vfs.Join(t.Dir(), fmt.Sprintf("%d.%s", now.UnixNano(), vfs.Base(path)))
+
+	if err := t.rename(path, target); err != nil {
+		return err
+	}
+
+	attrs := vfs.Attributes{}
+
+	attrs.SetString(OriginalPathAttr, path)
+	attrs.SetString(DeletedAttr, now.UTC().Format(time.RFC3339Nano))
+
+	if err := vfs.SetExtendedAttrs(t.FS, target, attrs); err != nil {
+		// The original path is also recoverable from the entry name and the deletion time
+		t.Logger().Warnf("Cannot record original path of %s in trash: %v", path, err)
+	}
+
+	return nil
+}
+
+// rename renames the given path to the target, or copies it and removes
+// the original if the target is on another mount.
+func (t *TrashFS) rename(path, target string) error {
+	err := t.FS.Rename(path, target)
+	if errors.Is(err, vfs.ErrNotSupported) || errors.Is(err, syscall.EXDEV) {
+		t.Logger().Debugf("Cannot rename %s to %s, copying instead: %v", path, target, err)
+
+		return t.move(path, target)
+	}
+
+	return err
+}
+
+// move copies the given path to the target and removes the original.
+func (t *TrashFS) move(path, target string) error {
+	if err := t.copy(path, target); err != nil {
+		vfs.RemoveAllWalk(t.FS, target) //nolint:errcheck
+
+		return err
+	}
+
+	return vfs.RemoveAllWalk(t.FS, path)
+}
+
+// copy copies the tree at the given path to the target, including extended attributes.
+func (t *TrashFS) copy(path, target string) error {
+	return vfs.Walk(t.FS, path, func(p string, fi vfs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		dst := target + strings.TrimPrefix(p, path)
+
+		switch {
+		case fi.IsDir():
+			err = t.FS.Mkdir(dst, fi.Mode().Perm())
+		case fi.Mode()&os.ModeSymlink != 0:
+			err = t.copySymlink(p, dst)
+		default:
+			err = t.copyFile(p, dst)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if attrs, err := fi.Extended(); err == nil && len(attrs) > 0 {
+			return vfs.SetExtendedAttrs(t.FS, dst, attrs)
+		}
+
+		return nil
+	})
+}
+
+func (t *TrashFS) copySymlink(path, target string) error {
+	symlinkFS, ok := t.FS.(vfs.SymlinkFS)
+	if !ok {
+		return vfs.ErrNotSupported
+	}
+
+	link, err := symlinkFS.Readlink(path)
+	if err != nil {
+		return err
+	}
+
+	return symlinkFS.Symlink(link, target)
+}
+
+func (t *TrashFS) copyFile(path, target string) error {
+	return vfs.CopyFile(t.FS, path, target, os.O_CREATE|os.O_EXCL)
+}
+
+func (t *TrashFS) Stat(path string) (vfs.FileInfo, error) {
+	return t.FS.Stat(path)
+}
+
+func (t *TrashFS) List(path string) (vfs.ListerAt, error) {
+	return t.FS.List(path)
+}
+
+func (t *TrashFS) FileRead(path string) (vfs.ReaderAt, error) {
+	return t.FS.FileRead(path)
+}
+
+func (t *TrashFS) FileWrite(path string, flags int) (vfs.WriterAt, error) {
+	return t.FS.FileWrite(path, flags)
+}
+
+func (t *TrashFS) Chmod(path string, mode os.FileMode) error {
+	return t.FS.Chmod(path, mode)
+}
+
+func (t *TrashFS) Chown(path string, uid, gid int) error {
+	return t.FS.Chown(path, uid, gid)
+}
+
+func (t *TrashFS) Chtimes(path string, atime, mtime time.Time) error {
+	return t.FS.Chtimes(path, atime, mtime)
+}
+
+func (t *TrashFS) Truncate(path string, size int64) error {
+	return t.FS.Truncate(path, size)
+}
+
+func (t *TrashFS) SetExtendedAttr(path, name string, value []byte) error {
+	return t.FS.SetExtendedAttr(path, name, value)
+}
+
+func (t *TrashFS) UnsetExtendedAttr(path, name string) error {
+	return t.FS.UnsetExtendedAttr(path, name)
+}
+
+func (t *TrashFS) SetExtendedAttrs(path string, attrs vfs.Attributes) error {
+	return vfs.SetExtendedAttrs(t.FS, path, attrs)
+}
+
+func (t *TrashFS) Rename(oldpath, newpath string) error {
+	return t.FS.Rename(oldpath, newpath)
+}
+
+// Rmdir moves the given empty directory into the trash.
+func (t *TrashFS) Rmdir(path string) error {
+	if t.inTrash(path) {
+		return t.FS.Rmdir(path)
+	}
+
+	if fi, err := t.lstat(path); err != nil {
+		return err
+	} else if !fi.IsDir() {
+		return syscall.ENOTDIR
+	}
+
+	lister, err := t.FS.List(path)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]vfs.FileInfo, 1)
+
+	n, err := lister.ListAt(buf, 0)
+
+	lister.Close()
+
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	if n > 0 {
+		// Let the underlying file system return the appropriate error
+		return t.FS.Rmdir(path)
+	}
+
+	return t.trash(path)
+}
+
+// Remove moves the given file into the trash.
+func (t *TrashFS) Remove(path string) error {
+	if t.inTrash(path) {
+		return t.FS.Remove(path)
+	}
+
+	if fi, err := t.lstat(path); err != nil {
+		return err
+	} else if fi.IsDir() {
+		return syscall.EISDIR
+	}
+
+	return t.trash(path)
+}
+
+// RemoveAll moves the given path and everything below it into the trash, as a single entry.
+func (t *TrashFS) RemoveAll(path string) error {
+	if t.inTrash(path) {
+		return vfs.RemoveAllWalk(t.FS, path)
+	}
+
+	if path == "/" || strings.HasPrefix(t.Root, path+"/") {
+		// The trash lies below the path, trash the children instead
+		return t.removeChildren(path)
+	}
+
+	if _, err := t.lstat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	return t.trash(path)
+}
+
+func (t *TrashFS) removeChildren(path string) error {
+	entries, err := vfs.ReadDir(t.FS, path)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := t.RemoveAll(vfs.Join(path, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *TrashFS) lstat(path string) (vfs.FileInfo, error) {
+	if symlinkFS, ok := t.FS.(vfs.SymlinkFS); ok {
+		return symlinkFS.Lstat(path)
+	}
+
+	return t.FS.Stat(path)
+}
+
+func (t *TrashFS) Mkdir(path string, perm os.FileMode) error {
+	return t.FS.Mkdir(path, perm)
+}
+
+func (t *TrashFS) Checksum(path string, algorithm crypto.Hash) ([]byte, error) {
+	if checksumFS, ok := t.FS.(vfs.ChecksumFS); ok {
+		return checksumFS.Checksum(path, algorithm)
+	}
+
+	return vfs.Checksum(t.FS, path, algorithm)
+}
+
+func (t *TrashFS) Close() error {
+	return t.FS.Close()
+}
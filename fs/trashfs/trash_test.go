@@ -0,0 +1,168 @@
+package trashfs
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/kuleuven/vfs"
+	"github.com/kuleuven/vfs/fs/chaosfs"
+	"github.com/kuleuven/vfs/fs/nativefs"
+)
+
+func TestTrashFS(t *testing.T) {
+	fs := New(t.Context(), nativefs.New(t.Context(), t.TempDir()))
+
+	defer func() {
+		if err := fs.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	vfs.RunTestSuiteRW(t, fs)
+}
+
+func TestTrash(t *testing.T) {
+	native := nativefs.New(t.Context(), t.TempDir())
+	fs := New(t.Context(), native, WithUser("alice"))
+
+	defer fs.Close()
+
+	now := time.Now()
+
+	fs.now = func() time.Time {
+		now = now.Add(time.Hour)
+
+		return now
+	}
+
+	if err := vfs.MkdirAll(fs, "/dir/sub", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"/file.txt", "/dir/sub/nested.txt"} {
+		if err := vfs.WriteFile(fs, name, []byte("0123456789"), os.O_CREATE|os.O_WRONLY); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := fs.Remove("/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Rmdir("/dir"); err == nil {
+		t.Error("Expected Rmdir of non-empty directory to fail")
+	}
+
+	if err := vfs.RemoveAll(fs, "/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Stat("/dir"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected ErrNotExist, got %v", err)
+	}
+
+	entries, err := fs.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 2 || entries[0].Path != "/file.txt" || entries[1].Path != "/dir" || entries[1].Size != 10 || !entries[1].IsDir {
+		t.Fatalf("Unexpected entries %v", entries)
+	}
+
+	// Restore with conflicts
+	if err := vfs.WriteFile(fs, "/file.txt", []byte("new"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Restore(entries[0].Name, "", ConflictFail); !errors.Is(err, os.ErrExist) {
+		t.Errorf("Expected ErrExist, got %v", err)
+	}
+
+	path, err := fs.Restore(entries[0].Name, "", ConflictRename)
+	if err != nil || path != "/file.txt.restored1" {
+		t.Fatalf("Expected /file.txt.restored1, got %q, %v", path, err)
+	}
+
+	if fi, err := fs.Stat(path); err != nil || fi.Size() != 10 {
+		t.Errorf("Expected restored file, got %v, %v", fi, err)
+	}
+
+	if _, err := fs.Restore(entries[1].Name, "/restored/dir", ConflictFail); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Stat("/restored/dir/sub/nested.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace moves the existing file into the trash
+	if err := fs.Remove("/file.txt.restored1"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err = fs.Entries()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %v, %v", entries, err)
+	}
+
+	if _, err := fs.Restore(entries[0].Name, "/file.txt", ConflictReplace); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := vfs.ReadFile(fs, "/file.txt"); err != nil || string(data) != "0123456789" {
+		t.Errorf("Expected restored content, got %q, %v", data, err)
+	}
+
+	// Purge by size, then by age; the trash holds the replaced file and file.txt
+	if err := fs.Remove("/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := fs.Purge(0, 10); err != nil || n != 1 {
+		t.Errorf("Expected 1 purged entry, got %d, %v", n, err)
+	}
+
+	if n, err := fs.Purge(time.Minute, 0); err != nil || n != 1 {
+		t.Errorf("Expected 1 purged entry, got %d, %v", n, err)
+	}
+
+	if entries, err := fs.Entries(); err != nil || len(entries) != 0 {
+		t.Errorf("Expected empty trash, got %v, %v", entries, err)
+	}
+}
+
+func TestCopyFallback(t *testing.T) {
+	rule := &chaosfs.Rule{Op: chaosfs.OpRename, Times: 1, Err: syscall.EXDEV}
+	fs := New(t.Context(), chaosfs.New(nativefs.New(t.Context(), t.TempDir()), 1, rule))
+
+	defer fs.Close()
+
+	if err := vfs.MkdirAll(fs, "/dir/sub", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vfs.WriteFile(fs, "/dir/sub/file.txt", []byte("test"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.RemoveAll("/dir"); err != nil {
+		t.Fatal(err)
+	}
+
+	if rule.Fired() != 1 {
+		t.Errorf("Expected rename to fail once, got %d", rule.Fired())
+	}
+
+	if _, err := fs.Stat("/dir"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected ErrNotExist, got %v", err)
+	}
+
+	entries, err := fs.Entries()
+	if err != nil || len(entries) != 1 || entries[0].Path != "/dir" || entries[0].Size != 4 {
+		t.Fatalf("Unexpected entries %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,560 @@
+package versionfs
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kuleuven/vfs"
+	"github.com/sirupsen/logrus"
+)
+
+var _ vfs.ChecksumFS = &VersionFS{}
+
+// Extended attributes set on stored versions.
+const (
+	TimeAttr     = "user.version.time"
+	UserAttr     = "user.version.user"
+	SizeAttr     = "user.version.size"
+	ChecksumAttr = "user.version.checksum"
+)
+
+var (
+	DefaultRoot        = "/.versions"
+	DefaultMaxVersions = 10
+)
+
+type Option func(*VersionFS)
+
+// WithStore stores versions in the given file system instead of in
+// a hidden tree of the versioned file system.
+func WithStore(store vfs.FS) Option {
+	return func(fs *VersionFS) {
+		fs.Store = store
+	}
+}
+
+// WithRoot sets the directory in the store that holds the versions.
+func WithRoot(root string) Option {
+	return func(fs *VersionFS) {
+		fs.Root = root
+	}
+}
+
+// WithMaxVersions sets the number of versions kept per file. Zero means unlimited.
+func WithMaxVersions(n int) Option {
+	return func(fs *VersionFS) {
+		fs.MaxVersions = n
+	}
+}
+
+// WithMaxAge sets how long versions are kept. Zero means forever.
+func WithMaxAge(age time.Duration) Option {
+	return func(fs *VersionFS) {
+		fs.MaxAge = age
+	}
+}
+
+// WithUser sets the user name that is recorded in new versions.
+// Defaults to the uid of the current process.
+func WithUser(user string) Option {
+	return func(fs *VersionFS) {
+		fs.User = user
+	}
+}
+
+// New returns a file system that stores the previous content of a file
+// before it is modified for the first time by a writer, or truncated.
+// By default, versions are stored in a hidden tree of the file system itself.
+func New(ctx context.Context, fs vfs.FS, options ...Option) *VersionFS {
+	v := &VersionFS{
+		Context:     ctx,
+		FS:          fs,
+		Store:       fs,
+		Root:        DefaultRoot,
+		MaxVersions: DefaultMaxVersions,
+		User:        strconv.Itoa(os.Getuid()),
+		now:         time.Now,
+	}
+
+	for _, option := range options {
+		option(v)
+	}
+
+	return v
+}
+
+type VersionFS struct {
+	Context     context.Context //nolint:containedctx
+	FS          vfs.FS
+	Store       vfs.FS
+	Root        string
+	MaxVersions int
+	MaxAge      time.Duration
+	User        string
+	now         func() time.Time
+}
+
+func (v *VersionFS) Logger() *logrus.Entry {
+	return vfs.Logger(v.Context)
+}
+
+// Version describes a stored version of a file.
+type Version struct {
+	ID       string
+	Time     time.Time
+	User     string
+	Size     int64
+	Checksum []byte // SHA-256 checksum of the content
+}
+
+// hidden returns whether the path is part of the version tree in the file system itself.
+func (v *VersionFS) hidden(path string) bool {
+	if v.Store != v.FS {
+		return false
+	}
+
+	return path == v.Root || strings.HasPrefix(path, v.Root+"/")
+}
+
+// versionDir returns the directory that holds the versions of the given path.
+// The names of the directories are prefixed, so that they cannot collide with
+// the version IDs of a file that had the same path as the parent directory.
+func (v *VersionFS) versionDir(path string) string {
+	dir := v.Root
+
+	for name := range strings.SplitSeq(strings.Trim(path, "/"), "/") {
+		if name != "" {
+			dir = vfs.Join(dir, dirPrefix+name)
+		}
+	}
+
+	return dir
+}
+
+const dirPrefix = "_"
+
+// reject returns an error if any of the paths is part of the version tree,
+// which cannot be accessed through the versioned file system.
+func (v *VersionFS) reject(op string, paths ...string) error {
+	for _, path := range paths {
+		if v.hidden(path) {
+			return &os.PathError{Op: op, Path: path, Err: os.ErrNotExist}
+		}
+	}
+
+	return nil
+}
+
+// version stores the current content of the given path as a new version,
+// and prunes the old versions.
+func (v *VersionFS) version(path string) error {
+	if err := v.snapshot(path); err != nil {
+		return err
+	}
+
+	return v.prune(path)
+}
+
+// snapshot stores the current content of the given path as a new version.
+// It does nothing if the path does not exist, or is not a regular file.
+func (v *VersionFS) snapshot(path string) error {
+	if v.hidden(path) {
+		return nil
+	}
+
+	fi, err := v.FS.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	now := v.now()
+	dir := v.versionDir(path)
+	target := vfs.Join(dir, fmt.Sprintf("%020d", now.UnixNano()))
+
+	if err := vfs.MkdirAll(v.Store, dir, 0o700); err != nil {
+		return err
+	}
+
+	size, checksum, err := v.copy(v.FS, path, v.Store, target)
+	if err != nil {
+		v.Store.Remove(target) //nolint:errcheck
+
+		return err
+	}
+
+	attrs := vfs.Attributes{}
+
+	attrs.SetString(TimeAttr, now.UTC().Format(time.RFC3339Nano))
+	attrs.SetString(UserAttr, v.User)
+	attrs.SetString(SizeAttr, strconv.FormatInt(size, 10))
+	attrs.SetString(ChecksumAttr, hex.EncodeToString(checksum))
+
+	if err := vfs.SetExtendedAttrs(v.Store, target, attrs); err != nil {
+		v.Store.Remove(target) //nolint:errcheck
+
+		return err
+	}
+
+	return nil
+}
+
+// copy copies a file between file systems, and returns its size and SHA-256 checksum.
+func (v *VersionFS) copy(src vfs.FS, path string, dst vfs.FS, target string) (int64, []byte, error) {
+	r, err := vfs.FileReadSeekCloser(src, path)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	defer r.Close()
+
+	w, err := vfs.FileWriteCloser(dst, target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	h := sha256.New()
+
+	n, err := io.Copy(io.MultiWriter(w, h), r)
+	if err != nil {
+		w.Close()
+
+		return 0, nil, err
+	}
+
+	return n, h.Sum(nil), w.Close()
+}
+
+// prune removes versions beyond the configured count and age.
+func (v *VersionFS) prune(path string) error {
+	versions, err := v.ListVersions(path)
+	if err != nil {
+		return err
+	}
+
+	for i, version := range versions {
+		tooMany := v.MaxVersions > 0 && i >= v.MaxVersions
+		tooOld := v.MaxAge > 0 && v.now().Sub(version.Time) > v.MaxAge
+
+		if !tooMany && !tooOld {
+			continue
+		}
+
+		if err := v.Store.Remove(vfs.Join(v.versionDir(path), version.ID)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ListVersions returns the stored versions of the given path, newest first.
+func (v *VersionFS) ListVersions(path string) ([]Version, error) {
+	if err := v.reject("versions", path); err != nil {
+		return nil, err
+	}
+
+	infos, err := vfs.ReadDir(v.Store, v.versionDir(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var versions []Version
+
+	for _, fi := range infos {
+		if fi.IsDir() {
+			// Versions of files below a directory with the same name
+			continue
+		}
+
+		version := Version{
+			ID:   fi.Name(),
+			Size: fi.Size(),
+		}
+
+		if nanos, err := strconv.ParseInt(fi.Name(), 10, 64); err == nil {
+			version.Time = time.Unix(0, nanos)
+		}
+
+		attrs, err := fi.Extended()
+		if err != nil {
+			return nil, err
+		}
+
+		if user, ok := attrs.GetString(UserAttr); ok {
+			version.User = user
+		}
+
+		if checksum, ok := attrs.GetString(ChecksumAttr); ok {
+			version.Checksum, _ = hex.DecodeString(checksum)
+		}
+
+		if ts, ok := attrs.GetString(TimeAttr); ok {
+			if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+				version.Time = t
+			}
+		}
+
+		versions = append(versions, version)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Time.After(versions[j].Time)
+	})
+
+	return versions, nil
+}
+
+// Restore replaces the content of the given path by the given version.
+// The current content is stored as a new version first.
+func (v *VersionFS) Restore(path, version string) error {
+	if err := v.reject("restore", path); err != nil {
+		return err
+	}
+
+	source := vfs.Join(v.versionDir(path), version)
+
+	if _, err := v.Store.Stat(source); err != nil {
+		return err
+	}
+
+	if err := v.snapshot(path); err != nil {
+		return err
+	}
+
+	if _, _, err := v.copy(v.Store, source, v.FS, path); err != nil {
+		return err
+	}
+
+	return v.prune(path)
+}
+
+func (v *VersionFS) Stat(path string) (vfs.FileInfo, error) {
+	if err := v.reject("stat", path); err != nil {
+		return nil, err
+	}
+
+	return v.FS.Stat(path)
+}
+
+// List hides the version tree from listings of its parent directory.
+func (v *VersionFS) List(path string) (vfs.ListerAt, error) {
+	if err := v.reject("list", path); err != nil {
+		return nil, err
+	}
+
+	lister, err := v.FS.List(path)
+	if err != nil || v.Store != v.FS || path != vfs.Dir(v.Root) {
+		return lister, err
+	}
+
+	defer lister.Close()
+
+	entries, err := vfs.ListAll(lister)
+	if err != nil {
+		return nil, err
+	}
+
+	var filtered vfs.FileInfoListerAt
+
+	for _, entry := range entries {
+		if entry.Name() != vfs.Base(v.Root) {
+			filtered = append(filtered, entry)
+		}
+	}
+
+	return filtered, nil
+}
+
+func (v *VersionFS) FileRead(path string) (vfs.ReaderAt, error) {
+	if err := v.reject("open", path); err != nil {
+		return nil, err
+	}
+
+	return v.FS.FileRead(path)
+}
+
+func (v *VersionFS) FileWrite(path string, flags int) (vfs.WriterAt, error) {
+	if err := v.reject("open", path); err != nil {
+		return nil, err
+	}
+
+	if flags&os.O_TRUNC != 0 {
+		// The content is lost when the file is opened
+		if err := v.version(path); err != nil {
+			return nil, err
+		}
+
+		return v.FS.FileWrite(path, flags)
+	}
+
+	_, err := v.FS.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// Nothing to preserve
+		return v.FS.FileWrite(path, flags)
+	} else if err != nil {
+		return nil, err
+	}
+
+	w, err := v.FS.FileWrite(path, flags)
+	if err != nil {
+		return nil, err
+	}
+
+	return &writerAt{WriterAt: w, v: v, path: path}, nil
+}
+
+func (v *VersionFS) Chmod(path string, mode os.FileMode) error {
+	if err := v.reject("chmod", path); err != nil {
+		return err
+	}
+
+	return v.FS.Chmod(path, mode)
+}
+
+func (v *VersionFS) Chown(path string, uid, gid int) error {
+	if err := v.reject("chown", path); err != nil {
+		return err
+	}
+
+	return v.FS.Chown(path, uid, gid)
+}
+
+func (v *VersionFS) Chtimes(path string, atime, mtime time.Time) error {
+	if err := v.reject("chtimes", path); err != nil {
+		return err
+	}
+
+	return v.FS.Chtimes(path, atime, mtime)
+}
+
+func (v *VersionFS) Truncate(path string, size int64) error {
+	if err := v.reject("truncate", path); err != nil {
+		return err
+	}
+
+	if err := v.version(path); err != nil {
+		return err
+	}
+
+	return v.FS.Truncate(path, size)
+}
+
+func (v *VersionFS) SetExtendedAttr(path, name string, value []byte) error {
+	if err := v.reject("setxattr", path); err != nil {
+		return err
+	}
+
+	return v.FS.SetExtendedAttr(path, name, value)
+}
+
+func (v *VersionFS) UnsetExtendedAttr(path, name string) error {
+	if err := v.reject("removexattr", path); err != nil {
+		return err
+	}
+
+	return v.FS.UnsetExtendedAttr(path, name)
+}
+
+func (v *VersionFS) SetExtendedAttrs(path string, attrs vfs.Attributes) error {
+	if err := v.reject("setxattr", path); err != nil {
+		return err
+	}
+
+	return vfs.SetExtendedAttrs(v.FS, path, attrs)
+}
+
+func (v *VersionFS) Rename(oldpath, newpath string) error {
+	if err := v.reject("rename", oldpath, newpath); err != nil {
+		return err
+	}
+
+	return v.FS.Rename(oldpath, newpath)
+}
+
+func (v *VersionFS) Rmdir(path string) error {
+	if err := v.reject("rmdir", path); err != nil {
+		return err
+	}
+
+	return v.FS.Rmdir(path)
+}
+
+func (v *VersionFS) Remove(path string) error {
+	if err := v.reject("remove", path); err != nil {
+		return err
+	}
+
+	return v.FS.Remove(path)
+}
+
+func (v *VersionFS) Mkdir(path string, perm os.FileMode) error {
+	if err := v.reject("mkdir", path); err != nil {
+		return err
+	}
+
+	return v.FS.Mkdir(path, perm)
+}
+
+func (v *VersionFS) Checksum(path string, algorithm crypto.Hash) ([]byte, error) {
+	if err := v.reject("checksum", path); err != nil {
+		return nil, err
+	}
+
+	if checksumFS, ok := v.FS.(vfs.ChecksumFS); ok {
+		return checksumFS.Checksum(path, algorithm)
+	}
+
+	return vfs.Checksum(v.FS, path, algorithm)
+}
+
+func (v *VersionFS) Close() error {
+	if v.Store != v.FS {
+		if err := v.Store.Close(); err != nil {
+			v.FS.Close()
+
+			return err
+		}
+	}
+
+	return v.FS.Close()
+}
+
+// writerAt stores a version before the first write.
+type writerAt struct {
+	vfs.WriterAt
+	v    *VersionFS
+	path string
+	once sync.Once
+	err  error
+}
+
+func (w *writerAt) WriteAt(buf []byte, offset int64) (int, error) {
+	w.once.Do(func() {
+		w.err = w.v.version(w.path)
+	})
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	return w.WriterAt.WriteAt(buf, offset)
+}
@@ -0,0 +1,206 @@
+package versionfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kuleuven/vfs"
+	"github.com/kuleuven/vfs/fs/nativefs"
+)
+
+func TestVersionFS(t *testing.T) {
+	fs := New(t.Context(), nativefs.New(t.Context(), t.TempDir()))
+
+	defer func() {
+		if err := fs.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	vfs.RunTestSuiteRW(t, fs)
+}
+
+func TestVersions(t *testing.T) {
+	fs := New(t.Context(), nativefs.New(t.Context(), t.TempDir()), WithMaxVersions(2), WithUser("alice"))
+
+	defer fs.Close()
+
+	now := time.Now()
+
+	fs.now = func() time.Time {
+		now = now.Add(time.Minute)
+
+		return now
+	}
+
+	for _, content := range []string{"one", "two", "three", "four"} {
+		if err := vfs.WriteFile(fs, "/file.txt", []byte(content), os.O_CREATE|os.O_WRONLY|os.O_TRUNC); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A writer without O_TRUNC stores a version before its first write only
+	w, err := fs.FileWrite("/file.txt", os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 2 {
+		if _, err := w.WriteAt([]byte("F"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	versions, err := fs.ListVersions("/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checksum := sha256.Sum256([]byte("four"))
+
+	if len(versions) != 2 || versions[0].Size != 4 || versions[0].User != "alice" || !bytes.Equal(versions[0].Checksum, checksum[:]) || versions[1].Size != 5 {
+		t.Fatalf("Unexpected versions %v", versions)
+	}
+
+	// The version tree is hidden
+	entries, err := vfs.ReadDir(fs, "/")
+	if err != nil || len(entries) != 1 {
+		t.Errorf("Expected only file.txt, got %v, %v", entries, err)
+	}
+
+	if err := fs.Restore("/file.txt", versions[1].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := vfs.ReadFile(fs, "/file.txt"); err != nil || string(data) != "three" {
+		t.Errorf("Expected 'three', got %q, %v", data, err)
+	}
+
+	// The restore stored the previous content as a version
+	versions, err = fs.ListVersions("/file.txt")
+	if err != nil || len(versions) != 2 || versions[0].Size != 4 {
+		t.Errorf("Unexpected versions %v, %v", versions, err)
+	}
+}
+
+func TestSidecarStore(t *testing.T) {
+	store := nativefs.New(t.Context(), t.TempDir())
+	fs := New(t.Context(), nativefs.New(t.Context(), t.TempDir()), WithStore(store), WithMaxAge(time.Hour))
+
+	defer fs.Close()
+
+	if err := vfs.WriteFile(fs, "/file.txt", []byte("old"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Truncate("/file.txt", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err := vfs.ReadFile(store, "/.versions/_file.txt/"+mustLatest(t, fs, "/file.txt").ID); err != nil || string(data) != "old" {
+		t.Errorf("Expected 'old' in store, got %q, %v", data, err)
+	}
+
+	// Versions expire
+	fs.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+
+	if err := fs.Truncate("/file.txt", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if versions, err := fs.ListVersions("/file.txt"); err != nil || len(versions) != 1 || versions[0].Size != 0 {
+		t.Errorf("Expected a single empty version, got %v, %v", versions, err)
+	}
+}
+
+func mustLatest(t *testing.T, fs *VersionFS, path string) Version {
+	t.Helper()
+
+	versions, err := fs.ListVersions(path)
+	if err != nil || len(versions) == 0 {
+		t.Fatalf("Expected versions, got %v, %v", versions, err)
+	}
+
+	return versions[0]
+}
+
+func TestHiddenTree(t *testing.T) {
+	fs := New(t.Context(), nativefs.New(t.Context(), t.TempDir()))
+
+	defer fs.Close()
+
+	if err := vfs.WriteFile(fs, "/file.txt", []byte("old"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Truncate("/file.txt", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	hidden := "/.versions/_file.txt/" + mustLatest(t, fs, "/file.txt").ID
+
+	if _, err := fs.Stat(hidden); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected ErrNotExist, got %v", err)
+	}
+
+	if err := fs.Remove(hidden); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected ErrNotExist, got %v", err)
+	}
+
+	if err := fs.Rename("/file.txt", "/.versions/file.txt"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected ErrNotExist, got %v", err)
+	}
+
+	if _, err := fs.FileWrite("/.versions/new", os.O_CREATE|os.O_WRONLY); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected ErrNotExist, got %v", err)
+	}
+}
+
+func TestVersionIDCollision(t *testing.T) {
+	fs := New(t.Context(), nativefs.New(t.Context(), t.TempDir()))
+
+	defer fs.Close()
+
+	if err := vfs.WriteFile(fs, "/a", []byte("file"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Truncate("/a", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	id := mustLatest(t, fs, "/a").ID
+
+	// Replace the file by a directory with a child named like the version
+	if err := fs.Remove("/a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Mkdir("/a", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vfs.WriteFile(fs, "/a/"+id, []byte("child"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Truncate("/a/"+id, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if versions, err := fs.ListVersions("/a"); err != nil || len(versions) != 1 || versions[0].Size != 4 {
+		t.Errorf("Expected a single version of /a, got %v, %v", versions, err)
+	}
+
+	if versions, err := fs.ListVersions("/a/" + id); err != nil || len(versions) != 1 || versions[0].Size != 5 {
+		t.Errorf("Expected a single version of the child, got %v, %v", versions, err)
+	}
+}
@@ -15,6 +15,8 @@ import (
 
 var _ vfs.FS = (*wrap)(nil)
 
+var _ vfs.WatchFS = (*wrap)(nil)
+
 var FileVisibilityTimeout = 45 * time.Minute
 
 var AllowRemove vfs.ContextKey = "wofs-allow-remove"
@@ -52,6 +54,21 @@ type wrap struct {
 	myfiles     []string // Files that I "know" about because the same process has opened them
 	user        string   // Username to store as metadata
 	allowRemove bool
+	notifier    vfs.Notifier
+}
+
+// Watch reports the changes made through the file system. Changes made by
+// others are not reported, as they are not visible to the client.
+func (w *wrap) Watch(path string, recursive bool) (vfs.Watcher, error) {
+	if _, err := w.Stat(path); err != nil {
+		return nil, err
+	}
+
+	return w.notifier.Watch(path, recursive), nil
+}
+
+func (w *wrap) notify(op vfs.EventOp, path string) {
+	w.notifier.Notify(vfs.Event{Op: op, Path: path})
 }
 
 func (w *wrap) FileRead(path string) (vfs.ReaderAt, error) {
@@ -71,7 +88,7 @@ func (w *wrap) FileRead(path string) (vfs.ReaderAt, error) {
 
 func (w *wrap) FileWrite(path string, flag int) (vfs.WriterAt, error) {
 	if slices.Contains(w.myfiles, path) {
-		return w.orig.FileWrite(path, flag)
+		return w.fileWrite(path, flag, false)
 	}
 
 	fi, err := w.orig.Stat(path)
@@ -102,7 +119,20 @@ func (w *wrap) FileWrite(path string, flag int) (vfs.WriterAt, error) {
 
 	w.myfiles = append(w.myfiles, path)
 
-	return w.orig.FileWrite(path, flag)
+	return w.fileWrite(path, flag, errors.Is(err, os.ErrNotExist))
+}
+
+func (w *wrap) fileWrite(path string, flag int, create bool) (vfs.WriterAt, error) {
+	writer, err := w.orig.FileWrite(path, flag)
+	if err != nil {
+		return nil, err
+	}
+
+	if create {
+		w.notify(vfs.EventCreate, path)
+	}
+
+	return w.notifier.NotifyWriter(writer, path), nil
 }
 
 const userMeta = "user.meta.mg.ingest.user"
@@ -127,7 +157,13 @@ func (w *wrap) Chtimes(path string, atime, mtime time.Time) error {
 
 func (w *wrap) Truncate(path string, size int64) error {
 	if slices.Contains(w.myfiles, path) {
-		return w.orig.Truncate(path, size)
+		if err := w.orig.Truncate(path, size); err != nil {
+			return err
+		}
+
+		w.notify(vfs.EventWrite, path)
+
+		return nil
 	}
 
 	// Never overwrite an existing file
@@ -142,7 +178,13 @@ func (w *wrap) Truncate(path string, size int64) error {
 
 	w.myfiles = append(w.myfiles, path)
 
-	return w.orig.Truncate(path, size)
+	if err := w.orig.Truncate(path, size); err != nil {
+		return err
+	}
+
+	w.notify(vfs.EventCreate, path)
+
+	return nil
 }
 
 func (w *wrap) Mkdir(path string, perm os.FileMode) error {
@@ -168,7 +210,13 @@ func (w *wrap) Mkdir(path string, perm os.FileMode) error {
 
 	w.myfiles = append(w.myfiles, path)
 
-	return w.orig.Mkdir(path, perm)
+	if err := w.orig.Mkdir(path, perm); err != nil {
+		return err
+	}
+
+	w.notify(vfs.EventCreate, path)
+
+	return nil
 }
 
 func (w *wrap) Stat(path string) (vfs.FileInfo, error) {
@@ -292,6 +340,8 @@ func (w *wrap) rename(oldpath, newpath string) error {
 		}
 	}
 
+	w.notifier.Notify(vfs.Event{Op: vfs.EventRename, Path: newpath, OldPath: oldpath})
+
 	return nil
 }
 
@@ -305,7 +355,13 @@ func (w *wrap) Remove(path string) error {
 		return os.ErrPermission
 	}
 
-	return w.orig.Remove(path)
+	if err := w.orig.Remove(path); err != nil {
+		return err
+	}
+
+	w.notify(vfs.EventRemove, path)
+
+	return nil
 }
 
 func (w *wrap) Rmdir(path string) error {
@@ -318,7 +374,13 @@ func (w *wrap) Rmdir(path string) error {
 		return os.ErrPermission
 	}
 
-	return w.orig.Rmdir(path)
+	if err := w.orig.Rmdir(path); err != nil {
+		return err
+	}
+
+	w.notify(vfs.EventRemove, path)
+
+	return nil
 }
 
 func GetAttr(m vfs.Attributes, key string) string {
@@ -347,7 +409,13 @@ func (w *wrap) SetExtendedAttr(path, name string, value []byte) error {
 		return os.ErrPermission
 	}
 
-	return w.orig.SetExtendedAttr(path, name, value)
+	if err := w.orig.SetExtendedAttr(path, name, value); err != nil {
+		return err
+	}
+
+	w.notify(vfs.EventXattr, path)
+
+	return nil
 }
 
 func (w *wrap) UnsetExtendedAttr(path, name string) error {
@@ -359,7 +427,13 @@ func (w *wrap) UnsetExtendedAttr(path, name string) error {
 		return os.ErrPermission
 	}
 
-	return w.orig.UnsetExtendedAttr(path, name)
+	if err := w.orig.UnsetExtendedAttr(path, name); err != nil {
+		return err
+	}
+
+	w.notify(vfs.EventXattr, path)
+
+	return nil
 }
 
 func (w *wrap) SetExtendedAttrs(path string, attrs vfs.Attributes) error {
@@ -387,5 +461,11 @@ func (w *wrap) SetExtendedAttrs(path string, attrs vfs.Attributes) error {
 
 	attrs.Set(timestampMeta, timestamp)
 
-	return vfs.SetExtendedAttrs(w.orig, path, attrs)
+	if err := vfs.SetExtendedAttrs(w.orig, path, attrs); err != nil {
+		return err
+	}
+
+	w.notify(vfs.EventXattr, path)
+
+	return nil
 }
@@ -2,6 +2,7 @@ package writeonlyfs
 
 import (
 	"context"
+	"os"
 	"testing"
 
 	"github.com/kuleuven/vfs"
@@ -29,3 +30,48 @@ func TestWriteOnlyFS(t *testing.T) {
 		}
 	}
 }
+
+func TestWriteOnlyFSWatch(t *testing.T) {
+	ctx := context.WithValue(t.Context(), AllowRemove, true)
+
+	fs := New(ctx, nativefs.New(ctx, t.TempDir()), "test")
+
+	defer fs.Close()
+
+	w, err := fs.(vfs.WatchFS).Watch("/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer w.Close()
+
+	if err := fs.Mkdir("/upload", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vfs.WriteFile(fs, "/upload/file", []byte("data"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Rename("/upload/file", "/upload/renamed"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Remove("/upload/renamed"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []vfs.Event{
+		{Op: vfs.EventCreate, Path: "/upload"},
+		{Op: vfs.EventCreate, Path: "/upload/file"},
+		{Op: vfs.EventWrite, Path: "/upload/file"},
+		{Op: vfs.EventRename, Path: "/upload/renamed", OldPath: "/upload/file"},
+		{Op: vfs.EventRemove, Path: "/upload/renamed"},
+	}
+
+	for _, e := range expected {
+		if event := <-w.Events(); event != e {
+			t.Fatalf("expected %v, got %v", e, event)
+		}
+	}
+}
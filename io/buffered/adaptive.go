@@ -0,0 +1,495 @@
+package buffered
+
+import (
+	"io"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AccessPattern is the access pattern that AdaptiveReaderAt detects.
+type AccessPattern int
+
+const (
+	Random AccessPattern = iota
+	Sequential
+	Strided
+)
+
+func (p AccessPattern) String() string {
+	switch p {
+	case Sequential:
+		return "sequential"
+	case Strided:
+		return "strided"
+	default:
+		return "random"
+	}
+}
+
+// ReadStats are the statistics of an AdaptiveReaderAt.
+type ReadStats struct {
+	Pattern         AccessPattern // The current access pattern
+	Hits            int64         // Chunk reads served by a loaded or loading chunk
+	Misses          int64         // Chunk reads that had to load the chunk
+	PrefetchedBytes int64         // Bytes loaded ahead of reads
+	WastedBytes     int64         // Prefetched bytes that were evicted without being read
+	Dropped         int64         // Prefetches that were skipped as the pool had no buffer
+}
+
+// HitRate returns the fraction of the chunk reads that were hits.
+func (s ReadStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// DefaultMaxInFlight is the number of chunks that AdaptiveReaderAt
+// prefetches in parallel if MaxInFlight is not set.
+var DefaultMaxInFlight = 4
+
+// AdaptiveReaderAt is a BufferedReaderAt that detects the access pattern
+// of the reads, and prefetches chunks accordingly. For sequential reads,
+// the number of chunks that are prefetched in parallel doubles each time a
+// prefetched chunk is used, up to MaxInFlight. For strided reads, the chunks
+// at the next strides are prefetched. Random reads are not prefetched.
+// Chunks that were read are evicted before prefetched chunks, and both in
+// least recently used order.
+//
+// If the Pool has no buffer, prefetches are dropped, and a read that needs a
+// chunk frees the chunks of the reader before it waits for the pool.
+type AdaptiveReaderAt struct {
+	ReaderAt    io.ReaderAt
+	ChunkSize   int
+	MaxChunks   int   // Defaults to MaxInFlight + 2
+	MaxInFlight int   // Defaults to DefaultMaxInFlight
+	Pool        *Pool // Optional pool for the chunk buffers
+	chunks      map[int64]*adaptiveChunk
+	clock       uint64
+	inFlight    int
+	window      int   // Number of chunks to prefetch
+	size        int64 // Size of the reader, if known, or -1
+	lastOffset  int64
+	lastEnd     int64
+	stride      int64
+	reads       int
+	waiting     int // Number of reads waiting for the pool
+	stats       ReadStats
+	closed      bool
+	wg          sync.WaitGroup
+	sync.Mutex
+}
+
+type adaptiveChunk struct {
+	*Chunk
+	ready      chan struct{} // Closed once loaded
+	err        error
+	n          int
+	prefetched bool // Loaded ahead of a read
+	used       bool // Read at least once
+	evicted    bool
+	refs       int // Number of loads and reads using the buffer
+	lastUse    uint64
+}
+
+func (a *AdaptiveReaderAt) init() {
+	if a.chunks != nil {
+		return
+	}
+
+	if a.MaxInFlight < 1 {
+		a.MaxInFlight = DefaultMaxInFlight
+	}
+
+	if a.MaxChunks < a.MaxInFlight+2 {
+		a.MaxChunks = a.MaxInFlight + 2
+	}
+
+	a.chunks = map[int64]*adaptiveChunk{}
+	a.size = -1
+}
+
+func (a *AdaptiveReaderAt) ReadAt(buf []byte, off int64) (int, error) {
+	a.Lock()
+	a.init()
+	a.observe(off, len(buf))
+	a.Unlock()
+
+	var (
+		n, seen int
+		err     error
+	)
+
+	for err == nil && seen < len(buf) {
+		n, err = a.readChunkAt(buf[seen:], off+int64(seen))
+		seen += n
+	}
+
+	a.Lock()
+	a.prefetch(off, len(buf))
+	a.Unlock()
+
+	logrus.Tracef("ReadAt [%d, %d] => %d, %v", off, off+int64(len(buf))-1, seen, err)
+
+	return seen, err
+}
+
+// observe updates the access pattern for a read.
+func (a *AdaptiveReaderAt) observe(off int64, length int) {
+	pattern := Random
+
+	// Parallel sequential reads can arrive slightly out of order
+	near := off >= a.lastOffset-int64(a.ChunkSize) && off <= a.lastEnd+int64(a.ChunkSize)
+
+	switch {
+	case a.reads == 0 && off == 0:
+		// Most reads that start at the beginning continue sequentially
+		pattern = Sequential
+	case a.reads == 0:
+	case near:
+		pattern = Sequential
+	case off-a.lastOffset == a.stride:
+		pattern = Strided
+	}
+
+	if a.reads > 0 {
+		a.stride = off - a.lastOffset
+	}
+
+	if pattern != a.stats.Pattern || pattern == Random {
+		a.window = 0
+	}
+
+	if pattern != Random && a.window == 0 {
+		a.window = 1
+	}
+
+	a.stats.Pattern = pattern
+	a.lastOffset = off
+	a.lastEnd = off + int64(length)
+	a.reads++
+}
+
+// prefetch starts loading the chunks that are expected to be read next.
+func (a *AdaptiveReaderAt) prefetch(off int64, length int) {
+	if a.closed || a.window == 0 {
+		return
+	}
+
+	var next func(i int) int64
+
+	switch a.stats.Pattern {
+	case Sequential:
+		last := a.chunkOffset(off + int64(length) - 1)
+
+		next = func(i int) int64 { return last + int64(i)*int64(a.ChunkSize) }
+	case Strided:
+		next = func(i int) int64 { return a.chunkOffset(off + int64(i)*a.stride) }
+	default:
+		return
+	}
+
+	for i := 1; i <= a.window && a.inFlight < a.MaxInFlight; i++ {
+		chunkOffset := next(i)
+
+		if chunkOffset < 0 || (a.size >= 0 && chunkOffset >= a.size) {
+			return
+		}
+
+		if _, ok := a.chunks[chunkOffset]; ok {
+			continue
+		}
+
+		chunk := a.newChunk(chunkOffset)
+		if chunk == nil {
+			a.stats.Dropped++
+
+			return
+		}
+
+		chunk.prefetched = true
+
+		a.wg.Add(1)
+
+		go func() {
+			defer a.wg.Done()
+
+			a.load(chunk)
+		}()
+	}
+}
+
+func (a *AdaptiveReaderAt) chunkOffset(off int64) int64 {
+	return (off / int64(a.ChunkSize)) * int64(a.ChunkSize)
+}
+
+// readChunkAt reads from a single chunk, like BufferedReaderAt.ReadChunkAt.
+func (a *AdaptiveReaderAt) readChunkAt(buf []byte, off int64) (int, error) {
+	a.Lock()
+
+	chunkOffset := a.chunkOffset(off)
+
+	chunk, ok := a.chunks[chunkOffset]
+	if !ok {
+		chunk = a.newChunk(chunkOffset)
+	}
+
+	if chunk == nil {
+		// Free the chunks of the reader, and wait for the pool
+		a.shed()
+		a.waiting++
+		a.Unlock()
+
+		b := a.Pool.Get(a.ChunkSize)
+
+		a.Lock()
+		a.waiting--
+
+		if chunk, ok = a.chunks[chunkOffset]; ok {
+			a.Pool.Put(b)
+		} else {
+			chunk = a.addChunk(chunkOffset, b)
+		}
+	}
+
+	if ok {
+		a.stats.Hits++
+	} else {
+		a.stats.Misses++
+	}
+
+	chunk.refs++
+
+	a.Unlock()
+
+	if !ok {
+		a.load(chunk)
+	}
+
+	<-chunk.ready
+
+	a.Lock()
+	defer a.Unlock()
+
+	defer a.unref(chunk)
+
+	if chunk.err != nil {
+		return 0, chunk.err
+	}
+
+	if chunk.prefetched && !chunk.used && a.stats.Pattern != Random && a.window < a.MaxInFlight {
+		// The prefetch paid off, read further ahead
+		a.window = min(2*a.window, a.MaxInFlight)
+	}
+
+	chunk.used = true
+	a.clock++
+	chunk.lastUse = a.clock
+
+	return returnEOF(chunk.ReadAt(buf, off))
+}
+
+// newChunk adds a chunk that is about to be loaded, evicting the least
+// recently used loaded chunk if needed, or returns nil if the pool has
+// no buffer for it.
+func (a *AdaptiveReaderAt) newChunk(offset int64) *adaptiveChunk {
+	var victim *adaptiveChunk
+
+	if len(a.chunks) >= a.MaxChunks {
+		for _, chunk := range a.chunks {
+			if !chunk.isReady() {
+				continue
+			}
+
+			if victim == nil || evictBefore(chunk, victim) {
+				victim = chunk
+			}
+		}
+	}
+
+	if victim != nil {
+		a.evict(victim)
+	}
+
+	buf, ok := a.Pool.TryGet(a.ChunkSize)
+	if !ok {
+		return nil
+	}
+
+	return a.addChunk(offset, buf)
+}
+
+// addChunk adds a chunk with the given buffer, referenced by its load.
+func (a *AdaptiveReaderAt) addChunk(offset int64, buf []byte) *adaptiveChunk {
+	chunk := &adaptiveChunk{
+		Chunk: newChunkWithBuffer(offset, buf),
+		ready: make(chan struct{}),
+		refs:  1,
+	}
+
+	a.clock++
+	chunk.lastUse = a.clock
+	a.chunks[offset] = chunk
+	a.inFlight++
+
+	return chunk
+}
+
+func (c *adaptiveChunk) isReady() bool {
+	select {
+	case <-c.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// evictBefore orders the chunks that were read before the prefetched
+// chunks that were not read yet, and both by least recent use.
+func evictBefore(a, b *adaptiveChunk) bool {
+	if a.used != b.used {
+		return a.used
+	}
+
+	return a.lastUse < b.lastUse
+}
+
+// evict removes a chunk. Its buffer returns to the pool once it is no longer used.
+func (a *AdaptiveReaderAt) evict(chunk *adaptiveChunk) {
+	if chunk.evicted {
+		return
+	}
+
+	if chunk.prefetched && !chunk.used {
+		a.stats.WastedBytes += int64(chunk.n)
+	}
+
+	if a.chunks[chunk.Offset()] == chunk {
+		delete(a.chunks, chunk.Offset())
+	}
+
+	chunk.evicted = true
+
+	a.releaseUnused(chunk)
+}
+
+func (a *AdaptiveReaderAt) unref(chunk *adaptiveChunk) {
+	chunk.refs--
+
+	a.releaseUnused(chunk)
+}
+
+func (a *AdaptiveReaderAt) releaseUnused(chunk *adaptiveChunk) {
+	if chunk.evicted && chunk.refs == 0 {
+		a.Pool.release(chunk.Chunk)
+	}
+}
+
+// shed evicts the loaded chunks.
+func (a *AdaptiveReaderAt) shed() {
+	for _, chunk := range a.chunks {
+		if chunk.isReady() {
+			a.evict(chunk)
+		}
+	}
+}
+
+// load populates a chunk that was added by newChunk.
+func (a *AdaptiveReaderAt) load(chunk *adaptiveChunk) {
+	logrus.Tracef("Reading [%d,%d]", chunk.Offset(), chunk.Offset()+int64(a.ChunkSize)-1)
+
+	n, err := chunk.FromReader(a.ReaderAt)
+
+	a.Lock()
+	defer a.Unlock()
+
+	defer a.unref(chunk)
+
+	a.inFlight--
+
+	if (err == nil && n < a.ChunkSize) || err == io.EOF {
+		a.size = chunk.Offset() + int64(n)
+	}
+
+	chunk.err = err
+
+	if err == nil {
+		chunk.n = n
+	}
+
+	close(chunk.ready)
+
+	// Failed chunks are not kept, a next read tries again
+	if err != nil {
+		a.evict(chunk)
+
+		return
+	}
+
+	if !chunk.prefetched {
+		return
+	}
+
+	a.stats.PrefetchedBytes += int64(n)
+
+	// A read of the reader waits for the pool, which is more urgent
+	if a.waiting > 0 {
+		a.evict(chunk)
+	}
+}
+
+// Invalidate invalidates all chunks that intersect with the given range,
+// like BufferedReaderAt.Invalidate.
+func (a *AdaptiveReaderAt) Invalidate(off int64, length int) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.init()
+
+	for _, chunk := range a.chunks {
+		if length > 0 && !chunk.Overlaps(off, length) {
+			continue
+		}
+
+		if length < 0 && chunk.Offset()+int64(chunk.Size()) <= off {
+			continue
+		}
+
+		a.evict(chunk)
+	}
+
+	a.size = -1
+}
+
+// Stats returns the statistics of the reader.
+func (a *AdaptiveReaderAt) Stats() ReadStats {
+	a.Lock()
+	defer a.Unlock()
+
+	return a.stats
+}
+
+// Close waits for the prefetches, and closes the underlying reader.
+// Chunks that were prefetched but never read count as wasted.
+func (a *AdaptiveReaderAt) Close() error {
+	a.Lock()
+	a.closed = true
+	a.Unlock()
+
+	a.wg.Wait()
+
+	a.Lock()
+	defer a.Unlock()
+
+	for _, chunk := range a.chunks {
+		a.evict(chunk)
+	}
+
+	if closer, ok := a.ReaderAt.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 type BackgroundReader struct {
 	ReaderAt  io.ReaderAt
 	ChunkSize int
+	Pool      *Pool // Optional pool for the chunk buffer
 	chunk     *Chunk
 	readErr   error
 	sync.WaitGroup
@@ -36,7 +37,7 @@ func (c *BackgroundReader) ReadAt(buf []byte, offset int64) (int, error) {
 	}
 
 	if c.chunk == nil {
-		c.chunk = newChunk(offset+int64(len(buf)), c.ChunkSize)
+		c.chunk = newChunkWithBuffer(offset+int64(len(buf)), c.Pool.Get(c.ChunkSize))
 	} else {
 		c.chunk.Reset(offset + int64(len(buf)))
 	}
@@ -56,6 +57,11 @@ func (c *BackgroundReader) ReadAt(buf []byte, offset int64) (int, error) {
 func (c *BackgroundReader) Close() error {
 	c.Wait()
 
+	if c.chunk != nil {
+		c.Pool.release(c.chunk)
+		c.chunk = nil
+	}
+
 	if closer, ok := c.ReaderAt.(io.Closer); ok {
 		return closer.Close()
 	}
@@ -66,6 +72,7 @@ func (c *BackgroundReader) Close() error {
 type BackgroundWriter struct {
 	WriterAt  io.WriterAt
 	ChunkSize int
+	Pool      *Pool // Optional pool for the chunk buffer
 	chunk     *Chunk
 	writeErr  error
 	sync.WaitGroup
@@ -79,7 +86,7 @@ func (c *BackgroundWriter) WriteAt(buf []byte, offset int64) (int, error) {
 	}
 
 	if c.chunk == nil {
-		c.chunk = newChunk(offset, c.ChunkSize)
+		c.chunk = newChunkWithBuffer(offset, c.Pool.Get(c.ChunkSize))
 	} else {
 		c.chunk.Reset(offset)
 	}
@@ -107,6 +114,11 @@ func (c *BackgroundWriter) WriteAt(buf []byte, offset int64) (int, error) {
 func (c *BackgroundWriter) Close() error {
 	c.Wait()
 
+	if c.chunk != nil {
+		c.Pool.release(c.chunk)
+		c.chunk = nil
+	}
+
 	errs := []error{
 		c.writeErr,
 	}
@@ -1,6 +1,7 @@
 package buffered
 
 import (
+	"errors"
 	"io"
 	"strings"
 	"sync"
@@ -12,6 +13,7 @@ type BufferedReaderAt struct {
 	ReaderAt  io.ReaderAt
 	ChunkSize int
 	MaxChunks int
+	Pool      *Pool // Optional pool for the chunk buffers
 	chunks    []*Chunk
 	sync.Mutex
 }
@@ -55,19 +57,34 @@ func (b *BufferedReaderAt) ReadChunkAt(buf []byte, off int64) (int, error) {
 	chunkOffset := (off / int64(b.ChunkSize)) * int64(b.ChunkSize)
 
 	if len(b.chunks) < b.MaxChunks {
-		chunk = newChunk(chunkOffset, b.ChunkSize)
-	} else {
+		if buf, ok := b.Pool.TryGet(b.ChunkSize); ok {
+			chunk = newChunkWithBuffer(chunkOffset, buf)
+		}
+	}
+
+	// Reuse the oldest chunk if there are enough, or the pool has no buffer
+	if chunk == nil && len(b.chunks) > 0 {
 		chunk = b.chunks[0]
 		b.chunks = b.chunks[1:]
 
 		chunk.Reset(chunkOffset)
 	}
 
+	// Do not wait for the pool while holding the lock, as its buffers might be
+	// held by idle readers. A reader has at most one buffer outside of the pool,
+	// as it is reused as long as the pool has no buffer.
+	if chunk == nil {
+		chunk = newChunk(chunkOffset, b.ChunkSize)
+		chunk.unpooled = true
+	}
+
 	// Populate the chunk
 	logrus.Tracef("Reading [%d,%d]", chunkOffset, chunkOffset+int64(b.ChunkSize)-1)
 
 	n, err := chunk.FromReader(b.ReaderAt)
 	if err != nil {
+		b.Pool.release(chunk)
+
 		return n, err
 	}
 
@@ -87,12 +104,13 @@ func (b *BufferedReaderAt) Invalidate(off int64, length int) {
 
 	// Read from the current chunks if possible
 	for _, chunk := range b.chunks {
-		if length > 0 && !chunk.Overlaps(off, length) {
+		switch {
+		case length > 0 && !chunk.Overlaps(off, length):
 			kept = append(kept, chunk)
-		}
-
-		if length < 0 && chunk.Offset()+int64(chunk.Size()) <= off {
+		case length < 0 && chunk.Offset()+int64(chunk.Size()) <= off:
 			kept = append(kept, chunk)
+		default:
+			b.Pool.release(chunk)
 		}
 	}
 
@@ -113,6 +131,12 @@ func (b *BufferedReaderAt) Close() error {
 
 	defer b.Unlock()
 
+	for _, chunk := range b.chunks {
+		b.Pool.release(chunk)
+	}
+
+	b.chunks = nil
+
 	if closer, ok := b.ReaderAt.(io.Closer); ok {
 		return closer.Close()
 	}
@@ -124,6 +148,7 @@ type BufferedWriterAt struct {
 	WriterAt  io.WriterAt
 	ChunkSize int
 	MaxChunks int
+	Pool      *Pool // Optional pool for the chunk buffers
 	chunks    []*Chunk
 	sync.Mutex
 }
@@ -174,10 +199,13 @@ func (b *BufferedWriterAt) WriteChunkAt(buf []byte, off int64) (int, error) {
 	return chunk.WriteAt(buf, off)
 }
 
-// Create a new chunk or reuse the chunk that has the most bytes written to it.
+// Create a new chunk or reuse the chunk that has the most bytes written to it,
+// also if the pool has no buffer. Only a writer without chunks waits for the pool.
 func (b *BufferedWriterAt) freeChunk(offset int64) (*Chunk, error) {
 	if len(b.chunks) < b.MaxChunks {
-		return newChunk(offset, b.ChunkSize), nil
+		if buf, ok := b.Pool.TryGet(b.ChunkSize); ok {
+			return newChunkWithBuffer(offset, buf), nil
+		}
 	}
 
 	// Discard largest chunk
@@ -194,7 +222,7 @@ func (b *BufferedWriterAt) freeChunk(offset int64) (*Chunk, error) {
 	}
 
 	if largestChunk == nil {
-		return newChunk(offset, b.ChunkSize), nil
+		return newChunkWithBuffer(offset, b.Pool.Get(b.ChunkSize)), nil
 	}
 
 	_, err := largestChunk.WriteTo(b.WriterAt)
@@ -246,8 +274,12 @@ func (b *BufferedWriterAt) Close() error {
 		_, err := chunk.WriteTo(b.WriterAt)
 
 		errs = append(errs, err)
+
+		b.Pool.release(chunk)
 	}
 
+	b.chunks = nil
+
 	if closer, ok := b.WriterAt.(io.Closer); ok {
 		errs = append(errs, closer.Close())
 	}
@@ -255,6 +287,128 @@ func (b *BufferedWriterAt) Close() error {
 	return MultipleError(errs...)
 }
 
+// sparseWriterAt is implemented by writers that know their data ranges.
+type sparseWriterAt interface {
+	SeekData(offset int64) (int64, error)
+	SeekHole(offset int64) (int64, error)
+}
+
+// SeekData returns the start of the first range at or after offset with
+// data that is buffered or in the underlying writer, or io.EOF if there is
+// none. The underlying writer must support SeekData and SeekHole.
+func (b *BufferedWriterAt) SeekData(offset int64) (int64, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	sparse, ok := b.WriterAt.(sparseWriterAt)
+	if !ok {
+		return 0, errors.ErrUnsupported
+	}
+
+	next, err := sparse.SeekData(offset)
+	if errors.Is(err, io.EOF) {
+		next = -1
+	} else if err != nil {
+		return 0, err
+	}
+
+	if buffered := b.seekData(offset); buffered >= 0 && (next < 0 || buffered < next) {
+		next = buffered
+	}
+
+	if next < 0 {
+		return 0, io.EOF
+	}
+
+	return next, nil
+}
+
+// SeekHole returns the start of the first range at or after offset
+// that is neither buffered nor written to the underlying writer.
+func (b *BufferedWriterAt) SeekHole(offset int64) (int64, error) {
+	b.Lock()
+	defer b.Unlock()
+
+	sparse, ok := b.WriterAt.(sparseWriterAt)
+	if !ok {
+		return 0, errors.ErrUnsupported
+	}
+
+	pos := offset
+
+	for {
+		hole, err := sparse.SeekHole(pos)
+		if errors.Is(err, io.EOF) && pos == offset && b.seekData(offset) < 0 {
+			return 0, io.EOF
+		} else if errors.Is(err, io.EOF) {
+			// Past the end of the underlying file
+			hole = pos
+		} else if err != nil {
+			return 0, err
+		}
+
+		end := b.dataEnd(hole)
+		if end == hole {
+			return hole, nil
+		}
+
+		pos = end
+	}
+}
+
+// seekData returns the first buffered offset at or after offset, or -1.
+func (b *BufferedWriterAt) seekData(offset int64) int64 {
+	next := int64(-1)
+
+	for _, chunk := range b.chunks {
+		if pos := chunk.seekData(offset); pos >= 0 && (next < 0 || pos < next) {
+			next = pos
+		}
+	}
+
+	return next
+}
+
+// dataEnd returns the end of the buffered data that contains offset,
+// or offset if it is not buffered.
+func (b *BufferedWriterAt) dataEnd(offset int64) int64 {
+	for {
+		var n int
+
+		for _, chunk := range b.chunks {
+			if n = chunk.SizeAt(offset); n > 0 {
+				break
+			}
+		}
+
+		if n == 0 {
+			return offset
+		}
+
+		offset += int64(n)
+	}
+}
+
+// PunchHole discards the buffered data in the given range, and punches
+// a hole in the underlying writer, which must support it.
+func (b *BufferedWriterAt) PunchHole(offset, length int64) error {
+	b.Lock()
+	defer b.Unlock()
+
+	puncher, ok := b.WriterAt.(interface {
+		PunchHole(offset, length int64) error
+	})
+	if !ok {
+		return errors.ErrUnsupported
+	}
+
+	for _, chunk := range b.chunks {
+		chunk.discard(offset, length)
+	}
+
+	return puncher.PunchHole(offset, length)
+}
+
 func MultipleError(errs ...error) error {
 	var realErrs []error
 
@@ -285,3 +439,7 @@ func (m MultipleErrors) Error() string {
 
 	return "multiple errors: " + strings.Join(errStrs, ", ")
 }
+
+func (m MultipleErrors) Unwrap() []error {
+	return m
+}
@@ -7,6 +7,7 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 // Mock implementations for testing
@@ -711,3 +712,540 @@ func TestEdgeCases(t *testing.T) {
 		t.Error("Expected error for zero-sized chunk write")
 	}
 }
+
+func TestAdaptiveReaderAt_Sequential(t *testing.T) {
+	data := make([]byte, 1000)
+
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	reader := &AdaptiveReaderAt{
+		ReaderAt:    &mockReaderAt{data: data},
+		ChunkSize:   10,
+		MaxInFlight: 4,
+	}
+
+	var result []byte
+
+	buf := make([]byte, 5)
+
+	for off := int64(0); ; off += 5 {
+		n, err := reader.ReadAt(buf, off)
+
+		result = append(result, buf[:n]...)
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !bytes.Equal(result, data) {
+		t.Fatal("Read data does not match")
+	}
+
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := reader.Stats()
+
+	if stats.Pattern != Sequential {
+		t.Errorf("Expected sequential pattern, got %s", stats.Pattern)
+	}
+
+	if stats.HitRate() < 0.9 {
+		t.Errorf("Expected a hit rate of at least 0.9, got %v", stats)
+	}
+
+	if stats.PrefetchedBytes == 0 || stats.WastedBytes != 0 {
+		t.Errorf("Expected prefetched bytes without waste, got %v", stats)
+	}
+}
+
+func TestAdaptiveReaderAt_Patterns(t *testing.T) {
+	data := make([]byte, 1000)
+
+	for _, test := range []struct {
+		offsets []int64
+		pattern AccessPattern
+		hits    int64
+	}{
+		{[]int64{500, 100, 900, 300, 700}, Random, 0},
+		{[]int64{100, 300, 500, 700}, Strided, 1},
+	} {
+		reader := &AdaptiveReaderAt{
+			ReaderAt:  &mockReaderAt{data: data},
+			ChunkSize: 10,
+		}
+
+		for _, off := range test.offsets {
+			if _, err := reader.ReadAt(make([]byte, 5), off); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := reader.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		stats := reader.Stats()
+
+		if stats.Pattern != test.pattern || stats.Hits != test.hits {
+			t.Errorf("Expected %s pattern with %d hits, got %v", test.pattern, test.hits, stats)
+		}
+
+		if test.pattern == Random && stats.PrefetchedBytes != 0 {
+			t.Errorf("Expected no prefetches for random reads, got %v", stats)
+		}
+
+		if test.pattern == Strided && stats.WastedBytes != 10 {
+			t.Errorf("Expected the chunk after the last stride to be wasted, got %v", stats)
+		}
+	}
+}
+
+func TestPool(t *testing.T) {
+	pool := NewPool(20)
+
+	first := pool.Get(10)
+
+	if _, ok := pool.TryGet(10); !ok {
+		t.Fatal("Expected a buffer within the budget")
+	}
+
+	if _, ok := pool.TryGet(10); ok {
+		t.Fatal("Expected no buffer beyond the budget")
+	}
+
+	done := make(chan []byte)
+
+	go func() {
+		done <- pool.Get(10)
+	}()
+
+	pool.Put(first)
+
+	// The returned buffer is recycled
+	if buf := <-done; &buf[0] != &first[0] {
+		t.Error("Expected the buffer to be recycled")
+	}
+
+	if used := pool.Used(); used != 20 {
+		t.Errorf("Expected 20 bytes in use, got %d", used)
+	}
+
+	// A nil pool has no budget
+	var unlimited *Pool
+
+	if buf, ok := unlimited.TryGet(10); !ok || len(buf) != 10 {
+		t.Error("Expected a buffer from a nil pool")
+	}
+}
+
+func TestPool_Budget(t *testing.T) {
+	data := make([]byte, 1000)
+
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	pool := NewPool(30)
+
+	reader := &AdaptiveReaderAt{
+		ReaderAt:    &mockReaderAt{data: data},
+		ChunkSize:   10,
+		MaxInFlight: 4,
+		Pool:        pool,
+	}
+
+	buf := make([]byte, 1000)
+
+	for off := 0; off < len(data); off += 100 {
+		if _, err := reader.ReadAt(buf[off:off+100], int64(off)); err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+	}
+
+	if !bytes.Equal(buf, data) {
+		t.Fatal("Read data does not match")
+	}
+
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats := reader.Stats(); stats.Dropped == 0 {
+		t.Errorf("Expected dropped prefetches, got %v", stats)
+	}
+
+	writer := &mockWriterAt{}
+
+	buffered := &BufferedWriterAt{
+		WriterAt:  writer,
+		ChunkSize: 10,
+		MaxChunks: 4,
+		Pool:      pool,
+	}
+
+	for off := 0; off < len(data); off += 25 {
+		if _, err := buffered.WriteAt(data[off:off+25], int64(off)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := buffered.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(writer.data, data) {
+		t.Fatal("Written data does not match")
+	}
+
+	if used := pool.Used(); used != 0 {
+		t.Errorf("Expected all buffers to be returned, got %d bytes in use", used)
+	}
+}
+
+func TestPool_IdleReader(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+
+	pool := NewPool(10)
+
+	idle := &BufferedReaderAt{ReaderAt: &mockReaderAt{data: data}, ChunkSize: 10, MaxChunks: 2, Pool: pool}
+
+	// The idle reader holds the only buffer of the pool
+	if _, err := idle.ReadAt(make([]byte, 5), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := &BufferedReaderAt{ReaderAt: &mockReaderAt{data: data}, ChunkSize: 10, MaxChunks: 2, Pool: pool}
+
+	done := make(chan error)
+
+	go func() {
+		buf := make([]byte, 20)
+
+		_, err := reader.ReadAt(buf, 0)
+		if err == nil && !bytes.Equal(buf, data) {
+			err = errors.New("read data does not match")
+		}
+
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the reader not to wait for the pool")
+	}
+
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := idle.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if used := pool.Used(); used != 0 {
+		t.Errorf("Expected all buffers to be returned, got %d bytes in use", used)
+	}
+}
+
+// streamWriter is a stream to a shared mockWriterAt, that records
+// the order and the concurrency of the writes.
+type streamWriter struct {
+	target  *mockWriterAt
+	offsets *[]int64
+	active  *int
+	peak    *int
+	failAt  int64
+	closed  bool
+	mu      *sync.Mutex
+}
+
+func (s *streamWriter) WriteAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	*s.active++
+	*s.peak = max(*s.peak, *s.active)
+	s.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	*s.active--
+	*s.offsets = append(*s.offsets, off)
+
+	if off == s.failAt {
+		return 0, errors.New("write error")
+	}
+
+	return s.target.WriteAt(p, off)
+}
+
+func (s *streamWriter) Close() error {
+	s.closed = true
+	return nil
+}
+
+func newStreamWriter(failAt int64) (*streamWriter, func() (io.WriterAt, error), *[]*streamWriter) {
+	primary := &streamWriter{
+		target:  &mockWriterAt{},
+		offsets: &[]int64{},
+		active:  new(int),
+		peak:    new(int),
+		failAt:  failAt,
+		mu:      &sync.Mutex{},
+	}
+
+	var opened []*streamWriter
+
+	return primary, func() (io.WriterAt, error) {
+		stream := *primary
+		stream.closed = false
+
+		opened = append(opened, &stream)
+
+		return &stream, nil
+	}, &opened
+}
+
+func TestParallelWriter(t *testing.T) {
+	primary, factory, opened := newStreamWriter(-1)
+
+	writer := &ParallelWriter{
+		WriterAt:    primary,
+		NewWriterAt: factory,
+		ChunkSize:   10,
+		Streams:     4,
+	}
+
+	data := []byte(strings.Repeat("0123456789", 8))
+
+	// Out of order
+	for _, off := range []int{70, 0, 30, 10, 60, 20, 50, 40} {
+		if _, err := writer.WriteAt(data[off:off+10], int64(off)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(primary.target.data, data) {
+		t.Fatal("Written data does not match")
+	}
+
+	if *primary.peak < 2 {
+		t.Errorf("Expected concurrent writes, got %d", *primary.peak)
+	}
+
+	if len(*opened) == 0 || len(*opened) > 3 {
+		t.Errorf("Expected 1 to 3 extra streams, got %d", len(*opened))
+	}
+
+	for _, stream := range append(*opened, primary) {
+		if !stream.closed {
+			t.Error("Expected all streams to be closed")
+		}
+	}
+}
+
+func TestParallelWriter_Ordered(t *testing.T) {
+	primary, _, _ := newStreamWriter(-1)
+
+	writer := &ParallelWriter{
+		WriterAt:  primary,
+		ChunkSize: 10,
+		Streams:   3,
+		Ordered:   true,
+	}
+
+	data := []byte(strings.Repeat("0123456789", 5))
+
+	for _, off := range []int{0, 20, 10, 40, 30} {
+		if _, err := writer.WriteAt(data[off:off+10], int64(off)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(primary.target.data, data) {
+		t.Fatal("Written data does not match")
+	}
+
+	if *primary.peak != 1 {
+		t.Errorf("Expected sequential writes, got %d concurrent", *primary.peak)
+	}
+
+	expected := []int64{0, 10, 20, 30, 40}
+
+	for i, off := range *primary.offsets {
+		if off != expected[i] {
+			t.Fatalf("Expected writes at %v, got %v", expected, *primary.offsets)
+		}
+	}
+}
+
+func TestParallelWriter_Error(t *testing.T) {
+	primary, _, _ := newStreamWriter(20)
+
+	writer := &ParallelWriter{
+		WriterAt:  primary,
+		ChunkSize: 10,
+		Streams:   2,
+	}
+
+	data := []byte(strings.Repeat("0123456789", 4))
+
+	for off := 0; off < len(data); off += 10 {
+		if _, err := writer.WriteAt(data[off:off+10], int64(off)); err != nil {
+			break
+		}
+	}
+
+	err := writer.Close()
+
+	var chunkErr *ChunkError
+
+	if !errors.As(err, &chunkErr) {
+		t.Fatalf("Expected a chunk error, got %v", err)
+	}
+
+	if chunkErr.Offset != 20 || chunkErr.Length != 10 {
+		t.Errorf("Expected an error for [20, 29], got %v", chunkErr)
+	}
+
+	if errs := writer.Errors(); len(errs) != 1 || errs[0].Offset != 20 {
+		t.Errorf("Expected one chunk error at 20, got %v", errs)
+	}
+}
+
+// mockSparseWriter tracks which bytes were written.
+type mockSparseWriter struct {
+	mockWriterAt
+	has     []bool
+	punched [][2]int64
+}
+
+func (m *mockSparseWriter) WriteAt(p []byte, off int64) (int, error) {
+	for int64(len(m.has)) < off+int64(len(p)) {
+		m.has = append(m.has, false)
+	}
+
+	for i := range p {
+		m.has[off+int64(i)] = true
+	}
+
+	return m.mockWriterAt.WriteAt(p, off)
+}
+
+func (m *mockSparseWriter) SeekData(off int64) (int64, error) {
+	for i := off; i < int64(len(m.has)); i++ {
+		if m.has[i] {
+			return i, nil
+		}
+	}
+
+	return 0, io.EOF
+}
+
+func (m *mockSparseWriter) SeekHole(off int64) (int64, error) {
+	if off >= int64(len(m.has)) {
+		return 0, io.EOF
+	}
+
+	for i := off; i < int64(len(m.has)); i++ {
+		if !m.has[i] {
+			return i, nil
+		}
+	}
+
+	return int64(len(m.has)), nil
+}
+
+func (m *mockSparseWriter) PunchHole(off, length int64) error {
+	m.punched = append(m.punched, [2]int64{off, length})
+
+	return nil
+}
+
+func TestBufferedWriterAt_Sparse(t *testing.T) {
+	sparse := &mockSparseWriter{}
+
+	if _, err := sparse.WriteAt(make([]byte, 10), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	writer := &BufferedWriterAt{
+		WriterAt:  sparse,
+		ChunkSize: 10,
+		MaxChunks: 4,
+	}
+
+	// Buffered data at [10, 15) and [30, 38)
+	for off, data := range map[int64]string{10: "01234", 30: "01234567"} {
+		if _, err := writer.WriteAt([]byte(data), off); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		hole     bool
+		offset   int64
+		expected int64
+	}{
+		{false, 0, 0},
+		{true, 0, 15},
+		{false, 15, 30},
+		{true, 30, 38},
+	} {
+		seek := writer.SeekData
+		if tc.hole {
+			seek = writer.SeekHole
+		}
+
+		if next, err := seek(tc.offset); err != nil || next != tc.expected {
+			t.Errorf("Expected %d for %v at %d, got %d (%v)", tc.expected, tc.hole, tc.offset, next, err)
+		}
+	}
+
+	if _, err := writer.SeekHole(38); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected EOF, got %v", err)
+	}
+
+	if err := writer.PunchHole(32, 4); err != nil {
+		t.Fatal(err)
+	}
+
+	if next, err := writer.SeekHole(30); err != nil || next != 32 {
+		t.Errorf("Expected a hole at 32, got %d (%v)", next, err)
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sparse.punched) != 1 || sparse.has[33] || !sparse.has[36] {
+		t.Errorf("Expected the hole to be punched, got %v", sparse.has)
+	}
+
+	// Writers without sparse support
+	unsupported := &BufferedWriterAt{WriterAt: &mockWriterAt{}, ChunkSize: 10, MaxChunks: 1}
+
+	if err := unsupported.PunchHole(0, 10); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("Expected ErrUnsupported, got %v", err)
+	}
+}
@@ -9,17 +9,22 @@ import (
 )
 
 type Chunk struct {
-	offset  int64
-	buf     []byte      // The actual buffer
-	slices  map[int]int // The start and lengths of each slice. These can overlap if Write is called for overlapping parts.
-	read    int         // Number of bytes read
-	written int         // Number of bytes written
+	offset   int64
+	buf      []byte      // The actual buffer
+	slices   map[int]int // The start and lengths of each slice. These can overlap if Write is called for overlapping parts.
+	read     int         // Number of bytes read
+	written  int         // Number of bytes written
+	unpooled bool        // Whether the buffer was not obtained from a Pool
 }
 
 func newChunk(offset int64, size int) *Chunk {
+	return newChunkWithBuffer(offset, make([]byte, size))
+}
+
+func newChunkWithBuffer(offset int64, buf []byte) *Chunk {
 	return &Chunk{
 		offset: offset,
-		buf:    make([]byte, size),
+		buf:    buf,
 		slices: map[int]int{},
 	}
 }
@@ -197,6 +202,48 @@ outer:
 	}
 }
 
+// seekData returns the first offset at or after offset that holds data, or -1.
+func (c *Chunk) seekData(offset int64) int64 {
+	next := int64(-1)
+
+	for pos, n := range c.slices {
+		start := c.offset + int64(pos)
+		end := start + int64(n)
+
+		if end <= offset {
+			continue
+		}
+
+		if start = max(start, offset); next < 0 || start < next {
+			next = start
+		}
+	}
+
+	return next
+}
+
+// discard forgets the data in the given range.
+func (c *Chunk) discard(offset, length int64) {
+	for pos, n := range c.slices {
+		start := c.offset + int64(pos)
+		end := start + int64(n)
+
+		if end <= offset || offset+length <= start {
+			continue
+		}
+
+		delete(c.slices, pos)
+
+		if start < offset {
+			c.slices[pos] = int(offset - start)
+		}
+
+		if offset+length < end {
+			c.slices[int(offset+length-c.offset)] = int(end - offset - length)
+		}
+	}
+}
+
 // has returns the relative start offset of a slice that contains the given offset.
 // If the offset is not found, -1 is returned.
 func (c *Chunk) has(relOffset int) int {
@@ -0,0 +1,277 @@
+package buffered
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// ChunkError is the error of writing the chunk at Offset.
+type ChunkError struct {
+	Offset int64
+	Length int
+	Err    error
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("write [%d, %d]: %v", e.Offset, e.Offset+int64(e.Length)-1, e.Err)
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// DefaultStreams is the number of chunks that a ParallelWriter
+// writes concurrently if Streams is not set.
+var DefaultStreams = 4
+
+// ParallelWriter is a BackgroundWriter that writes up to Streams chunks at
+// once. Each chunk is written through its own stream: WriterAt, or one of
+// the streams opened by NewWriterAt. Without NewWriterAt, WriterAt must
+// support concurrent writes.
+//
+// If Ordered is set, chunks are written one at a time through WriterAt, in
+// order of their offsets, for backends that need sequential writes. A chunk
+// is held back until the chunk before it was written, unless Streams chunks
+// are waiting, or on Flush and Close.
+//
+// Errors are reported per chunk as *ChunkError, and returned by all
+// subsequent calls.
+type ParallelWriter struct {
+	WriterAt    io.WriterAt
+	NewWriterAt func() (io.WriterAt, error) // Opens another stream to the same file
+	ChunkSize   int
+	Streams     int
+	Ordered     bool
+	Pool        *Pool // Optional pool for the chunk buffers
+	queued      int   // Chunks accepted, but not written yet
+	idle        []io.WriterAt
+	opened      []io.WriterAt
+	openErr     error
+	pending     []*Chunk // Chunks held back in ordered mode, by offset
+	writing     bool
+	started     bool
+	next        int64 // Offset after the last chunk written in ordered mode
+	errs        []error
+	cond        *sync.Cond
+	wg          sync.WaitGroup
+	sync.Mutex
+}
+
+func (w *ParallelWriter) init() {
+	if w.cond != nil {
+		return
+	}
+
+	if w.Streams < 1 {
+		w.Streams = DefaultStreams
+	}
+
+	w.cond = sync.NewCond(&w.Mutex)
+	w.idle = []io.WriterAt{w.WriterAt}
+}
+
+func (w *ParallelWriter) WriteAt(buf []byte, offset int64) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.init()
+
+	if len(w.errs) > 0 {
+		return 0, MultipleError(w.errs...)
+	}
+
+	for w.queued >= w.Streams {
+		w.cond.Wait()
+	}
+
+	// Reserve the slot before waiting for a buffer
+	w.queued++
+
+	w.Unlock()
+	b := w.Pool.Get(w.ChunkSize)
+	w.Lock()
+
+	chunk := newChunkWithBuffer(offset, b)
+
+	n, err := chunk.WriteAt(buf, offset)
+	if err != nil {
+		w.finish(chunk, nil)
+
+		return n, err
+	}
+
+	if w.Ordered {
+		i := sort.Search(len(w.pending), func(i int) bool { return w.pending[i].Offset() > offset })
+
+		w.pending = append(w.pending[:i], append([]*Chunk{chunk}, w.pending[i:]...)...)
+
+		w.commit(false)
+	} else {
+		w.wg.Add(1)
+
+		go w.write(chunk)
+	}
+
+	if n < len(buf) {
+		return n, io.ErrShortWrite
+	}
+
+	return n, nil
+}
+
+// write writes a chunk through an idle stream.
+func (w *ParallelWriter) write(chunk *Chunk) {
+	defer w.wg.Done()
+
+	stream := w.stream()
+
+	_, err := chunk.WriteTo(stream)
+
+	w.Lock()
+	defer w.Unlock()
+
+	if w.NewWriterAt != nil {
+		w.idle = append(w.idle, stream)
+	}
+
+	w.finish(chunk, err)
+}
+
+// stream returns an idle stream, and opens one if there is none.
+func (w *ParallelWriter) stream() io.WriterAt {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.NewWriterAt == nil {
+		return w.WriterAt
+	}
+
+	for len(w.idle) == 0 {
+		if w.openErr == nil {
+			w.Unlock()
+			stream, err := w.NewWriterAt()
+			w.Lock()
+
+			if err == nil {
+				w.opened = append(w.opened, stream)
+
+				return stream
+			}
+
+			// Continue with the streams that are open
+			w.openErr = err
+		}
+
+		w.cond.Wait()
+	}
+
+	stream := w.idle[len(w.idle)-1]
+	w.idle = w.idle[:len(w.idle)-1]
+
+	return stream
+}
+
+// commit writes the pending chunk with the lowest offset in ordered mode, if
+// it continues the chunks that were written, or if force is set or no more
+// chunks can be queued.
+func (w *ParallelWriter) commit(force bool) {
+	if w.writing || len(w.pending) == 0 {
+		return
+	}
+
+	chunk := w.pending[0]
+
+	if w.started && chunk.Offset() != w.next && !force && w.queued < w.Streams {
+		return
+	}
+
+	w.pending = w.pending[1:]
+	w.writing = true
+	w.started = true
+
+	w.wg.Add(1)
+
+	go func() {
+		defer w.wg.Done()
+
+		_, err := chunk.WriteTo(w.WriterAt)
+
+		w.Lock()
+		defer w.Unlock()
+
+		w.writing = false
+		w.next = chunk.Offset() + int64(chunk.Written())
+
+		w.finish(chunk, err)
+		w.commit(false)
+	}()
+}
+
+func (w *ParallelWriter) finish(chunk *Chunk, err error) {
+	if err != nil {
+		w.errs = append(w.errs, &ChunkError{
+			Offset: chunk.Offset(),
+			Length: chunk.Written(),
+			Err:    err,
+		})
+	}
+
+	w.Pool.release(chunk)
+
+	w.queued--
+
+	w.cond.Broadcast()
+}
+
+// Flush waits until all chunks are written.
+func (w *ParallelWriter) Flush() error {
+	w.Lock()
+	defer w.Unlock()
+
+	w.init()
+
+	for w.queued > 0 {
+		w.commit(true)
+		w.cond.Wait()
+	}
+
+	return MultipleError(w.errs...)
+}
+
+// Errors returns the errors of the chunks that failed.
+func (w *ParallelWriter) Errors() []*ChunkError {
+	w.Lock()
+	defer w.Unlock()
+
+	var errs []*ChunkError
+
+	for _, err := range w.errs {
+		errs = append(errs, err.(*ChunkError)) //nolint:errorlint,forcetypeassert
+	}
+
+	return errs
+}
+
+// Close flushes the chunks, and closes the streams that were opened,
+// before the underlying writer.
+func (w *ParallelWriter) Close() error {
+	errs := []error{
+		w.Flush(),
+	}
+
+	w.wg.Wait()
+
+	for _, stream := range w.opened {
+		if closer, ok := stream.(io.Closer); ok {
+			errs = append(errs, closer.Close())
+		}
+	}
+
+	if closer, ok := w.WriterAt.(io.Closer); ok {
+		errs = append(errs, closer.Close())
+	}
+
+	return MultipleError(errs...)
+}
@@ -0,0 +1,132 @@
+package buffered
+
+import "sync"
+
+// Pool recycles chunk buffers, and limits the bytes in use by all readers and
+// writers that share it to a budget. Buffers that are returned are kept for
+// reuse as long as they fit in the budget. A nil *Pool allocates buffers
+// without limit. A BufferedReaderAt does not wait for the pool, and uses a
+// single buffer outside of the budget if the pool has none.
+type Pool struct {
+	budget    int64
+	used      int64 // Bytes handed out
+	free      [][]byte
+	freeBytes int64
+	cond      *sync.Cond
+	sync.Mutex
+}
+
+// MaxIdleBuffers is the number of returned buffers that a pool
+// without budget keeps for reuse.
+var MaxIdleBuffers = 4
+
+// NewPool returns a pool with the given budget in bytes, or without limit if the budget is 0.
+func NewPool(budget int64) *Pool {
+	p := &Pool{
+		budget: budget,
+	}
+
+	p.cond = sync.NewCond(&p.Mutex)
+
+	return p
+}
+
+// Get returns a buffer of size bytes, and waits until it fits in the budget.
+// A buffer larger than the budget is handed out once no other buffers are in use.
+func (p *Pool) Get(size int) []byte {
+	if p == nil {
+		return make([]byte, size)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	for !p.fits(size) {
+		p.cond.Wait()
+	}
+
+	return p.take(size)
+}
+
+// TryGet returns a buffer of size bytes, or false if it does not fit in the budget.
+func (p *Pool) TryGet(size int) ([]byte, bool) {
+	if p == nil {
+		return make([]byte, size), true
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if !p.fits(size) {
+		return nil, false
+	}
+
+	return p.take(size), true
+}
+
+func (p *Pool) fits(size int) bool {
+	return p.budget == 0 || p.used == 0 || p.used+int64(size) <= p.budget
+}
+
+func (p *Pool) take(size int) []byte {
+	p.used += int64(size)
+
+	for i, buf := range p.free {
+		if len(buf) != size {
+			continue
+		}
+
+		p.free = append(p.free[:i], p.free[i+1:]...)
+		p.freeBytes -= int64(size)
+
+		return buf
+	}
+
+	// Drop idle buffers of other sizes that no longer fit
+	for len(p.free) > 0 && p.budget > 0 && p.used+p.freeBytes > p.budget {
+		p.freeBytes -= int64(len(p.free[0]))
+		p.free = p.free[1:]
+	}
+
+	return make([]byte, size)
+}
+
+// Put returns a buffer that was obtained from Get or TryGet.
+func (p *Pool) Put(buf []byte) {
+	if p == nil || buf == nil {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.used -= int64(len(buf))
+
+	if (p.budget > 0 && p.used+p.freeBytes+int64(len(buf)) <= p.budget) || (p.budget == 0 && len(p.free) < MaxIdleBuffers) {
+		p.free = append(p.free, buf)
+		p.freeBytes += int64(len(buf))
+	}
+
+	p.cond.Broadcast()
+}
+
+// Used returns the number of bytes in use.
+func (p *Pool) Used() int64 {
+	if p == nil {
+		return 0
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	return p.used
+}
+
+// release returns the buffer of a chunk that is no longer used.
+func (p *Pool) release(c *Chunk) {
+	if !c.unpooled {
+		p.Put(c.buf)
+	}
+
+	c.buf = nil
+}
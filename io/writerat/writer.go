@@ -40,7 +40,7 @@ func (r *writerFromWriterAt) Write(buf []byte) (int, error) {
 	defer r.Unlock()
 
 	n, err := r.WriteAt(buf, r.offset)
-	if err == nil || errors.Is(err, io.EOF) {
+	if err == nil || errors.Is(err, io.EOF) || errors.Is(err, io.ErrShortWrite) {
 		r.offset += int64(n)
 	}
 
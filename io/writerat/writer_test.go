@@ -241,6 +241,37 @@ func TestWriter(t *testing.T) { //nolint:gocognit,funlen
 			t.Fatalf("expected offset 0, got %d", writer.Offset())
 		}
 	})
+
+	t.Run("Short write", func(t *testing.T) {
+		writer := Writer(&shortWriterAt{newMockWriterAt(100)}, 0, 0)
+
+		n, err := writer.Write([]byte("Hello"))
+		if !errors.Is(err, io.ErrShortWrite) {
+			t.Fatalf("expected short write error, got %v", err)
+		}
+
+		if writer.Offset() != int64(n) {
+			t.Fatalf("expected offset %d, got %d", n, writer.Offset())
+		}
+	})
+}
+
+// shortWriterAt writes only the first byte of each call
+type shortWriterAt struct {
+	*mockWriterAt
+}
+
+func (s *shortWriterAt) WriteAt(p []byte, off int64) (int, error) {
+	if len(p) < 2 {
+		return s.mockWriterAt.WriteAt(p, off)
+	}
+
+	n, err := s.mockWriterAt.WriteAt(p[:1], off)
+	if err != nil {
+		return n, err
+	}
+
+	return n, io.ErrShortWrite
 }
 
 func TestWriterSeek(t *testing.T) { //nolint:gocognit,funlen
@@ -0,0 +1,269 @@
+package vfs
+
+import (
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+type LockType int
+
+const (
+	LockShared    LockType = iota // Compatible with shared locks of other owners
+	LockExclusive                 // Conflicts with all locks of other owners
+)
+
+// Lock describes a byte-range lock on a file, held by an owner such as a session.
+// A Length of zero extends the lock to the end of the file, including data
+// appended later.
+type Lock struct {
+	Owner  string
+	Type   LockType
+	Offset int64
+	Length int64
+	TTL    time.Duration // Lease duration, zero if the lock does not expire
+}
+
+// End returns the offset after the last locked byte.
+func (l Lock) End() int64 {
+	if l.Length == 0 {
+		return math.MaxInt64
+	}
+
+	return l.Offset + l.Length
+}
+
+// Overlaps returns whether the locks cover a common byte.
+func (l Lock) Overlaps(other Lock) bool {
+	return l.Offset < other.End() && other.Offset < l.End()
+}
+
+// Conflicts returns whether the locks cannot be held at the same time.
+func (l Lock) Conflicts(other Lock) bool {
+	return l.Owner != other.Owner && (l.Type == LockExclusive || other.Type == LockExclusive) && l.Overlaps(other)
+}
+
+// HeldLock is a lock that has been acquired.
+type HeldLock struct {
+	Lock
+	Expires time.Time // Zero if the lock does not expire
+}
+
+func (h HeldLock) Expired(now time.Time) bool {
+	return !h.Expires.IsZero() && !now.Before(h.Expires)
+}
+
+// LockSet is the set of locks held on a single file. Locks of the same
+// owner never overlap: as with fcntl locks, acquiring a lock replaces
+// the locks of the owner in the same range.
+type LockSet []HeldLock
+
+// Expire splits the set in the locks that are still valid, and the expired locks.
+func (s LockSet) Expire(now time.Time) (LockSet, LockSet) {
+	var valid, expired LockSet
+
+	for _, h := range s {
+		if h.Expired(now) {
+			expired = append(expired, h)
+		} else {
+			valid = append(valid, h)
+		}
+	}
+
+	return valid, expired
+}
+
+// Conflict returns a lock of another owner that conflicts with the given lock.
+func (s LockSet) Conflict(lock Lock) (HeldLock, bool) {
+	for _, h := range s {
+		if h.Conflicts(lock) {
+			return h, true
+		}
+	}
+
+	return HeldLock{}, false
+}
+
+// Acquire returns the set with the given lock added, or ErrLocked if it conflicts with a lock of another owner.
+func (s LockSet) Acquire(lock Lock, now time.Time) (LockSet, error) {
+	if _, ok := s.Conflict(lock); ok {
+		return s, ErrLocked
+	}
+
+	h := HeldLock{Lock: lock}
+
+	if lock.TTL > 0 {
+		h.Expires = now.Add(lock.TTL)
+	}
+
+	return append(s.Release(lock), h), nil
+}
+
+// Release returns the set without the locks of the owner of the given
+// lock in its range. Locks that partially overlap the range are shrunk.
+func (s LockSet) Release(lock Lock) LockSet {
+	var result LockSet
+
+	for _, h := range s {
+		if h.Owner != lock.Owner || !h.Overlaps(lock) {
+			result = append(result, h)
+
+			continue
+		}
+
+		if h.Offset < lock.Offset {
+			before := h
+			before.Length = lock.Offset - h.Offset
+
+			result = append(result, before)
+		}
+
+		if lock.End() < h.End() {
+			after := h
+			after.Offset = lock.End()
+
+			if h.Length > 0 {
+				after.Length = h.End() - lock.End()
+			}
+
+			result = append(result, after)
+		}
+	}
+
+	return result
+}
+
+// Owned returns whether the set contains locks of the given owner.
+func (s LockSet) Owned(owner string) bool {
+	return slices.ContainsFunc(s, func(h HeldLock) bool {
+		return h.Owner == owner
+	})
+}
+
+// LockManager keeps byte-range locks in memory, for file systems that have
+// no locking of their own. Locks are only enforced between users of the
+// same manager, and expired leases are released automatically.
+type LockManager struct {
+	OnExpire func(path string, lock HeldLock) // Called for each expired lock, with the manager locked
+	files    map[string]LockSet
+	timer    *time.Timer
+	now      func() time.Time
+	sync.Mutex
+}
+
+func NewLockManager() *LockManager {
+	return &LockManager{
+		files: map[string]LockSet{},
+		now:   time.Now,
+	}
+}
+
+// expire releases all expired locks, and schedules the next expiry.
+func (m *LockManager) expire() {
+	now := m.now()
+
+	var next time.Time
+
+	for path, set := range m.files {
+		valid, expired := set.Expire(now)
+
+		for _, h := range expired {
+			if m.OnExpire != nil {
+				m.OnExpire(path, h)
+			}
+		}
+
+		if len(valid) == 0 {
+			delete(m.files, path)
+		} else {
+			m.files[path] = valid
+		}
+
+		for _, h := range valid {
+			if !h.Expires.IsZero() && (next.IsZero() || h.Expires.Before(next)) {
+				next = h.Expires
+			}
+		}
+	}
+
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+
+	if !next.IsZero() {
+		m.timer = time.AfterFunc(next.Sub(now), func() {
+			m.Lock()
+			defer m.Unlock()
+
+			m.expire()
+		})
+	}
+}
+
+func (m *LockManager) AcquireLock(path string, lock Lock) error {
+	m.Lock()
+	defer m.Unlock()
+
+	path = Clean(path)
+
+	set, err := m.files[path].Acquire(lock, m.now())
+	if err != nil {
+		return err
+	}
+
+	m.files[path] = set
+
+	m.expire()
+
+	return nil
+}
+
+func (m *LockManager) ReleaseLock(path string, lock Lock) error {
+	m.Lock()
+	defer m.Unlock()
+
+	path = Clean(path)
+
+	m.files[path] = m.files[path].Release(lock)
+
+	m.expire()
+
+	return nil
+}
+
+func (m *LockManager) TestLock(path string, lock Lock) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.expire()
+
+	if _, ok := m.files[Clean(path)].Conflict(lock); ok {
+		return ErrLocked
+	}
+
+	return nil
+}
+
+// Locks returns the locks held on the given path.
+func (m *LockManager) Locks(path string) LockSet {
+	m.Lock()
+	defer m.Unlock()
+
+	m.expire()
+
+	return slices.Clone(m.files[Clean(path)])
+}
+
+// ReleaseOwner releases all locks of the given owner, e.g. when a session ends.
+func (m *LockManager) ReleaseOwner(owner string) {
+	m.Lock()
+	defer m.Unlock()
+
+	for path, set := range m.files {
+		m.files[path] = set.Release(Lock{Owner: owner})
+	}
+
+	m.expire()
+}
@@ -0,0 +1,101 @@
+package vfs
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLockSet(t *testing.T) {
+	now := time.Now()
+
+	var (
+		set LockSet
+		err error
+	)
+
+	set, err = set.Acquire(Lock{Owner: "a", Type: LockShared, Offset: 0, Length: 100}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = set.Acquire(Lock{Owner: "b", Type: LockShared, Offset: 50, Length: 100}, now); err != nil {
+		t.Fatalf("shared locks should not conflict: %v", err)
+	}
+
+	if _, err = set.Acquire(Lock{Owner: "b", Type: LockExclusive, Offset: 50, Length: 10}, now); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	if _, err = set.Acquire(Lock{Owner: "b", Type: LockExclusive, Offset: 100}, now); err != nil {
+		t.Fatalf("adjacent ranges should not conflict: %v", err)
+	}
+
+	// Upgrading a lock of the same owner replaces the overlapping part
+	set, err = set.Acquire(Lock{Owner: "a", Type: LockExclusive, Offset: 40, Length: 20}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(set) != 3 {
+		t.Fatalf("expected the shared lock to be split, got %v", set)
+	}
+
+	if _, ok := set.Conflict(Lock{Owner: "b", Type: LockShared, Offset: 45, Length: 1}); !ok {
+		t.Fatal("expected the exclusive range to conflict")
+	}
+
+	if _, ok := set.Conflict(Lock{Owner: "b", Type: LockShared, Offset: 70, Length: 1}); ok {
+		t.Fatal("expected the shared range not to conflict")
+	}
+
+	set = set.Release(Lock{Owner: "a", Offset: 0, Length: 0})
+
+	if set.Owned("a") {
+		t.Fatalf("expected all locks to be released, got %v", set)
+	}
+}
+
+func TestLockManagerExpiry(t *testing.T) {
+	m := NewLockManager()
+
+	now := time.Now()
+
+	m.now = func() time.Time {
+		return now
+	}
+
+	var expired []HeldLock
+
+	m.OnExpire = func(path string, h HeldLock) {
+		expired = append(expired, h)
+	}
+
+	if err := m.AcquireLock("/file", Lock{Owner: "a", Type: LockExclusive, TTL: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.TestLock("/file", Lock{Owner: "b", Type: LockShared}); !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+
+	if err := m.TestLock("/file", Lock{Owner: "b", Type: LockShared}); err != nil {
+		t.Fatalf("expected the lease to be expired, got %v", err)
+	}
+
+	if len(expired) != 1 || expired[0].Owner != "a" {
+		t.Fatalf("expected one expired lock, got %v", expired)
+	}
+
+	if err := m.AcquireLock("/file", Lock{Owner: "b", Type: LockShared}); err != nil {
+		t.Fatal(err)
+	}
+
+	m.ReleaseOwner("b")
+
+	if locks := m.Locks("/file"); len(locks) != 0 {
+		t.Fatalf("expected no locks, got %v", locks)
+	}
+}
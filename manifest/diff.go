@@ -0,0 +1,93 @@
+package manifest
+
+import (
+	"bytes"
+	"maps"
+)
+
+type ChangeType int
+
+const (
+	Added    ChangeType = iota + 1
+	Removed             // The path no longer exists
+	Modified            // The contents or the type changed
+	Metadata            // Only the mode, modification time or extended attributes changed
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Modified:
+		return "modified"
+	case Metadata:
+		return "metadata"
+	default:
+		return "unknown"
+	}
+}
+
+// Change describes the difference of a path between two manifests.
+type Change struct {
+	Type ChangeType
+	Path string
+	Old  *Entry // Nil if the path was added
+	New  *Entry // Nil if the path was removed
+}
+
+// Diff returns the changes that turn manifest a into manifest b, sorted by path.
+// File contents are compared by checksum if both manifests use the same
+// algorithm, and by size and modification time otherwise. The modification
+// times of directories are ignored, as they change with their children.
+func Diff(a, b *Manifest) []Change {
+	var (
+		changes  []Change
+		i, j     int
+		checksum = a.Algorithm != 0 && a.Algorithm == b.Algorithm
+	)
+
+	for i < len(a.Entries) || j < len(b.Entries) {
+		switch {
+		case j == len(b.Entries) || i < len(a.Entries) && a.Entries[i].Path < b.Entries[j].Path:
+			changes = append(changes, Change{Type: Removed, Path: a.Entries[i].Path, Old: &a.Entries[i]})
+			i++
+		case i == len(a.Entries) || b.Entries[j].Path < a.Entries[i].Path:
+			changes = append(changes, Change{Type: Added, Path: b.Entries[j].Path, New: &b.Entries[j]})
+			j++
+		default:
+			if t := compare(&a.Entries[i], &b.Entries[j], checksum); t != 0 {
+				changes = append(changes, Change{Type: t, Path: a.Entries[i].Path, Old: &a.Entries[i], New: &b.Entries[j]})
+			}
+
+			i++
+			j++
+		}
+	}
+
+	return changes
+}
+
+// compare returns the type of change between two entries for the same path, or zero.
+func compare(old, cur *Entry, checksum bool) ChangeType {
+	if old.Mode.Type() != cur.Mode.Type() || old.Size != cur.Size || old.Target != cur.Target {
+		return Modified
+	}
+
+	isFile := old.Mode.IsRegular()
+
+	switch {
+	case !isFile:
+	case checksum && !bytes.Equal(old.Checksum, cur.Checksum):
+		return Modified
+	case !checksum && !old.ModTime.Equal(cur.ModTime):
+		return Modified
+	}
+
+	if old.Mode != cur.Mode || isFile && !old.ModTime.Equal(cur.ModTime) || !maps.EqualFunc(old.Xattrs, cur.Xattrs, bytes.Equal) {
+		return Metadata
+	}
+
+	return 0
+}
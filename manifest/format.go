@@ -0,0 +1,291 @@
+package manifest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/kuleuven/vfs"
+)
+
+// ErrInvalid is returned when reading a manifest that cannot be decoded.
+var ErrInvalid = errors.New("invalid manifest")
+
+// The JSON lines format starts with a header line, followed by a line per entry.
+type header struct {
+	Version   int       `json:"version"`
+	Root      string    `json:"root"`
+	Algorithm string    `json:"algorithm,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+// The binary format starts with binaryMagic, followed by the header fields,
+// and each entry preceded by a non-zero byte. A zero byte ends the manifest,
+// so that truncated manifests are detected.
+var binaryMagic = []byte("VFSMAN\x00\x01")
+
+// WriteJSON writes the manifest in the JSON lines format.
+func (m *Manifest) WriteJSON(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+
+	h := header{
+		Version: 1,
+		Root:    m.Root,
+		Created: m.Created,
+	}
+
+	if m.Algorithm != 0 {
+		h.Algorithm = m.Algorithm.String()
+	}
+
+	if err := enc.Encode(h); err != nil {
+		return err
+	}
+
+	for i := range m.Entries {
+		if err := enc.Encode(&m.Entries[i]); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
+
+// WriteBinary writes the manifest in the compact binary format.
+func (m *Manifest) WriteBinary(w io.Writer) error {
+	e := encoder{Writer: bufio.NewWriter(w)}
+
+	e.Write(binaryMagic)
+	e.uvarint(uint64(m.Algorithm))
+	e.varint(m.Created.UnixNano())
+	e.string(m.Root)
+
+	for _, entry := range m.Entries {
+		e.WriteByte(1)
+		e.string(entry.Path)
+		e.uvarint(uint64(entry.Mode))
+		e.varint(entry.Size)
+		e.varint(entry.ModTime.UnixNano())
+		e.string(string(entry.Checksum))
+		e.string(entry.Target)
+		e.uvarint(uint64(len(entry.Xattrs)))
+
+		names := make([]string, 0, len(entry.Xattrs))
+
+		for name := range entry.Xattrs {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+
+		for _, name := range names {
+			e.string(name)
+			e.string(string(entry.Xattrs[name]))
+		}
+	}
+
+	e.WriteByte(0)
+
+	return e.Flush()
+}
+
+// Read reads a manifest in either format.
+func Read(r io.Reader) (*Manifest, error) {
+	br := bufio.NewReader(r)
+
+	magic, err := br.Peek(len(binaryMagic))
+	if err == nil && bytes.Equal(magic, binaryMagic) {
+		return readBinary(br)
+	}
+
+	return readJSON(br)
+}
+
+func readJSON(r io.Reader) (*Manifest, error) {
+	dec := json.NewDecoder(r)
+
+	var h header
+
+	if err := dec.Decode(&h); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalid, err)
+	}
+
+	if h.Version != 1 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalid, h.Version)
+	}
+
+	algorithm, err := parseAlgorithm(h.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{
+		Root:      h.Root,
+		Algorithm: algorithm,
+		Created:   h.Created,
+	}
+
+	for {
+		var entry Entry
+
+		err := dec.Decode(&entry)
+		if errors.Is(err, io.EOF) {
+			return m, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalid, err)
+		}
+
+		m.Entries = append(m.Entries, entry)
+	}
+}
+
+func parseAlgorithm(name string) (crypto.Hash, error) {
+	if name == "" {
+		return 0, nil
+	}
+
+	for h := crypto.MD4; h <= crypto.BLAKE2b_512; h++ {
+		if h.String() == name {
+			return h, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: unknown algorithm %s", ErrInvalid, name)
+}
+
+func readBinary(r *bufio.Reader) (*Manifest, error) {
+	d := decoder{Reader: r}
+
+	d.Discard(len(binaryMagic)) //nolint:errcheck
+
+	m := &Manifest{
+		Algorithm: crypto.Hash(d.uvarint()), //nolint:gosec
+		Created:   time.Unix(0, d.varint()),
+		Root:      d.string(),
+	}
+
+	for d.err == nil {
+		marker, err := d.ReadByte()
+		if err != nil {
+			d.err = err
+
+			break
+		}
+
+		if marker == 0 {
+			return m, nil
+		}
+
+		entry := Entry{
+			Path:     d.string(),
+			Mode:     os.FileMode(d.uvarint()), //nolint:gosec
+			Size:     d.varint(),
+			ModTime:  time.Unix(0, d.varint()),
+			Checksum: Checksum(d.string()),
+			Target:   d.string(),
+		}
+
+		if len(entry.Checksum) == 0 {
+			entry.Checksum = nil
+		}
+
+		if n := d.uvarint(); n > 0 {
+			entry.Xattrs = vfs.Attributes{}
+
+			for range n {
+				if d.err != nil {
+					break
+				}
+
+				name := d.string()
+				entry.Xattrs[name] = []byte(d.string())
+			}
+		}
+
+		m.Entries = append(m.Entries, entry)
+	}
+
+	if errors.Is(d.err, io.EOF) {
+		d.err = io.ErrUnexpectedEOF
+	}
+
+	return nil, fmt.Errorf("%w: %w", ErrInvalid, d.err)
+}
+
+type encoder struct {
+	*bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (e *encoder) uvarint(v uint64) {
+	e.Write(binary.AppendUvarint(e.buf[:0], v))
+}
+
+func (e *encoder) varint(v int64) {
+	e.Write(binary.AppendVarint(e.buf[:0], v))
+}
+
+func (e *encoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.WriteString(s)
+}
+
+// decoder reads values until the first error, which is kept in err.
+type decoder struct {
+	*bufio.Reader
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, err := binary.ReadUvarint(d.Reader)
+	d.err = err
+
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+
+	v, err := binary.ReadVarint(d.Reader)
+	d.err = err
+
+	return v
+}
+
+// maxString limits the allocation for a string of a corrupt manifest.
+const maxString = 1 << 20
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+
+	if d.err != nil {
+		return ""
+	}
+
+	if n > maxString {
+		d.err = fmt.Errorf("string of %d bytes", n)
+
+		return ""
+	}
+
+	buf := make([]byte, n)
+
+	_, d.err = io.ReadFull(d.Reader, buf)
+
+	return string(buf)
+}
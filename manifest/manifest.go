@@ -0,0 +1,329 @@
+// Package manifest captures the state of a directory tree, to compare it
+// later with another capture or to verify it against the file system.
+package manifest
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"errors"
+	"maps"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kuleuven/vfs"
+	"go.uber.org/multierr"
+)
+
+// Manifest describes a directory tree at a point in time.
+type Manifest struct {
+	Root      string      // Path of the tree in the file system
+	Algorithm crypto.Hash // Algorithm of the checksums, zero if no checksums were computed
+	Created   time.Time
+	Entries   []Entry // Sorted by path
+}
+
+// Entry describes a file, directory or symlink of the tree.
+type Entry struct {
+	Path     string         `json:"path"` // Relative to the root, starting with a slash
+	Size     int64          `json:"size"` // Zero for directories
+	ModTime  time.Time      `json:"mtime"`
+	Mode     os.FileMode    `json:"mode"`
+	Checksum Checksum       `json:"checksum,omitempty"` // Only for regular files
+	Target   string         `json:"target,omitempty"`   // Only for symlinks
+	Xattrs   vfs.Attributes `json:"xattrs,omitempty"`
+}
+
+// Checksum is a checksum that is encoded as a hex string.
+type Checksum []byte
+
+func (c Checksum) String() string {
+	return hex.EncodeToString(c)
+}
+
+func (c Checksum) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *Checksum) UnmarshalText(text []byte) error {
+	b, err := hex.DecodeString(string(text))
+	if err != nil {
+		return err
+	}
+
+	*c = b
+
+	return nil
+}
+
+// Lookup returns the entry for the given path.
+func (m *Manifest) Lookup(path string) (Entry, bool) {
+	i := sort.Search(len(m.Entries), func(i int) bool {
+		return m.Entries[i].Path >= path
+	})
+
+	if i < len(m.Entries) && m.Entries[i].Path == path {
+		return m.Entries[i], true
+	}
+
+	return Entry{}, false
+}
+
+// DefaultWorkers is the default number of checksums that are computed in parallel.
+var DefaultWorkers = 8
+
+type Option func(*options)
+
+type options struct {
+	algorithm crypto.Hash
+	xattrs    bool
+	workers   int
+}
+
+// WithAlgorithm sets the checksum algorithm. Defaults to SHA-256.
+// If zero, no checksums are computed.
+func WithAlgorithm(algorithm crypto.Hash) Option {
+	return func(o *options) {
+		o.algorithm = algorithm
+	}
+}
+
+// WithXattrs sets whether extended attributes are captured. Defaults to true.
+func WithXattrs(xattrs bool) Option {
+	return func(o *options) {
+		o.xattrs = xattrs
+	}
+}
+
+// WithWorkers sets the number of checksums that are computed in parallel.
+func WithWorkers(workers int) Option {
+	return func(o *options) {
+		o.workers = workers
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		algorithm: crypto.SHA256,
+		xattrs:    true,
+		workers:   DefaultWorkers,
+	}
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.workers < 1 {
+		o.workers = 1
+	}
+
+	return o
+}
+
+// Snapshot captures the tree at the given root. The root itself is not
+// included in the manifest. Checksums are computed in parallel, by the
+// file system if it implements vfs.ChecksumFS.
+func Snapshot(fs vfs.FS, root string, opts ...Option) (*Manifest, error) {
+	o := newOptions(opts)
+
+	m := &Manifest{
+		Root:      vfs.Clean(root),
+		Algorithm: o.algorithm,
+		Created:   time.Now(),
+	}
+
+	err := vfs.Walk(fs, m.Root, func(path string, info vfs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == m.Root {
+			return nil
+		}
+
+		entry := Entry{
+			Path:    relPath(m.Root, path),
+			ModTime: info.ModTime(),
+			Mode:    info.Mode(),
+		}
+
+		if info.Mode().IsRegular() {
+			entry.Size = info.Size()
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if symlinkFS, ok := fs.(vfs.SymlinkFS); ok {
+				if entry.Target, err = symlinkFS.Readlink(path); err != nil {
+					return err
+				}
+			}
+		}
+
+		if o.xattrs {
+			attrs, err := info.Extended()
+			if err != nil {
+				return err
+			}
+
+			if len(attrs) > 0 {
+				entry.Xattrs = maps.Clone(attrs)
+			}
+		}
+
+		m.Entries = append(m.Entries, entry)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(m.Entries, func(i, j int) bool {
+		return m.Entries[i].Path < m.Entries[j].Path
+	})
+
+	if o.algorithm == 0 {
+		return m, nil
+	}
+
+	err = parallel(o.workers, len(m.Entries), func(i int) error {
+		entry := &m.Entries[i]
+
+		if !entry.Mode.IsRegular() {
+			return nil
+		}
+
+		checksum, err := computeChecksum(fs, absPath(m.Root, entry.Path), o.algorithm)
+		if err != nil {
+			return err
+		}
+
+		entry.Checksum = checksum
+
+		return nil
+	})
+
+	return m, err
+}
+
+// Verify checks the regular files of the manifest against the file system,
+// by comparing their size and by recomputing their checksums in parallel.
+// It returns the files that are removed or modified. Files that were added
+// to the tree are not reported, use Diff with a new snapshot for that.
+func Verify(fs vfs.FS, m *Manifest, opts ...Option) ([]Change, error) {
+	o := newOptions(opts)
+
+	var (
+		changes []Change
+		mu      sync.Mutex
+	)
+
+	report := func(change Change) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		changes = append(changes, change)
+	}
+
+	err := parallel(o.workers, len(m.Entries), func(i int) error {
+		entry := m.Entries[i]
+
+		if !entry.Mode.IsRegular() {
+			return nil
+		}
+
+		path := absPath(m.Root, entry.Path)
+
+		fi, err := fs.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			report(Change{Type: Removed, Path: entry.Path, Old: &entry})
+
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		current := Entry{
+			Path:    entry.Path,
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+			Mode:    fi.Mode(),
+		}
+
+		if current.Size == entry.Size && entry.Checksum != nil {
+			if current.Checksum, err = computeChecksum(fs, path, m.Algorithm); err != nil {
+				return err
+			}
+		}
+
+		if !fi.Mode().IsRegular() || current.Size != entry.Size || !bytes.Equal(current.Checksum, entry.Checksum) {
+			report(Change{Type: Modified, Path: entry.Path, Old: &entry, New: &current})
+		}
+
+		return nil
+	})
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+
+	return changes, err
+}
+
+func computeChecksum(fs vfs.FS, path string, algorithm crypto.Hash) ([]byte, error) {
+	if checksumFS, ok := fs.(vfs.ChecksumFS); ok {
+		checksum, err := checksumFS.Checksum(path, algorithm)
+		if !errors.Is(err, vfs.ErrNotSupported) {
+			return checksum, err
+		}
+	}
+
+	return vfs.Checksum(fs, path, algorithm)
+}
+
+// parallel calls fn for the numbers 0 to n-1 using the given number of workers.
+func parallel(workers, n int, fn func(int) error) error {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		result error
+		queue  = make(chan int)
+	)
+
+	for range workers {
+		wg.Go(func() {
+			for i := range queue {
+				if err := fn(i); err != nil {
+					mu.Lock()
+					result = multierr.Append(result, err)
+					mu.Unlock()
+				}
+			}
+		})
+	}
+
+	for i := range n {
+		queue <- i
+	}
+
+	close(queue)
+
+	wg.Wait()
+
+	return result
+}
+
+func relPath(root, path string) string {
+	if root == "/" {
+		return path
+	}
+
+	return strings.TrimPrefix(path, root)
+}
+
+func absPath(root, path string) string {
+	return vfs.Join(root, path[1:])
+}
@@ -0,0 +1,189 @@
+package manifest
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/kuleuven/vfs"
+	"github.com/kuleuven/vfs/fs/nativefs"
+)
+
+func setupTree(t *testing.T) vfs.FS {
+	t.Helper()
+
+	fs := nativefs.New(t.Context(), t.TempDir())
+
+	t.Cleanup(func() {
+		fs.Close()
+	})
+
+	if err := vfs.MkdirAll(fs, "/ingest/sub", 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, data := range map[string]string{
+		"/ingest/a.txt":     "first",
+		"/ingest/b.txt":     "second",
+		"/ingest/sub/c.txt": "third",
+		"/outside.txt":      "ignored",
+	} {
+		if err := vfs.WriteFile(fs, path, []byte(data), os.O_CREATE|os.O_WRONLY); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := fs.SetExtendedAttr("/ingest/a.txt", "user.project", []byte("genome")); err != nil {
+		t.Fatal(err)
+	}
+
+	return fs
+}
+
+func changeTypes(changes []Change) map[string]ChangeType {
+	result := map[string]ChangeType{}
+
+	for _, change := range changes {
+		result[change.Path] = change.Type
+	}
+
+	return result
+}
+
+func TestSnapshotAndDiff(t *testing.T) {
+	fs := setupTree(t)
+
+	before, err := Snapshot(fs, "/ingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paths := []string{}
+
+	for _, entry := range before.Entries {
+		paths = append(paths, entry.Path)
+	}
+
+	if expected := []string{"/a.txt", "/b.txt", "/sub", "/sub/c.txt"}; !reflect.DeepEqual(paths, expected) {
+		t.Fatalf("expected %v, got %v", expected, paths)
+	}
+
+	entry, ok := before.Lookup("/a.txt")
+	if !ok || entry.Size != 5 || len(entry.Checksum) != crypto.SHA256.Size() || string(entry.Xattrs["user.project"]) != "genome" {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	if changes := Diff(before, before); len(changes) != 0 {
+		t.Fatalf("expected no changes, got %v", changes)
+	}
+
+	if err := vfs.WriteFile(fs, "/ingest/a.txt", []byte("FIRST"), os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Chmod("/ingest/b.txt", 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Remove("/ingest/sub/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := vfs.WriteFile(fs, "/ingest/d.txt", []byte("fourth"), os.O_CREATE|os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := Snapshot(fs, "/ingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]ChangeType{
+		"/a.txt":     Modified,
+		"/b.txt":     Metadata,
+		"/sub/c.txt": Removed,
+		"/d.txt":     Added,
+	}
+
+	if changes := changeTypes(Diff(before, after)); !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("expected %v, got %v", expected, changes)
+	}
+}
+
+func TestFormats(t *testing.T) {
+	fs := setupTree(t)
+
+	m, err := Snapshot(fs, "/ingest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, write := range map[string]func(*bytes.Buffer) error{
+		"json":   func(buf *bytes.Buffer) error { return m.WriteJSON(buf) },
+		"binary": func(buf *bytes.Buffer) error { return m.WriteBinary(buf) },
+	} {
+		var buf bytes.Buffer
+
+		if err := write(&buf); err != nil {
+			t.Fatal(err)
+		}
+
+		encoded := buf.Bytes()
+
+		read, err := Read(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if read.Root != m.Root || read.Algorithm != m.Algorithm || !read.Created.Equal(m.Created) {
+			t.Fatalf("%s: unexpected header %+v", name, read)
+		}
+
+		if changes := Diff(m, read); len(changes) != 0 {
+			t.Fatalf("%s: expected no changes, got %v", name, changes)
+		}
+
+		if _, err := Read(bytes.NewReader(encoded[:len(encoded)-3])); !errors.Is(err, ErrInvalid) {
+			t.Fatalf("%s: expected ErrInvalid for a truncated manifest, got %v", name, err)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	fs := setupTree(t)
+
+	m, err := Snapshot(fs, "/ingest", WithWorkers(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if changes, err := Verify(fs, m); err != nil || len(changes) != 0 {
+		t.Fatalf("expected no changes, got %v (%v)", changes, err)
+	}
+
+	// Same size, different contents
+	if err := vfs.WriteFile(fs, "/ingest/b.txt", []byte("SECOND"), os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := fs.Remove("/ingest/sub/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := Verify(fs, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]ChangeType{
+		"/b.txt":     Modified,
+		"/sub/c.txt": Removed,
+	}
+
+	if types := changeTypes(changes); !reflect.DeepEqual(types, expected) {
+		t.Fatalf("expected %v, got %v", expected, types)
+	}
+}
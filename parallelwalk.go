@@ -0,0 +1,374 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+)
+
+// DefaultWalkWorkers is the number of directories that ParallelWalk
+// lists concurrently if WalkOptions.Workers is not set.
+var DefaultWalkWorkers = 8
+
+// WalkOptions configures ParallelWalk.
+type WalkOptions struct {
+	// Context cancels the walk, in which case ParallelWalk returns its error.
+	Context context.Context //nolint:containedctx
+	// Workers is the number of directories that are listed concurrently.
+	Workers int
+	// Sort sorts the entries of each directory by name. A directory is
+	// then listed completely before its entries are passed to walkFn.
+	Sort bool
+	// Ordered passes the entries to walkFn in the same order as Walk,
+	// while subdirectories are listed ahead. Implies Sort.
+	Ordered bool
+}
+
+func (o WalkOptions) withDefaults() WalkOptions {
+	if o.Context == nil {
+		o.Context = context.Background()
+	}
+
+	if o.Workers < 1 {
+		o.Workers = DefaultWalkWorkers
+	}
+
+	if o.Ordered {
+		o.Sort = true
+	}
+
+	return o
+}
+
+// ParallelWalk walks the file tree rooted at root like Walk, but lists
+// directories concurrently. Entries are streamed to walkFn, which is always
+// called from the calling goroutine, so it needs not be safe for concurrent use.
+// SkipDir, SkipSubDirs and SkipAll have the same meaning as for Walk.
+//
+// Unless opts.Ordered is set, entries are passed in no particular order, and
+// a directory is passed to walkFn before it is listed, so that returning SkipDir
+// avoids listing it. If listing fails, walkFn is called a second time for the
+// directory with the error.
+//
+// If the file system implements ParallelWalkFS, its ParallelWalk method is used.
+func ParallelWalk(fs WalkableFS, root string, opts WalkOptions, walkFn WalkFunc) error {
+	if walkFS, ok := fs.(ParallelWalkFS); ok {
+		return walkFS.ParallelWalk(root, opts, walkFn)
+	}
+
+	return ParallelWalkList(fs, root, opts, walkFn)
+}
+
+// ParallelWalkList implements ParallelWalk by listing each directory.
+func ParallelWalkList(fs WalkableFS, root string, opts WalkOptions, walkFn WalkFunc) error {
+	info, err := lstat(fs, root)
+	if err != nil {
+		err = walkFn(root, nil, err)
+	} else {
+		err = newWalker(fs, opts, walkFn).run(root, info)
+	}
+
+	if err == SkipAll || err == SkipDir || err == SkipSubDirs {
+		return nil
+	}
+
+	return err
+}
+
+func lstat(fs WalkableFS, path string) (FileInfo, error) {
+	if symlinkFS, ok := fs.(SymlinkFS); ok {
+		return symlinkFS.Lstat(path)
+	}
+
+	return fs.Stat(path)
+}
+
+type walker struct {
+	fs     WalkableFS
+	opts   WalkOptions
+	walkFn WalkFunc
+	ctx    context.Context //nolint:containedctx
+	cancel context.CancelFunc
+	sem    chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newWalker(fs WalkableFS, opts WalkOptions, walkFn WalkFunc) *walker {
+	opts = opts.withDefaults()
+
+	ctx, cancel := context.WithCancel(opts.Context)
+
+	return &walker{
+		fs:     fs,
+		opts:   opts,
+		walkFn: walkFn,
+		ctx:    ctx,
+		cancel: cancel,
+		sem:    make(chan struct{}, opts.Workers),
+	}
+}
+
+func (w *walker) run(root string, info FileInfo) error {
+	// Stop and wait for the listings that are still running
+	defer w.wg.Wait()
+	defer w.cancel()
+
+	switch {
+	case !info.IsDir():
+		return w.walkFn(root, info, nil)
+	case w.opts.Ordered:
+		return w.ordered(root, info, w.prefetch(root), false)
+	default:
+		return w.unordered(root, info)
+	}
+}
+
+// readDir lists the directory in chunks, or in a single sorted chunk,
+// until emit returns false.
+func (w *walker) readDir(path string, emit func([]FileInfo) bool) error {
+	lister, err := w.fs.List(path)
+	if err != nil {
+		return err
+	}
+
+	defer lister.Close()
+
+	var (
+		sorted []FileInfo
+		offset int64
+	)
+
+	for {
+		if err := w.ctx.Err(); err != nil {
+			return err
+		}
+
+		buf := make([]FileInfo, ReadDirBufSize)
+
+		n, err := lister.ListAt(buf, offset)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+
+		offset += int64(n)
+
+		if w.opts.Sort {
+			sorted = append(sorted, buf[:n]...)
+		} else if n > 0 && !emit(buf[:n]) {
+			return nil
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	if w.opts.Sort {
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name() < sorted[j].Name() })
+
+		emit(sorted)
+	}
+
+	return nil
+}
+
+type walkDir struct {
+	path     string
+	info     FileInfo
+	skipDirs bool
+}
+
+type walkBatch struct {
+	dir     *walkDir
+	entries []FileInfo
+	err     error
+	done    bool
+}
+
+// unordered lists the pending directories in a pool of workers, and passes
+// the listed entries to walkFn as soon as they arrive.
+func (w *walker) unordered(root string, info FileInfo) error {
+	err := w.walkFn(root, info, nil)
+	if err != nil && err != SkipSubDirs {
+		return err
+	}
+
+	jobs := make(chan *walkDir)
+	results := make(chan walkBatch, w.opts.Workers)
+
+	defer close(jobs)
+
+	for range w.opts.Workers {
+		w.wg.Go(func() {
+			for dir := range jobs {
+				w.list(dir, results)
+			}
+		})
+	}
+
+	// The pending directories are handled depth first, to limit their number
+	pending := []*walkDir{{path: root, info: info, skipDirs: err == SkipSubDirs}}
+	active := 0
+
+	for len(pending) > 0 || active > 0 {
+		var (
+			next chan<- *walkDir
+			dir  *walkDir
+		)
+
+		if len(pending) > 0 {
+			next = jobs
+			dir = pending[len(pending)-1]
+		}
+
+		select {
+		case next <- dir:
+			pending = pending[:len(pending)-1]
+			active++
+		case batch := <-results:
+			if batch.done {
+				active--
+			}
+
+			if err := w.deliver(batch, &pending); err != nil {
+				return err
+			}
+		case <-w.ctx.Done():
+			return w.ctx.Err()
+		}
+	}
+
+	return nil
+}
+
+func (w *walker) list(dir *walkDir, results chan<- walkBatch) {
+	send := func(batch walkBatch) bool {
+		select {
+		case results <- batch:
+			return true
+		case <-w.ctx.Done():
+			return false
+		}
+	}
+
+	err := w.readDir(dir.path, func(entries []FileInfo) bool {
+		return send(walkBatch{dir: dir, entries: entries})
+	})
+
+	send(walkBatch{dir: dir, err: err, done: true})
+}
+
+func (w *walker) deliver(batch walkBatch, pending *[]*walkDir) error {
+	for _, entry := range batch.entries {
+		path := Join(batch.dir.path, entry.Name())
+
+		err := w.walkFn(path, entry, nil)
+
+		if entry.IsDir() && !batch.dir.skipDirs && (err == nil || err == SkipSubDirs) {
+			*pending = append(*pending, &walkDir{path: path, info: entry, skipDirs: err == SkipSubDirs})
+
+			continue
+		}
+
+		if err != nil && err != SkipDir && err != SkipSubDirs {
+			return err
+		}
+	}
+
+	if batch.err == nil {
+		return nil
+	}
+
+	if err := w.walkFn(batch.dir.path, batch.dir.info, batch.err); err != nil && err != SkipDir && err != SkipSubDirs {
+		return err
+	}
+
+	return nil
+}
+
+type walkListing struct {
+	done    chan struct{}
+	entries []FileInfo
+	err     error
+}
+
+// prefetch starts listing a directory in the background.
+func (w *walker) prefetch(path string) *walkListing {
+	listing := &walkListing{
+		done: make(chan struct{}),
+	}
+
+	w.wg.Go(func() {
+		defer close(listing.done)
+
+		select {
+		case w.sem <- struct{}{}:
+		case <-w.ctx.Done():
+			listing.err = w.ctx.Err()
+
+			return
+		}
+
+		defer func() { <-w.sem }()
+
+		listing.err = w.readDir(path, func(entries []FileInfo) bool {
+			listing.entries = entries
+
+			return true
+		})
+	})
+
+	return listing
+}
+
+// ordered mirrors walk, but lists up to Workers subdirectories ahead.
+func (w *walker) ordered(path string, info FileInfo, listing *walkListing, mustSkipDirs bool) error {
+	if !info.IsDir() || mustSkipDirs {
+		return w.walkFn(path, info, nil)
+	}
+
+	select {
+	case <-listing.done:
+	case <-w.ctx.Done():
+		return w.ctx.Err()
+	}
+
+	err1 := w.walkFn(path, info, listing.err)
+	if listing.err != nil || (err1 != nil && err1 != SkipSubDirs) {
+		return err1
+	}
+
+	entries := listing.entries
+	skipDirs := err1 == SkipSubDirs
+
+	// queue holds the listings of the subdirectories in entries[i:next]
+	var (
+		queue []*walkListing
+		next  int
+	)
+
+	for _, entry := range entries {
+		for next < len(entries) && len(queue) < w.opts.Workers {
+			if entries[next].IsDir() && !skipDirs {
+				queue = append(queue, w.prefetch(Join(path, entries[next].Name())))
+			}
+
+			next++
+		}
+
+		var sublisting *walkListing
+
+		if entry.IsDir() && !skipDirs {
+			sublisting, queue = queue[0], queue[1:]
+		}
+
+		err := w.ordered(Join(path, entry.Name()), entry, sublisting, skipDirs)
+		if err != nil && err != SkipDir && err != SkipSubDirs {
+			return err
+		}
+	}
+
+	return nil
+}
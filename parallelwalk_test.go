@@ -0,0 +1,178 @@
+package vfs_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"testing"
+
+	"github.com/kuleuven/vfs"
+	"github.com/kuleuven/vfs/fs/nativefs"
+)
+
+func walkTree(t *testing.T) vfs.FS {
+	t.Helper()
+
+	fs := nativefs.New(t.Context(), t.TempDir())
+
+	t.Cleanup(func() {
+		fs.Close()
+	})
+
+	for _, dir := range []string{"/t/a/sub", "/t/b/sub", "/t/c"} {
+		if err := vfs.MkdirAll(fs, dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// More files than ReadDirBufSize, to test listing in chunks
+	for i := range vfs.ReadDirBufSize + 10 {
+		if err := vfs.WriteFile(fs, fmt.Sprintf("/t/c/%04d", i), nil, os.O_CREATE|os.O_WRONLY); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, file := range []string{"/t/a/file", "/t/a/sub/file", "/t/b/file", "/t/b/sub/file"} {
+		if err := vfs.WriteFile(fs, file, []byte("data"), os.O_CREATE|os.O_WRONLY); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return fs
+}
+
+// collect walks the tree, checks that walkFn is never called concurrently,
+// and returns the visited paths.
+func collect(t *testing.T, walk func(vfs.WalkFunc) error, skip map[string]error) ([]string, error) {
+	t.Helper()
+
+	var (
+		paths  []string
+		inside bool
+	)
+
+	err := walk(func(path string, info vfs.FileInfo, err error) error {
+		if inside {
+			t.Error("concurrent call of walkFn")
+		}
+
+		inside = true
+
+		defer func() { inside = false }()
+
+		if err != nil {
+			return err
+		}
+
+		paths = append(paths, path)
+
+		return skip[path]
+	})
+
+	return paths, err
+}
+
+func TestParallelWalk(t *testing.T) {
+	fs := walkTree(t)
+
+	expected, err := collect(t, func(fn vfs.WalkFunc) error { return vfs.Walk(fs, "/t", fn) }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []vfs.WalkOptions{
+		{Workers: 1},
+		{Workers: 4},
+		{Workers: 4, Sort: true},
+		{Workers: 4, Ordered: true},
+	} {
+		paths, err := collect(t, func(fn vfs.WalkFunc) error { return vfs.ParallelWalk(fs, "/t", opts, fn) }, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !opts.Ordered {
+			slices.Sort(paths)
+		}
+
+		if !reflect.DeepEqual(paths, expected) {
+			t.Errorf("%+v: expected %v, got %v", opts, expected, paths)
+		}
+	}
+}
+
+func TestParallelWalkSkip(t *testing.T) {
+	fs := walkTree(t)
+
+	skip := map[string]error{
+		"/t/a": vfs.SkipSubDirs,
+		"/t/b": vfs.SkipDir,
+		"/t/c": vfs.SkipDir,
+	}
+
+	expected := []string{"/t", "/t/a", "/t/a/file", "/t/a/sub", "/t/b", "/t/c"}
+
+	for _, ordered := range []bool{false, true} {
+		paths, err := collect(t, func(fn vfs.WalkFunc) error {
+			return vfs.ParallelWalk(fs, "/t", vfs.WalkOptions{Ordered: ordered}, fn)
+		}, skip)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		slices.Sort(paths)
+
+		if !reflect.DeepEqual(paths, expected) {
+			t.Errorf("ordered %v: expected %v, got %v", ordered, expected, paths)
+		}
+
+		paths, err = collect(t, func(fn vfs.WalkFunc) error {
+			return vfs.ParallelWalk(fs, "/t", vfs.WalkOptions{Ordered: ordered}, fn)
+		}, map[string]error{"/t/c/0003": vfs.SkipAll})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if last := paths[len(paths)-1]; last != "/t/c/0003" {
+			t.Errorf("ordered %v: expected the walk to stop after SkipAll, got %s", ordered, last)
+		}
+	}
+}
+
+func TestParallelWalkErrors(t *testing.T) {
+	fs := walkTree(t)
+
+	errStop := errors.New("stop")
+
+	for _, ordered := range []bool{false, true} {
+		_, err := collect(t, func(fn vfs.WalkFunc) error {
+			return vfs.ParallelWalk(fs, "/t", vfs.WalkOptions{Ordered: ordered}, fn)
+		}, map[string]error{"/t/b/sub/file": errStop})
+		if !errors.Is(err, errStop) {
+			t.Errorf("ordered %v: expected %v, got %v", ordered, errStop, err)
+		}
+
+		_, err = collect(t, func(fn vfs.WalkFunc) error {
+			return vfs.ParallelWalk(fs, "/missing", vfs.WalkOptions{Ordered: ordered}, fn)
+		}, nil)
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("ordered %v: expected ErrNotExist, got %v", ordered, err)
+		}
+
+		ctx, cancel := context.WithCancel(t.Context())
+
+		_, err = collect(t, func(fn vfs.WalkFunc) error {
+			return vfs.ParallelWalk(fs, "/t", vfs.WalkOptions{Context: ctx, Ordered: ordered}, func(path string, info vfs.FileInfo, err error) error {
+				cancel()
+
+				return fn(path, info, err)
+			})
+		}, nil)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("ordered %v: expected context.Canceled, got %v", ordered, err)
+		}
+	}
+}
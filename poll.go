@@ -0,0 +1,304 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PollWatch returns a watcher that scans the path at the interval set by the
+// WatchInterval context key, and reports the differences between two scans.
+// Writes are detected by changes in size or modification time, and extended
+// attributes are only compared if the listed file infos include them.
+// Renames are detected if the file infos implement HandleFileInfo, and are
+// reported as a removal and a creation otherwise.
+// The watcher is closed when the context is done.
+func PollWatch(ctx context.Context, fs FS, path string, recursive bool) (Watcher, error) {
+	interval := Duration(ctx, WatchInterval)
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+
+	p := &poller{
+		ctx:       ctx,
+		fs:        fs,
+		path:      Clean(path),
+		recursive: recursive,
+		events:    make(chan Event),
+		done:      make(chan struct{}),
+	}
+
+	snapshot, err := p.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	go p.run(snapshot, interval)
+
+	return p, nil
+}
+
+type poller struct {
+	ctx       context.Context //nolint:containedctx
+	fs        FS
+	path      string
+	recursive bool
+	events    chan Event
+	done      chan struct{}
+	once      sync.Once
+}
+
+// entry is the state of a path in a snapshot.
+type entry struct {
+	dir    bool
+	size   int64
+	mtime  time.Time
+	handle string
+	xattrs string
+}
+
+type snapshot map[string]entry
+
+func (p *poller) Events() <-chan Event {
+	return p.events
+}
+
+func (p *poller) Close() error {
+	p.once.Do(func() {
+		close(p.done)
+	})
+
+	return nil
+}
+
+func (p *poller) run(previous snapshot, interval time.Duration) {
+	defer close(p.events)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			return
+		case <-p.ctx.Done():
+			return
+		}
+
+		current, err := p.scan()
+		if errors.Is(err, os.ErrNotExist) {
+			current = snapshot{}
+		} else if err != nil {
+			Logger(p.ctx).Warnf("Could not scan %s: %v", p.path, err)
+
+			continue
+		}
+
+		for _, event := range diff(previous, current) {
+			select {
+			case p.events <- event:
+			case <-p.done:
+				return
+			}
+		}
+
+		previous = current
+	}
+}
+
+func (p *poller) scan() (snapshot, error) {
+	s := snapshot{}
+
+	if p.recursive {
+		err := Walk(p.fs, p.path, func(path string, info FileInfo, err error) error {
+			if err != nil && path == p.path {
+				return err
+			}
+
+			if err == nil {
+				s[path] = newEntry(info)
+			}
+
+			return nil
+		})
+
+		return s, err
+	}
+
+	fi, err := p.fs.Stat(p.path)
+	if err != nil {
+		return nil, err
+	}
+
+	s[p.path] = newEntry(fi)
+
+	if !fi.IsDir() {
+		return s, nil
+	}
+
+	lister, err := p.fs.List(p.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if closer, ok := lister.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	buf := make([]FileInfo, 100)
+
+	for offset := int64(0); ; {
+		n, err := lister.ListAt(buf, offset)
+
+		for _, fi := range buf[:n] {
+			s[Join(p.path, fi.Name())] = newEntry(fi)
+		}
+
+		offset += int64(n)
+
+		if errors.Is(err, io.EOF) {
+			return s, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func newEntry(fi FileInfo) entry {
+	e := entry{
+		dir:   fi.IsDir(),
+		size:  fi.Size(),
+		mtime: fi.ModTime(),
+	}
+
+	if hfi, ok := fi.(HandleFileInfo); ok {
+		if handle, err := hfi.Handle(); err == nil {
+			e.handle = string(handle)
+		}
+	}
+
+	if attrs, err := fi.Extended(); err == nil {
+		e.xattrs = encodeAttributes(attrs)
+	}
+
+	return e
+}
+
+func encodeAttributes(attrs Attributes) string {
+	var buf bytes.Buffer
+
+	names := make([]string, 0, len(attrs))
+
+	for name := range attrs {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		buf.WriteString(name)
+		buf.WriteByte(0)
+		buf.Write(attrs[name])
+		buf.WriteByte(0)
+	}
+
+	return buf.String()
+}
+
+// diff returns the events that turn the previous snapshot into the current one.
+// Creations are ordered parents first, removals children first.
+func diff(previous, current snapshot) []Event {
+	var created, removed, events []Event
+
+	for path, e := range current {
+		old, ok := previous[path]
+
+		switch {
+		case !ok:
+			created = append(created, Event{Op: EventCreate, Path: path})
+		case old.dir != e.dir:
+			removed = append(removed, Event{Op: EventRemove, Path: path})
+			created = append(created, Event{Op: EventCreate, Path: path})
+		case !e.dir && (old.size != e.size || !old.mtime.Equal(e.mtime)):
+			events = append(events, Event{Op: EventWrite, Path: path})
+		}
+
+		if ok && old.dir == e.dir && old.xattrs != e.xattrs {
+			events = append(events, Event{Op: EventXattr, Path: path})
+		}
+	}
+
+	for path := range previous {
+		if _, ok := current[path]; !ok {
+			removed = append(removed, Event{Op: EventRemove, Path: path})
+		}
+	}
+
+	sort.Slice(created, func(i, j int) bool { return created[i].Path < created[j].Path })
+	sort.Slice(removed, func(i, j int) bool { return removed[i].Path > removed[j].Path })
+
+	renamed, created, removed := detectRenames(previous, current, created, removed)
+
+	return slices.Concat(renamed, created, events, removed)
+}
+
+// detectRenames pairs removed and created paths with the same handle. The
+// renames of the descendants of a renamed directory are not reported.
+func detectRenames(previous, current snapshot, created, removed []Event) ([]Event, []Event, []Event) {
+	byHandle := map[string]string{}
+
+	for _, event := range removed {
+		if handle := previous[event.Path].handle; handle != "" {
+			byHandle[handle] = event.Path
+		}
+	}
+
+	var renamed, remainingCreated []Event
+
+	matched := map[string]bool{}
+
+	for _, event := range created {
+		handle := current[event.Path].handle
+
+		oldPath, ok := byHandle[handle]
+		if handle == "" || !ok || matched[oldPath] {
+			remainingCreated = append(remainingCreated, event)
+
+			continue
+		}
+
+		matched[oldPath] = true
+
+		if !impliedRename(renamed, oldPath, event.Path) {
+			renamed = append(renamed, Event{Op: EventRename, Path: event.Path, OldPath: oldPath})
+		}
+	}
+
+	var remainingRemoved []Event
+
+	for _, event := range removed {
+		if !matched[event.Path] {
+			remainingRemoved = append(remainingRemoved, event)
+		}
+	}
+
+	return renamed, remainingCreated, remainingRemoved
+}
+
+func impliedRename(renamed []Event, oldPath, newPath string) bool {
+	for _, r := range renamed {
+		if rel, ok := strings.CutPrefix(oldPath, r.OldPath+"/"); ok && newPath == Join(r.Path, rel) {
+			return true
+		}
+	}
+
+	return false
+}
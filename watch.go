@@ -0,0 +1,327 @@
+package vfs
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/multierr"
+)
+
+type EventOp int
+
+const (
+	EventCreate   EventOp = iota + 1 // A file, directory or link was created
+	EventWrite                       // A file was closed after writing, or truncated
+	EventRemove                      // A file or directory was removed
+	EventRename                      // A file or directory was renamed from OldPath to Path
+	EventXattr                       // Extended attributes changed. Native watchers also report other metadata changes.
+	EventOverflow                    // Events were lost, the watched tree should be rescanned
+)
+
+func (op EventOp) String() string {
+	switch op {
+	case EventCreate:
+		return "create"
+	case EventWrite:
+		return "write"
+	case EventRemove:
+		return "remove"
+	case EventRename:
+		return "rename"
+	case EventXattr:
+		return "xattr"
+	case EventOverflow:
+		return "overflow"
+	default:
+		return "unknown"
+	}
+}
+
+// Event describes a change to a path of a file system.
+type Event struct {
+	Op      EventOp
+	Path    string
+	OldPath string // Previous path for EventRename
+}
+
+// Watcher reports events until it is closed.
+// The events channel is closed when the watcher is closed.
+type Watcher interface {
+	Events() <-chan Event
+	Close() error
+}
+
+// EventBufferSize is the number of events that are buffered for a watcher
+// that does not keep up, before EventOverflow is reported.
+var EventBufferSize = 1024
+
+// DefaultWatchInterval is the interval between two scans of a polling watcher,
+// if no WatchInterval is set in the context.
+var DefaultWatchInterval = 30 * time.Second
+
+// Matches returns whether a path is reported by a watcher on the given path.
+// A non-recursive watcher on a directory reports its direct children.
+func Matches(watchPath string, recursive bool, path string) bool {
+	switch {
+	case path == watchPath, Dir(path) == watchPath:
+		return true
+	case !recursive:
+		return false
+	case watchPath == "/":
+		return true
+	default:
+		return strings.HasPrefix(path, watchPath+string(Separator))
+	}
+}
+
+// Matches returns whether the event is reported by a watcher on the given path.
+func (e Event) Matches(watchPath string, recursive bool) bool {
+	if e.Op == EventOverflow {
+		return true
+	}
+
+	return Matches(watchPath, recursive, e.Path) || (e.Op == EventRename && Matches(watchPath, recursive, e.OldPath))
+}
+
+// Notifier distributes events synthesized by a file system to its watchers.
+// The zero value is ready to use.
+type Notifier struct {
+	watchers map[*notifierWatcher]struct{}
+	sync.Mutex
+}
+
+// Watch returns a watcher that reports the events for the given path.
+func (n *Notifier) Watch(path string, recursive bool) Watcher {
+	n.Lock()
+	defer n.Unlock()
+
+	w := &notifierWatcher{
+		notifier:  n,
+		path:      Clean(path),
+		recursive: recursive,
+		events:    make(chan Event, EventBufferSize),
+	}
+
+	if n.watchers == nil {
+		n.watchers = map[*notifierWatcher]struct{}{}
+	}
+
+	n.watchers[w] = struct{}{}
+
+	return w
+}
+
+// Watched returns whether any watcher reports events for the given path,
+// to avoid the work to determine an event if nobody is listening.
+func (n *Notifier) Watched(path string) bool {
+	n.Lock()
+	defer n.Unlock()
+
+	for w := range n.watchers {
+		if Matches(w.path, w.recursive, path) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Notify reports the event to the watchers of its path. It never blocks:
+// if the buffer of a watcher is full, the event is dropped and the watcher
+// reports EventOverflow as soon as possible.
+func (n *Notifier) Notify(event Event) {
+	n.Lock()
+	defer n.Unlock()
+
+	for w := range n.watchers {
+		if !event.Matches(w.path, w.recursive) {
+			continue
+		}
+
+		if w.overflow {
+			select {
+			case w.events <- Event{Op: EventOverflow}:
+				w.overflow = false
+			default:
+				continue
+			}
+		}
+
+		select {
+		case w.events <- event:
+		default:
+			w.overflow = true
+		}
+	}
+}
+
+// NotifyWriter returns a writer that reports EventWrite for the path when
+// it is closed, or w itself if nobody watches the path.
+func (n *Notifier) NotifyWriter(w WriterAt, path string) WriterAt {
+	if !n.Watched(path) {
+		return w
+	}
+
+	return &notifyWriter{WriterAt: w, notifier: n, path: path}
+}
+
+type notifyWriter struct {
+	WriterAt
+	notifier *Notifier
+	path     string
+}
+
+func (w *notifyWriter) Close() error {
+	err := w.WriterAt.Close()
+
+	w.notifier.Notify(Event{Op: EventWrite, Path: w.path})
+
+	return err
+}
+
+func (w *notifyWriter) PunchHole(offset, length int64) error {
+	if puncher, ok := w.WriterAt.(PunchHoleWriterAt); ok {
+		return puncher.PunchHole(offset, length)
+	}
+
+	return ErrNotSupported
+}
+
+type notifierWatcher struct {
+	notifier  *Notifier
+	path      string
+	recursive bool
+	events    chan Event
+	overflow  bool
+}
+
+func (w *notifierWatcher) Events() <-chan Event {
+	return w.events
+}
+
+func (w *notifierWatcher) Close() error {
+	w.notifier.Lock()
+	defer w.notifier.Unlock()
+
+	if _, ok := w.notifier.watchers[w]; ok {
+		delete(w.notifier.watchers, w)
+		close(w.events)
+	}
+
+	return nil
+}
+
+// DedupWindow is the period in which identical events reported by several
+// watchers of a MergeWatchers call are reported once.
+var DedupWindow = time.Second
+
+// MergeWatchers returns a watcher that reports the events of all given watchers.
+// Identical events reported within DedupWindow, e.g. an event synthesized by
+// a wrapper and the native event of the underlying file system, are reported once.
+func MergeWatchers(watchers ...Watcher) Watcher {
+	return newMergedWatcher(watchers, nil)
+}
+
+// FilterWatcher returns a watcher that reports the events of w as transformed
+// by fn. Events for which fn returns false are dropped.
+func FilterWatcher(w Watcher, fn func(Event) (Event, bool)) Watcher {
+	return newMergedWatcher([]Watcher{w}, fn)
+}
+
+type mergedWatcher struct {
+	sources []Watcher
+	fn      func(Event) (Event, bool)
+	events  chan Event
+	done    chan struct{}
+	seen    map[Event]time.Time
+	once    sync.Once
+	sync.Mutex
+}
+
+func newMergedWatcher(sources []Watcher, fn func(Event) (Event, bool)) *mergedWatcher {
+	m := &mergedWatcher{
+		sources: sources,
+		fn:      fn,
+		events:  make(chan Event),
+		done:    make(chan struct{}),
+		seen:    map[Event]time.Time{},
+	}
+
+	var wg sync.WaitGroup
+
+	for _, w := range sources {
+		wg.Go(func() {
+			m.forward(w)
+		})
+	}
+
+	go func() {
+		wg.Wait()
+		close(m.events)
+	}()
+
+	return m
+}
+
+func (m *mergedWatcher) forward(w Watcher) {
+	for event := range w.Events() {
+		if m.fn != nil {
+			var ok bool
+
+			if event, ok = m.fn(event); !ok {
+				continue
+			}
+		}
+
+		if len(m.sources) > 1 && m.duplicate(event) {
+			continue
+		}
+
+		select {
+		case m.events <- event:
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// duplicate returns whether the event was reported recently.
+func (m *mergedWatcher) duplicate(event Event) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+
+	for e, t := range m.seen {
+		if now.Sub(t) > DedupWindow {
+			delete(m.seen, e)
+		}
+	}
+
+	if _, ok := m.seen[event]; ok && event.Op != EventOverflow {
+		return true
+	}
+
+	m.seen[event] = now
+
+	return false
+}
+
+func (m *mergedWatcher) Events() <-chan Event {
+	return m.events
+}
+
+func (m *mergedWatcher) Close() error {
+	var err error
+
+	m.once.Do(func() {
+		close(m.done)
+
+		for _, w := range m.sources {
+			err = multierr.Append(err, w.Close())
+		}
+	})
+
+	return err
+}
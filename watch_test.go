@@ -0,0 +1,145 @@
+package vfs
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		watchPath string
+		recursive bool
+		path      string
+		expected  bool
+	}{
+		{"/dir", false, "/dir", true},
+		{"/dir", false, "/dir/file", true},
+		{"/dir", false, "/dir/sub/file", false},
+		{"/dir", true, "/dir/sub/file", true},
+		{"/dir", true, "/dirfile", false},
+		{"/", false, "/file", true},
+		{"/", true, "/dir/file", true},
+	}
+
+	for _, tt := range tests {
+		if got := Matches(tt.watchPath, tt.recursive, tt.path); got != tt.expected {
+			t.Errorf("Matches(%q, %v, %q) = %v, expected %v", tt.watchPath, tt.recursive, tt.path, got, tt.expected)
+		}
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	var n Notifier
+
+	w := n.Watch("/dir", false)
+
+	if !n.Watched("/dir/file") || n.Watched("/other") {
+		t.Fatal("unexpected watched paths")
+	}
+
+	n.Notify(Event{Op: EventCreate, Path: "/other/file"})
+	n.Notify(Event{Op: EventRename, Path: "/other/file", OldPath: "/dir/file"})
+
+	if event := <-w.Events(); event.Op != EventRename || event.OldPath != "/dir/file" {
+		t.Fatalf("unexpected event %v", event)
+	}
+
+	// Merged watchers report identical events once
+	merged := MergeWatchers(w, n.Watch("/", true))
+
+	n.Notify(Event{Op: EventWrite, Path: "/dir/file"})
+	n.Notify(Event{Op: EventRemove, Path: "/dir/file"})
+
+	for _, op := range []EventOp{EventWrite, EventRemove} {
+		if event := <-merged.Events(); event.Op != op {
+			t.Fatalf("expected %v, got %v", op, event)
+		}
+	}
+
+	if err := merged.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := <-merged.Events(); ok {
+		t.Fatal("expected the events channel to be closed")
+	}
+
+	if n.Watched("/dir/file") {
+		t.Fatal("expected no watchers")
+	}
+}
+
+func TestNotifierOverflow(t *testing.T) {
+	var n Notifier
+
+	w := n.Watch("/", true)
+
+	defer w.Close()
+
+	for range EventBufferSize + 1 {
+		n.Notify(Event{Op: EventWrite, Path: "/file"})
+	}
+
+	for range EventBufferSize {
+		<-w.Events()
+	}
+
+	n.Notify(Event{Op: EventRemove, Path: "/file"})
+
+	if event := <-w.Events(); event.Op != EventOverflow {
+		t.Fatalf("expected overflow, got %v", event)
+	}
+
+	if event := <-w.Events(); event.Op != EventRemove {
+		t.Fatalf("expected remove, got %v", event)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	now := time.Now()
+
+	previous := snapshot{
+		"/":             {dir: true},
+		"/dir":          {dir: true, handle: "1"},
+		"/dir/file":     {size: 1, mtime: now, handle: "2"},
+		"/changed":      {size: 1, mtime: now, handle: "3"},
+		"/removed":      {size: 1, mtime: now},
+		"/tagged":       {size: 1, mtime: now},
+		"/replaced/dir": {dir: true},
+	}
+
+	current := snapshot{
+		"/":             {dir: true},
+		"/moved":        {dir: true, handle: "1"},
+		"/moved/file":   {size: 1, mtime: now, handle: "2"},
+		"/changed":      {size: 2, mtime: now, handle: "3"},
+		"/created":      {size: 1, mtime: now},
+		"/tagged":       {size: 1, mtime: now, xattrs: "user.tag"},
+		"/replaced/dir": {size: 1, mtime: now},
+	}
+
+	expected := []Event{
+		{Op: EventRename, Path: "/moved", OldPath: "/dir"},
+		{Op: EventCreate, Path: "/created"},
+		{Op: EventCreate, Path: "/replaced/dir"},
+		{Op: EventRemove, Path: "/replaced/dir"},
+		{Op: EventRemove, Path: "/removed"},
+	}
+
+	events := diff(previous, current)
+
+	// Writes and xattr changes are reported in no particular order
+	for _, event := range []Event{{Op: EventWrite, Path: "/changed"}, {Op: EventXattr, Path: "/tagged"}} {
+		i := slices.Index(events, event)
+		if i < 0 {
+			t.Fatalf("expected %v in %v", event, events)
+		}
+
+		events = slices.Delete(events, i, i+1)
+	}
+
+	if !slices.Equal(events, expected) {
+		t.Fatalf("expected %v, got %v", expected, events)
+	}
+}